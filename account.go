@@ -0,0 +1,244 @@
+package diffsync
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/hiroapp-com/hync/comm"
+)
+
+// AccountDeletion is sent along with account-delete events
+type AccountDeletion struct {
+	// OwnedNotes is either "transfer" (the default), handing notes over to
+	// their oldest peer, or "delete". Notes without peers are always deleted.
+	OwnedNotes string `json:"owned_notes,omitempty"`
+}
+
+var errNoVerifiedAddr = Remark{Level: "error", Slug: "verified-address-required"}
+
+// handleAccountDeleteRequest sends a fresh delete-account token to the
+// verified email address or phone of the session's user. The client has to
+// send it back with an account-delete event to confirm the deletion.
+func (tok *TokenConsumer) handleAccountDeleteRequest(event Event) error {
+	u := event.ctx.User()
+	var rcpt comm.Rcpt
+	switch {
+	case u.Email != "" && u.EmailStatus == "verified":
+		rcpt = emailRcpt(u)
+	case u.Phone != "" && u.PhoneStatus == "verified":
+		rcpt = phoneRcpt(u)
+	default:
+		return tok.respond(event, errNoVerifiedAddr)
+	}
+	plain, err := tok.issueToken(Token{Kind: "delete-account", UID: u.UID}, TokenLimits{})
+	if err == nil {
+		err = event.ctx.store.commHandler(comm.NewRequest("account-delete", rcpt, map[string]interface{}{"token": plain}))
+	}
+	return tok.respond(event, err)
+}
+
+func (tok *TokenConsumer) handleAccountDelete(event Event) error {
+	token, err := tok.getToken(event.Token)
+	if err == nil && (token.Kind != "delete-account" || token.UID != event.ctx.uid) {
+		err = Remark{Level: "error", Slug: "token-noexist-or-invalid"}
+	}
+	if err == nil {
+		err = tok.markConsumed(token, event.ctx)
+	}
+	if err != nil {
+		return tok.respond(event, err)
+	}
+	opts := AccountDeletion{}
+	if event.Deletion != nil {
+		opts = *event.Deletion
+	}
+	// respond before the session is gone
+	tok.respond(event, nil)
+	return tok.deleteAccount(event.ctx.uid, opts, event.ctx)
+}
+
+// userForgetter is implemented by session backends which keep state about
+// users outside of the database, see SQLSessions.ForgetUser
+type userForgetter interface {
+	ForgetUser(uid string)
+}
+
+// deleteAccount removes the user and everything that belongs to it. Owned
+// notes are transferred or deleted according to opts; the user's authorship
+// in the changelog of notes which survive is anonymized.
+func (tok *TokenConsumer) deleteAccount(uid string, opts AccountDeletion, ctx Context) error {
+	sids, err := tok.sessions.SessionsOfUser(uid)
+	if err != nil {
+		return err
+	}
+	nids, err := queryStrings(tok.db, "SELECT nid FROM noterefs WHERE uid = $1 AND role <> 'owner'", uid)
+	if err != nil {
+		return err
+	}
+	owned, err := queryStrings(tok.db, "SELECT nid FROM noterefs WHERE uid = $1 AND role = 'owner'", uid)
+	if err != nil {
+		return err
+	}
+	contactOf, err := queryStrings(tok.db, "SELECT uid FROM contacts WHERE contact_uid = $1", uid)
+	if err != nil {
+		return err
+	}
+	txn, err := tok.db.Begin()
+	if err != nil {
+		return err
+	}
+	deleted := map[string][]string{}
+	for _, nid := range owned {
+		var heir string
+		if opts.OwnedNotes != "delete" {
+			// editors before viewers, longest-standing first
+			err = txn.QueryRow(`SELECT uid FROM noterefs
+								WHERE nid = $1 AND uid <> $2
+								ORDER BY CASE WHEN role = 'viewer' THEN 1 ELSE 0 END, created_at, uid
+								LIMIT 1`, nid, uid).Scan(&heir)
+			if err != nil && err != sql.ErrNoRows {
+				txn.Rollback()
+				return err
+			}
+		}
+		if heir != "" {
+			if _, err = txn.Exec("UPDATE noterefs SET role = 'owner' WHERE nid = $1 AND uid = $2", nid, heir); err != nil {
+				txn.Rollback()
+				return err
+			}
+			nids = append(nids, nid)
+			continue
+		}
+		peers, err := queryStrings(txn, "SELECT uid FROM noterefs WHERE nid = $1 AND uid <> $2", nid, uid)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+		deleted[nid] = peers
+		if err = deleteNote(txn, nid); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	for _, qry := range []string{
+		"DELETE FROM noterefs WHERE uid = $1",
+		"DELETE FROM folders WHERE uid = $1",
+		"DELETE FROM noteref_tags WHERE uid = $1",
+		"DELETE FROM imports WHERE uid = $1",
+		"DELETE FROM contacts WHERE uid = $1 OR contact_uid = $1",
+		"DELETE FROM sessions WHERE uid = $1",
+		"DELETE FROM token_consumptions WHERE uid = $1",
+		"DELETE FROM tokens WHERE uid = $1",
+		// share links of transferred notes stay valid
+		"UPDATE tokens SET created_by = '' WHERE created_by = $1",
+		"UPDATE note_changelog SET uid = '' WHERE uid = $1",
+		"UPDATE checklist_items SET assignee = '' WHERE assignee = $1",
+		"UPDATE note_comments SET author = '' WHERE author = $1",
+		"DELETE FROM users WHERE uid = $1",
+	} {
+		if _, err = txn.Exec(qry, uid); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	ctx.Log().Info("account deleted", Fields{"uid": uid, "notes_deleted": len(deleted), "notes_left": len(nids)})
+	if f, ok := tok.sessions.(userForgetter); ok {
+		f.ForgetUser(uid)
+	}
+	// the user's sessions are gone from the db, address them directly
+	for _, sid := range sids {
+		ctx.Router.Handle(Event{SID: sid, Name: "account-deleted", ctx: ctx})
+	}
+	for nid, peers := range deleted {
+		for _, peer := range peers {
+			ctx.Router.Handle(Event{UID: peer, Name: "res-remove", Res: Resource{Kind: "note", ID: nid}, ctx: ctx})
+			ctx.Router.Handle(Event{UID: peer, Name: "res-sync", Res: Resource{Kind: "folio", ID: peer}, ctx: ctx})
+		}
+	}
+	for _, nid := range nids {
+		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "note", ID: nid}, ctx: ctx})
+	}
+	for _, other := range contactOf {
+		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "profile", ID: other}, ctx: ctx})
+	}
+	return nil
+}
+
+// ChangelogEntry is a recorded change of a note's text
+type ChangelogEntry struct {
+	UID      string    `json:"uid,omitempty"`
+	Op       string    `json:"op"`
+	Delta    string    `json:"delta"`
+	Snapshot string    `json:"txt_snapshot"`
+	TS       time.Time `json:"ts"`
+}
+
+// ExportAccount writes a zip archive with the user's profile (including
+// contacts), folio and all notes in the folio with their full history.
+func (srv *Server) ExportAccount(uid string, w io.Writer) error {
+	archive := zip.NewWriter(w)
+	profile := Resource{Kind: "profile", ID: uid}
+	if err := srv.Store.Load(&profile); err != nil {
+		return err
+	}
+	folio := Resource{Kind: "folio", ID: uid}
+	if err := srv.Store.Load(&folio); err != nil {
+		return err
+	}
+	if err := writeJSON(archive, "profile.json", profile.Value); err != nil {
+		return err
+	}
+	if err := writeJSON(archive, "folio.json", folio.Value); err != nil {
+		return err
+	}
+	for _, ref := range folio.Value.(Folio).NoteRefs {
+		note := Resource{Kind: "note", ID: ref.NID}
+		if err := srv.Store.Load(&note); err != nil {
+			return err
+		}
+		if err := writeJSON(archive, "notes/"+ref.NID+".json", note.Value); err != nil {
+			return err
+		}
+		history, err := noteHistory(srv.db, ref.NID)
+		if err != nil {
+			return err
+		}
+		if err = writeJSON(archive, "notes/"+ref.NID+".changelog.json", history); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func noteHistory(db *sql.DB, nid string) ([]ChangelogEntry, error) {
+	rows, err := db.Query("SELECT uid, op, delta, txt_snapshot, ts FROM note_changelog WHERE nid = $1 ORDER BY ts", nid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []ChangelogEntry{}
+	for rows.Next() {
+		entry := ChangelogEntry{}
+		if err = rows.Scan(&entry.UID, &entry.Op, &entry.Delta, &entry.Snapshot, &entry.TS); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+func writeJSON(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
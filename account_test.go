@@ -0,0 +1,240 @@
+package diffsync
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// userSessions is a memSessions which knows the sessions of its users
+type userSessions struct {
+	memSessions
+	sids map[string][]string
+}
+
+func (m *userSessions) SessionsOfUser(uid string) ([]string, error) {
+	return m.sids[uid], nil
+}
+
+func accountDB(t *testing.T) *sql.DB {
+	db := testDB(t, allTables...)
+	db.Exec("INSERT INTO users (uid, name, tier) VALUES ('uid00001', 'leaving', 1), ('uid00002', 'peer', 1), ('uid00003', 'viewer', 1)")
+	db.Exec("INSERT INTO notes (nid, title, txt) VALUES ('nid00001', 'shared', 'shared text'), ('nid00002', 'private', ''), ('nid00003', 'foreign', '')")
+	// the viewer joined first, but editors are preferred heirs
+	db.Exec(`INSERT INTO noterefs (nid, uid, role, created_at) VALUES
+				('nid00001', 'uid00001', 'owner', '2014-01-01 00:00:00'),
+				('nid00001', 'uid00003', 'viewer', '2014-01-02 00:00:00'),
+				('nid00001', 'uid00002', 'peer', '2014-01-03 00:00:00'),
+				('nid00002', 'uid00001', 'owner', '2014-01-01 00:00:00'),
+				('nid00003', 'uid00002', 'owner', '2014-01-01 00:00:00'),
+				('nid00003', 'uid00001', 'peer', '2014-01-02 00:00:00')`)
+	db.Exec("INSERT INTO contacts (uid, contact_uid, name) VALUES ('uid00002', 'uid00001', 'leaving'), ('uid00001', 'uid00002', 'peer')")
+	db.Exec("INSERT INTO sessions (sid, uid) VALUES ('sid00001', 'uid00001'), ('sid00002', 'uid00002')")
+	db.Exec("INSERT INTO tokens (token, kind, uid) VALUES ('login1', 'login', 'uid00001')")
+	db.Exec("INSERT INTO tokens (token, kind, nid, created_by) VALUES ('share1', 'share-url', 'nid00001', 'uid00001')")
+	db.Exec(`INSERT INTO note_changelog (nid, uid, op, delta, txt_snapshot, ts) VALUES
+				('nid00001', 'uid00001', 'patch-text', '+shared', 'shared', '2014-01-01 00:00:00'),
+				('nid00001', 'uid00002', 'patch-text', '=6+ text', 'shared text', '2014-01-02 00:00:00'),
+				('nid00002', 'uid00001', 'set-title', 'private', '', '2014-01-01 00:00:00')`)
+	return db
+}
+
+func queryCount(db *sql.DB, qry string, args ...interface{}) (n int) {
+	db.QueryRow(qry, args...).Scan(&n)
+	return
+}
+
+func TestAccountDeletion(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	tok := NewTokenConsumer(&userSessions{sids: map[string][]string{"uid00001": {"sid00001"}}}, db, defaultLogger)
+	events := []Event{}
+	ctx := NewContext(FuncHandler{Fn: func(event Event) error {
+		event.ctx = Context{}
+		events = append(events, event)
+		return nil
+	}}, nil, nil)
+	ctx.uid, ctx.sid = "uid00001", "sid00001"
+
+	if !assert.NoError(t, tok.deleteAccount("uid00001", AccountDeletion{}, ctx)) {
+		return
+	}
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM users WHERE uid = 'uid00001'"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM noterefs WHERE uid = 'uid00001'"))
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = 'nid00001' AND uid = 'uid00002' AND role = 'owner'"), "note not transferred to oldest editor")
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM notes WHERE nid = 'nid00002'"), "note without peers not deleted")
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM note_changelog WHERE nid = 'nid00002'"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM note_changelog WHERE uid = 'uid00001'"), "changelog not anonymized")
+	assert.Equal(t, 2, queryCount(db, "SELECT count(*) FROM note_changelog WHERE nid = 'nid00001'"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM contacts"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM sessions WHERE uid = 'uid00001'"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM tokens WHERE token = 'login1'"))
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM tokens WHERE token = 'share1' AND created_by = ''"), "share link of transferred note lost")
+
+	assert.Contains(t, events, Event{SID: "sid00001", Name: "account-deleted"})
+	assert.Contains(t, events, Event{Name: "res-sync", Res: Resource{Kind: "note", ID: "nid00001"}})
+	assert.Contains(t, events, Event{Name: "res-sync", Res: Resource{Kind: "note", ID: "nid00003"}})
+	assert.Contains(t, events, Event{Name: "res-sync", Res: Resource{Kind: "profile", ID: "uid00002"}}, "contact owner not synced")
+}
+
+func TestAccountDeletionDeletesOwnedNotes(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	tok := NewTokenConsumer(&userSessions{}, db, defaultLogger)
+	events := []Event{}
+	ctx := NewContext(FuncHandler{Fn: func(event Event) error {
+		event.ctx = Context{}
+		events = append(events, event)
+		return nil
+	}}, nil, nil)
+
+	if !assert.NoError(t, tok.deleteAccount("uid00001", AccountDeletion{OwnedNotes: "delete"}, ctx)) {
+		return
+	}
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM notes WHERE nid IN ('nid00001', 'nid00002')"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = 'nid00001'"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM tokens WHERE nid = 'nid00001'"))
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM notes WHERE nid = 'nid00003'"), "notes of others must survive")
+	for _, peer := range []string{"uid00002", "uid00003"} {
+		assert.Contains(t, events, Event{UID: peer, Name: "res-remove", Res: Resource{Kind: "note", ID: "nid00001"}})
+		assert.Contains(t, events, Event{UID: peer, Name: "res-sync", Res: Resource{Kind: "folio", ID: peer}})
+	}
+}
+
+func TestAccountDeleteToken(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	tok := NewTokenConsumer(&userSessions{}, db, defaultLogger)
+	responses := []Event{}
+	ctx := NewContext(FuncHandler{Fn: func(Event) error { return nil }}, nil, FuncHandler{Fn: func(event Event) error {
+		responses = append(responses, event)
+		return nil
+	}})
+	ctx.uid, ctx.sid = "uid00002", "sid00002"
+	plain, err := tok.issueToken(Token{Kind: "delete-account", UID: "uid00001"}, TokenLimits{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// tokens of other users must not delete the session's account
+	tok.handleAccountDelete(Event{Name: "account-delete", SID: "sid00002", Token: plain, ctx: ctx})
+	if assert.Len(t, responses, 1) && assert.NotNil(t, responses[0].Remark) {
+		assert.Equal(t, "token-noexist-or-invalid", responses[0].Remark.Slug)
+	}
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM users WHERE uid = 'uid00002'"))
+
+	ctx.uid, ctx.sid = "uid00001", "sid00001"
+	tok.handleAccountDelete(Event{Name: "account-delete", SID: "sid00001", Token: plain, ctx: ctx})
+	if assert.Len(t, responses, 2) {
+		assert.Nil(t, responses[1].Remark)
+		assert.Empty(t, responses[1].Token, "token echoed back")
+	}
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM users WHERE uid = 'uid00001'"))
+}
+
+func TestAccountDeletionForgetsSessions(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	sessions := NewSQLSessions(db, nil)
+	tok := NewTokenConsumer(sessions, db, defaultLogger)
+	ctx := NewContext(FuncHandler{Fn: func(Event) error { return nil }}, nil, nil)
+	uid, err := tok.GetUID("sid00001")
+	assert.NoError(t, err)
+	assert.Equal(t, "uid00001", uid)
+
+	if !assert.NoError(t, tok.deleteAccount("uid00001", AccountDeletion{}, ctx)) {
+		return
+	}
+	_, err = tok.GetUID("sid00001")
+	assert.Equal(t, ErrInvalidSession(SessionNotfound), err, "uid of deleted session still cached")
+	// a runner saving the session late must not bring it back
+	assert.NoError(t, sessions.Save(NewSession("sid00001", "uid00001")))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM sessions WHERE sid = 'sid00001'"))
+}
+
+func TestAccountDeletedStopsRunner(t *testing.T) {
+	hub, backend := drainHub(nil)
+	defer hub.Stop()
+	client := connectClient(hub, "sid1")
+	hub.Handle(Event{Name: "account-deleted", SID: "sid1"})
+	assert.Equal(t, "account-deleted", awaitEvent(t, client).Name)
+	stopped := make(chan struct{})
+	go func() {
+		hub.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("runner of deleted session kept running")
+	}
+	assert.Equal(t, 0, backend.timesSaved("sid1"), "deleted session saved")
+}
+
+func TestExportAccount(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	srv, _ := NewServer(db, nil)
+	srv.Store.Mount("note", NewNoteSQLBackend(db))
+	srv.Store.Mount("folio", NewFolioSQLBackend(db))
+	srv.Store.Mount("profile", NewProfileSQLBackend(db))
+
+	buf := bytes.Buffer{}
+	if !assert.NoError(t, srv.ExportAccount("uid00001", &buf)) {
+		return
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	for _, name := range []string{"profile.json", "folio.json", "notes/nid00001.json", "notes/nid00002.json", "notes/nid00003.json"} {
+		assert.Contains(t, files, name)
+	}
+	if assert.Contains(t, files, "notes/nid00001.changelog.json") {
+		r, _ := files["notes/nid00001.changelog.json"].Open()
+		defer r.Close()
+		history := []ChangelogEntry{}
+		if assert.NoError(t, json.NewDecoder(r).Decode(&history)) && assert.Len(t, history, 2) {
+			assert.Equal(t, "uid00001", history[0].UID)
+			assert.Equal(t, "shared text", history[1].Snapshot)
+		}
+	}
+}
+
+func TestClaimedNotesAddedAfterCommit(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	db.Exec("UPDATE users SET email = 'shared@example.com' WHERE uid = 'uid00003'")
+	tok := NewTokenConsumer(nil, db, defaultLogger)
+	// sessions check the folio of the user before mounting added notes
+	visible := map[string]bool{}
+	ctx := NewContext(FuncHandler{Fn: func(event Event) error {
+		if event.Name == "res-add" {
+			timeout, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			var n int
+			db.QueryRowContext(timeout, "SELECT count(*) FROM noterefs WHERE uid = $1 AND nid = $2", event.UID, event.Res.ID).Scan(&n)
+			visible[event.UID+" "+event.Res.ID] = n > 0
+		}
+		return nil
+	}}, nil, nil)
+
+	if assert.NoError(t, tok.claimIDAndSignup("email", User{UID: "uid00002", Email: "shared@example.com"}, ctx)) {
+		assert.Equal(t, map[string]bool{"uid00002 nid00001": true}, visible)
+	}
+	visible = map[string]bool{}
+	if assert.NoError(t, tok.assimilateUser("uid00001", "uid00002", ctx)) {
+		assert.Equal(t, map[string]bool{"uid00002 nid00001": true, "uid00002 nid00002": true, "uid00002 nid00003": true}, visible)
+	}
+}
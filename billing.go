@@ -0,0 +1,223 @@
+package diffsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// tier a paying user drops back to after cancelling
+const tierSignedUp = 1
+
+// maxWebhookSize limits the request bodies accepted by the billing webhook
+const maxWebhookSize = 1 << 20
+
+var ErrInvalidSignature = errors.New("billing: invalid webhook signature")
+
+// errNoSubscription is returned by setTier for users who cannot have a
+// subscription. Redeliveries wouldn't change that, such events are
+// acknowledged and dropped.
+var errNoSubscription = errors.New("billing: user cannot have a subscription")
+
+// PaymentProvider authenticates and decodes the webhook deliveries of a
+// payment provider. Mapping the provider's plans to tiers is up to the
+// implementation.
+type PaymentProvider interface {
+	Name() string
+	// ParseWebhook returns ErrInvalidSignature if the delivery could
+	// not be authenticated
+	ParseWebhook(header http.Header, body []byte) (BillingEvent, error)
+}
+
+// BillingEvent is a change of a customer's subscription
+type BillingEvent struct {
+	// ID uniquely identifies the event at the provider. Deliveries of
+	// already processed events are ignored.
+	ID         string `json:"id"`
+	CustomerID string `json:"customer_id"`
+	// UID is only known for the first event of a customer, e.g. after
+	// checkout. Later events are matched via CustomerID.
+	UID  string `json:"uid,omitempty"`
+	Tier int64  `json:"tier"`
+	// Created is when the provider issued the event. Providers don't
+	// deliver in order, events older than the last one applied to the
+	// customer are ignored. Events without it are always applied.
+	Created time.Time `json:"created"`
+}
+
+type billingHandler struct {
+	db       *sql.DB
+	store    *Store
+	router   EventHandler
+	provider PaymentProvider
+	log      *Logger
+}
+
+// BillingHandler returns the endpoint for the given provider's webhooks.
+// Upgrades and downgrades are applied to the customer's profile.
+func (srv *Server) BillingHandler(provider PaymentProvider) http.Handler {
+	return &billingHandler{
+		db:       srv.db,
+		store:    srv.Store,
+		router:   srv.sessionHub,
+		provider: provider,
+		log:      srv.log.With(Fields{"provider": provider.Name()}),
+	}
+}
+
+func (h *billingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	ev, err := h.provider.ParseWebhook(r.Header, body)
+	if err == ErrInvalidSignature {
+		h.log.Warn("billing: rejected webhook with invalid signature")
+		stats.BillingEvents.Inc(h.provider.Name(), "invalid-signature")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		h.log.Warn("billing: cannot parse webhook", Fields{"err": err})
+		stats.BillingEvents.Inc(h.provider.Name(), "malformed")
+		http.Error(w, "malformed event", http.StatusBadRequest)
+		return
+	}
+	outcome, err := h.process(ev)
+	stats.BillingEvents.Inc(h.provider.Name(), outcome)
+	if err != nil {
+		h.log.Error("billing: processing event failed", Fields{"billing_event": ev.ID, "err": err})
+		// let the provider retry later
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *billingHandler) process(ev BillingEvent) (outcome string, err error) {
+	// claim the event first, so that concurrent deliveries of the same
+	// event are processed only once
+	res, err := h.db.Exec("INSERT INTO stripe_tokens (token, uid, seen_at) VALUES ($1, NULL, $2) ON CONFLICT (token) DO NOTHING", ev.ID, time.Now())
+	if err != nil {
+		return "error", err
+	}
+	if claimed, _ := res.RowsAffected(); claimed == 0 {
+		return "duplicate", nil
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// give up the claim, the provider retries failed deliveries
+		if _, e := h.db.Exec("DELETE FROM stripe_tokens WHERE token = $1", ev.ID); e != nil {
+			h.log.Error("billing: cannot release claimed event", Fields{"billing_event": ev.ID, "err": e})
+		}
+	}()
+	uid := ev.UID
+	if uid != "" && ev.CustomerID != "" {
+		_, err = h.db.Exec("UPDATE users SET stripe_cust_id = $1 WHERE uid = $2", ev.CustomerID, uid)
+	} else if ev.CustomerID != "" {
+		err = h.db.QueryRow("SELECT uid FROM users WHERE stripe_cust_id = $1", ev.CustomerID).Scan(&uid)
+	}
+	if err == sql.ErrNoRows || (err == nil && uid == "") {
+		h.log.Warn("billing: event does not belong to any user", Fields{"billing_event": ev.ID})
+		return "unknown-customer", nil
+	} else if err != nil {
+		return "error", err
+	}
+	if _, err = h.db.Exec("UPDATE stripe_tokens SET uid = $1 WHERE token = $2", uid, ev.ID); err != nil {
+		return "error", err
+	}
+	if !ev.Created.IsZero() {
+		// compare-and-set the customer's latest event, so that an older
+		// event never overrides the outcome of a newer one
+		res, err = h.db.Exec("UPDATE users SET billing_event_at = $1 WHERE uid = $2 AND (billing_event_at IS NULL OR billing_event_at <= $1)", ev.Created.UTC(), uid)
+		if err != nil {
+			return "error", err
+		}
+		if newer, _ := res.RowsAffected(); newer == 0 {
+			h.log.Info("billing: event superseded by a newer one", Fields{"billing_event": ev.ID, "uid": uid})
+			return "outdated", nil
+		}
+	}
+	if err = h.setTier(uid, ev.Tier); err == errNoSubscription {
+		h.log.Warn("billing: event for user who cannot have a subscription", Fields{"billing_event": ev.ID, "uid": uid})
+		return "no-subscription", nil
+	} else if err != nil {
+		return "error", err
+	}
+	return "ok", nil
+}
+
+func (h *billingHandler) setTier(uid string, tier int64) error {
+	ctx := NewContext(h.router, h.store, nil)
+	ctx.uid = "sys"
+	profile := Resource{Kind: "profile", ID: uid}
+	if err := h.store.Load(&profile); err != nil {
+		return err
+	}
+	current := profile.Value.(Profile).User.Tier
+	if current < tierSignedUp {
+		// anon, invited or disabled users cannot have a subscription
+		return errNoSubscription
+	}
+	if tier < tierSignedUp {
+		tier = tierSignedUp
+	}
+	if current == tier {
+		return nil
+	}
+	result := NewSyncResult()
+	if err := h.store.Patch(profile, Patch{Op: "set-tier", Path: "user/", Value: tier, OldValue: current}, result, ctx); err != nil {
+		return err
+	}
+	h.log.Info("billing: changed tier", Fields{"uid": uid, "from": current, "to": tier})
+	for _, res := range result.TaintedItems() {
+		ctx.Router.Handle(Event{Name: "res-sync", Res: res, ctx: ctx})
+	}
+	return nil
+}
+
+// FakePaymentProvider accepts BillingEvents as JSON bodies, signed with an
+// HMAC-SHA256 of Secret in the X-Signature header. It's meant for tests and
+// local development.
+type FakePaymentProvider struct {
+	Secret []byte
+}
+
+func (fake FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (fake FakePaymentProvider) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, fake.Secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (fake FakePaymentProvider) ParseWebhook(header http.Header, body []byte) (BillingEvent, error) {
+	sig, err := hex.DecodeString(header.Get("X-Signature"))
+	if err != nil {
+		return BillingEvent{}, ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, fake.Secret)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return BillingEvent{}, ErrInvalidSignature
+	}
+	ev := BillingEvent{}
+	if err = json.Unmarshal(body, &ev); err != nil {
+		return BillingEvent{}, err
+	}
+	return ev, nil
+}
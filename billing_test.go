@@ -0,0 +1,108 @@
+package diffsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBillingWebhook(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_CONTACTS, CREATE_STRIPETOKENS)
+	defer db.Close()
+	db.Exec("INSERT INTO users (uid, tier) VALUES ('uid00001', 1), ('uid00002', 0)")
+	store := NewStore(nil)
+	store.Mount("profile", NewProfileSQLBackend(db))
+	synced := make(chan Event, 4)
+	router := FuncHandler{Fn: func(event Event) error {
+		synced <- event
+		return nil
+	}}
+	provider := FakePaymentProvider{Secret: []byte("s3cr3t")}
+	srv := &Server{db: db, Store: store, log: nil}
+	handler := srv.BillingHandler(provider).(*billingHandler)
+	handler.router = router
+
+	deliver := func(ev BillingEvent, sign bool) int {
+		body, _ := json.Marshal(ev)
+		req := httptest.NewRequest("POST", "/billing", bytes.NewReader(body))
+		if sign {
+			req.Header.Set("X-Signature", provider.Sign(body))
+		} else {
+			req.Header.Set("X-Signature", provider.Sign([]byte("something else")))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	tier := func() (tier int64) {
+		db.QueryRow("SELECT tier FROM users WHERE uid = 'uid00001'").Scan(&tier)
+		return
+	}
+
+	upgrade := BillingEvent{ID: "ev1", CustomerID: "cus1", UID: "uid00001", Tier: 2}
+	assert.Equal(t, http.StatusUnauthorized, deliver(upgrade, false))
+	assert.Equal(t, int64(1), tier(), "unsigned event changed tier")
+
+	assert.Equal(t, http.StatusOK, deliver(upgrade, true))
+	assert.Equal(t, int64(2), tier(), "upgrade not applied")
+	if assert.Len(t, synced, 1, "profile not synced after upgrade") {
+		assert.Equal(t, Resource{Kind: "profile", ID: "uid00001"}, (<-synced).Res)
+	}
+
+	// downgrade only knows the customer
+	downgrade := BillingEvent{ID: "ev2", CustomerID: "cus1", Tier: 0}
+	assert.Equal(t, http.StatusOK, deliver(downgrade, true))
+	assert.Equal(t, int64(1), tier(), "downgrade not applied")
+	if assert.Len(t, synced, 1, "profile not synced after downgrade") {
+		<-synced
+	}
+
+	// redelivery of the upgrade must be ignored
+	assert.Equal(t, http.StatusOK, deliver(upgrade, true))
+	assert.Equal(t, int64(1), tier(), "redelivered event processed twice")
+	assert.Len(t, synced, 0)
+
+	// anon users can't subscribe, retrying won't help
+	anon := BillingEvent{ID: "ev3", CustomerID: "cus2", UID: "uid00002", Tier: 2}
+	assert.Equal(t, http.StatusOK, deliver(anon, true))
+	assert.Len(t, synced, 0)
+}
+
+func TestBillingEventOrder(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_CONTACTS, CREATE_STRIPETOKENS)
+	defer db.Close()
+	db.Exec("INSERT INTO users (uid, tier, stripe_cust_id) VALUES ('uid00001', 1, 'cus1')")
+	store := NewStore(nil)
+	store.Mount("profile", NewProfileSQLBackend(db))
+	srv := &Server{db: db, Store: store, log: nil}
+	handler := srv.BillingHandler(FakePaymentProvider{}).(*billingHandler)
+	handler.router = FuncHandler{Fn: func(Event) error { return nil }}
+	tier := func() (tier int64) {
+		db.QueryRow("SELECT tier FROM users WHERE uid = 'uid00001'").Scan(&tier)
+		return
+	}
+	issued := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	outcome, err := handler.process(BillingEvent{ID: "ev2", CustomerID: "cus1", Tier: 2, Created: issued})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", outcome)
+	// the cancellation was issued before the upgrade, but arrives late
+	outcome, err = handler.process(BillingEvent{ID: "ev1", CustomerID: "cus1", Tier: 0, Created: issued.Add(-time.Minute)})
+	assert.NoError(t, err)
+	assert.Equal(t, "outdated", outcome)
+	assert.Equal(t, int64(2), tier(), "older event overrode a newer one")
+
+	// a failed event must not stay claimed, otherwise retries are ignored
+	db.Exec("DROP TABLE users")
+	_, err = handler.process(BillingEvent{ID: "ev3", CustomerID: "cus1", Tier: 1, Created: issued.Add(time.Minute)})
+	assert.Error(t, err)
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM stripe_tokens WHERE token = 'ev3'"), "failed event still claimed")
+	outcome, _ = handler.process(BillingEvent{ID: "ev2", CustomerID: "cus1", Tier: 2, Created: issued})
+	assert.Equal(t, "duplicate", outcome)
+}
@@ -0,0 +1,259 @@
+package diffsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Note kinds, see NoteRef.Kind. The items of a checklist note are a
+// resource of their own, of kind "checklist" and with the note's nid as ID.
+// Everything else (title, peers, sharing) stays with the note.
+const (
+	NoteKindText      = ""
+	NoteKindChecklist = "checklist"
+)
+
+// maxItemIDLength is the maximum length of a client-generated item ID
+const maxItemIDLength = 32
+
+// ChecklistItem is an entry of a checklist. Items are identified by their
+// ID, which clients generate, and ordered by their SortKey.
+type ChecklistItem struct {
+	ID      string    `json:"id"`
+	Text    TextValue `json:"text"`
+	Checked bool      `json:"checked"`
+	// Assignee is the uid of a peer of the note responsible for the item
+	Assignee string    `json:"assignee,omitempty"`
+	Due      *UnixTime `json:"due,omitempty"`
+	SortKey  string    `json:"sort_key"`
+}
+
+type Checklist struct {
+	Items []ChecklistItem `json:"items"`
+}
+
+// ChecklistChange changes a single item, Path is the item's ID. Every
+// property of an item has its own op, concurrent changes to different
+// properties or items never conflict. Texts are merged like note texts.
+type ChecklistChange struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type ChecklistDelta []ChecklistChange
+
+func NewChecklist() Checklist {
+	return Checklist{Items: []ChecklistItem{}}
+}
+
+func (cl Checklist) Empty() ResourceValue {
+	return NewChecklist()
+}
+
+func (cl Checklist) Clone() ResourceValue {
+	items := make([]ChecklistItem, len(cl.Items))
+	copy(items, cl.Items)
+	return Checklist{Items: items}
+}
+
+func (cl Checklist) String() string {
+	done := 0
+	for _, item := range cl.Items {
+		if item.Checked {
+			done++
+		}
+	}
+	return fmt.Sprintf("<checklist items: %d, checked: %d>", len(cl.Items), done)
+}
+
+func (cl Checklist) indexOf(id string) (int, bool) {
+	for i := range cl.Items {
+		if cl.Items[i].ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (cl Checklist) GetDelta(latest ResourceValue) Delta {
+	master := latest.(Checklist)
+	delta := ChecklistDelta{}
+	for _, item := range master.Items {
+		i, ok := cl.indexOf(item.ID)
+		if !ok {
+			delta = append(delta, ChecklistChange{"add-item", item.ID, item})
+			continue
+		}
+		old := cl.Items[i]
+		if old.Text != item.Text {
+			delta = append(delta, ChecklistChange{"edit-text", item.ID, old.Text.GetDelta(item.Text)})
+		}
+		if old.Checked != item.Checked {
+			delta = append(delta, ChecklistChange{"toggle-item", item.ID, item.Checked})
+		}
+		if old.Assignee != item.Assignee {
+			delta = append(delta, ChecklistChange{"set-assignee", item.ID, item.Assignee})
+		}
+		if !sameTime(old.Due, item.Due) {
+			delta = append(delta, ChecklistChange{"set-due", item.ID, item.Due})
+		}
+		if old.SortKey != item.SortKey {
+			delta = append(delta, ChecklistChange{"move-item", item.ID, item.SortKey})
+		}
+	}
+	for _, item := range cl.Items {
+		if _, ok := master.indexOf(item.ID); !ok {
+			delta = append(delta, ChecklistChange{Op: "rem-item", Path: item.ID})
+		}
+	}
+	return delta
+}
+
+func (delta ChecklistDelta) HasChanges() bool {
+	return len(delta) > 0
+}
+
+func (delta ChecklistDelta) Apply(to ResourceValue) (ResourceValue, []Patch, error) {
+	original, ok := to.(Checklist)
+	if !ok {
+		return nil, nil, errors.New("cannot apply ChecklistDelta to non Checklist")
+	}
+	cl := original.Clone().(Checklist)
+	patches := make([]Patch, 0, len(delta))
+	for _, change := range delta {
+		if change.Op == "add-item" {
+			item, _ := change.Value.(ChecklistItem)
+			if item.ID == "" || len(item.ID) > maxItemIDLength || (item.SortKey != "" && !validSortKey(item.SortKey)) {
+				continue
+			}
+			if _, exists := cl.indexOf(item.ID); exists {
+				continue
+			}
+			if item.SortKey == "" {
+				item.SortKey = sortKeyBetween(cl.lastSortKey(), "")
+			}
+			cl.Items = append(cl.Items, item)
+			patches = append(patches, Patch{Op: "add-item", Path: item.ID, Value: item})
+			continue
+		}
+		i, ok := cl.indexOf(change.Path)
+		if !ok {
+			// removed concurrently
+			continue
+		}
+		item := &cl.Items[i]
+		switch change.Op {
+		case "rem-item":
+			cl.Items = append(cl.Items[:i], cl.Items[i+1:]...)
+			patches = append(patches, Patch{Op: "rem-item", Path: change.Path})
+		case "edit-text":
+			textDelta, _ := change.Value.(TextDelta)
+			if !textDelta.HasChanges() {
+				continue
+			}
+			text, textPatches, err := textDelta.Apply(item.Text)
+			if err != nil {
+				return nil, nil, err
+			}
+			patches = append(patches, Patch{Op: "edit-text", Path: change.Path, Value: textPatches[0].Value, OldValue: string(item.Text)})
+			item.Text = text.(TextValue)
+		case "toggle-item":
+			checked, _ := change.Value.(bool)
+			if item.Checked == checked {
+				continue
+			}
+			item.Checked = checked
+			patches = append(patches, Patch{Op: "toggle-item", Path: change.Path, Value: checked})
+		case "set-assignee":
+			uid, _ := change.Value.(string)
+			if item.Assignee == uid {
+				continue
+			}
+			patches = append(patches, Patch{Op: "set-assignee", Path: change.Path, Value: uid, OldValue: item.Assignee})
+			item.Assignee = uid
+		case "set-due":
+			due, _ := change.Value.(*UnixTime)
+			if sameTime(item.Due, due) {
+				continue
+			}
+			item.Due = due
+			patches = append(patches, Patch{Op: "set-due", Path: change.Path, Value: due})
+		case "move-item":
+			key, _ := change.Value.(string)
+			if !validSortKey(key) || item.SortKey == key {
+				continue
+			}
+			item.SortKey = key
+			patches = append(patches, Patch{Op: "move-item", Path: change.Path, Value: key})
+		}
+	}
+	sort.Sort(itemsByKey(cl.Items))
+	return cl, patches, nil
+}
+
+func (cl Checklist) lastSortKey() string {
+	keys := make([]string, len(cl.Items))
+	for i := range cl.Items {
+		keys[i] = cl.Items[i].SortKey
+	}
+	return lastSortKey(keys)
+}
+
+func (change *ChecklistChange) UnmarshalJSON(from []byte) (err error) {
+	tmp := struct {
+		Op       string          `json:"op"`
+		Path     string          `json:"path"`
+		RawValue json.RawMessage `json:"value"`
+	}{}
+	if err = json.Unmarshal(from, &tmp); err != nil {
+		return
+	}
+	change.Op = tmp.Op
+	change.Path = tmp.Path
+	if tmp.RawValue == nil {
+		return nil
+	}
+	switch tmp.Op {
+	case "add-item":
+		item := ChecklistItem{}
+		if err = json.Unmarshal(tmp.RawValue, &item); err == nil {
+			change.Value = item
+		}
+	case "edit-text":
+		var s string
+		if err = json.Unmarshal(tmp.RawValue, &s); err == nil {
+			change.Value = TextDelta(s)
+		}
+	case "toggle-item":
+		checked := false
+		if err = json.Unmarshal(tmp.RawValue, &checked); err == nil {
+			change.Value = checked
+		}
+	case "set-due":
+		var ts *UnixTime
+		if err = json.Unmarshal(tmp.RawValue, &ts); err == nil {
+			change.Value = ts
+		}
+	default:
+		s := ""
+		if err = json.Unmarshal(tmp.RawValue, &s); err == nil {
+			change.Value = s
+		}
+	}
+	return
+}
+
+// itemsByKey orders items by sort key, items with the same key by ID
+type itemsByKey []ChecklistItem
+
+func (items itemsByKey) Len() int      { return len(items) }
+func (items itemsByKey) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+func (items itemsByKey) Less(i, j int) bool {
+	if items[i].SortKey != items[j].SortKey {
+		return items[i].SortKey < items[j].SortKey
+	}
+	return items[i].ID < items[j].ID
+}
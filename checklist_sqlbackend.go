@@ -0,0 +1,204 @@
+package diffsync
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	DMP "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// maxTextRetries limits how often patching an item's text is retried when
+// its text changed concurrently
+const maxTextRetries = 5
+
+// ChecklistSQLBackend stores the items of checklist notes. Checklists share
+// their ID, peers and permissions with their note.
+type ChecklistSQLBackend struct {
+	db *sql.DB
+}
+
+func NewChecklistSQLBackend(db *sql.DB) ChecklistSQLBackend {
+	return ChecklistSQLBackend{db}
+}
+
+func (backend ChecklistSQLBackend) Get(nid string) (ResourceValue, error) {
+	var kind string
+	switch err := backend.db.QueryRow("SELECT kind FROM notes WHERE nid = $1", nid).Scan(&kind); {
+	case err == sql.ErrNoRows:
+		return nil, NoExistError{nid}
+	case err != nil:
+		return nil, err
+	case kind != NoteKindChecklist:
+		return nil, fmt.Errorf("checklistsqlbackend: note(%s) is not a checklist", nid)
+	}
+	rows, err := backend.db.Query("SELECT id, txt, checked, assignee, due, sort_key FROM checklist_items WHERE nid = $1", nid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cl := NewChecklist()
+	for rows.Next() {
+		item := ChecklistItem{}
+		var txt string
+		var due *time.Time
+		if err := rows.Scan(&item.ID, &txt, &item.Checked, &item.Assignee, &due, &item.SortKey); err != nil {
+			return nil, err
+		}
+		item.Text = TextValue(txt)
+		if due != nil {
+			t := UnixTime(*due)
+			item.Due = &t
+		}
+		cl.Items = append(cl.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(itemsByKey(cl.Items))
+	return cl, nil
+}
+
+func (backend ChecklistSQLBackend) Patch(nid string, patch Patch, result *SyncResult, ctx Context) error {
+	notes := NoteSQLBackend{backend.db}
+	if ctx.uid != "sys" {
+		role, err := notes.role(nid, ctx)
+		if err != nil {
+			return err
+		}
+		if role == "viewer" {
+			return Remark{Level: "error", Slug: "permission-denied", Data: map[string]string{"op": patch.Op, "role": role}}
+		}
+	}
+	var err error
+	switch patch.Op {
+	case "add-item":
+		// patch.Path contains ID of the new item
+		// patch.Value contains the ChecklistItem
+		// patch.OldValue empty
+		item := patch.Value.(ChecklistItem)
+		if item.Assignee != "" {
+			if err = backend.checkAssignee(nid, item.Assignee); err != nil {
+				return err
+			}
+		}
+		_, err = backend.db.Exec(`INSERT INTO checklist_items (nid, id, txt, checked, assignee, due, sort_key)
+									SELECT $1, $2, $3, $4, $5, $6, $7
+									WHERE NOT EXISTS (SELECT 1 FROM checklist_items WHERE nid = $1 AND id = $2)`,
+			nid, item.ID, string(item.Text), item.Checked, item.Assignee, dueTime(item.Due), item.SortKey)
+	case "rem-item":
+		// patch.Path contains ID of the item
+		// patch.Value empty
+		// patch.OldValue empty
+		_, err = backend.db.Exec("DELETE FROM checklist_items WHERE nid = $1 AND id = $2", nid, patch.Path)
+	case "edit-text":
+		// patch.Path contains ID of the item
+		// patch.Value contains text-patches
+		// patch.OldValue contains the text the patches were made for, for reference
+		err = backend.patchItemText(nid, patch.Path, patch.Value.([]DMP.Patch))
+	case "toggle-item":
+		// patch.Path contains ID of the item
+		// patch.Value contains the new checked state
+		// patch.OldValue empty
+		_, err = backend.db.Exec("UPDATE checklist_items SET checked = $1 WHERE nid = $2 AND id = $3", patch.Value.(bool), nid, patch.Path)
+	case "set-assignee":
+		// patch.Path contains ID of the item
+		// patch.Value contains uid of the assignee, empty to unassign
+		// patch.OldValue contains the former assignee
+		uid := patch.Value.(string)
+		if uid != "" {
+			if err = backend.checkAssignee(nid, uid); err != nil {
+				return err
+			}
+		}
+		_, err = backend.db.Exec("UPDATE checklist_items SET assignee = $1 WHERE nid = $2 AND id = $3", uid, nid, patch.Path)
+	case "set-due":
+		// patch.Path contains ID of the item
+		// patch.Value contains the due date, nil to remove it
+		// patch.OldValue empty
+		_, err = backend.db.Exec("UPDATE checklist_items SET due = $1 WHERE nid = $2 AND id = $3", dueTime(patch.Value.(*UnixTime)), nid, patch.Path)
+	case "move-item":
+		// patch.Path contains ID of the item
+		// patch.Value contains the new sort key
+		// patch.OldValue empty
+		_, err = backend.db.Exec("UPDATE checklist_items SET sort_key = $1 WHERE nid = $2 AND id = $3", patch.Value.(string), nid, patch.Path)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checklistsqlbackend: checklist(%s) %s of item `%s` failed: %s", nid, patch.Op, patch.Path, err)
+	}
+	if err = notes.pokeTimers(nid, true, ctx); err != nil {
+		ctx.Log().Warn("checklistsqlbackend: could not poke edit-timers", Fields{"nid": nid, "err": err})
+	}
+	switch patch.Op {
+	case "add-item", "rem-item", "edit-text":
+		ctx.store.reindex(nid)
+	}
+	result.Tainted(Resource{Kind: "checklist", ID: nid})
+	// the peers' edit-timers are part of the note
+	result.Tainted(Resource{Kind: "note", ID: nid})
+	return nil
+}
+
+// CreateEmpty creates a new note of kind checklist
+func (backend ChecklistSQLBackend) CreateEmpty(ctx Context) (string, error) {
+	nid, err := NoteSQLBackend{backend.db}.CreateEmpty(ctx)
+	if err != nil {
+		return "", err
+	}
+	if _, err = backend.db.Exec("UPDATE notes SET kind = $1 WHERE nid = $2", NoteKindChecklist, nid); err != nil {
+		return "", err
+	}
+	return nid, nil
+}
+
+// checkAssignee rejects assigning items to users who aren't peers of nid
+func (backend ChecklistSQLBackend) checkAssignee(nid, uid string) error {
+	var n int
+	if err := backend.db.QueryRow("SELECT count(*) FROM noterefs WHERE nid = $1 AND uid = $2", nid, uid).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return Remark{Level: "error", Slug: "invalid-assignee", Data: map[string]string{"uid": uid}}
+	}
+	return nil
+}
+
+// patchItemText applies text-patches to the text of an item. Instead of a
+// serializable transaction, which is overkill for the short texts of items,
+// the update only succeeds if the text is still the one patched and is
+// retried otherwise.
+func (backend ChecklistSQLBackend) patchItemText(nid, id string, patch []DMP.Patch) error {
+	for i := 0; i < maxTextRetries; i++ {
+		var original string
+		switch err := backend.db.QueryRow("SELECT txt FROM checklist_items WHERE nid = $1 AND id = $2", nid, id).Scan(&original); {
+		case err == sql.ErrNoRows:
+			// removed concurrently
+			return nil
+		case err != nil:
+			return err
+		}
+		patched, _ := dmp.PatchApply(patch, original)
+		if patched == original {
+			return nil
+		}
+		res, err := backend.db.Exec("UPDATE checklist_items SET txt = $1 WHERE nid = $2 AND id = $3 AND txt = $4", patched, nid, id, original)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("text changed concurrently %d times in a row", maxTextRetries)
+}
+
+func dueTime(due *UnixTime) *time.Time {
+	if due == nil {
+		return nil
+	}
+	t := time.Time(*due)
+	return &t
+}
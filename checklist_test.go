@@ -0,0 +1,180 @@
+package diffsync
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecklistDelta(t *testing.T) {
+	due := UnixTime(time.Unix(1400000000, 0))
+	shadow := Checklist{Items: []ChecklistItem{
+		{ID: "i1", Text: "milk", SortKey: "V"},
+		{ID: "i2", Text: "eggs", SortKey: "k"},
+		{ID: "i3", Text: "bread", SortKey: "t"},
+	}}
+	master := Checklist{Items: []ChecklistItem{
+		{ID: "i4", Text: "butter", SortKey: "F"},
+		{ID: "i1", Text: "oat milk", SortKey: "V", Checked: true, Assignee: "uid00002", Due: &due},
+		{ID: "i2", Text: "eggs", SortKey: "x"},
+	}}
+	delta := shadow.GetDelta(master)
+
+	// deltas travel as json
+	raw, _ := json.Marshal(delta)
+	decoded := ChecklistDelta{}
+	if !assert.NoError(t, json.Unmarshal(raw, &decoded)) {
+		return
+	}
+	res, patches, err := decoded.Apply(shadow)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, master.Items[0], res.(Checklist).Items[0])
+	assert.Equal(t, master.Items[2], res.(Checklist).Items[2])
+	assert.True(t, sameTime(&due, res.(Checklist).Items[1].Due))
+	ops := []string{}
+	for _, patch := range patches {
+		ops = append(ops, patch.Op+" "+patch.Path)
+	}
+	assert.Equal(t, []string{"add-item i4", "edit-text i1", "toggle-item i1", "set-assignee i1", "set-due i1", "move-item i2", "rem-item i3"}, ops)
+	assert.False(t, res.GetDelta(res).HasChanges())
+}
+
+func TestChecklistDeltaIgnoresInvalidChanges(t *testing.T) {
+	shadow := Checklist{Items: []ChecklistItem{{ID: "i1", Text: "milk", SortKey: "V"}}}
+	res, patches, err := ChecklistDelta{
+		{Op: "add-item", Path: "i1", Value: ChecklistItem{ID: "i1", Text: "dupe"}},
+		{Op: "add-item", Value: ChecklistItem{Text: "no id"}},
+		{Op: "add-item", Path: "i2", Value: ChecklistItem{ID: "i2", Text: "bad key", SortKey: "V0"}},
+		{Op: "toggle-item", Path: "gone", Value: true},
+		{Op: "toggle-item", Path: "i1", Value: false},
+		{Op: "move-item", Path: "i1", Value: "not a key!"},
+		// appended after the last item without a sort key
+		{Op: "add-item", Path: "i3", Value: ChecklistItem{ID: "i3", Text: "eggs"}},
+	}.Apply(shadow)
+	if assert.NoError(t, err) {
+		assert.Len(t, patches, 1)
+		items := res.(Checklist).Items
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, "i3", items[1].ID)
+			assert.True(t, items[1].SortKey > items[0].SortKey)
+		}
+	}
+}
+
+func TestChecklistSQLBackend(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	backend := NewChecklistSQLBackend(db)
+	ctx := Context{uid: "uid00001"}
+	nid, err := backend.CreateEmpty(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ($1, 'uid00002', 'peer'), ($1, 'uid00003', 'viewer')", nid)
+	value, err := backend.Get(nid)
+	if assert.NoError(t, err) {
+		assert.Equal(t, NewChecklist(), value)
+	}
+	_, err = backend.Get("nid00002")
+	assert.Error(t, err, "plain notes have no items")
+
+	due := UnixTime(time.Unix(1400000000, 0))
+	for _, patch := range []Patch{
+		{Op: "add-item", Path: "i1", Value: ChecklistItem{ID: "i1", Text: "buy milk", SortKey: "V"}},
+		{Op: "add-item", Path: "i2", Value: ChecklistItem{ID: "i2", Text: "buy eggs", SortKey: "k"}},
+		{Op: "toggle-item", Path: "i1", Value: true},
+		{Op: "set-assignee", Path: "i2", Value: "uid00002", OldValue: ""},
+		{Op: "set-due", Path: "i2", Value: &due},
+		{Op: "move-item", Path: "i2", Value: "F"},
+	} {
+		assert.NoError(t, backend.Patch(nid, patch, NewSyncResult(), ctx))
+	}
+	// peers edit the same item concurrently, both edits survive
+	for _, text := range []string{"buy oat milk", "buy milk!"} {
+		patch := Patch{Op: "edit-text", Path: "i1", Value: dmp.PatchMake("buy milk", text), OldValue: "buy milk"}
+		assert.NoError(t, backend.Patch(nid, patch, NewSyncResult(), ctx))
+	}
+	value, err = backend.Get(nid)
+	if assert.NoError(t, err) && assert.Len(t, value.(Checklist).Items, 2) {
+		items := value.(Checklist).Items
+		assert.Equal(t, "i2", items[0].ID)
+		assert.Equal(t, "uid00002", items[0].Assignee)
+		if assert.NotNil(t, items[0].Due) {
+			assert.True(t, time.Time(due).Equal(time.Time(*items[0].Due)))
+		}
+		assert.Equal(t, ChecklistItem{ID: "i1", Text: "buy oat milk!", Checked: true, SortKey: "V"}, items[1])
+	}
+
+	err = backend.Patch(nid, Patch{Op: "set-assignee", Path: "i1", Value: "uid99999"}, NewSyncResult(), ctx)
+	assert.Equal(t, "invalid-assignee", err.(Remark).Slug)
+	err = backend.Patch(nid, Patch{Op: "toggle-item", Path: "i1", Value: false}, NewSyncResult(), Context{uid: "uid00003"})
+	assert.Equal(t, "permission-denied", err.(Remark).Slug)
+
+	result := NewSyncResult()
+	assert.NoError(t, backend.Patch(nid, Patch{Op: "rem-item", Path: "i1"}, result, ctx))
+	assert.Contains(t, result.TaintedItems(), Resource{Kind: "checklist", ID: nid})
+	value, _ = backend.Get(nid)
+	assert.Len(t, value.(Checklist).Items, 1)
+
+	// the folio knows which notes are checklists
+	value, err = NewFolioSQLBackend(db).Get("uid00001")
+	if assert.NoError(t, err) {
+		for _, ref := range value.(Folio).NoteRefs {
+			if ref.NID == nid {
+				assert.Equal(t, NoteKindChecklist, ref.Kind)
+			} else {
+				assert.Equal(t, NoteKindText, ref.Kind)
+			}
+		}
+	}
+}
+
+func TestSessionMountsChecklists(t *testing.T) {
+	notes := NewMemBackend(func() ResourceValue { return NewNote("") })
+	notes.Upsert("nid00001", NewNote(""))
+	checklists := NewMemBackend(func() ResourceValue { return NewChecklist() })
+	checklists.Upsert("nid00001", Checklist{Items: []ChecklistItem{{ID: "i1", Text: "milk", SortKey: "V"}}})
+	folios := NewMemBackend(func() ResourceValue { return NewFolio() })
+	folio := NewFolio()
+	folio.NoteRefs = []NoteRef{{NID: "nid00001", Kind: NoteKindChecklist, Status: "active"}}
+	folios.Upsert("uid", folio)
+	store := NewStore(nil)
+	store.Mount("note", &countingBackend{MemBackend: notes})
+	store.Mount("checklist", &countingBackend{MemBackend: checklists})
+	store.Mount("folio", &countingBackend{MemBackend: folios})
+
+	sess := NewSession("sid", "uid")
+	sess.shadows = append(sess.shadows, NewShadow(Resource{Kind: "folio", ID: "uid", Value: folio.Clone()}))
+	pushed := []Resource{}
+	sess.client = FuncHandler{Fn: func(event Event) error {
+		pushed = append(pushed, event.Res.Ref())
+		return nil
+	}}
+	ctx := Context{ts: time.Now(), store: store}
+
+	sess.Handle(Event{Name: "res-add", SID: "sid", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	checklist := Resource{Kind: "checklist", ID: "nid00001"}
+	assert.True(t, sess.hasShadow(checklist), "items are mounted along with the note")
+	assert.Contains(t, pushed, checklist)
+
+	sess.Handle(Event{Name: "res-remove", SID: "sid", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	assert.False(t, sess.hasShadow(checklist))
+}
+
+func TestChecklistShadowJSON(t *testing.T) {
+	shadow := NewShadow(Resource{Kind: "checklist", ID: "nid00001", Value: Checklist{Items: []ChecklistItem{{ID: "i1", Text: "milk", SortKey: "V"}}}})
+	shadow.pending = []Edit{{Delta: ChecklistDelta{{Op: "edit-text", Path: "i1", Value: TextDelta("=4\t+!")}}, Backup: NewChecklist()}}
+	raw, err := json.Marshal(shadow)
+	if !assert.NoError(t, err) {
+		return
+	}
+	restored := Shadow{}
+	if assert.NoError(t, json.Unmarshal(raw, &restored)) {
+		assert.Equal(t, shadow.res, restored.res)
+		assert.Equal(t, shadow.pending, restored.pending)
+	}
+}
@@ -2,11 +2,6 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
-)
-
-var (
-	_ = log.Print
 )
 
 type Clock struct {
@@ -0,0 +1,263 @@
+package diffsync
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hiroapp-com/hync/comm"
+	DMP "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Comment is a remark of a peer on a note. Comments form threads: the first
+// comment of a thread is anchored to the range [Start, End) of the note's
+// text, its replies refer to it by Thread. Anchors count runes and move
+// along with the text, like marks do.
+type Comment struct {
+	ID string `json:"id"`
+	// Thread is the ID of the thread's first comment, empty for the first
+	// comment itself
+	Thread string `json:"thread,omitempty"`
+	// Author is the uid of the comment's author, set by the server
+	Author string `json:"author"`
+	Text   string `json:"text"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	// Resolved marks a thread as done, it's only set on a thread's first
+	// comment
+	Resolved  bool      `json:"resolved,omitempty"`
+	CreatedAt *UnixTime `json:"created_at,omitempty"`
+}
+
+type CommentList []Comment
+
+const (
+	// maxCommentID limits the length of client chosen comment IDs
+	maxCommentID = 32
+	// maxCommentLength is the maximum length of a comment's text in runes
+	maxCommentLength = 4000
+)
+
+func (c Comment) equals(other Comment) bool {
+	sameCreated := sameTime(c.CreatedAt, other.CreatedAt)
+	c.CreatedAt, other.CreatedAt = nil, nil
+	return sameCreated && c == other
+}
+
+func (c Comment) pathRef() string {
+	return "comments/" + c.ID
+}
+
+func (comments CommentList) indexFromPath(path string) (int, bool) {
+	if !strings.HasPrefix(path, "comments/") {
+		return 0, false
+	}
+	id := path[9:]
+	for i := range comments {
+		if comments[i].ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// valid checks a comment added by a client to a note with the given text.
+// Anchors beyond the text are cut off, replies have none.
+func (comments CommentList) valid(c Comment, text TextValue) (Comment, bool) {
+	if c.ID == "" || len(c.ID) > maxCommentID || strings.TrimSpace(c.Text) == "" || utf8.RuneCountInString(c.Text) > maxCommentLength {
+		return c, false
+	}
+	if _, exists := comments.indexFromPath(c.pathRef()); exists {
+		return c, false
+	}
+	c.Resolved = false
+	if c.Thread != "" {
+		i, ok := comments.indexFromPath("comments/" + c.Thread)
+		if !ok || comments[i].Thread != "" {
+			// replies to replies are not threaded
+			return c, false
+		}
+		c.Start, c.End = 0, 0
+		return c, true
+	}
+	if length := utf8.RuneCountInString(string(text)); c.End > length {
+		c.End = length
+	}
+	return c, c.Start >= 0 && c.Start <= c.End
+}
+
+// shift moves the anchors of comments along with a text delta against text.
+// Threads whose text has been deleted keep an empty anchor where it was.
+func (comments CommentList) shift(text TextValue, delta TextDelta) CommentList {
+	if len(comments) == 0 || !delta.HasChanges() {
+		return comments
+	}
+	diffs, err := dmp.DiffFromDelta(string(text), string(delta))
+	if err != nil {
+		return comments
+	}
+	return shiftComments(comments, diffs)
+}
+
+func shiftComments(comments CommentList, diffs []DMP.Diff) CommentList {
+	shifted := make(CommentList, len(comments))
+	for i, c := range comments {
+		if c.Thread == "" {
+			c.Start = shiftOffset(diffs, c.Start, true)
+			c.End = shiftOffset(diffs, c.End, false)
+			if c.End < c.Start {
+				c.End = c.Start
+			}
+		}
+		shifted[i] = c
+	}
+	return shifted
+}
+
+func diffComments(old, master CommentList) NoteDelta {
+	delta := NoteDelta{}
+	for _, c := range master {
+		idx, ok := old.indexFromPath(c.pathRef())
+		switch {
+		case !ok:
+			delta = append(delta, NoteDeltaElement{"add-comment", "comments/", c})
+		case !old[idx].equals(c):
+			delta = append(delta, NoteDeltaElement{"set-comment", c.pathRef(), c})
+		}
+	}
+	for _, c := range old {
+		if _, ok := master.indexFromPath(c.pathRef()); !ok {
+			delta = append(delta, NoteDeltaElement{Op: "rem-comment", Path: c.pathRef()})
+		}
+	}
+	return delta
+}
+
+func (backend NoteSQLBackend) getComments(nid string) (CommentList, error) {
+	rows, err := backend.db.Query(`SELECT id, thread, author, txt, start_pos, end_pos, resolved, created_at
+								   FROM note_comments
+								   WHERE nid = $1
+								   ORDER BY created_at, id`, nid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var comments CommentList
+	for rows.Next() {
+		c := Comment{}
+		var createdAt time.Time
+		if err = rows.Scan(&c.ID, &c.Thread, &c.Author, &c.Text, &c.Start, &c.End, &c.Resolved, &createdAt); err != nil {
+			return nil, err
+		}
+		ts := UnixTime(createdAt)
+		c.CreatedAt = &ts
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// addComment stores a comment of ctx's user and returns whether it's new
+func (backend NoteSQLBackend) addComment(nid string, c Comment, ctx Context) (bool, error) {
+	if c.Thread != "" {
+		var n int
+		if err := backend.db.QueryRow("SELECT count(*) FROM note_comments WHERE nid = $1 AND id = $2 AND thread = ''", nid, c.Thread).Scan(&n); err != nil {
+			return false, err
+		}
+		if n == 0 {
+			return false, Remark{Level: "error", Slug: "comment-invalid"}
+		}
+	}
+	res, err := backend.db.Exec(`INSERT INTO note_comments (nid, id, thread, author, txt, start_pos, end_pos, created_at)
+								 SELECT $1, $2, $3, $4, $5, $6, $7, $8
+								 WHERE NOT EXISTS (SELECT 1 FROM note_comments WHERE nid = $1 AND id = $2)`,
+		nid, c.ID, c.Thread, ctx.uid, c.Text, c.Start, c.End, time.Now())
+	if err != nil {
+		return false, err
+	}
+	added, _ := res.RowsAffected()
+	return added > 0, nil
+}
+
+// shiftStoredComments moves the anchors of nid's comments along with a
+// change of its text from original to patched, see shiftStoredMarks
+func shiftStoredComments(txn *sql.Tx, nid, original, patched string) error {
+	rows, err := txn.Query("SELECT id, start_pos, end_pos FROM note_comments WHERE nid = $1 AND thread = ''", nid)
+	if err != nil {
+		return err
+	}
+	comments := CommentList{}
+	for rows.Next() {
+		c := Comment{}
+		if err = rows.Scan(&c.ID, &c.Start, &c.End); err != nil {
+			rows.Close()
+			return err
+		}
+		comments = append(comments, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(comments) == 0 {
+		return err
+	}
+	shifted := shiftComments(comments, dmp.DiffMain(original, patched, false))
+	for i := range comments {
+		if shifted[i] == comments[i] {
+			continue
+		}
+		if _, err = txn.Exec("UPDATE note_comments SET start_pos = $1, end_pos = $2 WHERE nid = $3 AND id = $4", shifted[i].Start, shifted[i].End, nid, comments[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyReply tells everybody who took part in the thread of reply about it,
+// except for its author
+func (backend NoteSQLBackend) notifyReply(nid string, reply Comment, ctx Context) {
+	uids, err := queryStrings(backend.db, "SELECT DISTINCT author FROM note_comments WHERE nid = $1 AND (id = $2 OR thread = $2) AND author <> $3 AND author <> ''", nid, reply.Thread, ctx.uid)
+	if err != nil {
+		ctx.Log().Error("notifyReply: could not fetch participants of thread", Fields{"nid": nid, "thread": reply.Thread, "err": err})
+		return
+	}
+	if len(uids) == 0 {
+		return
+	}
+	var title string
+	if err = backend.db.QueryRow("SELECT title FROM notes WHERE nid = $1", nid).Scan(&title); err != nil {
+		ctx.Log().Error("notifyReply: could not fetch note info", Fields{"nid": nid, "err": err})
+		return
+	}
+	author, err := findUserByUID(backend.db, ctx.uid)
+	if err != nil || author == nil {
+		ctx.Log().Error("notifyReply: could not fetch profile info of author", Fields{"nid": nid, "err": err})
+		return
+	}
+	for _, uid := range uids {
+		rcpt, err := findUserByUID(backend.db, uid)
+		if err != nil || rcpt == nil {
+			ctx.Log().Warn("notifyReply: could not fetch participant", Fields{"nid": nid, "uid": uid, "err": err})
+			continue
+		}
+		if _, kind := rcpt.Addr(); kind == "" {
+			continue
+		}
+		token, hashed := GenerateToken()
+		if _, err = backend.db.Exec("INSERT INTO tokens (token, kind, uid) VALUES ($1, 'login', $2)", hashed, uid); err != nil {
+			ctx.Log().Error("notifyReply: failed to create logintoken", Fields{"nid": nid, "err": err})
+			continue
+		}
+		req := comm.NewRequest("comment-reply", *rcpt, map[string]interface{}{
+			"token":        token,
+			"nid":          nid,
+			"title":        title,
+			"thread":       reply.Thread,
+			"peek":         peek(reply.Text, 500),
+			"author_name":  author.Name,
+			"author_email": author.Email,
+			"author_phone": author.Phone,
+		})
+		if err = ctx.store.commHandler(req); err != nil {
+			ctx.Log().Error("notifyReply: could not forward request to comm.Handler", Fields{"nid": nid, "err": err})
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package diffsync
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hiroapp-com/hync/comm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommentAnchorsFollowText(t *testing.T) {
+	note := NewNote("some bold text")
+	note.Comments = CommentList{
+		{ID: "c1", Text: "bold?", Start: 5, End: 9},
+		{ID: "c2", Thread: "c1", Text: "yes"},
+	}
+	edit := func(text string) CommentList {
+		delta := NoteDelta{{"delta-text", "", note.Text.GetDelta(TextValue(text))}}
+		res, _, err := delta.Apply(note)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res.(Note).Comments
+	}
+	assert.Equal(t, CommentList{{ID: "c1", Text: "bold?", Start: 9, End: 13}, {ID: "c2", Thread: "c1", Text: "yes"}},
+		edit("so, some bold text"))
+	assert.Equal(t, CommentList{{ID: "c1", Text: "bold?", Start: 5, End: 5}, {ID: "c2", Thread: "c1", Text: "yes"}},
+		edit("some text"), "threads outlive their text")
+	assert.Equal(t, 5, note.Comments[0].Start, "shadow left untouched")
+}
+
+func TestNoteCommentDelta(t *testing.T) {
+	created := UnixTime(time.Unix(1400000000, 0))
+	shadow := NewNote("hello world")
+	shadow.Comments = CommentList{{ID: "c1", Author: "uid00001", Text: "which world?", Start: 6, End: 11, CreatedAt: &created}}
+	master := NewNote("oh, hello world")
+	master.Comments = CommentList{
+		{ID: "c1", Author: "uid00001", Text: "which world?", Start: 10, End: 15, Resolved: true, CreatedAt: &created},
+		{ID: "c2", Thread: "c1", Author: "uid00002", Text: "this one", CreatedAt: &created},
+	}
+	delta := shadow.GetDelta(master).(NoteDelta)
+	ops := []string{}
+	for _, elem := range delta {
+		ops = append(ops, elem.Op+" "+elem.Path)
+	}
+	assert.Equal(t, []string{"delta-text ", "set-comment comments/c1", "add-comment comments/"}, ops, "moved anchors are not sent")
+
+	raw, _ := json.Marshal(delta)
+	decoded := NoteDelta{}
+	if !assert.NoError(t, json.Unmarshal(raw, &decoded)) {
+		return
+	}
+	res, _, err := decoded.Apply(shadow)
+	if assert.NoError(t, err) {
+		assert.Equal(t, master.Text, res.(Note).Text)
+		assert.Equal(t, master.Comments, res.(Note).Comments)
+	}
+}
+
+func TestNoteCommentPatches(t *testing.T) {
+	note := NewNote("hello")
+	note.Comments = CommentList{
+		{ID: "c1", Text: "hi"},
+		{ID: "c2", Thread: "c1", Text: "reply"},
+	}
+	_, patches, err := NoteDelta{
+		{"add-comment", "comments/", Comment{ID: "c3", Text: "whole note", Start: 0, End: 99, Resolved: true}},
+		{"add-comment", "comments/", Comment{ID: "c4", Thread: "c1", Text: "another reply", Start: 1, End: 2}},
+		{"add-comment", "comments/", Comment{ID: "c5", Thread: "c2", Text: "reply to a reply"}},
+		{"add-comment", "comments/", Comment{ID: "c1", Text: "dupe"}},
+		{"add-comment", "comments/", Comment{ID: "c6", Text: "  "}},
+		{"add-comment", "comments/", Comment{ID: "c7", Text: "backwards", Start: 3, End: 1}},
+		{"resolve-comment", "comments/c1", true},
+		{"resolve-comment", "comments/c2", true},
+	}.Apply(note)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Patch{
+			{Op: "add-comment", Path: "c3", Value: Comment{ID: "c3", Text: "whole note", Start: 0, End: 5}},
+			{Op: "add-comment", Path: "c4", Value: Comment{ID: "c4", Thread: "c1", Text: "another reply"}},
+			{Op: "resolve-comment", Path: "c1", Value: true},
+		}, patches)
+	}
+}
+
+func TestNoteSQLBackendComments(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	db.Exec("UPDATE users SET email = uid || '@example.com'")
+	sent := make(chan comm.Request, 10)
+	store := NewStore(func(req comm.Request) error {
+		sent <- req
+		return nil
+	})
+	backend := NewNoteSQLBackend(db)
+	patch := func(uid string, p Patch) error {
+		return backend.Patch("nid00001", p, NewSyncResult(), Context{uid: uid, store: store})
+	}
+
+	// replies notify everybody else in the thread
+	notified := func(n int) []string {
+		rcpts := []string{}
+		timeout := time.After(time.Second)
+		for len(rcpts) < n {
+			select {
+			case req := <-sent:
+				assert.Equal(t, "comment-reply", req.Kind)
+				assert.Equal(t, "c1", req.Data["thread"])
+				addr, _ := req.Rcpt.Addr()
+				rcpts = append(rcpts, addr+" "+req.Data["peek"])
+			case <-timeout:
+				t.Fatalf("notifications missing, got %v", rcpts)
+			}
+		}
+		sort.Strings(rcpts)
+		return rcpts
+	}
+	assert.NoError(t, patch("uid00001", Patch{Op: "add-comment", Path: "c1", Value: Comment{ID: "c1", Author: "uid00002", Text: "why?", Start: 7, End: 11}}))
+	// viewers discuss as well
+	assert.NoError(t, patch("uid00003", Patch{Op: "add-comment", Path: "c2", Value: Comment{ID: "c2", Thread: "c1", Text: "dunno"}}))
+	assert.Equal(t, []string{"uid00001@example.com dunno"}, notified(1))
+	assert.NoError(t, patch("uid00002", Patch{Op: "add-comment", Path: "c3", Value: Comment{ID: "c3", Thread: "c1", Text: "because"}}))
+	assert.Equal(t, []string{"uid00001@example.com because", "uid00003@example.com because"}, notified(2))
+	err := patch("uid00003", Patch{Op: "resolve-comment", Path: "c1", Value: true})
+	assert.Equal(t, "permission-denied", err.(Remark).Slug, "viewers can't resolve threads")
+	assert.NoError(t, patch("uid00002", Patch{Op: "resolve-comment", Path: "c1", Value: true}))
+	err = patch("uid00002", Patch{Op: "add-comment", Path: "c4", Value: Comment{ID: "c4", Thread: "c3", Text: "nested"}})
+	assert.Equal(t, "comment-invalid", err.(Remark).Slug)
+
+	txn, _ := db.Begin()
+	assert.NoError(t, shiftStoredComments(txn, "nid00001", "shared text", "our shared text"))
+	txn.Commit()
+
+	value, err := backend.Get("nid00001")
+	if assert.NoError(t, err) && assert.Len(t, value.(Note).Comments, 3) {
+		comments := value.(Note).Comments
+		thread := comments[0]
+		assert.Equal(t, "uid00001", thread.Author, "authors can't be forged")
+		assert.Equal(t, 11, thread.Start)
+		assert.Equal(t, 15, thread.End)
+		assert.True(t, thread.Resolved)
+		assert.NotNil(t, thread.CreatedAt)
+	}
+
+	assert.Len(t, sent, 0)
+}
@@ -1,8 +1,8 @@
 package diffsync
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
@@ -16,6 +16,8 @@ type Context struct {
 	store  *Store
 	Router EventHandler
 	Client EventHandler
+	// Addr is the client's remote address, if known to the transport
+	Addr string
 }
 
 func NewContext(router EventHandler, store *Store, client EventHandler) Context {
@@ -42,18 +44,37 @@ func (c Context) Clone() Context {
 	return c
 }
 
+// Log returns the store's logger, annotated with the context's sid and uid
+func (c Context) Log() *Logger {
+	l := defaultLogger
+	if c.store != nil && c.store.log != nil {
+		l = c.store.log
+	}
+	f := Fields{}
+	if c.sid != "" {
+		f["sid"] = c.sid
+	}
+	if c.uid != "" {
+		f["uid"] = c.uid
+	}
+	return l.With(f)
+}
+
+// LogError logs err and reports it to rollbar. Both only get to see the
+// scrubbed message (see scrubError), error strings must not contain note
+// contents regardless.
 func (c Context) LogError(err error) {
-	log.Println("ERROR", err, personFromUser(c.User()))
-	rollbar.Error(rollbar.ERR, err, personFromUser(c.User()))
+	c.Log().Error("error", Fields{"err": err})
+	rollbar.Error(rollbar.ERR, errors.New(scrubError(err)), personFromUser(c.User()))
 }
 
 func (c Context) LogCritical(err error) {
-	log.Println("CRITICAL", err, personFromUser(c.User()))
-	rollbar.Error(rollbar.CRIT, err, personFromUser(c.User()))
+	c.Log().Error("critical error", Fields{"err": err, "critical": true})
+	rollbar.Error(rollbar.CRIT, errors.New(scrubError(err)), personFromUser(c.User()))
 }
 
 func (c Context) LogInfo(msg string, args ...interface{}) {
-	log.Println("INFO", msg, args)
+	c.Log().Info(fmt.Sprintf(msg, args...))
 	rollbar.Message(rollbar.INFO, fmt.Sprintf(msg, args...), personFromUser(c.User()))
 }
 
@@ -0,0 +1,53 @@
+package diffsync
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Drain prepares the server for shutting down: no new sessions are accepted
+// anymore, every active session is flushed and saved and its client receives
+// a `server-draining` event with a hint where to reconnect. After all runners
+// stopped, or timeout passed, the server is stopped.
+func (srv *Server) Drain(timeout time.Duration) {
+	atomic.StoreInt32(&srv.draining, 1)
+	srv.log.Info("server: draining", Fields{"timeout": timeout})
+	if !srv.sessionHub.Drain(srv.farewell("server-draining", ""), timeout) {
+		srv.log.Warn("server: drain timed out, stopping remaining runners")
+	}
+	srv.Stop()
+}
+
+// Handover flushes, saves and stops the runner of the given session, so that
+// another process can take it over, e.g. during a rolling deploy. The client
+// is told to reconnect and all further events addressed to the session are
+// passed on to Config.Forward.
+func (srv *Server) Handover(sid string, timeout time.Duration) error {
+	stopped := srv.sessionHub.Handover(srv.farewell("session-handover", sid))
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("session handover timed out")
+	}
+}
+
+func (srv *Server) isDraining() bool {
+	return atomic.LoadInt32(&srv.draining) == 1
+}
+
+func (srv *Server) farewell(name, sid string) Event {
+	ctx := NewContext(srv.sessionHub, srv.Store, nil)
+	ctx.sid = sid
+	return Event{Name: name, SID: sid, Remark: srv.reconnectRemark(), ctx: ctx}
+}
+
+func (srv *Server) reconnectRemark() *Remark {
+	data := map[string]string{"reconnect-after": strconv.Itoa(int(srv.cfg.ReconnectDelay / time.Second))}
+	if srv.cfg.ReconnectURL != "" {
+		data["reconnect-url"] = srv.cfg.ReconnectURL
+	}
+	return &Remark{Level: "warn", Slug: "server-draining", Data: data}
+}
@@ -0,0 +1,135 @@
+package diffsync
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memSessions is a SessionBackend which hands out blank sessions and keeps
+// track of loads and saves. If saving is set, Save waits for it to be closed.
+type memSessions struct {
+	sync.Mutex
+	saved  map[string]int
+	ops    []string
+	saving chan struct{}
+}
+
+func (m *memSessions) Get(sid string) (*Session, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.ops = append(m.ops, "get "+sid)
+	return NewSession(sid, "uid-"+sid), nil
+}
+
+func (m *memSessions) GetUID(sid string) (string, error) {
+	return "uid-" + sid, nil
+}
+
+func (m *memSessions) Save(sess *Session) error {
+	if m.saving != nil {
+		<-m.saving
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.ops = append(m.ops, "save "+sess.sid)
+	m.saved[sess.sid]++
+	return nil
+}
+
+func (m *memSessions) history() []string {
+	m.Lock()
+	defer m.Unlock()
+	return append([]string{}, m.ops...)
+}
+
+func (m *memSessions) timesSaved(sid string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.saved[sid]
+}
+
+func (m *memSessions) SessionsOfUser(string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *memSessions) GetSubscriptions(Resource) (map[string]Resource, error) {
+	return map[string]Resource{}, nil
+}
+
+func drainHub(forward EventHandler) (*SessionHub, *memSessions) {
+	backend := &memSessions{saved: map[string]int{}}
+	cfg := DefaultConfig()
+	cfg.Logger = nil
+	cfg.Forward = forward
+	hub := NewSessionHub(backend, cfg)
+	go hub.Run()
+	return hub, backend
+}
+
+func connectClient(hub *SessionHub, sid string) <-chan Event {
+	events := make(chan Event, 8)
+	client := FuncHandler{Fn: func(event Event) error {
+		events <- event
+		return nil
+	}}
+	ctx := Context{sid: sid, Client: client, Router: hub, store: NewStore(nil)}
+	hub.Handle(Event{Name: "client-ehlo", SID: sid, ctx: ctx})
+	return events
+}
+
+func awaitEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestSessionHubDrain(t *testing.T) {
+	hub, backend := drainHub(nil)
+	defer hub.Stop()
+	clients := []<-chan Event{connectClient(hub, "sid1"), connectClient(hub, "sid2")}
+	time.Sleep(50 * time.Millisecond)
+	remark := &Remark{Level: "warn", Slug: "server-draining", Data: map[string]string{"reconnect-after": "5"}}
+	assert.True(t, hub.Drain(Event{Name: "server-draining", Remark: remark}, time.Second), "runners did not stop in time")
+	for i, sid := range []string{"sid1", "sid2"} {
+		event := awaitEvent(t, clients[i])
+		assert.Equal(t, "server-draining", event.Name)
+		assert.Equal(t, sid, event.SID)
+		assert.Equal(t, "5", event.Remark.Data["reconnect-after"])
+		assert.Equal(t, 1, backend.timesSaved(sid), "session not saved on drain")
+	}
+}
+
+func TestSessionHubHandover(t *testing.T) {
+	forwarded := make(chan Event, 1)
+	hub, backend := drainHub(FuncHandler{Fn: func(event Event) error {
+		forwarded <- event
+		return nil
+	}})
+	defer hub.Stop()
+	client := connectClient(hub, "sid1")
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-hub.Handover(Event{Name: "session-handover", SID: "sid1", Remark: &Remark{Slug: "server-draining"}}):
+	case <-time.After(time.Second):
+		t.Fatal("runner did not stop after handover")
+	}
+	assert.Equal(t, "session-handover", awaitEvent(t, client).Name)
+	assert.Equal(t, 1, backend.timesSaved("sid1"), "session not saved on handover")
+	hub.Handle(Event{Name: "client-ehlo", SID: "sid1"})
+	assert.Equal(t, "sid1", awaitEvent(t, forwarded).SID, "event for released session not forwarded")
+}
+
+func TestServerStopAfterDrain(t *testing.T) {
+	db := testDB(t, allTables...)
+	srv, _ := NewServer(db, nil)
+	srv.Run()
+	srv.Drain(time.Second)
+	assert.NotPanics(t, srv.Stop, "stopping a drained server panicked")
+}
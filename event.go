@@ -84,6 +84,14 @@ type Event struct {
 	// session-create events use the Token to authenticate themself.
 	Token string `json:"token,omitempty"`
 
+	// Credentials can be used by session-create events instead of a Token
+	// to log in with email or phone and password
+	Credentials *Credentials `json:"credentials,omitempty"`
+
+	// Identity holds an assertion of an external identity provider. Used by
+	// session-create events to log in and by identity-link/-unlink events
+	Identity *IdentityAssertion `json:"identity,omitempty"`
+
 	// The Edit-Queue sent along with any res-sync requests
 	Changes []Edit `json:"changes,omitempty"`
 
@@ -104,6 +112,19 @@ type Event struct {
 
 	Remark *Remark `json:"remark,omitempty"`
 
+	// Tokens is the response to a token-list event
+	Tokens []TokenInfo `json:"tokens,omitempty"`
+
+	// Deletion holds the options of an account-delete event
+	Deletion *AccountDeletion `json:"deletion,omitempty"`
+
+	// Lazy asks session-create to only mount the most recently edited notes
+	Lazy bool `json:"lazy,omitempty"`
+
+	// Query is the search query of a search event, Results its response
+	Query   string         `json:"query,omitempty"`
+	Results []SearchResult `json:"results,omitempty"`
+
 	// A channel that wants from now on receive client-responses to this
 	// event and any further events for this Event's SID
 	//
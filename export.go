@@ -0,0 +1,288 @@
+package diffsync
+
+import (
+	"archive/zip"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NoteFormatter renders a note for export. Peers of the note are expected to
+// have their names filled in where known.
+type NoteFormatter interface {
+	// Ext is the file extension of formatted notes, e.g. ".md"
+	Ext() string
+	Format(w io.Writer, note Note) error
+}
+
+var noteFormatters = map[string]NoteFormatter{
+	"markdown": markdownFormatter{},
+	"html":     htmlFormatter{},
+	"txt":      textFormatter{},
+}
+
+// RegisterNoteFormatter makes a formatter available for exports under name,
+// replacing any formatter previously registered under that name
+func RegisterNoteFormatter(name string, f NoteFormatter) {
+	noteFormatters[name] = f
+}
+
+// ExportManifest describes the contents of a folio export
+type ExportManifest struct {
+	Format     string         `json:"format"`
+	UID        string         `json:"uid"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Notes      []ExportedNote `json:"notes"`
+}
+
+// ExportedNote is a note's entry in an ExportManifest
+type ExportedNote struct {
+	NID    string   `json:"nid"`
+	Title  string   `json:"title"`
+	File   string   `json:"file"`
+	Status string   `json:"status"`
+	Folder string   `json:"folder,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// ExportNote writes nid formatted in the given format to w
+func (srv *Server) ExportNote(nid, format string, w io.Writer) error {
+	f, ok := noteFormatters[format]
+	if !ok {
+		return fmt.Errorf("export: unknown format `%s`", format)
+	}
+	note, err := srv.exportedNote(nid, map[string]User{})
+	if err != nil {
+		return err
+	}
+	return f.Format(w, note)
+}
+
+// ExportFolio writes a zip archive to w with all notes in uid's folio in the
+// given format and a manifest.json listing them
+func (srv *Server) ExportFolio(uid, format string, w io.Writer) error {
+	f, ok := noteFormatters[format]
+	if !ok {
+		return fmt.Errorf("export: unknown format `%s`", format)
+	}
+	profile := Resource{Kind: "profile", ID: uid}
+	if err := srv.Store.Load(&profile); err != nil {
+		return err
+	}
+	folio := Resource{Kind: "folio", ID: uid}
+	if err := srv.Store.Load(&folio); err != nil {
+		return err
+	}
+	// peers are only known by uid, name them after the user's contacts
+	known := map[string]User{uid: profile.Value.(Profile).User}
+	for _, contact := range profile.Value.(Profile).Contacts {
+		known[contact.UID] = contact
+	}
+	archive := zip.NewWriter(w)
+	manifest := ExportManifest{Format: format, UID: uid, ExportedAt: time.Now().UTC(), Notes: []ExportedNote{}}
+	for _, ref := range folio.Value.(Folio).NoteRefs {
+		note, err := srv.exportedNote(ref.NID, known)
+		if err != nil {
+			return err
+		}
+		entry := ExportedNote{
+			NID:    ref.NID,
+			Title:  note.Title,
+			File:   "notes/" + ref.NID + f.Ext(),
+			Status: ref.Status,
+			Folder: ref.Folder,
+			Tags:   ref.Tags,
+		}
+		out, err := archive.Create(entry.File)
+		if err != nil {
+			return err
+		}
+		if err = f.Format(out, note); err != nil {
+			return err
+		}
+		manifest.Notes = append(manifest.Notes, entry)
+	}
+	if err := writeJSON(archive, "manifest.json", manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// exportedNote loads nid along with its creation time and checklist items,
+// which the note backend leaves out, and names its peers from known
+func (srv *Server) exportedNote(nid string, known map[string]User) (Note, error) {
+	res := Resource{Kind: "note", ID: nid}
+	if err := srv.Store.Load(&res); err != nil {
+		return Note{}, err
+	}
+	note := res.Value.(Note)
+	var kind string
+	if err := srv.db.QueryRow("SELECT created_at, kind FROM notes WHERE nid = $1", nid).Scan(&note.CreatedAt, &kind); err != nil {
+		return Note{}, err
+	}
+	if kind == NoteKindChecklist {
+		checklist := Resource{Kind: "checklist", ID: nid}
+		if err := srv.Store.Load(&checklist); err != nil {
+			return Note{}, err
+		}
+		note.Items = checklist.Value.(Checklist).Items
+	}
+	peers := make(PeerList, len(note.Peers))
+	for i, peer := range note.Peers {
+		if user, ok := known[peer.User.UID]; ok {
+			peer.User = user
+		}
+		peers[i] = peer
+	}
+	note.Peers = peers
+	return note, nil
+}
+
+// exportView holds what all formatters show of a note
+type exportView struct {
+	Title     string
+	Text      string
+	CreatedAt string
+	LastEdit  string
+	Peers     []string
+	Items     []exportItem
+}
+
+type exportItem struct {
+	Text    string
+	Checked bool
+}
+
+const exportTimeFormat = "2006-01-02 15:04 MST"
+
+func newExportView(note Note) exportView {
+	view := exportView{Title: firstNonEmpty(strings.TrimSpace(note.Title), "Untitled"), Text: string(note.Text)}
+	if created := time.Time(note.CreatedAt); !created.IsZero() {
+		view.CreatedAt = created.UTC().Format(exportTimeFormat)
+	}
+	var lastEdit time.Time
+	for _, peer := range note.Peers {
+		if peer.LastEdit != nil && time.Time(*peer.LastEdit).After(lastEdit) {
+			lastEdit = time.Time(*peer.LastEdit)
+		}
+		name := firstNonEmpty(peer.User.Name, peer.User.Email, peer.User.Phone, peer.User.UID)
+		view.Peers = append(view.Peers, fmt.Sprintf("%s (%s)", name, peer.Role))
+	}
+	sort.Strings(view.Peers)
+	for _, item := range note.Items {
+		view.Items = append(view.Items, exportItem{Text: string(item.Text), Checked: item.Checked})
+	}
+	if !lastEdit.IsZero() {
+		view.LastEdit = lastEdit.UTC().Format(exportTimeFormat)
+	}
+	return view
+}
+
+// body returns the text of view followed by its checklist items, each
+// prefixed with the marker for its state
+func (view exportView) body(checked, unchecked string) string {
+	lines := []string{}
+	if text := strings.TrimRight(view.Text, "\n"); text != "" {
+		lines = append(lines, text)
+	}
+	if len(lines) > 0 && len(view.Items) > 0 {
+		lines = append(lines, "")
+	}
+	for _, item := range view.Items {
+		marker := unchecked
+		if item.Checked {
+			marker = checked
+		}
+		lines = append(lines, marker+item.Text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// details lists the metadata of view as label/value pairs
+func (view exportView) details() [][2]string {
+	details := [][2]string{}
+	if view.CreatedAt != "" {
+		details = append(details, [2]string{"Created", view.CreatedAt})
+	}
+	if view.LastEdit != "" {
+		details = append(details, [2]string{"Last edit", view.LastEdit})
+	}
+	if len(view.Peers) > 0 {
+		details = append(details, [2]string{"Shared with", strings.Join(view.Peers, ", ")})
+	}
+	return details
+}
+
+type markdownFormatter struct{}
+
+func (markdownFormatter) Ext() string { return ".md" }
+
+func (markdownFormatter) Format(w io.Writer, note Note) error {
+	view := newExportView(note)
+	if _, err := fmt.Fprintf(w, "# %s\n\n%s\n", view.Title, view.body("- [x] ", "- [ ] ")); err != nil {
+		return err
+	}
+	if details := view.details(); len(details) > 0 {
+		fmt.Fprint(w, "\n---\n\n")
+		for _, d := range details {
+			if _, err := fmt.Fprintf(w, "- %s: %s\n", d[0], d[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type textFormatter struct{}
+
+func (textFormatter) Ext() string { return ".txt" }
+
+func (textFormatter) Format(w io.Writer, note Note) error {
+	view := newExportView(note)
+	if _, err := fmt.Fprintf(w, "%s\n%s\n\n%s\n", view.Title, strings.Repeat("=", len([]rune(view.Title))), view.body("[x] ", "[ ] ")); err != nil {
+		return err
+	}
+	if details := view.details(); len(details) > 0 {
+		fmt.Fprint(w, "\n-- \n")
+		for _, d := range details {
+			if _, err := fmt.Fprintf(w, "%s: %s\n", d[0], d[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var htmlExport = template.Must(template.New("note").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div style="white-space: pre-wrap">{{.Text}}</div>
+{{with .Items}}<ul style="list-style: none">
+{{range .}}<li><input type="checkbox" disabled{{if .Checked}} checked{{end}}> {{.Text}}</li>
+{{end}}</ul>
+{{end}}{{with .Details}}<dl>
+{{range .}}<dt>{{index . 0}}</dt><dd>{{index . 1}}</dd>
+{{end}}</dl>
+{{end}}</body>
+</html>
+`))
+
+type htmlFormatter struct{}
+
+func (htmlFormatter) Ext() string { return ".html" }
+
+func (htmlFormatter) Format(w io.Writer, note Note) error {
+	view := newExportView(note)
+	return htmlExport.Execute(w, struct {
+		exportView
+		Details [][2]string
+	}{view, view.details()})
+}
@@ -0,0 +1,112 @@
+package diffsync
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestNoteFormatters(t *testing.T) {
+	edited := UnixTime(time.Date(2014, 5, 13, 16, 53, 0, 0, time.UTC))
+	note := Note{
+		Title:     "Shopping <list>",
+		Text:      TextValue("- milk & eggs\n- bread\n"),
+		CreatedAt: UnixTime(time.Date(2014, 5, 1, 9, 30, 0, 0, time.UTC)),
+		Peers: PeerList{
+			{User: User{UID: "uid00001", Name: "Flo"}, Role: "owner", LastEdit: &edited},
+			{User: User{UID: "uid00002", Email: "peer@example.com"}, Role: "peer"},
+		},
+	}
+	for name, f := range noteFormatters {
+		buf := bytes.Buffer{}
+		if !assert.NoError(t, f.Format(&buf, note), name) {
+			continue
+		}
+		golden := filepath.Join("testdata", "export", "note"+f.Ext())
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, string(expected), buf.String(), "%s output differs from %s", name, golden)
+		}
+	}
+}
+
+func TestExportFolio(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	srv, _ := NewServer(db, nil)
+	srv.Store.Mount("note", NewNoteSQLBackend(db))
+	srv.Store.Mount("folio", NewFolioSQLBackend(db))
+	srv.Store.Mount("profile", NewProfileSQLBackend(db))
+
+	buf := bytes.Buffer{}
+	assert.Error(t, srv.ExportFolio("uid00001", "docx", &buf))
+	if !assert.NoError(t, srv.ExportFolio("uid00001", "markdown", &buf)) {
+		return
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	if !assert.Contains(t, files, "manifest.json") {
+		return
+	}
+	r, _ := files["manifest.json"].Open()
+	defer r.Close()
+	manifest := ExportManifest{}
+	if assert.NoError(t, json.NewDecoder(r).Decode(&manifest)) && assert.Len(t, manifest.Notes, 3) {
+		assert.Equal(t, "markdown", manifest.Format)
+		for _, entry := range manifest.Notes {
+			assert.Contains(t, files, entry.File)
+		}
+	}
+	if assert.Contains(t, files, "notes/nid00001.md") {
+		r, _ := files["notes/nid00001.md"].Open()
+		defer r.Close()
+		md, _ := ioutil.ReadAll(r)
+		assert.Contains(t, string(md), "# shared\n\nshared text\n")
+		// peers are named after the user's contacts
+		assert.Contains(t, string(md), "peer (peer)")
+	}
+}
+
+func TestExportChecklist(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	db.Exec("UPDATE notes SET kind = 'checklist', txt = '' WHERE nid = 'nid00002'")
+	db.Exec(`INSERT INTO checklist_items (nid, id, txt, checked, sort_key) VALUES
+				('nid00002', 'i1', 'milk', true, 'V'),
+				('nid00002', 'i2', 'bread & <butter>', false, 'W')`)
+	srv, _ := NewServer(db, nil)
+	srv.Store.Mount("note", NewNoteSQLBackend(db))
+	srv.Store.Mount("checklist", NewChecklistSQLBackend(db))
+
+	expected := map[string]string{
+		"markdown": "\n\n- [x] milk\n- [ ] bread & <butter>\n",
+		"txt":      "\n\n[x] milk\n[ ] bread & <butter>\n",
+		"html":     "<li><input type=\"checkbox\" disabled checked> milk</li>\n<li><input type=\"checkbox\" disabled> bread &amp; &lt;butter&gt;</li>",
+	}
+	for format, items := range expected {
+		buf := bytes.Buffer{}
+		if assert.NoError(t, srv.ExportNote("nid00002", format, &buf), format) {
+			assert.Contains(t, buf.String(), items, format)
+		}
+	}
+}
@@ -2,15 +2,41 @@ package diffsync
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"encoding/json"
 )
 
 type NoteRef struct {
-	NID    string `json:"nid"`
+	NID string `json:"nid"`
+	// Kind is NoteKindText or NoteKindChecklist. It's chosen when the note
+	// is created and never changes.
+	Kind string `json:"kind,omitempty"`
+	// Status is one of active, archived or trashed
 	Status string `json:"status"`
-	tmpNID string `json:"-"`
+	Pinned bool   `json:"pinned,omitempty"`
+	// TrashedAt is set by the server when the noteref is moved to the trash
+	TrashedAt *UnixTime `json:"trashed_at,omitempty"`
+	// LastEdit is the time anyone last edited the note, set by the server
+	LastEdit *UnixTime `json:"last_edit,omitempty"`
+	// Folder is the path of the folder containing the note, empty for the
+	// folio's root
+	Folder  string `json:"folder,omitempty"`
+	SortKey string `json:"sort_key,omitempty"`
+	// Tags are private to the folio's user, peers never see them
+	Tags   []string `json:"tags,omitempty"`
+	tmpNID string   `json:"-"`
+	// role of the user adding an existing note, defaults to peer
+	role string
+}
+
+// Folder organizes noterefs. Paths are slash separated, e.g. "work/2014",
+// and every ancestor of a folder exists in the folio as well.
+type Folder struct {
+	Path    string `json:"path"`
+	SortKey string `json:"sort_key,omitempty"`
 }
 
 type FolioChange struct {
@@ -23,44 +49,230 @@ func (change *FolioChange) String() string {
 	return fmt.Sprintf("<delta op: %s, path: %s, val: %s", change.Op, change.Path, change.Value)
 }
 
-type Folio []NoteRef
+type Folio struct {
+	NoteRefs []NoteRef `json:"noterefs"`
+	Folders  []Folder  `json:"folders"`
+}
 type FolioDelta []FolioChange
 
+var errInvalidFolder = Remark{Level: "error", Slug: "invalid-folder"}
+
+func NewFolio() Folio {
+	return Folio{NoteRefs: []NoteRef{}, Folders: []Folder{}}
+}
+
 func (folio Folio) Empty() ResourceValue {
-	return Folio{}
+	return NewFolio()
 }
 
 func (folio Folio) Clone() ResourceValue {
-	f := make(Folio, len(folio))
-	copy(f, folio)
+	f := Folio{NoteRefs: make([]NoteRef, len(folio.NoteRefs)), Folders: make([]Folder, len(folio.Folders))}
+	copy(f.NoteRefs, folio.NoteRefs)
+	copy(f.Folders, folio.Folders)
+	for i := range f.NoteRefs {
+		if f.NoteRefs[i].Tags != nil {
+			f.NoteRefs[i].Tags = append([]string{}, f.NoteRefs[i].Tags...)
+		}
+	}
 	return f
 }
 
-func (f *Folio) remove(path string) Folio {
+func (f *Folio) remove(path string) {
 	i, ok := f.indexFromPath(path)
 	if !ok {
-		return *f
+		return
 	}
-	folio := *f
-	folio[i] = folio[len(folio)-1]
-	folio = folio[0 : len(folio)-1]
-	*f = folio
-	return folio
+	refs := f.NoteRefs
+	refs[i] = refs[len(refs)-1]
+	f.NoteRefs = refs[0 : len(refs)-1]
 }
 
 func (f Folio) indexFromPath(path string) (int, bool) {
-	if path[:4] != "nid:" {
+	if !strings.HasPrefix(path, "nid:") {
 		// for now, only nid entries may be searched
 		return 0, false
 	}
-	for i := range f {
-		if f[i].NID == path[4:] || f[i].tmpNID == path[4:] {
+	for i := range f.NoteRefs {
+		if f.NoteRefs[i].NID == path[4:] || f.NoteRefs[i].tmpNID == path[4:] {
 			return i, true
 		}
 	}
 	return 0, false
 }
 
+func (f Folio) folderIndex(path string) (int, bool) {
+	for i := range f.Folders {
+		if f.Folders[i].Path == path {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ensureFolder adds the folder at path and all of its missing ancestors and
+// returns the folder's index
+func (f *Folio) ensureFolder(path string) int {
+	for _, p := range append(folderAncestors(path), path) {
+		if _, ok := f.folderIndex(p); !ok {
+			f.Folders = append(f.Folders, Folder{Path: p})
+		}
+	}
+	i, _ := f.folderIndex(path)
+	return i
+}
+
+func (f *Folio) addFolder(folder Folder) {
+	i := f.ensureFolder(folder.Path)
+	f.Folders[i].SortKey = folder.SortKey
+}
+
+// removeFolder removes the folder at path with all its subfolders. Their
+// noterefs move up to the removed folder's parent.
+func (f *Folio) removeFolder(path string) {
+	folders := f.Folders[:0]
+	for _, folder := range f.Folders {
+		if !inFolder(folder.Path, path) {
+			folders = append(folders, folder)
+		}
+	}
+	f.Folders = folders
+	for i := range f.NoteRefs {
+		if inFolder(f.NoteRefs[i].Folder, path) {
+			f.NoteRefs[i].Folder = parentFolder(path)
+		}
+	}
+}
+
+// renameFolder moves the folder at path with its subfolders and noterefs to
+// to.Path. Subfolders which exist at the destination already are merged.
+func (f *Folio) renameFolder(path string, to Folder) {
+	existing := map[string]bool{}
+	for _, folder := range f.Folders {
+		if !inFolder(folder.Path, path) {
+			existing[folder.Path] = true
+		}
+	}
+	folders := f.Folders[:0]
+	for _, folder := range f.Folders {
+		if inFolder(folder.Path, path) {
+			folder.Path = to.Path + folder.Path[len(path):]
+			if existing[folder.Path] {
+				continue
+			}
+		}
+		folders = append(folders, folder)
+	}
+	f.Folders = folders
+	for i := range f.NoteRefs {
+		if inFolder(f.NoteRefs[i].Folder, path) {
+			f.NoteRefs[i].Folder = to.Path + f.NoteRefs[i].Folder[len(path):]
+		}
+	}
+	f.addFolder(to)
+}
+
+// recentNoteRefs returns the n most recently edited of refs
+func recentNoteRefs(refs []NoteRef, n int) []NoteRef {
+	recent := make([]NoteRef, len(refs))
+	copy(recent, refs)
+	sort.Sort(noteRefsByLastEdit(recent))
+	if n < 0 {
+		n = 0
+	}
+	if len(recent) > n {
+		recent = recent[:n]
+	}
+	return recent
+}
+
+// noteRefsByLastEdit sorts the most recently edited noterefs first, never
+// edited ones last
+type noteRefsByLastEdit []NoteRef
+
+func (refs noteRefsByLastEdit) Len() int      { return len(refs) }
+func (refs noteRefsByLastEdit) Swap(i, j int) { refs[i], refs[j] = refs[j], refs[i] }
+func (refs noteRefsByLastEdit) Less(i, j int) bool {
+	a, b := refs[i].LastEdit, refs[j].LastEdit
+	switch {
+	case a == nil && b == nil, a != nil && b != nil && time.Time(*a).Equal(time.Time(*b)):
+		return refs[i].NID < refs[j].NID
+	case a == nil || b == nil:
+		return b == nil
+	}
+	return time.Time(*a).After(time.Time(*b))
+}
+
+func sameTime(a, b *UnixTime) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return time.Time(*a).Equal(time.Time(*b))
+}
+
+// maxTagLength is the maximum length of a tag in bytes
+const maxTagLength = 64
+
+func cleanTag(tag string) (string, bool) {
+	tag = strings.TrimSpace(tag)
+	return tag, tag != "" && len(tag) <= maxTagLength
+}
+
+// cleanTags drops invalid and duplicate tags
+func cleanTags(tags []string) []string {
+	clean := []string{}
+	for _, tag := range tags {
+		if tag, ok := cleanTag(tag); ok && !hasTag(clean, tag) {
+			clean = append(clean, tag)
+		}
+	}
+	return clean
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanFolderPath returns path without leading, trailing and duplicate
+// slashes. ok is false if nothing is left.
+func cleanFolderPath(path string) (string, bool) {
+	parts := []string{}
+	for _, part := range strings.Split(path, "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/"), len(parts) > 0
+}
+
+// inFolder returns whether path equals folder or lies below it
+func inFolder(path, folder string) bool {
+	return path == folder || strings.HasPrefix(path, folder+"/")
+}
+
+func parentFolder(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// folderAncestors returns the paths of all of path's ancestors, outermost
+// first
+func folderAncestors(path string) []string {
+	ancestors := []string{}
+	for i := range path {
+		if path[i] == '/' {
+			ancestors = append(ancestors, path[:i])
+		}
+	}
+	return ancestors
+}
+
 func (d FolioDelta) HasChanges() bool {
 	return len(d) > 0
 }
@@ -71,25 +283,140 @@ func (delta FolioDelta) Apply(to ResourceValue) (ResourceValue, []Patch, error)
 	for _, change := range delta {
 		switch change.Op {
 		case "add-noteref":
-			folio = append(folio, change.Value.(NoteRef))
-			patches = append(patches, Patch{Op: "add-noteref", Value: change.Value})
+			ref := change.Value.(NoteRef)
+			if ref.Kind != NoteKindChecklist {
+				ref.Kind = NoteKindText
+			}
+			ref.Folder, _ = cleanFolderPath(ref.Folder)
+			if ref.Tags != nil {
+				ref.Tags = cleanTags(ref.Tags)
+			}
+			if ref.Folder != "" {
+				folio.ensureFolder(ref.Folder)
+			}
+			folio.NoteRefs = append(folio.NoteRefs, ref)
+			patches = append(patches, Patch{Op: "add-noteref", Value: ref})
 		case "rem-noteref":
 			if !strings.HasPrefix(change.Path, "nid:") {
 				continue
 			}
 			folio.remove(change.Path)
-			patches = append(patches, Patch{Op: "rem-noteref", Value: change.Path[4:]})
+			patches = append(patches, Patch{Op: "rem-noteref", Path: change.Path[4:]})
 		//case "set-nid", "swap-noteref": continue // only sent by server, never received
 		case "set-status":
 			if !strings.HasPrefix(change.Path, "nid:") {
 				continue
 			}
 			if i, ok := folio.indexFromPath(change.Path); ok {
-				patch := Patch{Op: "set-status", Path: change.Path[4:], OldValue: folio[i].Status}
-				folio[i].Status = change.Value.(string)
-				patch.Value = folio[i].Status
+				patch := Patch{Op: "set-status", Path: change.Path[4:], OldValue: folio.NoteRefs[i].Status}
+				folio.NoteRefs[i].Status = change.Value.(string)
+				if folio.NoteRefs[i].Status != "trashed" {
+					// restored
+					folio.NoteRefs[i].TrashedAt = nil
+				}
+				patch.Value = folio.NoteRefs[i].Status
 				patches = append(patches, patch)
 			}
+		case "set-pinned":
+			if i, ok := folio.indexFromPath(change.Path); ok {
+				pinned, _ := change.Value.(bool)
+				folio.NoteRefs[i].Pinned = pinned
+				patches = append(patches, Patch{Op: "set-pinned", Path: change.Path[4:], Value: pinned})
+			}
+		case "set-trashed-at":
+			// only sent by the server, nothing to persist
+			if i, ok := folio.indexFromPath(change.Path); ok {
+				trashedAt, _ := change.Value.(*UnixTime)
+				folio.NoteRefs[i].TrashedAt = trashedAt
+			}
+		case "set-last-edit":
+			// only sent by the server, nothing to persist
+			if i, ok := folio.indexFromPath(change.Path); ok {
+				lastEdit, _ := change.Value.(*UnixTime)
+				folio.NoteRefs[i].LastEdit = lastEdit
+			}
+		case "move-noteref":
+			// an empty folder moves the noteref to the root
+			i, ok := folio.indexFromPath(change.Path)
+			if !ok {
+				continue
+			}
+			value, _ := change.Value.(string)
+			folder, _ := cleanFolderPath(value)
+			if folder != "" {
+				folio.ensureFolder(folder)
+			}
+			patches = append(patches, Patch{Op: "move-noteref", Path: change.Path[4:], Value: folder, OldValue: folio.NoteRefs[i].Folder})
+			folio.NoteRefs[i].Folder = folder
+		case "reorder":
+			key, _ := change.Value.(string)
+			if !validSortKey(key) {
+				continue
+			}
+			if i, ok := folio.indexFromPath(change.Path); ok {
+				folio.NoteRefs[i].SortKey = key
+			} else if i, ok := folio.folderIndex(strings.TrimPrefix(change.Path, "folder:")); ok && strings.HasPrefix(change.Path, "folder:") {
+				folio.Folders[i].SortKey = key
+			} else {
+				continue
+			}
+			patches = append(patches, Patch{Op: "reorder", Path: change.Path, Value: key})
+		case "add-tag", "rem-tag":
+			i, ok := folio.indexFromPath(change.Path)
+			if !ok {
+				continue
+			}
+			value, _ := change.Value.(string)
+			tag, valid := cleanTag(value)
+			if !valid || hasTag(folio.NoteRefs[i].Tags, tag) == (change.Op == "add-tag") {
+				continue
+			}
+			ref := &folio.NoteRefs[i]
+			if change.Op == "add-tag" {
+				ref.Tags = append(ref.Tags, tag)
+			} else {
+				tags := []string{}
+				for _, t := range ref.Tags {
+					if t != tag {
+						tags = append(tags, t)
+					}
+				}
+				ref.Tags = tags
+			}
+			patches = append(patches, Patch{Op: change.Op, Path: change.Path[4:], Value: tag})
+		case "add-folder":
+			folder, _ := change.Value.(Folder)
+			var ok bool
+			if folder.Path, ok = cleanFolderPath(folder.Path); !ok || (folder.SortKey != "" && !validSortKey(folder.SortKey)) {
+				continue
+			}
+			folio.addFolder(folder)
+			patches = append(patches, Patch{Op: "add-folder", Value: folder})
+		case "set-folder":
+			// renames and/or reorders a folder
+			if !strings.HasPrefix(change.Path, "folder:") {
+				continue
+			}
+			path := change.Path[7:]
+			folder, _ := change.Value.(Folder)
+			var ok bool
+			if folder.Path, ok = cleanFolderPath(folder.Path); !ok || (folder.SortKey != "" && !validSortKey(folder.SortKey)) {
+				continue
+			}
+			if _, ok = folio.folderIndex(path); !ok || (folder.Path != path && inFolder(folder.Path, path)) {
+				// cannot move a folder into itself
+				continue
+			}
+			folio.renameFolder(path, folder)
+			patches = append(patches, Patch{Op: "set-folder", Path: path, Value: folder})
+		case "rem-folder":
+			if !strings.HasPrefix(change.Path, "folder:") {
+				continue
+			}
+			if _, ok := folio.folderIndex(change.Path[7:]); ok {
+				folio.removeFolder(change.Path[7:])
+				patches = append(patches, Patch{Op: "rem-folder", Path: change.Path[7:]})
+			}
 		default:
 			// don't add to patches, we didn't understand the action anyways
 			continue
@@ -118,6 +445,21 @@ func (change *FolioChange) UnmarshalJSON(from []byte) (err error) {
 		if err = json.Unmarshal(tmp.RawValue, &nr); err == nil {
 			change.Value = nr
 		}
+	case "set-pinned":
+		pinned := false
+		if err = json.Unmarshal(tmp.RawValue, &pinned); err == nil {
+			change.Value = pinned
+		}
+	case "set-trashed-at", "set-last-edit":
+		var ts *UnixTime
+		if err = json.Unmarshal(tmp.RawValue, &ts); err == nil {
+			change.Value = ts
+		}
+	case "add-folder", "set-folder":
+		folder := Folder{}
+		if err = json.Unmarshal(tmp.RawValue, &folder); err == nil {
+			change.Value = folder
+		}
 	default:
 		s := ""
 		if err = json.Unmarshal(tmp.RawValue, &s); err == nil {
@@ -127,12 +469,61 @@ func (change *FolioChange) UnmarshalJSON(from []byte) (err error) {
 	return
 }
 
+// MarshalJSON sends the folio as the plain list of noterefs clients expect.
+// Its folders are sent along separately (see jsonSession) and only stored
+// together with the noterefs in sessions (see folioState).
+func (folio Folio) MarshalJSON() ([]byte, error) {
+	if folio.NoteRefs == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(folio.NoteRefs)
+}
+
+// folioState is how folios are stored in sessions, folders included
+type folioState struct {
+	NoteRefs []NoteRef `json:"noterefs"`
+	Folders  []Folder  `json:"folders"`
+}
+
+func (folio *Folio) UnmarshalJSON(from []byte) error {
+	refs := []NoteRef{}
+	if err := json.Unmarshal(from, &refs); err == nil {
+		// sent by clients, or stored before folders existed
+		*folio = Folio{NoteRefs: refs, Folders: []Folder{}}
+		return nil
+	}
+	tmp := folioState{[]NoteRef{}, []Folder{}}
+	if err := json.Unmarshal(from, &tmp); err != nil {
+		return err
+	}
+	*folio = Folio{NoteRefs: tmp.NoteRefs, Folders: tmp.Folders}
+	return nil
+}
+
 func (folio Folio) GetDelta(latest ResourceValue) Delta {
 	delta := FolioDelta{}
 	master := latest.(Folio)
 
+	// folders first, noterefs might be moved into new ones
+	oldFolders := map[string]Folder{}
+	for _, folder := range folio.Folders {
+		oldFolders[folder.Path] = folder
+	}
+	reorders := FolioDelta{}
+	for _, folder := range master.Folders {
+		old, ok := oldFolders[folder.Path]
+		if !ok {
+			delta = append(delta, FolioChange{"add-folder", "", folder})
+			continue
+		}
+		if old.SortKey != folder.SortKey {
+			reorders = append(reorders, FolioChange{"reorder", "folder:" + folder.Path, folder.SortKey})
+		}
+		delete(oldFolders, folder.Path)
+	}
+
 	oldExisting := map[string]NoteRef{}
-	for _, noteref := range folio {
+	for _, noteref := range folio.NoteRefs {
 		// fill references
 		if noteref.NID != "" {
 			oldExisting[noteref.NID] = noteref
@@ -141,23 +532,47 @@ func (folio Folio) GetDelta(latest ResourceValue) Delta {
 		}
 	}
 	// now check out the current master-version
-	for i := range master {
-		old, ok := oldExisting[master[i].NID]
+	for _, ref := range master.NoteRefs {
+		old, ok := oldExisting[ref.NID]
 		if !ok {
-			old, ok = oldExisting[master[i].tmpNID]
+			old, ok = oldExisting[ref.tmpNID]
 		}
 		if !ok {
 			// Looks like a new one!
-			cpy := master[i]
-			delta = append(delta, FolioChange{"add-noteref", "", cpy})
+			delta = append(delta, FolioChange{"add-noteref", "", ref})
 			continue
 		}
 		// already existes in old folio, check differences
-		if old.NID != master[i].NID {
-			delta = append(delta, FolioChange{"set-nid", "nid:" + old.NID, master[i].NID})
+		if old.NID != ref.NID {
+			delta = append(delta, FolioChange{"set-nid", "nid:" + old.NID, ref.NID})
+		}
+		if old.Status != ref.Status {
+			delta = append(delta, FolioChange{"set-status", "nid:" + ref.NID, ref.Status})
+		}
+		if old.Pinned != ref.Pinned {
+			delta = append(delta, FolioChange{"set-pinned", "nid:" + ref.NID, ref.Pinned})
+		}
+		if !sameTime(old.TrashedAt, ref.TrashedAt) {
+			delta = append(delta, FolioChange{"set-trashed-at", "nid:" + ref.NID, ref.TrashedAt})
 		}
-		if old.Status != master[i].Status {
-			delta = append(delta, FolioChange{"set-status", "nid:" + master[i].NID, master[i].Status})
+		if !sameTime(old.LastEdit, ref.LastEdit) {
+			delta = append(delta, FolioChange{"set-last-edit", "nid:" + ref.NID, ref.LastEdit})
+		}
+		if old.Folder != ref.Folder {
+			delta = append(delta, FolioChange{"move-noteref", "nid:" + ref.NID, ref.Folder})
+		}
+		if old.SortKey != ref.SortKey {
+			delta = append(delta, FolioChange{"reorder", "nid:" + ref.NID, ref.SortKey})
+		}
+		for _, tag := range ref.Tags {
+			if !hasTag(old.Tags, tag) {
+				delta = append(delta, FolioChange{"add-tag", "nid:" + ref.NID, tag})
+			}
+		}
+		for _, tag := range old.Tags {
+			if !hasTag(ref.Tags, tag) {
+				delta = append(delta, FolioChange{"rem-tag", "nid:" + ref.NID, tag})
+			}
 		}
 		delete(oldExisting, old.NID)
 		delete(oldExisting, old.tmpNID)
@@ -170,6 +585,17 @@ func (folio Folio) GetDelta(latest ResourceValue) Delta {
 			delta = append(delta, FolioChange{Op: "rem-noteref", Path: "nid:" + old.tmpNID})
 		}
 	}
+	delta = append(delta, reorders...)
+	// removed folders are empty by now. remove subfolders before their
+	// parents, removing a folder removes its subfolders as well
+	removed := []string{}
+	for path := range oldFolders {
+		removed = append(removed, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	for _, path := range removed {
+		delta = append(delta, FolioChange{Op: "rem-folder", Path: "folder:" + path})
+	}
 	return delta
 }
 
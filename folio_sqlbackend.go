@@ -2,15 +2,13 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
+	"sort"
+	"strings"
+	"time"
 
 	"database/sql"
 )
 
-var (
-	_ = log.Print
-)
-
 type FolioSQLBackend struct {
 	db *sql.DB
 }
@@ -20,51 +18,239 @@ func NewFolioSQLBackend(db *sql.DB) FolioSQLBackend {
 }
 
 func (backend FolioSQLBackend) Get(uid string) (ResourceValue, error) {
-	folio := Folio{}
-	rows, err := backend.db.Query("SELECT nid, status, tmp_nid FROM noterefs WHERE uid = $1 ", uid)
+	folio := NewFolio()
+	rows, err := backend.db.Query("SELECT nid, status, tmp_nid, folder, sort_key, pinned, trashed_at FROM noterefs WHERE uid = $1 ", uid)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		noteRef := NoteRef{}
-		if err := rows.Scan(&noteRef.NID, &noteRef.Status, &noteRef.tmpNID); err != nil {
+		var trashedAt *time.Time
+		if err := rows.Scan(&noteRef.NID, &noteRef.Status, &noteRef.tmpNID, &noteRef.Folder, &noteRef.SortKey, &noteRef.Pinned, &trashedAt); err != nil {
 			return nil, err
 		}
-		folio = append(folio, noteRef)
+		if trashedAt != nil {
+			t := UnixTime(*trashedAt)
+			noteRef.TrashedAt = &t
+		}
+		folio.NoteRefs = append(folio.NoteRefs, noteRef)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	if folio.Folders, err = backend.getFolders(uid); err != nil {
+		return nil, err
+	}
+	tags, err := backend.getTags(uid)
+	if err != nil {
+		return nil, err
+	}
+	lastEdits, err := backend.getLastEdits(uid)
+	if err != nil {
+		return nil, err
+	}
+	checklists, err := queryStrings(backend.db, "SELECT nid FROM notes WHERE kind = $1 AND nid IN (SELECT nid FROM noterefs WHERE uid = $2)", NoteKindChecklist, uid)
+	if err != nil {
+		return nil, err
+	}
+	isChecklist := map[string]bool{}
+	for _, nid := range checklists {
+		isChecklist[nid] = true
+	}
+	for i := range folio.NoteRefs {
+		folio.NoteRefs[i].Tags = tags[folio.NoteRefs[i].NID]
+		if isChecklist[folio.NoteRefs[i].NID] {
+			folio.NoteRefs[i].Kind = NoteKindChecklist
+		}
+		if t, ok := lastEdits[folio.NoteRefs[i].NID]; ok {
+			lastEdit := UnixTime(t)
+			folio.NoteRefs[i].LastEdit = &lastEdit
+		}
+	}
+	sort.Sort(noteRefsByKey(folio.NoteRefs))
+	sort.Sort(foldersByKey(folio.Folders))
 	return folio, nil
 }
 
+// getLastEdits returns the time each note in uid's folio was last edited
+// by any of its peers
+func (backend FolioSQLBackend) getLastEdits(uid string) (map[string]time.Time, error) {
+	lastEdits := map[string]time.Time{}
+	rows, err := backend.db.Query(`SELECT nid, last_edit FROM noterefs
+									WHERE last_edit IS NOT NULL AND nid IN (SELECT nid FROM noterefs WHERE uid = $1)`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nid string
+		var lastEdit time.Time
+		if err := rows.Scan(&nid, &lastEdit); err != nil {
+			return nil, err
+		}
+		if lastEdit.After(lastEdits[nid]) {
+			lastEdits[nid] = lastEdit
+		}
+	}
+	return lastEdits, rows.Err()
+}
+
+func (backend FolioSQLBackend) getFolders(uid string) ([]Folder, error) {
+	folders := []Folder{}
+	rows, err := backend.db.Query("SELECT path, sort_key FROM folders WHERE uid = $1", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		folder := Folder{}
+		if err := rows.Scan(&folder.Path, &folder.SortKey); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// getTags returns the tags of uid's noterefs by nid
+func (backend FolioSQLBackend) getTags(uid string) (map[string][]string, error) {
+	tags := map[string][]string{}
+	rows, err := backend.db.Query("SELECT nid, tag FROM noteref_tags WHERE uid = $1 ORDER BY tag", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nid, tag string
+		if err := rows.Scan(&nid, &tag); err != nil {
+			return nil, err
+		}
+		tags[nid] = append(tags[nid], tag)
+	}
+	return tags, rows.Err()
+}
+
+// NotesByTag returns the nids of all notes uid tagged with tag
+func (backend FolioSQLBackend) NotesByTag(uid, tag string) ([]string, error) {
+	return queryStrings(backend.db, "SELECT nid FROM noteref_tags WHERE uid = $1 AND tag = $2 ORDER BY nid", uid, tag)
+}
+
+func (backend FolioSQLBackend) addTag(uid, nid, tag string) error {
+	_, err := backend.db.Exec("INSERT INTO noteref_tags (uid, nid, tag) SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM noteref_tags WHERE uid = $1 AND nid = $2 AND tag = $3)", uid, nid, tag)
+	return err
+}
+
+// ensureFolder creates the folder at path and its missing ancestors
+func ensureFolder(db execer, uid, path string) error {
+	for _, p := range append(folderAncestors(path), path) {
+		if _, err := db.Exec("INSERT INTO folders (uid, path) SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM folders WHERE uid = $1 AND path = $2)", uid, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextSortKey returns a sort key which puts a new noteref after all others
+func (backend FolioSQLBackend) nextSortKey(uid string) (string, error) {
+	keys, err := queryStrings(backend.db, "SELECT sort_key FROM noterefs WHERE uid = $1", uid)
+	if err != nil {
+		return "", err
+	}
+	return sortKeyBetween(lastSortKey(keys), ""), nil
+}
+
+func (backend FolioSQLBackend) renameFolder(uid, path string, to Folder) error {
+	txn, err := backend.db.Begin()
+	if err != nil {
+		return err
+	}
+	// merge into subfolders which exist at the destination already
+	for _, qry := range []string{
+		`DELETE FROM folders WHERE $1 || substr(path, length($2) + 1) IN (
+				SELECT path FROM folders WHERE uid = $3 AND NOT (path = $2 OR substr(path, 1, length($2) + 1) = $2 || '/'))
+			AND uid = $3 AND (path = $2 OR substr(path, 1, length($2) + 1) = $2 || '/')`,
+		"UPDATE folders SET path = $1 || substr(path, length($2) + 1) WHERE uid = $3 AND (path = $2 OR substr(path, 1, length($2) + 1) = $2 || '/')",
+		"UPDATE noterefs SET folder = $1 || substr(folder, length($2) + 1) WHERE uid = $3 AND (folder = $2 OR substr(folder, 1, length($2) + 1) = $2 || '/')",
+	} {
+		if _, err = txn.Exec(qry, to.Path, path, uid); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	if err = ensureFolder(txn, uid, to.Path); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if _, err = txn.Exec("UPDATE folders SET sort_key = $1 WHERE uid = $2 AND path = $3", to.SortKey, uid, to.Path); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func (backend FolioSQLBackend) removeFolder(uid, path string) error {
+	txn, err := backend.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = txn.Exec("UPDATE noterefs SET folder = $1 WHERE uid = $2 AND (folder = $3 OR substr(folder, 1, length($3) + 1) = $3 || '/')", parentFolder(path), uid, path); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if _, err = txn.Exec("DELETE FROM folders WHERE uid = $1 AND (path = $2 OR substr(path, 1, length($2) + 1) = $2 || '/')", uid, path); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
 func (backend FolioSQLBackend) Patch(uid string, patch Patch, result *SyncResult, ctx Context) error {
 	switch patch.Op {
 	case "rem-noteref":
 		// patch.Path contains Note ID
 		// patch.Value empty
 		// patch.OldValue empty
-		_, err := backend.db.Exec("DELETE FROM noteref WHERE nid = $1 AND uid = $2", patch.Path, uid)
+		// removes the noteref for good, see set-status for the trash
+		deleted, peers, err := purgeNoteRef(backend.db, uid, patch.Path)
 		if err != nil {
 			return err
 		}
-		ctx.Router.Handle(Event{UID: uid, Name: "res-remove", Res: Resource{Kind: "note", ID: patch.Path}, ctx: ctx})
+		notifyPurged(uid, patch.Path, peers, ctx)
 		result.Tainted(Resource{Kind: "folio", ID: uid})
-		result.Tainted(Resource{Kind: "note", ID: patch.Path})
+		if !deleted {
+			result.Tainted(Resource{Kind: "note", ID: patch.Path})
+		}
 	case "set-status":
 		// patch.Path contains Note ID
 		// patch.Value contains new Status
 		// patch.OldValue contains old Status for CAS
 		status := patch.Value.(string)
-		if !(status == "active" || status == "archived") {
+		if !(status == "active" || status == "archived" || status == "trashed") {
 			return fmt.Errorf("folioSQLbackend: received invalid status: %s", status)
 		}
-		_, err := backend.db.Exec("UPDATE noterefs SET status = $1 WHERE uid = $2 and nid = $3 and status = $4", status, uid, patch.Path, patch.OldValue.(string))
+		if status == patch.OldValue.(string) {
+			// don't restart the trash's retention
+			break
+		}
+		// trashed noterefs are purged after Config.TrashRetention
+		var trashedAt *time.Time
+		if status == "trashed" {
+			now := time.Now()
+			trashedAt = &now
+		}
+		_, err := backend.db.Exec("UPDATE noterefs SET status = $1, trashed_at = $2 WHERE uid = $3 and nid = $4 and status = $5", status, trashedAt, uid, patch.Path, patch.OldValue.(string))
 		if err != nil {
 			return fmt.Errorf("folioSQLbackend: uid(%s) status change for nid(%s): could not persist new status: `%s`", uid, patch.Path, status)
 		}
 		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "set-pinned":
+		// patch.Path contains Note ID
+		// patch.Value contains the new flag
+		if _, err := backend.db.Exec("UPDATE noterefs SET pinned = $1 WHERE uid = $2 AND nid = $3", patch.Value.(bool), uid, patch.Path); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
 	case "add-noteref":
 		// patch.Path empty
 		// patch.Value contains new NoteRef value
@@ -72,30 +258,79 @@ func (backend FolioSQLBackend) Patch(uid string, patch Patch, result *SyncResult
 		ref := patch.Value.(NoteRef)
 		var res sql.Result
 		var err error
+		if ref.SortKey == "" {
+			if ref.SortKey, err = backend.nextSortKey(uid); err != nil {
+				return err
+			}
+		}
+		if ref.Folder != "" {
+			if err = ensureFolder(backend.db, uid, ref.Folder); err != nil {
+				return err
+			}
+		}
 		if len(ref.NID) < 5 {
+			var owned int
+			if err = backend.db.QueryRow("SELECT count(*) FROM noterefs WHERE uid = $1 AND role = 'owner'", uid).Scan(&owned); err != nil {
+				return err
+			}
+			if err = ctx.store.checkQuota(ctx, quotaNotes, owned+1); err != nil {
+				return err
+			}
 			// save blank note with new NID
-			newnote, err := ctx.store.NewResource("note", ctx)
+			kind := "note"
+			if ref.Kind == NoteKindChecklist && ctx.store.hasBackend("checklist") {
+				kind = "checklist"
+			}
+			newnote, err := ctx.store.NewResource(kind, ctx)
 			if err != nil {
 				return err
 			}
 			ref.tmpNID = ref.NID
 			ref.NID = newnote.ID
-			if res, err = backend.db.Exec("UPDATE noterefs SET tmp_nid = $1, status = $2, role = 'owner' WHERE uid = $3 and nid = $4",
+			if res, err = backend.db.Exec("UPDATE noterefs SET tmp_nid = $1, status = $2, role = 'owner', folder = $3, sort_key = $4 WHERE uid = $5 and nid = $6",
 				ref.tmpNID,
 				ref.Status,
+				ref.Folder,
+				ref.SortKey,
 				uid,
 				ref.NID,
 			); err != nil {
 				return err
 			}
 		} else {
-			// add existing note to folio
-			if res, err = backend.db.Exec("INSERT INTO noterefs (uid, nid, status, role) VALUES ($1, $2, 'active', 'peer')", uid, ref.NID); err != nil {
+			// add existing note to folio. Clients may only re-add notes they
+			// have access to, keeping their role; everybody else joins
+			// through a token (see TokenConsumer)
+			role := ref.role
+			if role == "" {
+				switch err = backend.db.QueryRow("SELECT role FROM noterefs WHERE uid = $1 AND nid = $2", uid, ref.NID).Scan(&role); {
+				case err == sql.ErrNoRows:
+					return Remark{Level: "error", Slug: "permission-denied", Data: map[string]string{"op": patch.Op, "nid": ref.NID}}
+				case err != nil:
+					return err
+				}
+			} else {
+				// joining through a token makes the user another peer
+				var numPeers int
+				if err = backend.db.QueryRow("SELECT count(*) FROM noterefs WHERE nid = $1 AND uid <> $2", ref.NID, uid).Scan(&numPeers); err != nil {
+					return err
+				}
+				if err = ctx.store.checkNoteQuota(backend.db, ref.NID, ctx, quotaPeers, numPeers+1); err != nil {
+					return err
+				}
+			}
+			if res, err = backend.db.Exec(`INSERT INTO noterefs (uid, nid, status, role, folder, sort_key)
+											SELECT $1, $2, 'active', $3, $4, $5
+											WHERE NOT EXISTS (SELECT 1 FROM noterefs WHERE uid = $1 AND nid = $2)`, uid, ref.NID, role, ref.Folder, ref.SortKey); err != nil {
+				return err
+			}
+		}
+		for _, tag := range ref.Tags {
+			if err = backend.addTag(uid, ref.NID, tag); err != nil {
 				return err
 			}
 		}
 		if added, _ := res.RowsAffected(); added > 0 {
-			// TODO(flo) check permissin?
 			if err = ctx.Router.Handle(Event{UID: uid, Name: "res-add", Res: Resource{Kind: "note", ID: ref.NID}, ctx: ctx}); err != nil {
 				return err
 			}
@@ -103,6 +338,72 @@ func (backend FolioSQLBackend) Patch(uid string, patch Patch, result *SyncResult
 			result.Tainted(Resource{Kind: "folio", ID: uid})
 			result.Tainted(Resource{Kind: "note", ID: ref.NID})
 		}
+	case "move-noteref":
+		// patch.Path contains Note ID
+		// patch.Value contains the new folder, empty for the root
+		folder := patch.Value.(string)
+		if folder != "" {
+			if err := ensureFolder(backend.db, uid, folder); err != nil {
+				return err
+			}
+		}
+		if _, err := backend.db.Exec("UPDATE noterefs SET folder = $1 WHERE uid = $2 AND nid = $3", folder, uid, patch.Path); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "reorder":
+		// patch.Path contains nid:<Note ID> or folder:<path>
+		// patch.Value contains the new sort key
+		var err error
+		switch {
+		case strings.HasPrefix(patch.Path, "nid:"):
+			_, err = backend.db.Exec("UPDATE noterefs SET sort_key = $1 WHERE uid = $2 AND nid = $3", patch.Value.(string), uid, patch.Path[4:])
+		case strings.HasPrefix(patch.Path, "folder:"):
+			_, err = backend.db.Exec("UPDATE folders SET sort_key = $1 WHERE uid = $2 AND path = $3", patch.Value.(string), uid, patch.Path[7:])
+		default:
+			return fmt.Errorf("folioSQLbackend: cannot reorder `%s`", patch.Path)
+		}
+		if err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "add-tag":
+		// patch.Path contains Note ID
+		// patch.Value contains the tag
+		if err := backend.addTag(uid, patch.Path, patch.Value.(string)); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "rem-tag":
+		// patch.Path contains Note ID
+		// patch.Value contains the tag
+		if _, err := backend.db.Exec("DELETE FROM noteref_tags WHERE uid = $1 AND nid = $2 AND tag = $3", uid, patch.Path, patch.Value.(string)); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "add-folder":
+		// patch.Value contains the new Folder
+		folder := patch.Value.(Folder)
+		if err := ensureFolder(backend.db, uid, folder.Path); err != nil {
+			return err
+		}
+		if _, err := backend.db.Exec("UPDATE folders SET sort_key = $1 WHERE uid = $2 AND path = $3", folder.SortKey, uid, folder.Path); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "set-folder":
+		// patch.Path contains the folder's path
+		// patch.Value contains the renamed and/or reordered Folder
+		if err := backend.renameFolder(uid, patch.Path, patch.Value.(Folder)); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
+	case "rem-folder":
+		// patch.Path contains the folder's path
+		if err := backend.removeFolder(uid, patch.Path); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "folio", ID: uid})
 	}
 	return nil
 }
@@ -0,0 +1,241 @@
+package diffsync
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortKeyBetween(t *testing.T) {
+	for _, bounds := range [][2]string{{"", ""}, {"", "1"}, {"", "01"}, {"V", "W"}, {"V", ""}, {"z", ""}, {"zz", ""}, {"V", "V1"}, {"Az", "B"}} {
+		key := sortKeyBetween(bounds[0], bounds[1])
+		assert.True(t, validSortKey(key), "invalid key %q between %q and %q", key, bounds[0], bounds[1])
+		assert.True(t, key > bounds[0], "%q not after %q", key, bounds[0])
+		if bounds[1] != "" {
+			assert.True(t, key < bounds[1], "%q not before %q", key, bounds[1])
+		}
+	}
+	// always room for one more
+	lo, hi := "", ""
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			lo = sortKeyBetween(lo, hi)
+		} else {
+			hi = sortKeyBetween(lo, hi)
+		}
+		assert.True(t, hi == "" || lo < hi, "%q not before %q", lo, hi)
+	}
+}
+
+func TestFolioFolders(t *testing.T) {
+	folio := NewFolio()
+	folio.NoteRefs = []NoteRef{{NID: "nid00001", Status: "active"}, {NID: "nid00002", Status: "active"}}
+	delta := FolioDelta{
+		{"add-folder", "", Folder{Path: "/work//2014/", SortKey: "V"}},
+		{"move-noteref", "nid:nid00001", "work/2014"},
+		{"move-noteref", "nid:nid00002", "work"},
+		{"reorder", "nid:nid00002", "1"},
+		{"reorder", "nid:nid00001", "not valid"},
+	}
+	res, patches, err := delta.Apply(folio)
+	if !assert.NoError(t, err) {
+		return
+	}
+	moved := res.(Folio)
+	assert.Len(t, folio.Folders, 0, "folio modified in place")
+	assert.Equal(t, []Folder{{Path: "work"}, {Path: "work/2014", SortKey: "V"}}, moved.Folders, "ancestors not created")
+	assert.Equal(t, NoteRef{NID: "nid00001", Status: "active", Folder: "work/2014"}, moved.NoteRefs[0])
+	assert.Equal(t, NoteRef{NID: "nid00002", Status: "active", Folder: "work", SortKey: "1"}, moved.NoteRefs[1])
+	assert.Len(t, patches, 4)
+
+	// the delta between both versions recreates the changes
+	res, _, _ = folio.GetDelta(moved).(FolioDelta).Apply(folio)
+	assert.Equal(t, moved, res)
+
+	// renaming moves everything below
+	res, patches, _ = FolioDelta{{"set-folder", "folder:work", Folder{Path: "archive/work"}}}.Apply(moved)
+	renamed := res.(Folio)
+	assert.Equal(t, []Patch{{Op: "set-folder", Path: "work", Value: Folder{Path: "archive/work"}}}, patches)
+	assert.Equal(t, "archive/work/2014", renamed.NoteRefs[0].Folder)
+	assert.Equal(t, "archive/work", renamed.NoteRefs[1].Folder)
+	paths := []string{}
+	for _, folder := range renamed.Folders {
+		paths = append(paths, folder.Path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"archive", "archive/work", "archive/work/2014"}, paths)
+	_, patches, _ = FolioDelta{{"set-folder", "folder:archive", Folder{Path: "archive/sub"}}}.Apply(renamed)
+	assert.Len(t, patches, 0, "folder moved into itself")
+
+	// removing a folder removes its subfolders and moves the notes up
+	res, _, _ = FolioDelta{{"rem-folder", "folder:archive/work", nil}}.Apply(renamed)
+	removed := res.(Folio)
+	assert.Equal(t, []Folder{{Path: "archive"}}, removed.Folders)
+	assert.Equal(t, "archive", removed.NoteRefs[0].Folder)
+	assert.Equal(t, "archive", removed.NoteRefs[1].Folder)
+	res, _, _ = renamed.GetDelta(removed).(FolioDelta).Apply(renamed)
+	assert.Equal(t, removed, res)
+}
+
+func TestFolioUnmarshalLegacy(t *testing.T) {
+	folio := NewFolio()
+	if assert.NoError(t, json.Unmarshal([]byte(`[{"nid": "nid00001", "status": "active"}]`), &folio)) {
+		assert.Equal(t, Folio{NoteRefs: []NoteRef{{NID: "nid00001", Status: "active"}}, Folders: []Folder{}}, folio)
+	}
+	// clients get the plain list, sessions store the folders as well
+	stored := Folio{NoteRefs: []NoteRef{{NID: "nid00001", Folder: "work"}}, Folders: []Folder{{Path: "work"}}}
+	raw, _ := json.Marshal(stored)
+	assert.Equal(t, `[{"nid":"nid00001","status":"","folder":"work"}]`, string(raw))
+	raw, _ = json.Marshal(NewShadow(Resource{Kind: "folio", ID: "uid00001", Value: stored}))
+	shadow := NewShadow(Resource{})
+	if assert.NoError(t, json.Unmarshal(raw, shadow)) {
+		assert.Equal(t, stored, shadow.res.Value)
+	}
+}
+
+func TestFolioSQLBackendFolders(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_FOLDERS, CREATE_NOTEREFTAGS)
+	defer db.Close()
+	db.Exec("INSERT INTO users (uid) VALUES ('uid00001')")
+	db.Exec("INSERT INTO notes (nid) VALUES ('nid00001'), ('nid00002')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role, sort_key) VALUES ('nid00001', 'uid00001', 'owner', 'V'), ('nid00002', 'uid00001', 'owner', '1')")
+	backend := NewFolioSQLBackend(db)
+	ctx := Context{uid: "uid00001"}
+	patch := func(p Patch) {
+		assert.NoError(t, backend.Patch("uid00001", p, NewSyncResult(), ctx))
+	}
+	get := func() Folio {
+		value, err := backend.Get("uid00001")
+		assert.NoError(t, err)
+		return value.(Folio)
+	}
+
+	folio := get()
+	assert.Equal(t, []NoteRef{{NID: "nid00002", Status: "", SortKey: "1"}, {NID: "nid00001", SortKey: "V"}}, folio.NoteRefs, "not ordered by sort key")
+
+	patch(Patch{Op: "move-noteref", Path: "nid00001", Value: "work/2014"})
+	patch(Patch{Op: "add-folder", Value: Folder{Path: "work_old", SortKey: "z"}})
+	patch(Patch{Op: "reorder", Path: "nid:nid00001", Value: "0V"})
+	patch(Patch{Op: "reorder", Path: "folder:work", Value: "a"})
+	folio = get()
+	assert.Equal(t, []Folder{{Path: "work/2014"}, {Path: "work", SortKey: "a"}, {Path: "work_old", SortKey: "z"}}, folio.Folders)
+	assert.Equal(t, NoteRef{NID: "nid00001", Folder: "work/2014", SortKey: "0V"}, folio.NoteRefs[0])
+
+	// work_old shares the prefix, but is no subfolder
+	patch(Patch{Op: "add-folder", Value: Folder{Path: "archive/2014"}})
+	patch(Patch{Op: "set-folder", Path: "work", Value: Folder{Path: "archive", SortKey: "b"}})
+	folio = get()
+	assert.Equal(t, []Folder{{Path: "archive/2014"}, {Path: "archive", SortKey: "b"}, {Path: "work_old", SortKey: "z"}}, folio.Folders)
+	assert.Equal(t, "archive/2014", folio.NoteRefs[0].Folder)
+
+	patch(Patch{Op: "rem-folder", Path: "archive"})
+	folio = get()
+	assert.Equal(t, []Folder{{Path: "work_old", SortKey: "z"}}, folio.Folders)
+	assert.Equal(t, "", folio.NoteRefs[0].Folder)
+}
+
+func TestFolioTags(t *testing.T) {
+	folio := NewFolio()
+	folio.NoteRefs = []NoteRef{{NID: "nid00001", Tags: []string{"work"}}}
+	res, patches, _ := FolioDelta{
+		{"add-tag", "nid:nid00001", " todo "},
+		{"add-tag", "nid:nid00001", "work"},
+		{"rem-tag", "nid:nid00001", "work"},
+		{"add-tag", "nid:nid00001", ""},
+	}.Apply(folio)
+	tagged := res.(Folio)
+	assert.Equal(t, []string{"work"}, folio.NoteRefs[0].Tags, "folio modified in place")
+	assert.Equal(t, []string{"todo"}, tagged.NoteRefs[0].Tags)
+	assert.Equal(t, []Patch{{Op: "add-tag", Path: "nid00001", Value: "todo"}, {Op: "rem-tag", Path: "nid00001", Value: "work"}}, patches)
+
+	delta := folio.GetDelta(tagged).(FolioDelta)
+	assert.Equal(t, FolioDelta{{"add-tag", "nid:nid00001", "todo"}, {"rem-tag", "nid:nid00001", "work"}}, delta)
+}
+
+func TestFolioSQLBackendTags(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_FOLDERS, CREATE_NOTEREFTAGS)
+	defer db.Close()
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ('nid00001', 'uid00001', 'owner'), ('nid00002', 'uid00001', 'owner'), ('nid00001', 'uid00002', 'peer')")
+	backend := NewFolioSQLBackend(db)
+	ctx := Context{uid: "uid00001"}
+	for _, patch := range []Patch{
+		{Op: "add-tag", Path: "nid00001", Value: "work"},
+		{Op: "add-tag", Path: "nid00001", Value: "todo"},
+		{Op: "add-tag", Path: "nid00001", Value: "todo"},
+		{Op: "add-tag", Path: "nid00002", Value: "work"},
+		{Op: "rem-tag", Path: "nid00002", Value: "work"},
+	} {
+		assert.NoError(t, backend.Patch("uid00001", patch, NewSyncResult(), ctx))
+	}
+	value, err := backend.Get("uid00001")
+	if assert.NoError(t, err) {
+		refs := value.(Folio).NoteRefs
+		sort.Sort(noteRefsByKey(refs))
+		assert.Equal(t, []string{"todo", "work"}, refs[0].Tags)
+		assert.Nil(t, refs[1].Tags)
+	}
+	value, _ = backend.Get("uid00002")
+	assert.Nil(t, value.(Folio).NoteRefs[0].Tags, "tags leaked to peer")
+
+	nids, err := backend.NotesByTag("uid00001", "work")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nid00001"}, nids)
+	nids, _ = backend.NotesByTag("uid00002", "work")
+	assert.Len(t, nids, 0)
+}
+
+func TestFolioSQLBackendAddExistingNote(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	backend := NewFolioSQLBackend(db)
+	store := NewStore(nil)
+	store.Mount("folio", backend)
+	ctx := NewContext(FuncHandler{Fn: func(Event) error { return nil }}, store, nil)
+	add := func(uid, nid, role string) error {
+		ctx.uid = uid
+		return backend.Patch(uid, Patch{Op: "add-noteref", Value: NoteRef{NID: nid, Status: "active", role: role}}, NewSyncResult(), ctx)
+	}
+	role := func(uid, nid string) (role string) {
+		db.QueryRow("SELECT role FROM noterefs WHERE uid = $1 AND nid = $2", uid, nid).Scan(&role)
+		return
+	}
+
+	// knowing a nid is not enough to join a note
+	err := add("uid00002", "nid00002", "")
+	if assert.IsType(t, Remark{}, err) {
+		assert.Equal(t, "permission-denied", err.(Remark).Slug)
+	}
+	assert.Equal(t, "", role("uid00002", "nid00002"))
+
+	// viewers can't become peers by leaving and re-joining
+	assert.NoError(t, add("uid00003", "nid00001", ""))
+	assert.Equal(t, "viewer", role("uid00003", "nid00001"))
+	ctx.uid = "uid00003"
+	assert.NoError(t, backend.Patch("uid00003", Patch{Op: "rem-noteref", Path: "nid00001"}, NewSyncResult(), ctx))
+	assert.IsType(t, Remark{}, add("uid00003", "nid00001", ""))
+	assert.Equal(t, "", role("uid00003", "nid00001"))
+
+	// tokens grant their role
+	assert.NoError(t, add("uid00003", "nid00001", "viewer"))
+	assert.Equal(t, "viewer", role("uid00003", "nid00001"))
+}
+
+func TestSessionPayloadFolders(t *testing.T) {
+	folio := Folio{NoteRefs: []NoteRef{{NID: "nid00001", Folder: "work"}}, Folders: []Folder{{Path: "work"}}}
+	sess := NewSession("sid", "uid")
+	sess.shadows = append(sess.shadows, NewShadow(Resource{Kind: "folio", ID: "uid", Value: folio}))
+	raw, _ := json.Marshal(jsonSession(sess))
+	payload := struct {
+		Folio struct {
+			Value []NoteRef `json:"val"`
+		} `json:"folio"`
+		Folders []Folder `json:"folders"`
+	}{}
+	if assert.NoError(t, json.Unmarshal(raw, &payload)) {
+		assert.Equal(t, folio.NoteRefs, payload.Folio.Value)
+		assert.Equal(t, folio.Folders, payload.Folders)
+	}
+}
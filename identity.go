@@ -0,0 +1,196 @@
+package diffsync
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// IdentityProvider verifies assertions issued by an external identity
+// provider (e.g. a signed id-token of an OAuth login) and extracts the
+// identity they vouch for.
+type IdentityProvider interface {
+	Name() string
+	Verify(assertion string) (Identity, error)
+}
+
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdentityAssertion is sent by clients with session-create, identity-link
+// and identity-unlink events. Assertion is not needed for unlinking.
+type IdentityAssertion struct {
+	Provider  string `json:"provider"`
+	Assertion string `json:"assertion,omitempty"`
+}
+
+var (
+	errIdentityInvalid  = Remark{Level: "error", Slug: "identity-invalid"}
+	errIdentityTaken    = Remark{Level: "error", Slug: "identity-taken"}
+	errIdentityLastAuth = Remark{Level: "error", Slug: "identity-last-login"}
+)
+
+func (tok *TokenConsumer) verifyIdentity(assertion IdentityAssertion) (Identity, error) {
+	provider, ok := tok.providers[assertion.Provider]
+	if !ok {
+		return Identity{}, Remark{Level: "error", Slug: "identity-provider-unknown", Data: map[string]string{"provider": assertion.Provider}}
+	}
+	ident, err := provider.Verify(assertion.Assertion)
+	if err != nil {
+		tok.log.Info("identity assertion rejected", Fields{"provider": assertion.Provider, "err": err})
+		return Identity{}, errIdentityInvalid
+	}
+	ident.Provider = provider.Name()
+	return ident, nil
+}
+
+// authenticateIdentity swaps a verified identity assertion for a token which
+// can be passed on to createSession like any other login token. Unknown
+// identities get linked to the user owning its verified email address, or to
+// a freshly signed up user.
+func (tok *TokenConsumer) authenticateIdentity(assertion IdentityAssertion, ctx Context) (Token, error) {
+	ident, err := tok.verifyIdentity(assertion)
+	if err != nil {
+		return Token{}, err
+	}
+	linked, err := tok.identityOwner(ident)
+	if err != nil {
+		return Token{}, err
+	}
+	var owner *User
+	if ident.Email != "" && ident.EmailVerified {
+		owner, err = findUserByQuery(tok.db, "email = $1 AND email_status = 'verified' AND tier > 0", ident.Email)
+		if err != nil {
+			return Token{}, err
+		}
+	}
+	switch {
+	case owner != nil && linked != "" && linked != owner.UID:
+		// the identity has an account of its own, but its email has been
+		// verified by another one in the meantime. merge them.
+		if err = tok.assimilateUser(linked, owner.UID, ctx); err != nil {
+			return Token{}, err
+		}
+		if _, err = tok.db.Exec("UPDATE identities SET uid = $1 WHERE provider = $2 AND subject = $3", owner.UID, ident.Provider, ident.Subject); err != nil {
+			return Token{}, err
+		}
+		linked = owner.UID
+	case owner != nil && linked == "":
+		if err = tok.linkIdentity(owner.UID, ident); err != nil {
+			return Token{}, err
+		}
+		linked = owner.UID
+	case linked == "":
+		if linked, err = tok.signupWithIdentity(ident, ctx); err != nil {
+			return Token{}, err
+		}
+	}
+	return Token{Kind: "identity", UID: linked, Email: ident.Email}, nil
+}
+
+// identityOwner returns the uid the identity is linked to, if any
+func (tok *TokenConsumer) identityOwner(ident Identity) (uid string, err error) {
+	err = tok.db.QueryRow("SELECT uid FROM identities WHERE provider = $1 AND subject = $2", ident.Provider, ident.Subject).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+func (tok *TokenConsumer) linkIdentity(uid string, ident Identity) error {
+	_, err := tok.db.Exec("INSERT INTO identities (provider, subject, uid, email) VALUES ($1, $2, $3, $4)", ident.Provider, ident.Subject, uid, ident.Email)
+	return err
+}
+
+// signupWithIdentity signs up a new user for ident. A verified email is
+// claimed the same way as after a verify token, taking over the notes and
+// contacts of anonymous users who were invited via that address.
+func (tok *TokenConsumer) signupWithIdentity(ident Identity, ctx Context) (string, error) {
+	profile, err := ctx.store.NewResource("profile", Context{sid: ctx.sid})
+	if err != nil {
+		return "", err
+	}
+	user := profile.Value.(Profile).User
+	user.Name, user.Email = ident.Name, ident.Email
+	emailStatus := ""
+	if ident.Email != "" {
+		emailStatus = "unverified"
+	}
+	_, err = tok.db.Exec("UPDATE users SET tier = 1, name = $1, email = $2, email_status = $3, signup_at = $4 WHERE uid = $5", ident.Name, ident.Email, emailStatus, time.Now(), user.UID)
+	if err != nil {
+		return "", err
+	}
+	if ident.Email != "" && ident.EmailVerified {
+		if err = tok.claimIDAndSignup("email", user, ctx); err != nil {
+			return "", err
+		}
+	}
+	return user.UID, tok.linkIdentity(user.UID, ident)
+}
+
+// handleIdentityLink links the identity of event.Identity to the session's
+// user. The event is sent back to the client, with a Remark on failure.
+func (tok *TokenConsumer) handleIdentityLink(event Event) error {
+	ident, err := tok.verifyIdentity(*event.Identity)
+	if err == nil {
+		var linked string
+		linked, err = tok.identityOwner(ident)
+		switch {
+		case err != nil:
+		case linked == event.ctx.uid:
+			// nothing to do
+		case linked != "":
+			err = errIdentityTaken
+		default:
+			err = tok.linkIdentity(event.ctx.uid, ident)
+		}
+	}
+	return tok.respondIdentity(event, err)
+}
+
+// handleIdentityUnlink removes the link between the session's user and the
+// given provider, unless it is the only way left for the user to log in.
+func (tok *TokenConsumer) handleIdentityUnlink(event Event) error {
+	var others int
+	var password sql.NullString
+	err := tok.db.QueryRow(`SELECT (SELECT count(*) FROM identities WHERE uid = $1 AND provider <> $2), password
+							FROM users WHERE uid = $1`, event.ctx.uid, event.Identity.Provider).Scan(&others, &password)
+	if err == nil {
+		u := event.ctx.User()
+		if others == 0 && password.String == "" && u.EmailStatus != "verified" && u.PhoneStatus != "verified" {
+			err = errIdentityLastAuth
+		} else {
+			_, err = tok.db.Exec("DELETE FROM identities WHERE uid = $1 AND provider = $2", event.ctx.uid, event.Identity.Provider)
+		}
+	}
+	return tok.respondIdentity(event, err)
+}
+
+func (tok *TokenConsumer) respondIdentity(event Event, err error) error {
+	event.Identity = nil
+	return tok.respond(event, err)
+}
+
+// FakeIdentityProvider accepts every assertion listed in Identities. It's
+// meant for tests and local development.
+type FakeIdentityProvider struct {
+	ProviderName string
+	Identities   map[string]Identity
+}
+
+func (fake FakeIdentityProvider) Name() string {
+	return fake.ProviderName
+}
+
+func (fake FakeIdentityProvider) Verify(assertion string) (Identity, error) {
+	ident, ok := fake.Identities[assertion]
+	if !ok {
+		return Identity{}, fmt.Errorf("fakeidentityprovider: unknown assertion")
+	}
+	return ident, nil
+}
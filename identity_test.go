@@ -0,0 +1,128 @@
+package diffsync
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func identityTestSetup(t *testing.T) (*TokenConsumer, Context, *sql.DB) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_CONTACTS, CREATE_IDENTITIES)
+	tok := NewTokenConsumer(nil, db, nil)
+	tok.AddIdentityProvider(FakeIdentityProvider{"fake", map[string]Identity{
+		"alice":    {Subject: "1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"},
+		"bob":      {Subject: "2", Email: "bob@example.com", EmailVerified: true},
+		"mallory":  {Subject: "3", Email: "alice@example.com"},
+		"unlinked": {Subject: "4"},
+	}})
+	store := NewStore(nil)
+	store.Mount("profile", NewProfileSQLBackend(db))
+	ctx := Context{store: store, Router: FuncHandler{Fn: func(Event) error { return nil }}}
+	return tok, ctx, db
+}
+
+func TestIdentitySignupAndLogin(t *testing.T) {
+	tok, ctx, db := identityTestSetup(t)
+	defer db.Close()
+	_, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "forged"}, ctx)
+	assert.Equal(t, errIdentityInvalid, err)
+
+	token, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "alice"}, ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "identity", token.Kind)
+	u, _ := findUserByUID(db, token.UID)
+	if assert.NotNil(t, u, "no user signed up") {
+		assert.Equal(t, int64(1), u.Tier)
+		assert.Equal(t, "Alice", u.Name)
+		assert.Equal(t, "verified", u.EmailStatus)
+	}
+	again, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "alice"}, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, token.UID, again.UID, "second login created another user")
+
+	// an unverified email must never grant access to an existing account
+	other, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "mallory"}, ctx)
+	assert.NoError(t, err)
+	assert.NotEqual(t, token.UID, other.UID, "unverified email matched existing account")
+}
+
+func TestIdentityMergesVerifiedEmail(t *testing.T) {
+	tok, ctx, db := identityTestSetup(t)
+	defer db.Close()
+	// bob signs up via identity first, and later verifies the same email
+	// with a regular account
+	viaIdentity, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "bob"}, ctx)
+	assert.NoError(t, err)
+	db.Exec("UPDATE users SET email_status = 'unverified' WHERE uid = $1", viaIdentity.UID)
+	db.Exec("INSERT INTO users (uid, tier, email, email_status) VALUES ('bobuid01', 1, 'bob@example.com', 'verified')")
+	db.Exec("INSERT INTO noterefs (nid, uid, status) VALUES ('note1', $1, 'active')", viaIdentity.UID)
+
+	token, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "bob"}, ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "bobuid01", token.UID, "identity not moved to verified email's account")
+	var owner string
+	db.QueryRow("SELECT uid FROM noterefs WHERE nid = 'note1'").Scan(&owner)
+	assert.Equal(t, "bobuid01", owner, "notes of identity account not merged")
+	old, _ := findUserByUID(db, viaIdentity.UID)
+	assert.Equal(t, int64(-2), old.Tier, "merged account not disabled")
+}
+
+func TestIdentitySignupClaimsEmail(t *testing.T) {
+	tok, ctx, db := identityTestSetup(t)
+	defer db.Close()
+	// alice has been invited to a note by email before she ever signed up
+	db.Exec("INSERT INTO users (uid, tier, email, email_status) VALUES ('invited1', 0, 'alice@example.com', 'unverified')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role, status) VALUES ('note1', 'invited1', 'peer', 'active')")
+
+	token, err := tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "alice"}, ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, "invited1", token.UID)
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = 'note1' AND uid = $1", token.UID), "invited note not claimed")
+	invited, _ := findUserByUID(db, "invited1")
+	assert.Equal(t, int64(-2), invited.Tier, "invited user not disabled")
+	u, _ := findUserByUID(db, token.UID)
+	assert.Equal(t, "verified", u.EmailStatus)
+	assert.Equal(t, int64(1), u.Tier)
+}
+
+func TestIdentityLinkUnlink(t *testing.T) {
+	tok, ctx, db := identityTestSetup(t)
+	defer db.Close()
+	db.Exec("INSERT INTO users (uid, tier) VALUES ('uid00001', 1)")
+	tok.authenticateIdentity(IdentityAssertion{Provider: "fake", Assertion: "alice"}, ctx)
+	responses := make(chan Event, 1)
+	ctx.uid = "uid00001"
+	ctx.Client = FuncHandler{Fn: func(event Event) error {
+		responses <- event
+		return nil
+	}}
+	send := func(name, assertion string) *Remark {
+		ev := Event{Name: name, Identity: &IdentityAssertion{Provider: "fake", Assertion: assertion}, ctx: ctx}
+		if name == "identity-link" {
+			tok.handleIdentityLink(ev)
+		} else {
+			tok.handleIdentityUnlink(ev)
+		}
+		return (<-responses).Remark
+	}
+
+	assert.Nil(t, send("identity-link", "unlinked"), "linking failed")
+	owner, _ := tok.identityOwner(Identity{Provider: "fake", Subject: "4"})
+	assert.Equal(t, "uid00001", owner)
+	if r := send("identity-link", "alice"); assert.NotNil(t, r, "linked identity of another user") {
+		assert.Equal(t, "identity-taken", r.Slug)
+	}
+	if r := send("identity-unlink", ""); assert.NotNil(t, r, "unlinked the only way to log in") {
+		assert.Equal(t, "identity-last-login", r.Slug)
+	}
+	db.Exec("UPDATE users SET email = 'me@example.com', email_status = 'verified' WHERE uid = 'uid00001'")
+	assert.Nil(t, send("identity-unlink", ""), "unlinking failed")
+	owner, _ = tok.identityOwner(Identity{Provider: "fake", Subject: "4"})
+	assert.Equal(t, "", owner, "identity still linked")
+}
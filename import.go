@@ -0,0 +1,293 @@
+package diffsync
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImportItem is a note to be imported into a user's folio
+type ImportItem struct {
+	// Source identifies the item within its origin, e.g. the path of an
+	// imported file. Items are imported only once per Source and user.
+	Source    string
+	Title     string
+	Text      string
+	Folder    string
+	Tags      []string
+	CreatedAt time.Time
+}
+
+// ImportedItem is a successfully imported, or previously imported, item
+type ImportedItem struct {
+	Source string `json:"source"`
+	NID    string `json:"nid"`
+}
+
+// ImportError is an item which could not be read or imported
+type ImportError struct {
+	Source string `json:"source"`
+	Err    string `json:"error"`
+}
+
+// ImportReport is the outcome of an import
+type ImportReport struct {
+	Imported []ImportedItem `json:"imported"`
+	// Skipped lists items imported before, with the existing note's nid
+	Skipped []ImportedItem `json:"skipped"`
+	Errors  []ImportError  `json:"errors"`
+}
+
+func newImportReport() ImportReport {
+	return ImportReport{Imported: []ImportedItem{}, Skipped: []ImportedItem{}, Errors: []ImportError{}}
+}
+
+func (report *ImportReport) fail(source string, err error) {
+	report.Errors = append(report.Errors, ImportError{Source: source, Err: err.Error()})
+}
+
+// Import adds a new note to uid's folio for each of items. Items which have
+// been imported before and are still in the folio are skipped. Connected
+// sessions of the user see the notes appear right away.
+func (srv *Server) Import(uid string, items []ImportItem) (ImportReport, error) {
+	report := newImportReport()
+	backend, ok := srv.Store.backends["note"].(NoteSQLBackend)
+	if !ok {
+		return report, errors.New("import: notes are not backed by a NoteSQLBackend")
+	}
+	ctx := NewContext(srv.sessionHub, srv.Store, nil)
+	ctx.uid = uid
+	for _, item := range items {
+		nid, err := importedNID(srv.db, uid, item.Source)
+		if err != nil {
+			return report, err
+		}
+		if nid != "" {
+			report.Skipped = append(report.Skipped, ImportedItem{Source: item.Source, NID: nid})
+			continue
+		}
+		if nid, err = srv.importItem(backend, item, ctx); err != nil {
+			report.fail(item.Source, err)
+			continue
+		}
+		report.Imported = append(report.Imported, ImportedItem{Source: item.Source, NID: nid})
+	}
+	srv.log.Info("import: finished", Fields{"uid": uid, "imported": len(report.Imported), "skipped": len(report.Skipped), "failed": len(report.Errors)})
+	return report, nil
+}
+
+func (srv *Server) importItem(backend NoteSQLBackend, item ImportItem, ctx Context) (string, error) {
+	var owned int
+	if err := srv.db.QueryRow("SELECT count(*) FROM noterefs WHERE uid = $1 AND role = 'owner'", ctx.uid).Scan(&owned); err != nil {
+		return "", err
+	}
+	if err := srv.Store.checkQuota(ctx, quotaNotes, owned+1); err != nil {
+		return "", err
+	}
+	if err := srv.Store.checkQuota(ctx, quotaNoteSize, len(item.Text)); err != nil {
+		return "", err
+	}
+	// create the note without a noteref, add-noteref takes care of that
+	note, err := srv.Store.NewResource("note", Context{store: srv.Store})
+	if err != nil {
+		return "", err
+	}
+	if err = backend.importContent(note.ID, item, ctx.uid); err != nil {
+		deleteNote(srv.db, note.ID)
+		return "", err
+	}
+	ctx.store.reindex(note.ID)
+	result := NewSyncResult()
+	ref := NoteRef{NID: note.ID, Status: "active", Tags: cleanTags(item.Tags), role: "owner"}
+	ref.Folder, _ = cleanFolderPath(item.Folder)
+	if err = srv.Store.Patch(Resource{Kind: "folio", ID: ctx.uid}, Patch{Op: "add-noteref", Value: ref}, result, ctx); err != nil {
+		deleteNote(srv.db, note.ID)
+		return "", err
+	}
+	if _, err = srv.db.Exec("DELETE FROM imports WHERE uid = $1 AND source = $2", ctx.uid, item.Source); err != nil {
+		return "", err
+	}
+	if _, err = srv.db.Exec("INSERT INTO imports (uid, source, nid) VALUES ($1, $2, $3)", ctx.uid, item.Source, note.ID); err != nil {
+		return "", err
+	}
+	for _, res := range result.tainted {
+		ctx.Router.Handle(Event{Name: "res-sync", Res: res, ctx: ctx})
+	}
+	return note.ID, nil
+}
+
+// importedNID returns the note imported from source before, if it's still
+// part of uid's folio
+func importedNID(db *sql.DB, uid, source string) (string, error) {
+	var nid string
+	err := db.QueryRow(`SELECT imports.nid FROM imports
+						JOIN noterefs ON noterefs.nid = imports.nid AND noterefs.uid = imports.uid
+						WHERE imports.uid = $1 AND imports.source = $2`, uid, source).Scan(&nid)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return nid, err
+}
+
+// ReadImportDir reads all Markdown (.md, .markdown) and plain-text (.txt)
+// files below dir. Subdirectories become folders. The title of a Markdown
+// file is its leading "# " heading, otherwise the file's name.
+func ReadImportDir(dir string) ([]ImportItem, []ImportError, error) {
+	items := []ImportItem{}
+	failed := []ImportError{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if info.IsDir() || (ext != ".md" && ext != ".markdown" && ext != ".txt") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			failed = append(failed, ImportError{Source: "file:" + rel, Err: err.Error()})
+			return nil
+		}
+		item := ImportItem{
+			Source:    "file:" + rel,
+			Title:     strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel)),
+			Text:      strings.Replace(string(raw), "\r\n", "\n", -1),
+			CreatedAt: info.ModTime(),
+		}
+		if folder := filepath.ToSlash(filepath.Dir(rel)); folder != "." {
+			item.Folder = folder
+		}
+		if ext != ".txt" {
+			item.Title, item.Text = markdownTitle(item.Title, item.Text)
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, failed, err
+}
+
+// markdownTitle splits off a leading "# " heading of text as the title
+func markdownTitle(title, text string) (string, string) {
+	trimmed := strings.TrimLeft(text, "\n")
+	if !strings.HasPrefix(trimmed, "# ") {
+		return title, text
+	}
+	heading := trimmed
+	rest := ""
+	if i := strings.IndexByte(trimmed, '\n'); i >= 0 {
+		heading, rest = trimmed[:i], trimmed[i+1:]
+	}
+	return strings.TrimSpace(heading[2:]), strings.TrimLeft(rest, "\n")
+}
+
+// enexNote is a <note> of an Evernote export
+type enexNote struct {
+	Title   string   `xml:"title"`
+	Content string   `xml:"content"`
+	Created string   `xml:"created"`
+	Tags    []string `xml:"tag"`
+}
+
+const enexTimeFormat = "20060102T150405Z"
+
+// ReadENEX reads the notes of an Evernote export (ENEX). ENEX has no note
+// ids, notes are recognized by their title, creation time and content.
+func ReadENEX(r io.Reader) ([]ImportItem, []ImportError, error) {
+	items := []ImportItem{}
+	failed := []ImportError{}
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return items, failed, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+		note := enexNote{}
+		if err = dec.DecodeElement(&note, &start); err != nil {
+			return items, failed, err
+		}
+		sum := sha1.Sum([]byte(note.Title + "\x00" + note.Created + "\x00" + note.Content))
+		item := ImportItem{Source: "enex:" + hex.EncodeToString(sum[:]), Title: strings.TrimSpace(note.Title), Tags: note.Tags}
+		if item.Text, err = enmlText(note.Content); err != nil {
+			failed = append(failed, ImportError{Source: item.Source, Err: fmt.Sprintf("note `%s`: %s", item.Title, err)})
+			continue
+		}
+		if note.Created != "" {
+			item.CreatedAt, _ = time.Parse(enexTimeFormat, note.Created)
+		}
+		items = append(items, item)
+	}
+	return items, failed, nil
+}
+
+// enmlBlocks are the ENML elements which start a new line
+var enmlBlocks = map[string]bool{
+	"div": true, "p": true, "br": true, "li": true, "tr": true, "blockquote": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// enmlText converts the ENML (Evernote's XHTML dialect) content of a note
+// to plain text
+func enmlText(content string) (string, error) {
+	dec := xml.NewDecoder(strings.NewReader(content))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	text := bytes.Buffer{}
+	newline := func() {
+		if text.Len() > 0 && !bytes.HasSuffix(text.Bytes(), []byte("\n")) {
+			text.WriteByte('\n')
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "br" {
+				text.WriteByte('\n')
+			} else if enmlBlocks[t.Name.Local] {
+				newline()
+			}
+			if t.Name.Local == "li" {
+				text.WriteString("- ")
+			}
+		case xml.EndElement:
+			if enmlBlocks[t.Name.Local] && t.Name.Local != "br" {
+				newline()
+			}
+		case xml.CharData:
+			if bytes.ContainsRune(t, '\n') && len(bytes.TrimSpace(t)) == 0 {
+				// indentation between elements
+				continue
+			}
+			text.Write(t)
+		}
+	}
+	return strings.TrimSpace(text.String()), nil
+}
@@ -0,0 +1,105 @@
+package diffsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadImportDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "work", "2014"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "todo.txt"), []byte("milk\r\neggs\r\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "work", "2014", "plan.md"), []byte("\n# The Plan\n\nstep one\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "work", "photo.jpg"), []byte{0xff, 0xd8}, 0644)
+
+	items, failed, err := ReadImportDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, failed, 0)
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, ImportItem{Source: "file:todo.txt", Title: "todo", Text: "milk\neggs\n", CreatedAt: items[0].CreatedAt}, items[0])
+		assert.Equal(t, ImportItem{Source: "file:work/2014/plan.md", Title: "The Plan", Text: "step one\n", Folder: "work/2014", CreatedAt: items[1].CreatedAt}, items[1])
+	}
+}
+
+const testENEX = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-export SYSTEM "http://xml.evernote.com/pub/evernote-export3.dtd">
+<en-export export-date="20140601T120000Z" application="Evernote" version="Evernote Mac 5.5.2">
+<note><title>Groceries</title><content><![CDATA[<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd">
+<en-note>
+  <div>Buy &amp; bring:</div>
+  <ul><li>milk</li><li>eggs&nbsp;(6)</li></ul>
+  <div>thanks<br/>flo</div>
+</en-note>]]></content><created>20140513T165300Z</created><tag>home</tag><tag>todo</tag></note>
+<note><title>Empty</title><content><![CDATA[<en-note></en-note>]]></content></note>
+</en-export>`
+
+func TestReadENEX(t *testing.T) {
+	items, failed, err := ReadENEX(strings.NewReader(testENEX))
+	assert.NoError(t, err)
+	assert.Len(t, failed, 0)
+	if !assert.Len(t, items, 2) {
+		return
+	}
+	assert.Equal(t, "Groceries", items[0].Title)
+	assert.Equal(t, "Buy & bring:\n- milk\n- eggs (6)\nthanks\nflo", items[0].Text)
+	assert.Equal(t, []string{"home", "todo"}, items[0].Tags)
+	assert.Equal(t, "2014-05-13T16:53:00Z", items[0].CreatedAt.Format("2006-01-02T15:04:05Z07:00"))
+	assert.True(t, strings.HasPrefix(items[0].Source, "enex:"))
+	assert.NotEqual(t, items[0].Source, items[1].Source)
+
+	again, _, _ := ReadENEX(strings.NewReader(testENEX))
+	assert.Equal(t, items[0].Source, again[0].Source, "source not stable")
+}
+
+func TestImport(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Dialect = DialectSQLite
+	srv, _ := NewServerWithConfig(db, nil, cfg)
+	srv.Store.Mount("note", NewNoteSQLBackend(db))
+	srv.Store.Mount("folio", NewFolioSQLBackend(db))
+	items := []ImportItem{
+		{Source: "file:work/plan.md", Title: "The Plan", Text: "step one", Folder: "work", Tags: []string{"plans", ""}},
+		{Source: "file:todo.txt", Title: "todo", Text: "milk"},
+	}
+
+	report, err := srv.Import("uid00002", items)
+	if !assert.NoError(t, err) || !assert.Len(t, report.Imported, 2, "errors: %v", report.Errors) {
+		return
+	}
+	nid := report.Imported[0].NID
+	var title, txt, createdBy string
+	db.QueryRow("SELECT title, txt, created_by FROM notes WHERE nid = $1", nid).Scan(&title, &txt, &createdBy)
+	assert.Equal(t, []string{"The Plan", "step one", "uid00002"}, []string{title, txt, createdBy})
+	folio, _ := srv.Store.backends["folio"].Get("uid00002")
+	for _, ref := range folio.(Folio).NoteRefs {
+		if ref.NID == nid {
+			assert.Equal(t, "work", ref.Folder)
+			assert.Equal(t, []string{"plans"}, ref.Tags)
+		}
+	}
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = $1 AND uid = 'uid00002' AND role = 'owner'", nid))
+
+	// importing again skips what's still in the folio
+	db.Exec("DELETE FROM noterefs WHERE nid = $1", report.Imported[1].NID)
+	again, err := srv.Import("uid00002", items)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImportedItem{{Source: "file:work/plan.md", NID: nid}}, again.Skipped)
+	assert.Len(t, again.Imported, 1)
+	assert.Equal(t, 3, queryCount(db, "SELECT count(*) FROM notes WHERE created_by = 'uid00002'"))
+	results, _ := srv.Search("uid00002", "step", 10)
+	if assert.Len(t, results, 1, "imported note not indexed") {
+		assert.Equal(t, nid, results[0].NID)
+	}
+}
@@ -2,7 +2,6 @@ package diffsync
 
 import (
 	"encoding/json"
-	"log"
 )
 
 type jsonAdapter struct {
@@ -23,13 +22,27 @@ func (a jsonAdapter) MsgToEvent(from []byte) (Event, error) {
 		SID:   a.buf.SID,
 		Tag:   a.buf.Tag,
 		Token: a.buf.Token,
+		Query: a.buf.Query,
+		Lazy:  a.buf.Lazy,
+	}
+	if a.buf.Credentials != nil {
+		creds := *a.buf.Credentials
+		ev.Credentials = &creds
+	}
+	if a.buf.Identity != nil {
+		ident := *a.buf.Identity
+		ev.Identity = &ident
+	}
+	if a.buf.Deletion != nil {
+		opts := *a.buf.Deletion
+		ev.Deletion = &opts
 	}
 	if a.buf.Res == nil {
 		return ev, nil
 	}
 	ev.Res = Resource{Kind: a.buf.Res.Kind, ID: a.buf.Res.ID}
 	if a.buf.Res.Value != nil {
-		log.Println("TODO: res.value in incoming payload")
+		defaultLogger.Debug("ignoring res.value in incoming payload (not supported yet)", Fields{"event": a.buf.Name})
 	}
 	if a.buf.Name == "res-sync" && a.buf.Changes != nil {
 		ev.Changes = make([]Edit, len(a.buf.Changes))
@@ -50,6 +63,8 @@ func (a jsonAdapter) EventToMsg(ev Event) ([]byte, error) {
 	a.buf.Tag = ev.Tag
 	a.buf.Token = ev.Token
 	a.buf.Remark = ev.Remark
+	a.buf.Tokens = ev.Tokens
+	a.buf.Results = ev.Results
 	a.buf.Changes = make([]jsonEdit, len(ev.Changes))
 	for i, edit := range ev.Changes {
 		rawDelta, err := json.Marshal(edit.Delta)
@@ -111,14 +126,21 @@ type jsonResource struct {
 }
 
 type jsonMsg struct {
-	Name    string                 `json:"name"`
-	SID     string                 `json:"sid"`
-	Tag     string                 `json:"tag, omitempty"`
-	Token   string                 `json:"token,omitempty"`
-	Changes []jsonEdit             `json:"changes,omitempty"`
-	Res     *jsonResource          `json:"res,omitempty"`
-	Remark  *Remark                `json:"remark,omitempty"`
-	Session map[string]interface{} `json:"session,omitempty"`
+	Name        string                 `json:"name"`
+	SID         string                 `json:"sid"`
+	Tag         string                 `json:"tag, omitempty"`
+	Token       string                 `json:"token,omitempty"`
+	Credentials *Credentials           `json:"credentials,omitempty"`
+	Identity    *IdentityAssertion     `json:"identity,omitempty"`
+	Changes     []jsonEdit             `json:"changes,omitempty"`
+	Res         *jsonResource          `json:"res,omitempty"`
+	Remark      *Remark                `json:"remark,omitempty"`
+	Tokens      []TokenInfo            `json:"tokens,omitempty"`
+	Deletion    *AccountDeletion       `json:"deletion,omitempty"`
+	Lazy        bool                   `json:"lazy,omitempty"`
+	Query       string                 `json:"query,omitempty"`
+	Results     []SearchResult         `json:"results,omitempty"`
+	Session     map[string]interface{} `json:"session,omitempty"`
 }
 
 var deltas = map[string]func([]byte) (Delta, error){
@@ -143,12 +165,21 @@ var deltas = map[string]func([]byte) (Delta, error){
 		}
 		return delta, nil
 	},
+	"checklist": func(from []byte) (Delta, error) {
+		delta := ChecklistDelta{}
+		if err := json.Unmarshal(from, &delta); err != nil {
+			return nil, err
+		}
+		return delta, nil
+	},
 }
 
 func jsonSession(sess *Session) map[string]interface{} {
 	folio := Resource{}
+	folders := []Folder{}
 	profile := Resource{}
 	notes := make(map[string]*Resource)
+	checklists := make(map[string]*Resource)
 
 	for _, shadow := range sess.shadows {
 		switch shadow.res.Kind {
@@ -156,17 +187,24 @@ func jsonSession(sess *Session) map[string]interface{} {
 			profile = shadow.res
 		case "folio":
 			folio = shadow.res
+			if value, ok := folio.Value.(Folio); ok && value.Folders != nil {
+				folders = value.Folders
+			}
 		case "note":
 			notes[shadow.res.ID] = &shadow.res
+		case "checklist":
+			checklists[shadow.res.ID] = &shadow.res
 		default:
 		}
 
 	}
 	return map[string]interface{}{
-		"sid":     sess.sid,
-		"uid":     sess.uid,
-		"profile": profile,
-		"folio":   folio,
-		"notes":   notes,
+		"sid":        sess.sid,
+		"uid":        sess.uid,
+		"profile":    profile,
+		"folio":      folio,
+		"folders":    folders,
+		"notes":      notes,
+		"checklists": checklists,
 	}
 }
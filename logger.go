@@ -0,0 +1,218 @@
+package diffsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (lvl LogLevel) String() string {
+	return levelNames[lvl]
+}
+
+// redactedFields lists the field keys whose values must never end up in the
+// log output. They may contain note contents or credentials. Only the length
+// of the value will be logged.
+var redactedFields = map[string]bool{
+	"text":     true,
+	"txt":      true,
+	"title":    true,
+	"peek":     true,
+	"delta":    true,
+	"changes":  true,
+	"value":    true,
+	"token":    true,
+	"password": true,
+	"query":    true,
+}
+
+// defaultLogger is used whenever a component has not been handed a Logger,
+// e.g. Contexts without a Store or Sessions outside of a SessionHub
+var defaultLogger = NewLogger(os.Stderr, LevelInfo)
+
+type Fields map[string]interface{}
+
+// Logger writes leveled, structured log lines in logfmt format.
+//
+// Loggers derived via With() share their output, level and sampling
+// counters with their parent. A nil *Logger is valid and discards everything,
+// which is what Sample() returns for skipped log calls.
+type Logger struct {
+	core   *logCore
+	fields Fields
+}
+
+type logCore struct {
+	sync.Mutex
+	out     io.Writer
+	level   LogLevel
+	samples map[string]uint64
+}
+
+func NewLogger(out io.Writer, level LogLevel) *Logger {
+	return &Logger{core: &logCore{out: out, level: level, samples: map[string]uint64{}}, fields: Fields{}}
+}
+
+// With returns a child logger which adds the given fields to every line
+func (l *Logger) With(fields Fields) *Logger {
+	if l == nil {
+		return nil
+	}
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{core: l.core, fields: merged}
+}
+
+// Sample lets through only every n-th call for the given key and returns nil
+// otherwise. Used to thin out logging on hot paths, e.g.
+//   log.Sample("store-load", 100).Debug("loading resource", ...)
+func (l *Logger) Sample(key string, n uint64) *Logger {
+	if l == nil {
+		return nil
+	}
+	l.core.Lock()
+	cnt := l.core.samples[key]
+	l.core.samples[key] = cnt + 1
+	l.core.Unlock()
+	if n > 1 && cnt%n != 0 {
+		return nil
+	}
+	return l
+}
+
+func (l *Logger) Enabled(lvl LogLevel) bool {
+	return l != nil && lvl >= l.core.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Fields) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Fields) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Fields) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(lvl LogLevel, msg string, extra []Fields) {
+	if !l.Enabled(lvl) {
+		return
+	}
+	all := make(Fields, len(l.fields))
+	for k, v := range l.fields {
+		all[k] = v
+	}
+	for i := range extra {
+		for k, v := range extra[i] {
+			all[k] = v
+		}
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	line := make([]string, 0, len(keys)+3)
+	line = append(line,
+		"ts="+time.Now().UTC().Format(time.RFC3339Nano),
+		"lvl="+lvl.String(),
+		"msg="+logfmtValue(msg),
+	)
+	for _, k := range keys {
+		line = append(line, k+"="+logfmtValue(redact(k, all[k])))
+	}
+	l.core.Lock()
+	defer l.core.Unlock()
+	fmt.Fprintln(l.core.out, strings.Join(line, " "))
+}
+
+// credentialPattern matches session ids, tokens and their hashes
+var credentialPattern = regexp.MustCompile(`[0-9a-fA-F]{20,}`)
+
+// maxErrorLength caps logged error messages
+const maxErrorLength = 300
+
+// scrubError returns the message of err with credentials cut down to their
+// prefix, like sid fields, and capped at maxErrorLength. Errors may quote
+// values from the database or from clients.
+func scrubError(err error) string {
+	s := credentialPattern.ReplaceAllStringFunc(err.Error(), func(m string) string { return m[:6] })
+	return peek(s, maxErrorLength)
+}
+
+func redact(key string, val interface{}) string {
+	s := fmt.Sprint(val)
+	if err, ok := val.(error); ok {
+		s = scrubError(err)
+	}
+	switch {
+	case redactedFields[key]:
+		return fmt.Sprintf("[redacted len=%d]", len(s))
+	case key == "sid" && len(s) > 6:
+		// session ids are bearer credentials, a prefix is enough to correlate
+		return s[:6]
+	}
+	return s
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// eventFields extracts the loggable parts of an Event. Tokens and changes
+// are deliberately left out.
+func eventFields(event Event) Fields {
+	f := Fields{"event": event.Name}
+	if event.SID != "" {
+		f["sid"] = event.SID
+	}
+	if event.UID != "" {
+		f["uid"] = event.UID
+	}
+	if event.Res.Kind != "" {
+		f["res"] = event.Res.StringRef()
+	}
+	if event.Tag != "" {
+		f["tag"] = event.Tag
+	}
+	if event.Remark != nil {
+		f["remark"] = event.Remark.Slug
+	}
+	return f
+}
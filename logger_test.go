@@ -0,0 +1,63 @@
+package diffsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerLevelsAndFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := NewLogger(buf, LevelInfo).With(Fields{"uid": "abcdefgh"})
+	log.Debug("not shown")
+	log.Info("hello world", Fields{"res": "note:123"})
+	out := buf.String()
+	assert.NotContains(t, out, "not shown", "debug line logged at info level")
+	assert.Contains(t, out, `lvl=info msg="hello world" res=note:123 uid=abcdefgh`)
+}
+
+func TestLoggerRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := NewLogger(buf, LevelDebug)
+	log.Warn("sync", Fields{"text": "my secret note", "token": "0123456789", "sid": "0123456789abcdef"})
+	out := buf.String()
+	assert.NotContains(t, out, "secret", "note text leaked into log")
+	assert.NotContains(t, out, "0123456789", "token or sid leaked into log")
+	assert.Contains(t, out, `text="[redacted len=14]"`)
+	assert.Contains(t, out, "sid=012345")
+}
+
+func TestLoggerSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := NewLogger(buf, LevelDebug)
+	for i := 0; i < 10; i++ {
+		log.Sample("hot", 5).Debug("hot path")
+	}
+	assert.Equal(t, 2, strings.Count(buf.String(), "hot path"), "sampling let through wrong number of lines")
+	// nil loggers must be safe to use
+	var nilLog *Logger
+	nilLog.With(Fields{"a": 1}).Error("dropped")
+}
+
+func TestLogErrorKeepsSidsShort(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := NewStore(nil)
+	store.log = NewLogger(buf, LevelDebug)
+	store.Mount("profile", &countingBackend{MemBackend: NewMemBackend(func() ResourceValue { return NewProfile() })})
+	(Context{sid: "0123456789abcdef", store: store}).LogError(errors.New("boom"))
+	out := buf.String()
+	assert.NotContains(t, out, "0123456789", "sid leaked into log")
+	assert.Contains(t, out, `msg=error err=boom sid=012345`)
+
+	// credentials quoted in errors are cut down the same way
+	buf.Reset()
+	(Context{store: store}).LogError(fmt.Errorf("session `0123456789abcdef0123456789abcdef` not found: %s", strings.Repeat("x", 400)))
+	out = buf.String()
+	assert.NotContains(t, out, "0123456789", "sid leaked into log")
+	assert.Contains(t, out, "session `012345` not found")
+	assert.True(t, len(out) < 400, "error not capped: %d", len(out))
+}
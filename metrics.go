@@ -0,0 +1,370 @@
+package diffsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stats is the process-wide metrics registry. Every component records into
+// it directly, and the Server exposes it via MetricsHandler() in the
+// prometheus text exposition format.
+var stats = newStats()
+
+var defaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+var sizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+var depthBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128}
+
+type Stats struct {
+	*Registry
+	ActiveRunners       *Gauge
+	HubInboxDepth       *Gauge
+	HubOverflows        *Counter
+	SessionInboxDepth   *Histogram
+	QueueOverflows      *Counter
+	TaintsMerged        *Counter
+	DeferredFlushes     *Counter
+	Events              *Counter
+	SyncDuration        *Histogram
+	FatalRemarks        *Counter
+	TagRetries          *Counter
+	SessionSaveDuration *Histogram
+	SessionSaveBytes    *Histogram
+	PatchOps            *Counter
+	TokenConsumptions   *Counter
+	BillingEvents       *Counter
+	RateLimited         *Counter
+}
+
+func newStats() *Stats {
+	reg := NewRegistry()
+	return &Stats{
+		Registry:            reg,
+		ActiveRunners:       reg.Gauge("diffsync_hub_active_runners", "Number of session runners currently active in the SessionHub."),
+		HubInboxDepth:       reg.Gauge("diffsync_hub_inbox_depth", "Number of events waiting in the SessionHub inbox."),
+		HubOverflows:        reg.Counter("diffsync_hub_inbox_overflows_total", "Events dropped because the SessionHub inbox was full.", "policy"),
+		SessionInboxDepth:   reg.Histogram("diffsync_session_inbox_depth", "Depth of a session runner's inbox at the time an event is enqueued.", depthBuckets),
+		QueueOverflows:      reg.Counter("diffsync_session_queue_overflows_total", "Events routed to a full session queue.", "policy", "outcome"),
+		TaintsMerged:        reg.Counter("diffsync_session_queue_merged_taints_total", "Taints merged into an already queued taint of the same resource."),
+		DeferredFlushes:     reg.Counter("diffsync_session_deferred_flushes_total", "Taint-driven flushes executed after the debounce window.", "trigger"),
+		Events:              reg.Counter("diffsync_events_total", "Events routed through the SessionHub.", "name"),
+		SyncDuration:        reg.Histogram("diffsync_sync_duration_seconds", "Time spent handling a client res-sync.", defaultBuckets, "kind"),
+		FatalRemarks:        reg.Counter("diffsync_fatal_remarks_total", "Fatal remarks pushed to clients.", "slug"),
+		TagRetries:          reg.Counter("diffsync_tag_retries_total", "Stale tags re-sent to clients during flush.", "kind"),
+		SessionSaveDuration: reg.Histogram("diffsync_session_save_duration_seconds", "Time spent persisting a session.", defaultBuckets),
+		SessionSaveBytes:    reg.Histogram("diffsync_session_save_bytes", "Size of a persisted session blob.", sizeBuckets),
+		PatchOps:            reg.Counter("diffsync_patch_ops_total", "Patches applied to resource backends.", "backend", "op", "result"),
+		TokenConsumptions:   reg.Counter("diffsync_token_consumptions_total", "Token consumption attempts.", "kind", "outcome"),
+		BillingEvents:       reg.Counter("diffsync_billing_events_total", "Webhook deliveries of payment providers.", "provider", "outcome"),
+		RateLimited:         reg.Counter("diffsync_rate_limited_total", "Actions rejected by the rate limiter.", "action", "key"),
+	}
+}
+
+// knownEvents and knownPatchOps bound the label values of Events and
+// PatchOps. Event names and ops are chosen by clients, everything unknown is
+// counted as "other".
+var (
+	knownEvents = map[string]bool{
+		"session-create": true, "token-consume": true, "res-add": true, "res-remove": true, "res-sync": true,
+		"client-ehlo": true, "client-gone": true, "snapshot": true, "server-draining": true,
+		"session-handover": true, "account-deleted": true,
+	}
+	knownPatchOps = map[string]map[string]bool{
+		"note": {
+			"text": true, "title": true, "invite-user": true, "set-cursor": true, "rem-peer": true, "format": true,
+			"add-mark": true, "set-mark": true, "rem-mark": true, "add-comment": true, "resolve-comment": true,
+			"add-share-link": true, "rem-share-link": true, "set-seen": true,
+		},
+		"folio": {
+			"rem-noteref": true, "set-status": true, "set-pinned": true, "add-noteref": true, "move-noteref": true,
+			"reorder": true, "add-tag": true, "rem-tag": true, "add-folder": true, "set-folder": true, "rem-folder": true,
+		},
+		"profile": {
+			"add-user": true, "set-name": true, "set-email": true, "set-phone": true, "set-password": true, "set-tier": true,
+		},
+		"checklist": {
+			"add-item": true, "rem-item": true, "edit-text": true, "toggle-item": true, "set-assignee": true,
+			"set-due": true, "move-item": true,
+		},
+	}
+)
+
+// eventLabel returns the label value of an event name
+func eventLabel(name string) string {
+	if knownEvents[name] {
+		return name
+	}
+	return "other"
+}
+
+// kindLabel returns the label value of a resource kind
+func kindLabel(kind string) string {
+	if _, ok := knownPatchOps[kind]; ok {
+		return kind
+	}
+	return "other"
+}
+
+// opLabel returns the label value of a patch op of kind, ok is false for
+// ops no backend knows about
+func opLabel(kind, op string) (label string, ok bool) {
+	if knownPatchOps[kind][op] {
+		return op, true
+	}
+	return "other", false
+}
+
+func (srv *Server) MetricsHandler() http.Handler {
+	return stats.Registry
+}
+
+// Registry is a minimal, dependency-free collection of metrics which can be
+// rendered in the prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for i := range reg.metrics {
+		if reg.metrics[i].name() == m.name() {
+			panic("metrics: duplicate registration of " + m.name())
+		}
+	}
+	reg.metrics = append(reg.metrics, m)
+}
+
+func (reg *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels)}
+	reg.register(c)
+	return c
+}
+
+func (reg *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels)}
+	reg.register(g)
+	return g
+}
+
+func (reg *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{vec: newVec(name, help, "histogram", labels), buckets: buckets, series: map[string]*histSeries{}}
+	reg.register(h)
+	return h
+}
+
+func (reg *Registry) WriteTo(w io.Writer) (int64, error) {
+	reg.mu.Lock()
+	metrics := make([]metric, len(reg.metrics))
+	copy(metrics, reg.metrics)
+	reg.mu.Unlock()
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	reg.WriteTo(w)
+}
+
+type vec struct {
+	sync.Mutex
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{metricName: name, help: help, kind: kind, labels: labels}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+func (v *vec) key(lvs []string) string {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.metricName, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.metricName, v.kind)
+}
+
+// labelString renders the label set of a series; extra is appended verbatim
+// (used for histogram's le="..." label)
+func (v *vec) labelString(key string, extra string) string {
+	pairs := []string{}
+	if len(v.labels) > 0 {
+		for i, lv := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", v.labels[i], strconv.Quote(lv)))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type Counter struct {
+	vec
+	values map[string]float64
+}
+
+func (c *Counter) Inc(lvs ...string) {
+	c.Add(1, lvs...)
+}
+
+func (c *Counter) Add(delta float64, lvs ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.values == nil {
+		c.values = map[string]float64{}
+	}
+	c.values[c.key(lvs)] += delta
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type Gauge struct {
+	vec
+	values map[string]float64
+}
+
+func (g *Gauge) Set(val float64, lvs ...string) {
+	g.Lock()
+	defer g.Unlock()
+	if g.values == nil {
+		g.values = map[string]float64{}
+	}
+	g.values[g.key(lvs)] = val
+}
+
+func (g *Gauge) Add(delta float64, lvs ...string) {
+	g.Lock()
+	defer g.Unlock()
+	if g.values == nil {
+		g.values = map[string]float64{}
+	}
+	g.values[g.key(lvs)] += delta
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+	g.header(w)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelString(key, ""), formatFloat(g.values[key]))
+	}
+}
+
+type Histogram struct {
+	vec
+	buckets []float64
+	series  map[string]*histSeries
+}
+
+type histSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(val float64, lvs ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := h.key(lvs)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if val <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += val
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, lvs ...string) {
+	h.Observe(time.Since(start).Seconds(), lvs...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, fmt.Sprintf("le=%q", formatFloat(upper))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key, ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,75 @@
+package diffsync
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if !assert.NoError(t, err, "cannot scrape metrics handler") {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"), "wrong content-type")
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err, "cannot read metrics response")
+	return string(body)
+}
+
+func TestMetricsExposition(t *testing.T) {
+	reg := NewRegistry()
+	events := reg.Counter("test_events_total", "Events seen.", "name")
+	runners := reg.Gauge("test_runners", "Active runners.")
+	latency := reg.Histogram("test_latency_seconds", "Latency.", []float64{.1, 1}, "kind")
+
+	events.Inc("res-sync")
+	events.Inc("res-sync")
+	events.Add(3, "session-create")
+	runners.Set(4)
+	latency.Observe(.05, "note")
+	latency.Observe(.5, "note")
+
+	body := scrape(t, reg)
+	assert.Contains(t, body, "# TYPE test_events_total counter\n")
+	assert.Contains(t, body, `test_events_total{name="res-sync"} 2`+"\n")
+	assert.Contains(t, body, `test_events_total{name="session-create"} 3`+"\n")
+	assert.Contains(t, body, "# TYPE test_runners gauge\ntest_runners 4\n")
+	assert.Contains(t, body, `test_latency_seconds_bucket{kind="note",le="0.1"} 1`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_bucket{kind="note",le="1"} 2`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_bucket{kind="note",le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_sum{kind="note"} 0.55`+"\n")
+	assert.Contains(t, body, `test_latency_seconds_count{kind="note"} 2`+"\n")
+}
+
+func TestMetricsLabelMismatch(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("test_total", "Test.", "kind", "outcome")
+	assert.Panics(t, func() { c.Inc("note") }, "missing label value did not panic")
+}
+
+func TestServerMetricsHandler(t *testing.T) {
+	stats.PatchOps.Inc("note", "title", "ok")
+	body := scrape(t, (&Server{}).MetricsHandler())
+	assert.Contains(t, body, "# TYPE diffsync_patch_ops_total counter\n")
+	assert.Contains(t, body, `diffsync_patch_ops_total{backend="note",op="title",result="ok"}`)
+	assert.Contains(t, body, "# TYPE diffsync_session_save_duration_seconds histogram\n")
+}
+
+func TestMetricsLabelsBounded(t *testing.T) {
+	store := NewStore(nil)
+	store.Mount("note", &countingBackend{MemBackend: NewMemBackend(func() ResourceValue { return NewNote("") })})
+	store.Patch(Resource{Kind: "note", ID: "n1"}, Patch{Op: "made-up-op-1234"}, NewSyncResult(), Context{})
+	stats.Events.Inc(eventLabel("made-up-event-1234"))
+
+	body := scrape(t, (&Server{}).MetricsHandler())
+	assert.NotContains(t, body, "1234", "client-chosen label values exposed")
+	assert.Contains(t, body, `diffsync_patch_ops_total{backend="note",op="other",result="ignored"}`)
+	assert.Contains(t, body, `diffsync_events_total{name="other"}`)
+}
@@ -3,26 +3,31 @@ package diffsync
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"encoding/json"
 )
 
-var (
-	_ = log.Print
-)
-
 type UnixTime time.Time
 
 type Note struct {
-	Title        string    `json:"title"`
-	Text         TextValue `json:"text"`
-	Peers        PeerList  `json:"peers"`
-	SharingToken string    `json:"sharing_token"`
-	CreatedAt    UnixTime  `json:"-"`
-	CreatedBy    User      `json:"-"`
+	Title string    `json:"title"`
+	Text  TextValue `json:"text"`
+	// Format is NoteFormatPlain or NoteFormatRich. Marks format the text of
+	// rich notes.
+	Format       string   `json:"format,omitempty"`
+	Marks        MarkList `json:"marks,omitempty"`
+	Peers        PeerList `json:"peers"`
+	SharingToken string   `json:"sharing_token"`
+	// ShareLinks are additional share-urls created by the note's owners
+	ShareLinks ShareLinkList `json:"share_links,omitempty"`
+	Comments   CommentList   `json:"comments,omitempty"`
+	CreatedAt  UnixTime      `json:"-"`
+	CreatedBy  User          `json:"-"`
+	// Items of checklist notes, they are synced as their own resource and
+	// only filled in for exports
+	Items []ChecklistItem `json:"-"`
 }
 
 func (note Note) String() string {
@@ -144,6 +149,25 @@ func (pl PeerList) indexFromPath(path string) (int, bool) {
 }
 
 func (note Note) Clone() ResourceValue {
+	if note.ShareLinks != nil {
+		note.ShareLinks = append(ShareLinkList{}, note.ShareLinks...)
+	}
+	if note.Marks != nil {
+		note.Marks = append(MarkList{}, note.Marks...)
+	}
+	if note.Comments != nil {
+		note.Comments = append(CommentList{}, note.Comments...)
+	}
+	return note
+}
+
+// viewOf hides the share-url from everybody but owners and peers, as it
+// grants peer access to whoever holds it
+func (note Note) viewOf(uid string) ResourceValue {
+	if i, ok := note.Peers.indexFromPath("uid:" + uid); ok && note.Peers[i].Role != "viewer" {
+		return note
+	}
+	note.SharingToken = ""
 	return note
 }
 
@@ -158,12 +182,25 @@ func (note Note) GetDelta(latest ResourceValue) Delta {
 	if note.Title != master.Title {
 		delta = append(delta, NoteDeltaElement{"set-title", "", master.Title})
 	}
-	if textDelta := note.Text.GetDelta(master.Text).(TextDelta); textDelta.HasChanges() {
+	if note.Format != master.Format {
+		delta = append(delta, NoteDeltaElement{"set-format", "", master.Format})
+	}
+	var textDelta TextDelta
+	if master.Format == NoteFormatRich {
+		old := RichText{Text: note.Text, Marks: note.Marks}
+		if richDelta := old.GetDelta(RichText{Text: master.Text, Marks: master.Marks}).(RichTextDelta); richDelta.HasChanges() {
+			delta = append(delta, NoteDeltaElement{"delta-rich", "", richDelta})
+			textDelta = richDelta.Text
+		}
+	} else if textDelta = note.Text.GetDelta(master.Text).(TextDelta); textDelta.HasChanges() {
 		delta = append(delta, NoteDeltaElement{"delta-text", "", textDelta})
 	}
 	if note.SharingToken != master.SharingToken {
 		delta = append(delta, NoteDeltaElement{"set-token", "", master.SharingToken})
 	}
+	delta = append(delta, diffShareLinks(note.ShareLinks, master.ShareLinks)...)
+	// anchors move along with the text delta on the receiving end
+	delta = append(delta, diffComments(note.Comments.shift(note.Text, textDelta), master.Comments)...)
 
 	// pupulate lookup objects of old versions
 	oldExisting := map[string]Peer{}
@@ -252,6 +289,21 @@ func (delta *NoteDeltaElement) UnmarshalJSON(from []byte) (err error) {
 		if err = json.Unmarshal(tmp.RawValue, &p); err == nil {
 			delta.Value = p
 		}
+	case "add-share-link", "set-share-link":
+		link := ShareLink{}
+		if err = json.Unmarshal(tmp.RawValue, &link); err == nil {
+			delta.Value = link
+		}
+	case "add-comment", "set-comment":
+		c := Comment{}
+		if err = json.Unmarshal(tmp.RawValue, &c); err == nil {
+			delta.Value = c
+		}
+	case "resolve-comment":
+		resolved := false
+		if err = json.Unmarshal(tmp.RawValue, &resolved); err == nil {
+			delta.Value = resolved
+		}
 	case "set-ts":
 		ts := Timestamp{}
 		if err = json.Unmarshal(tmp.RawValue, &ts); err == nil {
@@ -267,6 +319,11 @@ func (delta *NoteDeltaElement) UnmarshalJSON(from []byte) (err error) {
 		if err = json.Unmarshal(tmp.RawValue, &tv); err == nil {
 			delta.Value = tv
 		}
+	case "delta-rich":
+		rd := RichTextDelta{}
+		if err = json.Unmarshal(tmp.RawValue, &rd); err == nil {
+			delta.Value = rd
+		}
 	default:
 		s := ""
 		if err = json.Unmarshal(tmp.RawValue, &s); err == nil {
@@ -305,7 +362,35 @@ func (delta NoteDelta) Apply(to ResourceValue) (ResourceValue, []Patch, error) {
 				return nil, nil, err
 			}
 			newres.Text = tmpText.(TextValue)
+			newres.Comments = newres.Comments.shift(original.Text, diff.Value.(TextDelta))
 			patches = append(patches, textPatches...)
+			if len(newres.Marks) > 0 {
+				// keep the formatting in place for clients editing rich
+				// notes as plain text
+				if diffs, err := dmp.DiffFromDelta(string(original.Text), string(diff.Value.(TextDelta))); err == nil {
+					newres.Marks = shiftMarks(newres.Marks, diffs)
+				}
+			}
+		case "delta-rich":
+			richDelta, ok := diff.Value.(RichTextDelta)
+			if !ok {
+				break
+			}
+			tmp, richPatches, err := richDelta.Apply(RichText{Text: newres.Text, Marks: newres.Marks})
+			if err != nil {
+				return nil, nil, err
+			}
+			newres.Comments = newres.Comments.shift(newres.Text, richDelta.Text)
+			newres.Text = tmp.(RichText).Text
+			newres.Marks = tmp.(RichText).Marks
+			patches = append(patches, richPatches...)
+		case "set-format":
+			format, _ := diff.Value.(string)
+			if format != NoteFormatPlain && format != NoteFormatRich || format == newres.Format {
+				break
+			}
+			patches = append(patches, Patch{Op: "format", Value: format, OldValue: newres.Format})
+			newres.Format = format
 		case "invite":
 			user, ok := diff.Value.(User)
 			if !ok || diff.Path != "peers/" {
@@ -334,6 +419,70 @@ func (delta NoteDelta) Apply(to ResourceValue) (ResourceValue, []Patch, error) {
 			}
 			patches = append(patches, Patch{Op: "rem-peer", Path: newres.Peers[idx].User.UID})
 			newres.Peers = append(newres.Peers[:idx], newres.Peers[idx+1:]...)
+		case "add-share-link":
+			link, ok := diff.Value.(ShareLink)
+			if !ok || diff.Path != "share_links/" {
+				break
+			}
+			if _, exists := newres.ShareLinks.indexFromPath(link.pathRef()); exists {
+				break
+			}
+			patches = append(patches, Patch{Op: "add-share-link", Value: link})
+			// the plaintext password is for the backend only, it must
+			// neither end up in the shadow nor reach other peers. Tokens
+			// are issued by the server.
+			link.Password, link.Token = "", ""
+			newres.ShareLinks = append(newres.ShareLinks, link)
+		case "set-share-link":
+			// links are changed by the server only, e.g. to fill in the
+			// token of a new link. Deliberately not creating a patch here
+			link, ok := diff.Value.(ShareLink)
+			if !ok {
+				break
+			}
+			if idx, ok := newres.ShareLinks.indexFromPath(diff.Path); ok {
+				newres.ShareLinks[idx] = link
+			}
+		case "rem-share-link":
+			idx, ok := newres.ShareLinks.indexFromPath(diff.Path)
+			if !ok {
+				break
+			}
+			patches = append(patches, Patch{Op: "rem-share-link", Path: newres.ShareLinks[idx].ID})
+			newres.ShareLinks = append(newres.ShareLinks[:idx], newres.ShareLinks[idx+1:]...)
+		case "add-comment":
+			c, ok := diff.Value.(Comment)
+			if !ok || diff.Path != "comments/" {
+				break
+			}
+			if c, ok = newres.Comments.valid(c, newres.Text); !ok {
+				break
+			}
+			newres.Comments = append(newres.Comments, c)
+			patches = append(patches, Patch{Op: "add-comment", Path: c.ID, Value: c})
+		case "set-comment":
+			// comments are changed by the server only, e.g. to fill in the
+			// author of a new one. Deliberately not creating a patch here
+			c, ok := diff.Value.(Comment)
+			if !ok {
+				break
+			}
+			if idx, ok := newres.Comments.indexFromPath(diff.Path); ok {
+				newres.Comments[idx] = c
+			}
+		case "rem-comment":
+			// only sent by the server, e.g. for rejected comments
+			if idx, ok := newres.Comments.indexFromPath(diff.Path); ok {
+				newres.Comments = append(newres.Comments[:idx], newres.Comments[idx+1:]...)
+			}
+		case "resolve-comment":
+			resolved, ok := diff.Value.(bool)
+			idx, found := newres.Comments.indexFromPath(diff.Path)
+			if !ok || !found || newres.Comments[idx].Thread != "" || newres.Comments[idx].Resolved == resolved {
+				break
+			}
+			newres.Comments[idx].Resolved = resolved
+			patches = append(patches, Patch{Op: "resolve-comment", Path: newres.Comments[idx].ID, Value: resolved})
 		case "set-cursor":
 			cursor, ok := diff.Value.(int64)
 			if !ok {
@@ -2,7 +2,6 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -16,7 +15,6 @@ import (
 )
 
 var (
-	_   = log.Print
 	rnd *rand.Rand
 )
 
@@ -31,7 +29,7 @@ func NewNoteSQLBackend(db *sql.DB) NoteSQLBackend {
 func (backend NoteSQLBackend) Get(key string) (ResourceValue, error) {
 	note := NewNote("")
 	var txt string
-	err := backend.db.QueryRow("SELECT title, txt, sharing_token FROM notes WHERE nid = $1", key).Scan(&note.Title, &txt, &note.SharingToken)
+	err := backend.db.QueryRow("SELECT title, txt, sharing_token, format FROM notes WHERE nid = $1", key).Scan(&note.Title, &txt, &note.SharingToken, &note.Format)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, NoExistError{key}
@@ -66,22 +64,39 @@ func (backend NoteSQLBackend) Get(key string) (ResourceValue, error) {
 		return nil, err
 	}
 	note.Peers = peers
+	if note.ShareLinks, err = backend.getShareLinks(key); err != nil {
+		return nil, err
+	}
+	if note.Format == NoteFormatRich {
+		if note.Marks, err = backend.getMarks(key); err != nil {
+			return nil, err
+		}
+	}
+	if note.Comments, err = backend.getComments(key); err != nil {
+		return nil, err
+	}
 	return note, nil
 }
 
 func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult, ctx Context) error {
+	if err := backend.checkPermission(nid, patch.Op, ctx); err != nil {
+		return err
+	}
 	switch patch.Op {
 	case "text":
 		// patch.Path empty
 		// patch.Value contains text-patches
 		// patch.OldValue empty
 		err := backend.patchText(nid, patch.Value.([]DMP.Patch), result, ctx)
-		if err != nil {
-			return fmt.Errorf("notesqlbackend: note(%s) could not be patched. patch: `%v`, err: `%s`", nid, patch.Value, err)
+		if r, ok := err.(Remark); ok {
+			return r
+		} else if err != nil {
+			return fmt.Errorf("notesqlbackend: note(%s) could not be patched. err: `%s`", nid, err)
 		}
 		if err = backend.pokeTimers(nid, true, ctx); err != nil {
-			log.Printf("notesqlbackend: note(%s) couldnot poke edit-timers for uid %s. err: %s", nid, ctx.uid, err)
+			ctx.Log().Warn("notesqlbackend: could not poke edit-timers", Fields{"nid": nid, "err": err})
 		}
+		ctx.store.reindex(nid)
 		result.Tainted(Resource{Kind: "note", ID: nid})
 	case "title":
 		// patch.Path empty
@@ -89,11 +104,14 @@ func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult,
 		// patch.OldValue contains old Title, for reference
 		res, err := backend.db.Exec("UPDATE notes SET title = $1 WHERE nid = $2 and title = $3", patch.Value.(string), nid, patch.OldValue.(string))
 		if err != nil {
-			return fmt.Errorf("notesqlbackend: note(%s) title could not be set. old: `%s` new `%s`", nid, patch.OldValue.(string), patch.Value.(string))
+			return fmt.Errorf("notesqlbackend: note(%s) title could not be set. err: `%s`", nid, err)
 		}
 		numChanges, _ := res.RowsAffected()
 		if err = backend.pokeTimers(nid, numChanges > 0, ctx); err != nil {
-			log.Printf("notesqlbackend: note(%s) couldnot poke edit-timers for uid %s. err: %s", nid, ctx.uid, err)
+			ctx.Log().Warn("notesqlbackend: could not poke edit-timers", Fields{"nid": nid, "err": err})
+		}
+		if numChanges > 0 {
+			ctx.store.reindex(nid)
 		}
 		result.Tainted(Resource{Kind: "note", ID: nid})
 	case "invite-user":
@@ -113,6 +131,13 @@ func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult,
 		ref := patch.Value.(User)
 		var u *User
 		var err error
+		var numPeers int
+		if err = backend.db.QueryRow("SELECT count(*) FROM noterefs WHERE nid = $1", nid).Scan(&numPeers); err != nil {
+			return err
+		}
+		if err = ctx.store.checkNoteQuota(backend.db, nid, ctx, quotaPeers, numPeers+1); err != nil {
+			return err
+		}
 		if len(ref.UID) == 8 {
 			u, err = findUserByUID(backend.db, ref.UID)
 			if err != nil {
@@ -130,7 +155,7 @@ func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult,
 			}
 			if u == nil {
 				// email provided but not found in DB, create invited user
-				u.Email = ref.Email
+				u = &User{UID: ref.UID, Email: ref.Email}
 				if err = createInvitedUser(backend.db, u); err != nil {
 					return err
 				}
@@ -141,8 +166,8 @@ func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult,
 				return err
 			}
 			if u == nil {
-				// email provided but not found in DB, create invited user
-				u.Phone = ref.Phone
+				// phone provided but not found in DB, create invited user
+				u = &User{UID: ref.UID, Phone: ref.Phone}
 				if err = createInvitedUser(backend.db, u); err != nil {
 					return err
 				}
@@ -194,6 +219,59 @@ func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult,
 		ctx.Router.Handle(Event{UID: patch.Path, Name: "res-remove", Res: Resource{Kind: "note", ID: nid}, ctx: ctx})
 		result.Tainted(Resource{Kind: "folio", ID: patch.Path})
 		result.Tainted(Resource{Kind: "note", ID: nid})
+	case "format":
+		// patch.Path empty
+		// patch.Value contains the new format
+		// patch.OldValue contains the old format
+		if _, err := backend.db.Exec("UPDATE notes SET format = $1 WHERE nid = $2", patch.Value.(string), nid); err != nil {
+			return fmt.Errorf("notesqlbackend: note(%s) format could not be set: %s", nid, err)
+		}
+		result.Tainted(Resource{Kind: "note", ID: nid})
+	case "add-mark", "set-mark", "rem-mark":
+		// patch.Path contains ID of the mark
+		// patch.Value contains the Mark (empty for rem-mark)
+		// patch.OldValue empty
+		if err := backend.patchMark(nid, patch); err != nil {
+			return fmt.Errorf("notesqlbackend: note(%s) mark %s failed: %s", nid, patch.Op, err)
+		}
+		result.Tainted(Resource{Kind: "note", ID: nid})
+	case "add-comment":
+		// patch.Path contains ID of the comment
+		// patch.Value contains the new Comment, its author is ctx's user
+		// patch.OldValue empty
+		c := patch.Value.(Comment)
+		added, err := backend.addComment(nid, c, ctx)
+		if err != nil {
+			return err
+		}
+		if added && c.Thread != "" {
+			go backend.notifyReply(nid, c, ctx)
+		}
+		result.Tainted(Resource{Kind: "note", ID: nid})
+	case "resolve-comment":
+		// patch.Path contains ID of the thread's first comment
+		// patch.Value contains the new resolved state
+		// patch.OldValue empty
+		if _, err := backend.db.Exec("UPDATE note_comments SET resolved = $1 WHERE nid = $2 AND id = $3 AND thread = ''", patch.Value.(bool), nid, patch.Path); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "note", ID: nid})
+	case "add-share-link":
+		// patch.Path empty
+		// patch.Value contains the new ShareLink, with its plaintext password if any
+		// patch.OldValue empty
+		if err := backend.addShareLink(nid, patch.Value.(ShareLink), result, ctx); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "note", ID: nid})
+	case "rem-share-link":
+		// patch.Path contains ID of the link to remove
+		// patch.Value empty
+		// patch.OldValue empty
+		if err := backend.remShareLink(nid, patch.Path); err != nil {
+			return err
+		}
+		result.Tainted(Resource{Kind: "note", ID: nid})
 	case "set-seen":
 		// patch.Path contains UID of peer who has seen stuff
 		// patch.Value empty
@@ -202,7 +280,7 @@ func (backend NoteSQLBackend) Patch(nid string, patch Patch, result *SyncResult,
 			return fmt.Errorf("cannot set seen for user other than context user. %s != %s ", ctx.uid, patch.Path)
 		}
 		if err := backend.pokeTimers(nid, false, ctx); err != nil {
-			log.Printf("notesqlbackend: note(%s) couldnot poke edit-timers for uid %s. err: %s", nid, ctx.uid, err)
+			ctx.Log().Warn("notesqlbackend: could not poke edit-timers", Fields{"nid": nid, "err": err})
 		}
 		result.Tainted(Resource{Kind: "note", ID: nid})
 	}
@@ -230,6 +308,17 @@ func (backend NoteSQLBackend) CreateEmpty(ctx Context) (string, error) {
 	return nid, nil
 }
 
+// importContent fills a note created for an import
+func (backend NoteSQLBackend) importContent(nid string, item ImportItem, uid string) error {
+	var err error
+	if item.CreatedAt.IsZero() {
+		_, err = backend.db.Exec("UPDATE notes SET title = $1, txt = $2, created_by = $3 WHERE nid = $4", item.Title, item.Text, uid, nid)
+	} else {
+		_, err = backend.db.Exec("UPDATE notes SET title = $1, txt = $2, created_by = $3, created_at = $4 WHERE nid = $5", item.Title, item.Text, uid, item.CreatedAt, nid)
+	}
+	return err
+}
+
 func (backend NoteSQLBackend) patchText(id string, patch []DMP.Patch, result *SyncResult, ctx Context) error {
 BeginTransaction:
 	txn, err := backend.db.Begin()
@@ -253,6 +342,13 @@ BeginTransaction:
 		txn.Rollback()
 		return nil
 	}
+	if len(patched) > len(original) {
+		// shrinking a note which is over the limit is fine
+		if err = ctx.store.checkNoteQuota(txn, id, ctx, quotaNoteSize, len(patched)); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
 	// update text in database
 	if _, err = txn.Exec("UPDATE notes SET txt = $1 WHERE nid = $2", patched, id); err != nil {
 		txn.Rollback()
@@ -262,6 +358,20 @@ BeginTransaction:
 		}
 		return err
 	}
+	if err = shiftStoredMarks(txn, id, original, patched); err != nil {
+		txn.Rollback()
+		if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "40001" {
+			goto BeginTransaction
+		}
+		return err
+	}
+	if err = shiftStoredComments(txn, id, original, patched); err != nil {
+		txn.Rollback()
+		if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "40001" {
+			goto BeginTransaction
+		}
+		return err
+	}
 	// save changes to changelog
 	delta := string(TextValue(original).GetDelta(TextValue(patched)).(TextDelta))
 	if !wantSnapshot() {
@@ -295,7 +405,7 @@ func (backend NoteSQLBackend) sendInvite(user User, nid string, ctx Context) {
 	// get info from inviter
 	res := Resource{Kind: "profile", ID: ctx.uid}
 	if err := ctx.store.Load(&res); err != nil {
-		log.Printf("error: sendInvite could not fetch profile info of inviter; err: %v", err)
+		ctx.Log().Error("sendInvite: could not fetch profile info of inviter", Fields{"nid": nid, "err": err})
 		return
 	}
 	inviter := res.Value.(Profile).User
@@ -308,18 +418,18 @@ func (backend NoteSQLBackend) sendInvite(user User, nid string, ctx Context) {
 	case "email", "phone":
 		_, err = backend.db.Exec(fmt.Sprintf("INSERT INTO tokens (token, kind, uid, nid, %s, created_by) VALUES ($1, 'share', $2, $3, $4, $5)", aKind), hashed, user.UID, nid, addr, ctx.uid)
 	default:
-		log.Printf("warn: cannot invite user[%s]. no usable contanct-addr found", user.UID)
+		ctx.Log().Warn("sendInvite: no usable contact-addr found", Fields{"nid": nid, "invitee": user.UID})
 		return
 	}
 	if err != nil {
-		log.Printf("error: sendInvite failed at storing a token - aborting invite; err: %v", err)
+		ctx.Log().Error("sendInvite: failed at storing a token, aborting invite", Fields{"nid": nid, "err": err})
 		return
 	}
 
 	// collect info about the shared note
 	res = Resource{Kind: "note", ID: nid}
 	if err = ctx.store.Load(&res); err != nil {
-		log.Printf("error: sendInvite could not fetch note info of shared note; err: %v", err)
+		ctx.Log().Error("sendInvite: could not fetch note info of shared note", Fields{"nid": nid, "err": err})
 	}
 	note := res.Value.(Note)
 	if txt := string(note.Text); len(txt) > 500 {
@@ -336,7 +446,7 @@ func (backend NoteSQLBackend) sendInvite(user User, nid string, ctx Context) {
 	reqData["invitee_tier"] = strconv.Itoa(int(user.Tier))
 	req := comm.NewRequest("invite", user, reqData)
 	if err = ctx.store.commHandler(req); err != nil {
-		log.Printf("error: sendInvite could not forward request to comm.Handler; err: %v", err)
+		ctx.Log().Error("sendInvite: could not forward request to comm.Handler", Fields{"nid": nid, "err": err})
 	}
 }
 
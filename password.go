@@ -0,0 +1,176 @@
+package diffsync
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// after maxFailedLogins consecutive failed attempts, an account
+	// is locked for loginLockout
+	maxFailedLogins = 5
+	loginLockout    = 15 * time.Minute
+)
+
+// scrypt cost parameters for newly hashed passwords. They are stored along
+// with every hash, so they can be raised without invalidating old passwords.
+var scryptN, scryptR, scryptP = 1 << 15, 8, 1
+
+// Credentials can be sent along with a session-create instead of a Token
+type Credentials struct {
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Password string `json:"password"`
+}
+
+// PasswordChange is the value of a profile's set-password op. Current may
+// be empty if the user has no password yet.
+type PasswordChange struct {
+	Current string `json:"current"`
+	New     string `json:"new"`
+}
+
+var (
+	errInvalidCredentials = Remark{Level: "error", Slug: "invalid-credentials"}
+	errPasswordTooShort   = Remark{Level: "error", Slug: "password-too-short", Data: map[string]string{"min-length": strconv.Itoa(minPasswordLength)}}
+)
+
+// hashPassword derives a key from plain using scrypt and encodes it as
+// `scrypt$N$r$p$salt$key`
+func hashPassword(plain string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(plain), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s", scryptN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(plain, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "scrypt" {
+		return false, errors.New("password: unsupported hash format")
+	}
+	params := [3]int{}
+	for i := range params {
+		v, err := strconv.Atoi(parts[i+1])
+		if err != nil {
+			return false, fmt.Errorf("password: malformed hash parameters: %s", err)
+		}
+		params[i] = v
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	got, err := scrypt.Key([]byte(plain), salt, params[0], params[1], params[2], len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// dummyHash is checked against when no account matched, so that response
+// times don't reveal which addresses have an account
+var dummyHash, _ = hashPassword("")
+
+type passwordAccount struct {
+	uid          string
+	hash         string
+	failedLogins int
+	lockedUntil  *time.Time
+}
+
+func loadPasswordAccount(db *sql.DB, where string, args ...interface{}) (*passwordAccount, error) {
+	acc := passwordAccount{}
+	var hash sql.NullString
+	err := db.QueryRow("SELECT uid, password, failed_logins, locked_until FROM users WHERE "+where, args...).Scan(&acc.uid, &hash, &acc.failedLogins, &acc.lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	acc.hash = hash.String
+	return &acc, nil
+}
+
+// verify checks plain against the account's password. Failed attempts are
+// counted, and the account gets locked once there were too many of them.
+func (acc *passwordAccount) verify(db *sql.DB, plain string) error {
+	if acc.lockedUntil != nil && time.Now().Before(*acc.lockedUntil) {
+		retry := int(acc.lockedUntil.Sub(time.Now()) / time.Second)
+		return Remark{Level: "error", Slug: "account-locked", Data: map[string]string{"retry-after": strconv.Itoa(retry + 1)}}
+	}
+	if acc.hash == "" {
+		// no password set, nothing to compare against
+		checkPassword(plain, dummyHash)
+		return errInvalidCredentials
+	}
+	ok, err := checkPassword(plain, acc.hash)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if acc.failedLogins > 0 {
+			_, err = db.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE uid = $1", acc.uid)
+		}
+		return err
+	}
+	// count in the database, concurrent attempts must not be able to
+	// overwrite each other's failures
+	var failed int
+	if err = db.QueryRow("UPDATE users SET failed_logins = failed_logins + 1 WHERE uid = $1 RETURNING failed_logins", acc.uid).Scan(&failed); err != nil {
+		return err
+	}
+	if failed >= maxFailedLogins {
+		if _, err = db.Exec("UPDATE users SET failed_logins = 0, locked_until = $1 WHERE uid = $2", time.Now().Add(loginLockout), acc.uid); err != nil {
+			return err
+		}
+	}
+	return errInvalidCredentials
+}
+
+// authenticate swaps credentials for a token which can be passed on to
+// createSession like any other login token.
+func (tok *TokenConsumer) authenticate(creds Credentials) (Token, error) {
+	var acc *passwordAccount
+	var err error
+	switch {
+	case creds.Email != "":
+		acc, err = loadPasswordAccount(tok.db, "email = $1 AND email_status = 'verified' AND tier > 0", creds.Email)
+	case creds.Phone != "":
+		acc, err = loadPasswordAccount(tok.db, "phone = $1 AND phone_status = 'verified' AND tier > 0", creds.Phone)
+	default:
+		return Token{}, errInvalidCredentials
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if acc == nil {
+		checkPassword(creds.Password, dummyHash)
+		return Token{}, errInvalidCredentials
+	}
+	if err = acc.verify(tok.db, creds.Password); err != nil {
+		return Token{}, err
+	}
+	return Token{Kind: "password", UID: acc.uid, Email: creds.Email, Phone: creds.Phone}, nil
+}
@@ -0,0 +1,132 @@
+package diffsync
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fastScrypt lowers the cost of password hashing until the returned
+// function is called
+func fastScrypt() (restore func()) {
+	n := scryptN
+	scryptN = 1 << 10
+	return func() { scryptN = n }
+}
+
+func TestPasswordHash(t *testing.T) {
+	defer fastScrypt()()
+	hash, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+	ok, err := checkPassword("correct horse", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok, "password did not match its own hash")
+	ok, _ = checkPassword("battery staple", hash)
+	assert.False(t, ok, "wrong password matched")
+	other, _ := hashPassword("correct horse")
+	assert.NotEqual(t, hash, other, "hashes not salted")
+}
+
+// allTables creates every table of the sqlite schema
+var allTables = []string{CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_CONTACTS, CREATE_SESSIONS, CREATE_TOKENS,
+	CREATE_STRIPETOKENS, CREATE_IDENTITIES, CREATE_TOKENCONSUMPTIONS, CREATE_SHARELINKS, CREATE_RATELIMITS, CREATE_NOTECHANGELOG,
+	CREATE_FOLDERS, CREATE_NOTEREFTAGS, CREATE_NOTESEARCH, CREATE_IMPORTS, CREATE_NOTEMARKS, CREATE_CHECKLISTITEMS, CREATE_NOTECOMMENTS}
+
+// testDB opens an in-memory sqlite database with the given tables
+func testDB(t *testing.T, schemas ...string) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would get its own in-memory db
+	db.SetMaxOpenConns(1)
+	for _, qry := range schemas {
+		if _, err = db.Exec(qry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestPasswordLoginLockout(t *testing.T) {
+	defer fastScrypt()()
+	db := testDB(t, CREATE_USERS)
+	defer db.Close()
+	hash, _ := hashPassword("correct horse")
+	db.Exec("INSERT INTO users (uid, tier, email, email_status, password) VALUES ('u1', 1, 'a@b.c', 'verified', $1)", hash)
+	tok := NewTokenConsumer(nil, db, nil)
+
+	token, err := tok.authenticate(Credentials{Email: "a@b.c", Password: "correct horse"})
+	assert.NoError(t, err)
+	assert.Equal(t, Token{Kind: "password", UID: "u1", Email: "a@b.c"}, token)
+	_, err = tok.authenticate(Credentials{Email: "x@b.c", Password: "correct horse"})
+	assert.Equal(t, errInvalidCredentials, err, "unknown email should fail like a wrong password")
+
+	// attempts read the account before any of them counts its failure
+	accounts := make([]*passwordAccount, maxFailedLogins)
+	for i := range accounts {
+		accounts[i], _ = loadPasswordAccount(db, "uid = 'u1'")
+	}
+	for _, acc := range accounts {
+		assert.Equal(t, errInvalidCredentials, acc.verify(db, "wrong"))
+	}
+	_, err = tok.authenticate(Credentials{Email: "a@b.c", Password: "correct horse"})
+	if assert.IsType(t, Remark{}, err) {
+		assert.Equal(t, "account-locked", err.(Remark).Slug, "account not locked after too many failed attempts")
+	}
+}
+
+func TestAnonPasswordLogin(t *testing.T) {
+	defer fastScrypt()()
+	db := testDB(t, allTables...)
+	defer db.Close()
+	hash, _ := hashPassword("correct horse")
+	db.Exec("INSERT INTO users (uid, tier, email, email_status, password) VALUES ('uid00001', 1, 'test@example.com', 'verified', $1)", hash)
+	db.Exec("INSERT INTO users (uid, tier) VALUES ('uid00002', 0)")
+	db.Exec("INSERT INTO notes (nid) VALUES ('nid00001'), ('nid00002'), ('nid00003')")
+	db.Exec(`INSERT INTO noterefs (nid, uid, role) VALUES
+				('nid00001', 'uid00001', 'owner'),
+				('nid00002', 'uid00001', 'owner'),
+				('nid00003', 'uid00002', 'owner')`)
+	db.Exec("INSERT INTO sessions (sid, uid) VALUES ('sid00002', 'uid00002')")
+	store := NewStore(nil)
+	store.Mount("profile", NewProfileSQLBackend(db))
+	store.Mount("folio", NewFolioSQLBackend(db))
+	store.Mount("note", NewNoteSQLBackend(db))
+	sessions := &memSessions{saved: map[string]int{}}
+	tok := NewTokenConsumer(sessions, db, nil)
+	var pushed, created []Event
+	nop := FuncHandler{Fn: func(Event) error { return nil }}
+	ctx := Context{store: store, Router: nop, Client: FuncHandler{Fn: func(event Event) error {
+		pushed = append(pushed, event)
+		return nil
+	}}}
+	login := func(password string) {
+		creds := &Credentials{Email: "test@example.com", Password: password}
+		assert.NoError(t, tok.Handle(Event{Name: "session-create", SID: "sid00002", Credentials: creds, ctx: ctx}, FuncHandler{Fn: func(event Event) error {
+			created = append(created, event)
+			return nil
+		}}))
+	}
+
+	// wrong password must not create a session
+	login("battery staple")
+	assert.Len(t, created, 0, "login with wrong password succeeded")
+	if assert.Len(t, pushed, 1) && assert.NotNil(t, pushed[0].Remark) {
+		assert.Equal(t, "invalid-credentials", pushed[0].Remark.Slug)
+	}
+
+	login("correct horse")
+	if !assert.Len(t, created, 1, "password login did not create a session") {
+		return
+	}
+	assert.Equal(t, "uid00001", created[0].ctx.uid)
+	assert.Equal(t, 1, sessions.timesSaved(created[0].SID), "new session not saved")
+	// anon session's note must have been merged
+	folio, err := NewFolioSQLBackend(db).Get("uid00001")
+	if assert.NoError(t, err) {
+		assert.Len(t, folio.(Folio).NoteRefs, 3, "folio has the wrong number of notes")
+	}
+}
@@ -3,7 +3,6 @@ package diffsync
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
@@ -11,17 +10,13 @@ import (
 	"encoding/json"
 )
 
-var (
-	_ = log.Print
-)
-
 type User struct {
 	UID           string     `json:"uid,omitempty"`
 	Name          string     `json:"name,omitempty"`
 	Email         string     `json:"email,omitempty"`
 	EmailStatus   string     `json:"email_status"`
 	Phone         string     `json:"phone,omitempty"`
-	PhoneStatus   string     `json:"email_status"`
+	PhoneStatus   string     `json:"phone_status"`
 	Tier          int64      `json:"tier"`
 	SignupAt      *UnixTime  `json:"signup_at,omitempty"`
 	CreatedAt     *time.Time `json:"-"`
@@ -215,6 +210,11 @@ func (uc *UserChange) UnmarshalJSON(from []byte) (err error) {
 		if err = json.Unmarshal(tmp.RawValue, &u); err == nil {
 			uc.Value = u
 		}
+	case "set-password":
+		change := PasswordChange{}
+		if err = json.Unmarshal(tmp.RawValue, &change); err == nil {
+			uc.Value = change
+		}
 	case "set-tier":
 		i := 0
 		if err = json.Unmarshal(tmp.RawValue, &i); err == nil {
@@ -278,6 +278,29 @@ func (delta ProfileDelta) Apply(to ResourceValue) (ResourceValue, []Patch, error
 			}
 			patches = append(patches, Patch{Op: "set-email", Path: "user/", Value: newEmail, OldValue: newres.User.Email})
 			newres.User.Email = newEmail
+		case "set-phone":
+			if !strings.HasPrefix(diff.Path, "user/") {
+				// cannot change phone of anyone but own user for now
+				continue
+			}
+			newPhone, ok := diff.Value.(string)
+			if !ok {
+				continue
+			}
+			patches = append(patches, Patch{Op: "set-phone", Path: "user/", Value: newPhone, OldValue: newres.User.Phone})
+			newres.User.Phone = newPhone
+		case "set-password":
+			if diff.Path != "user/" {
+				// only the own password can be changed
+				continue
+			}
+			change, ok := diff.Value.(PasswordChange)
+			if !ok {
+				continue
+			}
+			// passwords are not part of the profile's value, the store
+			// takes care of verifying and saving it
+			patches = append(patches, Patch{Op: "set-password", Path: "user/", Value: change})
 		}
 	}
 	return newres, patches, nil
@@ -2,17 +2,12 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/hiroapp-com/hync/comm"
 
 	"database/sql"
 )
 
-var (
-	_ = log.Print
-)
-
 type ProfileSQLBackend struct {
 	db *sql.DB
 }
@@ -90,7 +85,7 @@ func createContact(uid1, uid2, name, email, phone string, db *sql.DB, ctx Contex
 }
 
 func (backend ProfileSQLBackend) Patch(uid string, patch Patch, result *SyncResult, ctx Context) error {
-	log.Printf("received Profile-Patch: %#v", patch)
+	ctx.Log().Sample("profile-patch", 10).Debug("profilesqlbackend: received patch", Fields{"op": patch.Op, "profile": uid})
 	switch patch.Op {
 	case "add-user":
 		// patch.Path namespace prefix for new user (currently only "contacts/" supported
@@ -190,7 +185,7 @@ func (backend ProfileSQLBackend) Patch(uid string, patch Patch, result *SyncResu
 		res, err := backend.db.Exec(`UPDATE users 
 								     SET email = $1 , email_status = 'unverified' 
 									 WHERE uid = $2 
-									   AND email = $2 
+									   AND email = $3 
 									   AND (SELECT count(uid) 
 											 FROM users 
 											 WHERE email = $1 AND tier > 0
@@ -203,12 +198,70 @@ func (backend ProfileSQLBackend) Patch(uid string, patch Patch, result *SyncResu
 		}
 		result.Tainted(Resource{Kind: "profile", ID: uid})
 
+	case "set-phone":
+		// patch.Path must be "user/"
+		// patch.Value contains the new Phone
+		// patch.OldValue contains the old Phone for CAS
+		if patch.Path != "user/" || uid != ctx.uid {
+			return nil
+		}
+		res, err := backend.db.Exec(`UPDATE users 
+								     SET phone = $1 , phone_status = 'unverified' 
+									 WHERE uid = $2 
+									   AND phone = $3 
+									   AND (SELECT count(uid) 
+											 FROM users 
+											 WHERE phone = $1 AND tier > 0
+										   ) = 0`, patch.Value.(string), uid, patch.OldValue.(string))
+		if err != nil {
+			return err
+		}
+		if affected, _ := res.RowsAffected(); affected > 0 {
+			go backend.sendVerifyToken(uid, phoneRcpt(User{Phone: patch.Value.(string)}), ctx.store)
+		}
+		result.Tainted(Resource{Kind: "profile", ID: uid})
+	case "set-password":
+		// patch.Path must be "user/"
+		// patch.Value contains a PasswordChange
+		// patch.OldValue empty, the current password is used as a guard instead
+		if patch.Path != "user/" || uid != ctx.uid {
+			return nil
+		}
+		change := patch.Value.(PasswordChange)
+		if len(change.New) < minPasswordLength {
+			return errPasswordTooShort
+		}
+		acc, err := loadPasswordAccount(backend.db, "uid = $1 AND tier > 0", uid)
+		if err != nil {
+			return err
+		}
+		if acc == nil {
+			// only signed up users can log in with a password
+			return Remark{Level: "error", Slug: "signup-required"}
+		}
+		if acc.hash != "" {
+			if err = acc.verify(backend.db, change.Current); err != nil {
+				return err
+			}
+		}
+		hash, err := hashPassword(change.New)
+		if err != nil {
+			return err
+		}
+		res, err := backend.db.Exec("UPDATE users SET password = $1 WHERE uid = $2 AND COALESCE(password, '') = $3", hash, uid, acc.hash)
+		if err != nil {
+			return err
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			// changed concurrently, let the client retry
+			return errInvalidCredentials
+		}
 	case "set-tier":
 		// patch.Path must be "user/"
 		// patch.Value contains the new Tier
 		// patch.OldValue contains the old Tier for CAS
 		if ctx.uid != "sys" {
-			log.Printf("non-`sys` context tried to set a user's tier. target-uid: %s context uid: %s", uid, ctx.uid)
+			ctx.Log().Warn("profilesqlbackend: non-`sys` context tried to set a user's tier", Fields{"profile": uid})
 			return nil
 		}
 		if patch.Path != "user/" {
@@ -249,7 +302,7 @@ func (backend ProfileSQLBackend) sendVerifyToken(uid string, rcpt comm.Rcpt, sto
 		"token": token,
 	}))
 	if err != nil {
-		log.Printf("error: could not send out verify-token (type %s) to address `%s`; err: %s", addrKind, addr, err)
+		store.log.Error("could not send out verify-token", Fields{"uid": uid, "addr_kind": addrKind, "err": err})
 	}
 }
 
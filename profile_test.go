@@ -1,15 +1,18 @@
 package diffsync
 
 import (
+	"database/sql"
 	"encoding/json"
 	"testing"
 	"time"
 
+	"github.com/hiroapp-com/hync/comm"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestUserSerialize(t *testing.T) {
-	ts := time.Now()
+	ts := UnixTime(time.Unix(1400000000, 0))
 	user := User{UID: "uid-test",
 		Name:        "name-test",
 		Email:       "test@hiroapp.com",
@@ -21,6 +24,7 @@ func TestUserSerialize(t *testing.T) {
 	}
 	res, err := json.Marshal(user)
 	if assert.NoError(t, err, "cannot jsonify user") {
+		user = User{}
 		err = json.Unmarshal(res, &user)
 		if assert.NoError(t, err, "cannot parse user json") {
 			assert.Equal(t, "uid-test", user.UID, "uid mismatch after serializaion")
@@ -29,8 +33,60 @@ func TestUserSerialize(t *testing.T) {
 			assert.Equal(t, "+100012345", user.Phone, "phone mismatch after serializaion")
 			assert.Equal(t, "verified", user.EmailStatus, "email_status mismatch after serializaion")
 			assert.Equal(t, "unverified", user.PhoneStatus, "phone_status mismatch after serializaion")
-			assert.Equal(t, 2, user.Tier, "tier mismatch after serializaion")
-			assert.Equal(t, ts, *user.SignupAt, "signup_at mismatch after serializaion")
+			assert.Equal(t, int64(2), user.Tier, "tier mismatch after serializaion")
+			assert.True(t, time.Time(ts).Equal(time.Time(*user.SignupAt)), "signup_at mismatch after serializaion")
 		}
 	}
 }
+
+func TestProfileSetPhone(t *testing.T) {
+	prof := Profile{User: User{UID: "uid-test", Phone: "+100012345", PhoneStatus: "verified"}, Contacts: []User{}}
+	res, patches, err := ProfileDelta{UserChange{"set-phone", "user/", "+100054321"}}.Apply(prof)
+	if assert.NoError(t, err, "cannot apply set-phone") {
+		assert.Equal(t, "+100054321", res.(Profile).User.Phone, "phone not changed")
+		assert.Equal(t, []Patch{{Op: "set-phone", Path: "user/", Value: "+100054321", OldValue: "+100012345"}}, patches)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, qry := range []string{CREATE_USERS, CREATE_TOKENS} {
+		if _, err = db.Exec(qry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec("INSERT INTO users (uid, tier, phone, phone_status) VALUES ('uid-test', 1, '+100012345', 'verified')")
+	db.Exec("INSERT INTO users (uid, tier, phone, phone_status) VALUES ('uid-other', 1, '+100099999', 'verified')")
+	reqs := make(chan comm.Request, 1)
+	store := NewStore(func(req comm.Request) error {
+		reqs <- req
+		return nil
+	})
+	backend := NewProfileSQLBackend(db)
+	ctx := Context{uid: "uid-test", store: store}
+
+	// numbers of other signed up users cannot be claimed
+	result := NewSyncResult()
+	err = backend.Patch("uid-test", Patch{Op: "set-phone", Path: "user/", Value: "+100099999", OldValue: "+100012345"}, result, ctx)
+	assert.NoError(t, err)
+	u, _ := findUserByUID(db, "uid-test")
+	assert.Equal(t, "+100012345", u.Phone, "phone of another user claimed")
+
+	err = backend.Patch("uid-test", patches[0], result, ctx)
+	assert.NoError(t, err)
+	u, _ = findUserByUID(db, "uid-test")
+	assert.Equal(t, "+100054321", u.Phone, "phone not saved")
+	assert.Equal(t, "unverified", u.PhoneStatus, "new phone not marked unverified")
+	select {
+	case req := <-reqs:
+		assert.Equal(t, "verify", req.Kind)
+		assert.NotEmpty(t, req.Data["token"], "token missing in comm.Request")
+		var phone string
+		db.QueryRow("SELECT phone FROM tokens WHERE kind = 'verify' AND uid = 'uid-test'").Scan(&phone)
+		assert.Equal(t, "+100054321", phone, "verify token not bound to new phone")
+	case <-time.After(time.Second):
+		t.Error("no verify token sent")
+	}
+}
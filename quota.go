@@ -0,0 +1,128 @@
+package diffsync
+
+import (
+	"database/sql"
+	"strconv"
+)
+
+// Quota limits what users of a tier may do. A zero limit means unlimited.
+type Quota struct {
+	// MaxNotes is the number of notes a user may own
+	MaxNotes int
+	// MaxNoteSize is the maximum length of a note's text in bytes
+	MaxNoteSize int
+	// MaxPeersPerNote limits the number of users a note can be shared with
+	MaxPeersPerNote int
+}
+
+// QuotaPolicy maps tiers to their Quota. Tiers without an entry get the
+// quota of the next lower tier which has one, or no limits at all.
+type QuotaPolicy map[int64]Quota
+
+const (
+	quotaNotes    = "notes"
+	quotaNoteSize = "note-size"
+	quotaPeers    = "peers"
+)
+
+func DefaultQuotaPolicy() QuotaPolicy {
+	return QuotaPolicy{
+		// anon
+		0: {MaxNotes: 20, MaxNoteSize: 100 << 10, MaxPeersPerNote: 5},
+		// signed up
+		1: {MaxNotes: 500, MaxNoteSize: 1 << 20, MaxPeersPerNote: 20},
+		// paying users
+		2: {},
+	}
+}
+
+func (policy QuotaPolicy) For(tier int64) Quota {
+	best, found := int64(0), false
+	for t := range policy {
+		if t <= tier && (!found || t > best) {
+			best, found = t, true
+		}
+	}
+	if !found {
+		return Quota{}
+	}
+	return policy[best]
+}
+
+func (q Quota) limit(name string) int {
+	switch name {
+	case quotaNotes:
+		return q.MaxNotes
+	case quotaNoteSize:
+		return q.MaxNoteSize
+	case quotaPeers:
+		return q.MaxPeersPerNote
+	}
+	return 0
+}
+
+// lowest returns the smallest limit for name across all tiers, or 0 if no
+// tier is limited
+func (policy QuotaPolicy) lowest(name string) int {
+	min := 0
+	for _, q := range policy {
+		if l := q.limit(name); l > 0 && (min == 0 || l < min) {
+			min = l
+		}
+	}
+	return min
+}
+
+// checkQuota returns a quota-exceeded Remark if value is above the named
+// limit of the user ctx acts for
+func (store *Store) checkQuota(ctx Context, name string, value int) error {
+	if !store.mayExceed(ctx, name, value) {
+		return nil
+	}
+	return store.quotaRemark(ctx.User().Tier, name, value)
+}
+
+// checkNoteQuota is like checkQuota, but applies the limits of the owner of
+// note nid: it's the owner's tier which pays for the note, no matter which
+// peer edits it or joins it
+func (store *Store) checkNoteQuota(db rowQuerier, nid string, ctx Context, name string, value int) error {
+	if !store.mayExceed(ctx, name, value) {
+		return nil
+	}
+	var tier sql.NullInt64
+	err := db.QueryRow(`SELECT max(u.tier) FROM noterefs r
+							JOIN users u ON u.uid = r.uid
+							WHERE r.nid = $1 AND r.role = 'owner'`, nid).Scan(&tier)
+	if err != nil {
+		return err
+	}
+	if !tier.Valid {
+		// orphaned note, nobody but the editor to account it to
+		return store.quotaRemark(ctx.User().Tier, name, value)
+	}
+	return store.quotaRemark(tier.Int64, name, value)
+}
+
+// mayExceed reports whether value could be above the named limit of any
+// tier at all
+func (store *Store) mayExceed(ctx Context, name string, value int) bool {
+	if store.quotas == nil || ctx.uid == "sys" {
+		return false
+	}
+	// don't bother looking up the user's tier if nobody could be over
+	// the limit, e.g. on every keystroke of a short note
+	lowest := store.quotas.lowest(name)
+	return lowest > 0 && value > lowest
+}
+
+func (store *Store) quotaRemark(tier int64, name string, value int) error {
+	max := store.quotas.For(tier).limit(name)
+	if max == 0 || value <= max {
+		return nil
+	}
+	return Remark{Level: "error", Slug: "quota-exceeded", Data: map[string]string{
+		"limit": name,
+		"max":   strconv.Itoa(max),
+		"tier":  strconv.Itoa(int(tier)),
+	}}
+}
@@ -0,0 +1,122 @@
+package diffsync
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaPolicyFor(t *testing.T) {
+	policy := QuotaPolicy{
+		0: {MaxNotes: 10},
+		2: {MaxNotes: 100},
+	}
+	assert.Equal(t, 10, policy.For(0).MaxNotes)
+	assert.Equal(t, 10, policy.For(1).MaxNotes, "tier without entry must fall back to next lower tier")
+	assert.Equal(t, 100, policy.For(5).MaxNotes)
+	assert.Equal(t, 0, policy.For(-1).MaxNotes, "tier below all entries must be unlimited")
+	assert.Equal(t, 10, policy.lowest(quotaNotes))
+	assert.Equal(t, 0, policy.lowest(quotaPeers))
+}
+
+func quotaDB(t *testing.T) *sql.DB {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_CONTACTS)
+	db.Exec("INSERT INTO users (uid, tier) VALUES ('uid00001', 0), ('uid00002', 0), ('uid00003', 0), ('uid00004', 2)")
+	db.Exec("INSERT INTO notes (nid, txt) VALUES ('nid00001', 'hello')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ('nid00001', 'uid00001', 'owner'), ('nid00001', 'uid00004', 'peer')")
+	return db
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	db := quotaDB(t)
+	defer db.Close()
+	store := NewStore(nil)
+	store.Mount("profile", NewProfileSQLBackend(db))
+	store.Mount("folio", NewFolioSQLBackend(db))
+	store.Mount("note", NewNoteSQLBackend(db))
+	store.quotas = QuotaPolicy{
+		0: {MaxNotes: 1, MaxNoteSize: 10, MaxPeersPerNote: 2},
+		2: {},
+	}
+	ctx := NewContext(FuncHandler{Fn: func(Event) error { return nil }}, store, nil)
+	ctx.uid = "uid00001"
+
+	err := store.Patch(Resource{Kind: "note", ID: "nid00001"}, Patch{Op: "invite-user", Value: User{UID: "uid00002"}}, NewSyncResult(), ctx)
+	if assert.IsType(t, Remark{}, err) {
+		r := err.(Remark)
+		assert.Equal(t, "quota-exceeded", r.Slug)
+		assert.Equal(t, map[string]string{"limit": "peers", "max": "2", "tier": "0"}, r.Data)
+	}
+	var peers int
+	db.QueryRow("SELECT count(*) FROM noterefs WHERE nid = 'nid00001'").Scan(&peers)
+	assert.Equal(t, 2, peers, "invitee added despite quota")
+
+	// joining through a token counts against the same limit
+	ctx.uid = "uid00002"
+	err = store.Patch(Resource{Kind: "folio", ID: "uid00002"}, Patch{Op: "add-noteref", Value: NoteRef{NID: "nid00001", Status: "active", role: "peer"}}, NewSyncResult(), ctx)
+	if assert.IsType(t, Remark{}, err) {
+		assert.Equal(t, "peers", err.(Remark).Data["limit"])
+	}
+	db.QueryRow("SELECT count(*) FROM noterefs WHERE nid = 'nid00001'").Scan(&peers)
+	assert.Equal(t, 2, peers, "token consumer added despite quota")
+
+	// the owner's tier applies, no matter who acts on the note
+	ctx.uid = "uid00004"
+	err = store.Patch(Resource{Kind: "note", ID: "nid00001"}, Patch{Op: "invite-user", Value: User{UID: "uid00002"}}, NewSyncResult(), ctx)
+	assert.IsType(t, Remark{}, err, "peer of a higher tier lifted the owner's limit")
+	assert.IsType(t, Remark{}, store.checkNoteQuota(db, "nid00001", ctx, quotaNoteSize, 100))
+	db.Exec("INSERT INTO notes (nid, txt) VALUES ('nid00002', '')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ('nid00002', 'uid00004', 'owner'), ('nid00002', 'uid00001', 'peer')")
+	ctx.uid = "uid00001"
+	assert.NoError(t, store.checkNoteQuota(db, "nid00002", ctx, quotaNoteSize, 100), "owner's unlimited tier not applied")
+
+	err = store.Patch(Resource{Kind: "folio", ID: "uid00001"}, Patch{Op: "add-noteref", Value: NoteRef{NID: "tmp1"}}, NewSyncResult(), ctx)
+	if assert.IsType(t, Remark{}, err) {
+		assert.Equal(t, "notes", err.(Remark).Data["limit"])
+	}
+	var notes int
+	db.QueryRow("SELECT count(*) FROM notes").Scan(&notes)
+	assert.Equal(t, 2, notes, "note created despite quota")
+
+	// unlimited tier
+	ctx.uid = "uid00004"
+	assert.NoError(t, store.checkQuota(ctx, quotaNotes, 1000))
+	// system changes are never limited
+	ctx.uid = "sys"
+	assert.NoError(t, store.checkQuota(ctx, quotaNotes, 1000))
+}
+
+// rejectingBackend rejects every patch like an exceeded quota would
+type rejectingBackend struct {
+	*MemBackend
+}
+
+func (b rejectingBackend) Patch(string, Patch, *SyncResult, Context) error {
+	return Remark{Level: "error", Slug: "quota-exceeded"}
+}
+
+func (b rejectingBackend) CreateEmpty(Context) (string, error) {
+	return b.Insert(NewNote(""))
+}
+
+func TestShadowRejectedPatch(t *testing.T) {
+	backend := rejectingBackend{NewMemBackend(func() ResourceValue { return NewNote("") })}
+	backend.Upsert("n1", NewNote("hello"))
+	store := NewStore(nil)
+	store.Mount("note", backend)
+	shadow := NewShadow(Resource{Kind: "note", ID: "n1", Value: NewNote("hello")})
+	edit := Edit{Delta: NewNote("hello").GetDelta(NewNote("hello world"))}
+	result := NewSyncResult()
+
+	err := shadow.SyncIncoming(edit, result, Context{store: store})
+	assert.NoError(t, err, "rejected patch must not fail the sync")
+	assert.Len(t, result.Remarks(), 1)
+	assert.Equal(t, TextValue("hello world"), shadow.res.Value.(Note).Text, "shadow must match the client's")
+	assert.Equal(t, int64(1), shadow.CV, "edit not acknowledged")
+
+	// the next delta reverts the change on the client
+	assert.True(t, shadow.UpdatePending(false, store, "uid00001"))
+	assert.Equal(t, TextValue("hello"), shadow.res.Value.(Note).Text)
+}
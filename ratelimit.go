@@ -0,0 +1,206 @@
+package diffsync
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: it allows Burst actions at once and refills
+// one action every Every.
+type RateLimit struct {
+	Burst int
+	Every time.Duration
+}
+
+// RateLimits maps event names (e.g. session-create) and patch ops (e.g.
+// invite-user, see patchActions) to their limit. Each limit applies
+// separately per session, per user and per client address. Calls of
+// anonymous clients without a known address share a single bucket.
+type RateLimits map[string]RateLimit
+
+// patchActions maps the rate limited patch ops of each resource kind to
+// their action in RateLimits. Ops are chosen by clients and never used as
+// actions directly.
+var patchActions = map[string]map[string]string{
+	"note":    {"invite-user": "invite-user"},
+	"profile": {"add-user": "add-user", "set-email": "set-email", "set-phone": "set-phone"},
+}
+
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		"session-create":         {Burst: 20, Every: 3 * time.Second},
+		"token-consume":          {Burst: 10, Every: 6 * time.Second},
+		"invite-user":            {Burst: 20, Every: time.Minute},
+		"add-user":               {Burst: 20, Every: time.Minute},
+		"set-email":              {Burst: 5, Every: 10 * time.Minute},
+		"set-phone":              {Burst: 5, Every: 10 * time.Minute},
+		"account-delete-request": {Burst: 3, Every: 10 * time.Minute},
+	}
+}
+
+// RateLimitStore keeps the state of the token buckets
+type RateLimitStore interface {
+	// Take removes a token from the bucket stored at key. If the bucket is
+	// empty, it returns how long to wait until the next token is available.
+	Take(key string, limit RateLimit, now time.Time) (retryAfter time.Duration, err error)
+}
+
+type RateLimiter struct {
+	limits RateLimits
+	store  RateLimitStore
+	log    *Logger
+}
+
+func NewRateLimiter(limits RateLimits, store RateLimitStore, log *Logger) *RateLimiter {
+	if log == nil {
+		log = defaultLogger
+	}
+	return &RateLimiter{limits: limits, store: store, log: log}
+}
+
+// Allow returns a rate-limited Remark if ctx's session, user or address used
+// up the limit of action. Actions without a limit are always allowed.
+func (rl *RateLimiter) Allow(action string, ctx Context) error {
+	if rl == nil || ctx.uid == "sys" {
+		return nil
+	}
+	limit, ok := rl.limits[action]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	keys := []struct{ kind, val string }{{"sid", ctx.sid}, {"uid", ctx.uid}, {"addr", ctx.Addr}}
+	if ctx.uid == "" && ctx.Addr == "" {
+		// sids of anonymous clients are of their own choosing
+		keys = append(keys, struct{ kind, val string }{"anon", "*"})
+	}
+	for _, key := range keys {
+		if key.val == "" {
+			continue
+		}
+		wait, err := rl.store.Take(action+":"+key.kind+":"+key.val, limit, now)
+		if err != nil {
+			// rather let somebody through than lock everybody out
+			rl.log.Warn("ratelimit: cannot take token", Fields{"action": action, "err": err})
+			continue
+		}
+		if wait > 0 {
+			stats.RateLimited.Inc(action, key.kind)
+			return Remark{Level: "error", Slug: "rate-limited", Data: map[string]string{
+				"action":      action,
+				"retry-after": strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+			}}
+		}
+	}
+	return nil
+}
+
+// refill returns the tokens in a bucket which had tokens left at last
+func refill(tokens float64, last, now time.Time, limit RateLimit) float64 {
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens += float64(elapsed) / float64(limit.Every)
+	}
+	return math.Min(tokens, float64(limit.Burst))
+}
+
+// take removes a token from a bucket holding tokens, see RateLimitStore.Take
+func take(tokens float64, limit RateLimit) (float64, time.Duration) {
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) * float64(limit.Every))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemRateLimitStore keeps the buckets in memory. It is only suitable for
+// setups running a single process.
+type MemRateLimitStore struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+// sweep idle buckets every sweepInterval takes
+const sweepInterval = 1024
+
+func NewMemRateLimitStore() *MemRateLimitStore {
+	return &MemRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+func (mem *MemRateLimitStore) Take(key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	mem.Lock()
+	defer mem.Unlock()
+	mem.takes++
+	if mem.takes%sweepInterval == 0 {
+		mem.sweep(now)
+	}
+	b, ok := mem.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		mem.buckets[key] = b
+	}
+	var wait time.Duration
+	b.tokens, wait = take(refill(b.tokens, b.last, now, limit), limit)
+	b.last = now
+	return wait, nil
+}
+
+// sweep drops buckets which have not been used for an hour. They'd be
+// refilled completely by now for all sane limits.
+func (mem *MemRateLimitStore) sweep(now time.Time) {
+	for key, b := range mem.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(mem.buckets, key)
+		}
+	}
+}
+
+// SQLRateLimitStore keeps the buckets in the rate_limits table, so that
+// limits are shared by all processes.
+type SQLRateLimitStore struct {
+	db *sql.DB
+}
+
+func NewSQLRateLimitStore(db *sql.DB) SQLRateLimitStore {
+	return SQLRateLimitStore{db}
+}
+
+func (store SQLRateLimitStore) Take(key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	// optimistic locking: retry if another process changed the bucket in
+	// the meantime
+	for attempt := 0; attempt < 3; attempt++ {
+		var tokens float64
+		var last time.Time
+		err := store.db.QueryRow("SELECT tokens, updated_at FROM rate_limits WHERE key = $1", key).Scan(&tokens, &last)
+		if err == sql.ErrNoRows {
+			tokens, wait := take(float64(limit.Burst), limit)
+			res, err := store.db.Exec("INSERT INTO rate_limits (key, tokens, updated_at) SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM rate_limits WHERE key = $1)", key, tokens, now)
+			if err != nil {
+				return 0, err
+			}
+			if inserted, _ := res.RowsAffected(); inserted > 0 {
+				return wait, nil
+			}
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		newTokens, wait := take(refill(tokens, last, now, limit), limit)
+		res, err := store.db.Exec("UPDATE rate_limits SET tokens = $1, updated_at = $2 WHERE key = $3 AND updated_at = $4", newTokens, now, key, last)
+		if err != nil {
+			return 0, err
+		}
+		if updated, _ := res.RowsAffected(); updated > 0 {
+			return wait, nil
+		}
+	}
+	return 0, fmt.Errorf("ratelimit: bucket `%s` too contended", key)
+}
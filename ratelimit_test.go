@@ -0,0 +1,76 @@
+package diffsync
+
+import (
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRateLimitStore(t *testing.T, store RateLimitStore) {
+	limit := RateLimit{Burst: 2, Every: time.Minute}
+	start := time.Now()
+	take := func(offset time.Duration) time.Duration {
+		wait, err := store.Take("key", limit, start.Add(offset))
+		assert.NoError(t, err)
+		return wait
+	}
+	assert.Equal(t, time.Duration(0), take(0))
+	assert.Equal(t, time.Duration(0), take(0))
+	assert.Equal(t, time.Minute, take(0), "burst exceeded")
+	assert.Equal(t, 30*time.Second, take(30*time.Second))
+	assert.Equal(t, time.Duration(0), take(time.Minute), "bucket not refilled")
+	assert.Equal(t, time.Minute, take(time.Minute))
+	// refills never exceed the burst
+	assert.Equal(t, time.Duration(0), take(time.Hour))
+	assert.Equal(t, time.Duration(0), take(time.Hour))
+	assert.NotEqual(t, time.Duration(0), take(time.Hour))
+	wait, _ := store.Take("other", limit, start)
+	assert.Equal(t, time.Duration(0), wait, "buckets not separated by key")
+}
+
+func TestMemRateLimitStore(t *testing.T) {
+	testRateLimitStore(t, NewMemRateLimitStore())
+}
+
+func TestSQLRateLimitStore(t *testing.T) {
+	db := testDB(t, CREATE_RATELIMITS)
+	defer db.Close()
+	testRateLimitStore(t, NewSQLRateLimitStore(db))
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{"invite-user": {Burst: 1, Every: time.Hour}}, NewMemRateLimitStore(), nil)
+	store := NewStore(nil)
+	store.limiter = limiter
+	store.Mount("note", &countingBackend{MemBackend: NewMemBackend(func() ResourceValue { return NewNote("") })})
+	ctx := Context{sid: "sid1", uid: "uid1", Addr: "10.0.0.1"}
+	invite := Patch{Op: "invite-user", Value: User{Email: "a@example.com"}}
+
+	assert.NoError(t, store.Patch(Resource{Kind: "note", ID: "n1"}, invite, NewSyncResult(), ctx))
+	err := store.Patch(Resource{Kind: "note", ID: "n1"}, invite, NewSyncResult(), ctx)
+	assert.Equal(t, Remark{Level: "error", Slug: "rate-limited", Data: map[string]string{"action": "invite-user", "retry-after": "3600"}}, err)
+
+	// a new session of the same user from the same address is still limited
+	ctx.sid = "sid2"
+	assert.Error(t, limiter.Allow("invite-user", ctx))
+	// ...and so are other users behind the same address
+	assert.Error(t, limiter.Allow("invite-user", Context{sid: "sid3", uid: "uid3", Addr: "10.0.0.1"}))
+	assert.NoError(t, limiter.Allow("invite-user", Context{sid: "sid4", uid: "uid4", Addr: "10.0.0.4"}))
+
+	assert.NoError(t, limiter.Allow("set-title", ctx), "actions without limit must be allowed")
+	// ops are only limited as the action of their resource kind
+	store.Mount("folio", &countingBackend{MemBackend: NewMemBackend(func() ResourceValue { return NewFolio() })})
+	assert.NoError(t, store.Patch(Resource{Kind: "folio", ID: "uid1"}, Patch{Op: "invite-user"}, NewSyncResult(), ctx))
+
+	// anonymous calls without an address can't dodge the limit with new sids
+	anon := NewRateLimiter(RateLimits{"session-create": {Burst: 1, Every: time.Hour}}, NewMemRateLimitStore(), nil)
+	assert.NoError(t, anon.Allow("session-create", Context{sid: "sid5"}))
+	assert.Error(t, anon.Allow("session-create", Context{sid: "sid6"}))
+	assert.Error(t, anon.Allow("session-create", Context{}))
+	assert.NoError(t, anon.Allow("session-create", Context{sid: "sid7", Addr: "10.0.0.7"}))
+	assert.NoError(t, limiter.Allow("invite-user", Context{uid: "sys"}), "system must never be limited")
+	var nilLimiter *RateLimiter
+	assert.NoError(t, nilLimiter.Allow("invite-user", ctx))
+}
@@ -16,6 +16,13 @@ type ResourceValue interface {
 	fmt.Stringer
 }
 
+// restrictedValue is implemented by values of which users only get to see
+// the parts their role on the resource allows
+type restrictedValue interface {
+	// viewOf returns the value as seen by uid
+	viewOf(uid string) ResourceValue
+}
+
 // todo(refactore) export fields
 type Resource struct {
 	Kind  string        `json:"kind"`
@@ -5,15 +5,10 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/hiroapp-com/hync/comm"
 )
 
-var (
-	_ = log.Print
-)
-
 type ResourceBackend interface {
 	Get(string) (ResourceValue, error)
 	Patch(string, Patch, *SyncResult, Context) error
@@ -23,6 +18,10 @@ type ResourceBackend interface {
 type Store struct {
 	backends    map[string]ResourceBackend
 	commHandler comm.Handler
+	log         *Logger
+	quotas      QuotaPolicy
+	limiter     *RateLimiter
+	search      SearchIndex
 }
 
 type Patch struct {
@@ -42,13 +41,18 @@ type InvalidValueError struct {
 }
 
 func NewStore(comm comm.Handler) *Store {
-	return &Store{backends: map[string]ResourceBackend{}, commHandler: comm}
+	return &Store{backends: map[string]ResourceBackend{}, commHandler: comm, log: defaultLogger}
 }
 
 func (store *Store) Mount(kind string, backend ResourceBackend) {
 	store.backends[kind] = backend
 }
 
+func (store *Store) hasBackend(kind string) bool {
+	_, ok := store.backends[kind]
+	return ok
+}
+
 func (store *Store) NewResource(kind string, ctx Context) (Resource, error) {
 	res := Resource{Kind: kind}
 	// create new Nil Resource in backend
@@ -65,7 +69,7 @@ func (store *Store) NewResource(kind string, ctx Context) (Resource, error) {
 }
 
 func (store *Store) Load(res *Resource) error {
-	log.Printf("resource[%s]: loading data", res.StringRef())
+	store.log.Sample("store-load", 100).Debug("loading resource", Fields{"res": res.StringRef()})
 	// todo: send get request via gdata connection
 	value, err := store.backends[res.Kind].Get(res.ID)
 	if err != nil {
@@ -76,7 +80,24 @@ func (store *Store) Load(res *Resource) error {
 }
 
 func (store *Store) Patch(res Resource, patch Patch, result *SyncResult, ctx Context) error {
-	return store.backends[res.Kind].Patch(res.ID, patch, result, ctx)
+	kind := kindLabel(res.Kind)
+	op, known := opLabel(res.Kind, patch.Op)
+	if err := store.limiter.Allow(patchActions[res.Kind][patch.Op], ctx); err != nil {
+		stats.PatchOps.Inc(kind, op, "rate-limited")
+		return err
+	}
+	err := store.backends[res.Kind].Patch(res.ID, patch, result, ctx)
+	switch {
+	case err != nil:
+		stats.PatchOps.Inc(kind, op, "error")
+		return err
+	case !known:
+		// backends skip ops they don't know
+		stats.PatchOps.Inc(kind, op, "ignored")
+	default:
+		stats.PatchOps.Inc(kind, op, "ok")
+	}
+	return nil
 }
 
 func (err InvalidValueError) Error() string {
@@ -0,0 +1,297 @@
+package diffsync
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	DMP "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Note formats, see Note.Format
+const (
+	NoteFormatPlain = ""
+	NoteFormatRich  = "rich"
+)
+
+// markTypes are the kinds of formatting a Mark can apply. Block types
+// (heading, list-item, quote) are expected to span whole lines.
+var markTypes = map[string]bool{
+	"bold": true, "italic": true, "underline": true, "strike": true, "code": true,
+	"link": true, "heading": true, "list-item": true, "quote": true,
+}
+
+// Mark formats the range [Start, End) of a note's text. Offsets count runes,
+// like the text deltas do. Marks are identified by their ID, which clients
+// generate, so concurrent changes to different marks never conflict.
+type Mark struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	// Value holds the mark's attribute, e.g. the url of a link or the
+	// level of a heading
+	Value string `json:"value,omitempty"`
+}
+
+func (mark Mark) valid() bool {
+	return mark.ID != "" && len(mark.ID) <= 32 && markTypes[mark.Type] && mark.Start >= 0 && mark.Start < mark.End
+}
+
+type MarkList []Mark
+
+func (marks MarkList) indexOf(id string) (int, bool) {
+	for i := range marks {
+		if marks[i].ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (marks MarkList) Len() int      { return len(marks) }
+func (marks MarkList) Swap(i, j int) { marks[i], marks[j] = marks[j], marks[i] }
+func (marks MarkList) Less(i, j int) bool {
+	if marks[i].Start != marks[j].Start {
+		return marks[i].Start < marks[j].Start
+	}
+	if marks[i].End != marks[j].End {
+		return marks[i].End < marks[j].End
+	}
+	return marks[i].ID < marks[j].ID
+}
+
+// RichText is a text along with the marks formatting it
+type RichText struct {
+	Text  TextValue `json:"text"`
+	Marks MarkList  `json:"marks"`
+}
+
+// RichTextDelta changes the text of a RichText and its marks. Marks are
+// first moved along with the text changes, then MarkChanges are applied.
+type RichTextDelta struct {
+	Text  TextDelta    `json:"text,omitempty"`
+	Marks []MarkChange `json:"marks,omitempty"`
+}
+
+// MarkChange adds, sets or removes (Op add, set, rem) a mark. Removals only
+// need the mark's ID.
+type MarkChange struct {
+	Op   string `json:"op"`
+	Mark Mark   `json:"mark"`
+}
+
+func (rt RichText) Empty() ResourceValue {
+	return RichText{Text: TextValue(""), Marks: MarkList{}}
+}
+
+func (rt RichText) Clone() ResourceValue {
+	rt.Marks = append(MarkList{}, rt.Marks...)
+	return rt
+}
+
+func (rt RichText) String() string {
+	return fmt.Sprintf("<richtext text: %s, marks: %d>", peek(string(rt.Text), 100), len(rt.Marks))
+}
+
+func (rt RichText) GetDelta(latest ResourceValue) Delta {
+	master := latest.(RichText)
+	diffs := dmp.DiffMain(string(rt.Text), string(master.Text), false)
+	diffs = dmp.DiffCleanupEfficiency(diffs)
+	delta := RichTextDelta{Text: TextDelta(dmp.DiffToDelta(diffs)), Marks: []MarkChange{}}
+	if !delta.Text.HasChanges() {
+		delta.Text = ""
+	}
+	// marks as they'll be after the text changes
+	shifted := shiftMarks(rt.Marks, diffs)
+	for _, mark := range shifted {
+		if _, ok := master.Marks.indexOf(mark.ID); !ok {
+			delta.Marks = append(delta.Marks, MarkChange{Op: "rem", Mark: Mark{ID: mark.ID}})
+		}
+	}
+	for _, mark := range master.Marks {
+		i, ok := shifted.indexOf(mark.ID)
+		switch {
+		case !ok:
+			delta.Marks = append(delta.Marks, MarkChange{Op: "add", Mark: mark})
+		case shifted[i] != mark:
+			delta.Marks = append(delta.Marks, MarkChange{Op: "set", Mark: mark})
+		}
+	}
+	return delta
+}
+
+func (delta RichTextDelta) HasChanges() bool {
+	return delta.Text.HasChanges() || len(delta.Marks) > 0
+}
+
+func (delta RichTextDelta) Apply(to ResourceValue) (ResourceValue, []Patch, error) {
+	original, ok := to.(RichText)
+	if !ok {
+		return nil, nil, errors.New("cannot apply RichTextDelta to non RichText")
+	}
+	res := original.Clone().(RichText)
+	patches := []Patch{}
+	if delta.Text != "" {
+		diffs, err := dmp.DiffFromDelta(string(original.Text), string(delta.Text))
+		if err != nil {
+			return nil, nil, err
+		}
+		res.Text = TextValue(dmp.DiffText2(diffs))
+		res.Marks = shiftMarks(res.Marks, diffs)
+		if delta.Text.HasChanges() {
+			patches = append(patches, Patch{Op: "text", Value: dmp.PatchMake(string(original.Text), diffs)})
+		}
+	}
+	length := utf8.RuneCountInString(string(res.Text))
+	for _, change := range delta.Marks {
+		mark := change.Mark
+		i, exists := res.Marks.indexOf(mark.ID)
+		switch change.Op {
+		case "add", "set":
+			if mark.End > length {
+				mark.End = length
+			}
+			if !mark.valid() {
+				continue
+			}
+			if exists {
+				if res.Marks[i] == mark {
+					continue
+				}
+				res.Marks[i] = mark
+				patches = append(patches, Patch{Op: "set-mark", Path: mark.ID, Value: mark})
+			} else {
+				res.Marks = append(res.Marks, mark)
+				patches = append(patches, Patch{Op: "add-mark", Path: mark.ID, Value: mark})
+			}
+		case "rem":
+			if !exists {
+				continue
+			}
+			res.Marks = append(res.Marks[:i], res.Marks[i+1:]...)
+			patches = append(patches, Patch{Op: "rem-mark", Path: mark.ID})
+		}
+	}
+	sort.Sort(res.Marks)
+	return res, patches, nil
+}
+
+// shiftMarks moves marks along with the text changes of diffs. Text inserted
+// right at the edges of a mark stays unformatted, marks whose text has been
+// deleted entirely are dropped.
+func shiftMarks(marks MarkList, diffs []DMP.Diff) MarkList {
+	shifted := MarkList{}
+	for _, mark := range marks {
+		mark.Start = shiftOffset(diffs, mark.Start, true)
+		mark.End = shiftOffset(diffs, mark.End, false)
+		if mark.Start < mark.End {
+			shifted = append(shifted, mark)
+		}
+	}
+	sort.Sort(shifted)
+	return shifted
+}
+
+// shiftOffset maps a rune offset of the text before diffs to the text after
+// them. Text inserted at the offset ends up before it if after is set.
+func shiftOffset(diffs []DMP.Diff, offset int, after bool) int {
+	old, cur := 0, 0
+	for _, diff := range diffs {
+		n := utf8.RuneCountInString(diff.Text)
+		switch diff.Type {
+		case DMP.DiffEqual:
+			if offset < old+n || (offset == old+n && !after) {
+				return cur + offset - old
+			}
+			old, cur = old+n, cur+n
+		case DMP.DiffDelete:
+			if offset < old+n {
+				return cur
+			}
+			old += n
+		case DMP.DiffInsert:
+			if offset == old && !after {
+				return cur
+			}
+			cur += n
+		}
+	}
+	return cur + offset - old
+}
+
+func (backend NoteSQLBackend) getMarks(nid string) (MarkList, error) {
+	rows, err := backend.db.Query("SELECT id, type, start_pos, end_pos, value FROM note_marks WHERE nid = $1", nid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	marks := MarkList{}
+	for rows.Next() {
+		mark := Mark{}
+		if err = rows.Scan(&mark.ID, &mark.Type, &mark.Start, &mark.End, &mark.Value); err != nil {
+			return nil, err
+		}
+		marks = append(marks, mark)
+	}
+	sort.Sort(marks)
+	return marks, rows.Err()
+}
+
+// patchMark persists an add-mark, set-mark or rem-mark patch
+func (backend NoteSQLBackend) patchMark(nid string, patch Patch) error {
+	var err error
+	switch patch.Op {
+	case "add-mark":
+		mark := patch.Value.(Mark)
+		_, err = backend.db.Exec("INSERT INTO note_marks (nid, id, type, start_pos, end_pos, value) SELECT $1, $2, $3, $4, $5, $6 WHERE NOT EXISTS (SELECT 1 FROM note_marks WHERE nid = $1 AND id = $2)",
+			nid, mark.ID, mark.Type, mark.Start, mark.End, mark.Value)
+	case "set-mark":
+		mark := patch.Value.(Mark)
+		_, err = backend.db.Exec("UPDATE note_marks SET type = $1, start_pos = $2, end_pos = $3, value = $4 WHERE nid = $5 AND id = $6",
+			mark.Type, mark.Start, mark.End, mark.Value, nid, mark.ID)
+	case "rem-mark":
+		_, err = backend.db.Exec("DELETE FROM note_marks WHERE nid = $1 AND id = $2", nid, patch.Path)
+	}
+	return err
+}
+
+// shiftStoredMarks moves the marks of nid along with a change of its text
+// from original to patched. It runs within the transaction patching the
+// text, so marks always match the stored text.
+func shiftStoredMarks(txn *sql.Tx, nid, original, patched string) error {
+	rows, err := txn.Query("SELECT id, type, start_pos, end_pos, value FROM note_marks WHERE nid = $1", nid)
+	if err != nil {
+		return err
+	}
+	marks := MarkList{}
+	for rows.Next() {
+		mark := Mark{}
+		if err = rows.Scan(&mark.ID, &mark.Type, &mark.Start, &mark.End, &mark.Value); err != nil {
+			rows.Close()
+			return err
+		}
+		marks = append(marks, mark)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(marks) == 0 {
+		return err
+	}
+	diffs := dmp.DiffMain(original, patched, false)
+	shifted := shiftMarks(marks, diffs)
+	for _, mark := range marks {
+		i, ok := shifted.indexOf(mark.ID)
+		switch {
+		case !ok:
+			_, err = txn.Exec("DELETE FROM note_marks WHERE nid = $1 AND id = $2", nid, mark.ID)
+		case shifted[i] != mark:
+			_, err = txn.Exec("UPDATE note_marks SET start_pos = $1, end_pos = $2 WHERE nid = $3 AND id = $4", shifted[i].Start, shifted[i].End, nid, mark.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
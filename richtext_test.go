@@ -0,0 +1,134 @@
+package diffsync
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShiftMarks(t *testing.T) {
+	// "some bold ital text"
+	marks := MarkList{
+		{ID: "m1", Type: "bold", Start: 5, End: 9},
+		{ID: "m2", Type: "italic", Start: 10, End: 14},
+	}
+	shift := func(to string) MarkList {
+		return shiftMarks(marks, dmp.DiffMain("some bold ital text", to, false))
+	}
+	assert.Equal(t, MarkList{{ID: "m1", Type: "bold", Start: 6, End: 10}, {ID: "m2", Type: "italic", Start: 11, End: 15}},
+		shift("xsome bold ital text"), "insert before")
+	assert.Equal(t, MarkList{{ID: "m1", Type: "bold", Start: 5, End: 11}, {ID: "m2", Type: "italic", Start: 12, End: 16}},
+		shift("some boxxld ital text"), "insert within")
+	assert.Equal(t, MarkList{{ID: "m1", Type: "bold", Start: 6, End: 10}, {ID: "m2", Type: "italic", Start: 11, End: 15}},
+		shift("some  bold ital text"), "insert at start is not formatted")
+	assert.Equal(t, MarkList{{ID: "m1", Type: "bold", Start: 5, End: 9}, {ID: "m2", Type: "italic", Start: 11, End: 15}},
+		shift("some bold  ital text"), "insert at end is not formatted")
+	assert.Equal(t, MarkList{{ID: "m2", Type: "italic", Start: 5, End: 9}},
+		shift("some ital text"), "deleted mark not dropped")
+	assert.Equal(t, MarkList{{ID: "m1", Type: "bold", Start: 5, End: 7}, {ID: "m2", Type: "italic", Start: 7, End: 11}},
+		shift("some boital text"), "partial delete")
+	assert.Equal(t, marks, shift("søme bold ital text"), "offsets must count runes")
+}
+
+func TestRichTextDelta(t *testing.T) {
+	shadow := RichText{Text: "hello world", Marks: MarkList{{ID: "m1", Type: "bold", Start: 6, End: 11}}}
+
+	// text changes move the marks along
+	edited, _, err := RichTextDelta{Text: TextDelta(dmp.DiffToDelta(dmp.DiffMain("hello world", "oh, hello world", false)))}.Apply(shadow)
+	if assert.NoError(t, err) {
+		assert.Equal(t, MarkList{{ID: "m1", Type: "bold", Start: 10, End: 15}}, edited.(RichText).Marks)
+	}
+
+	// formatting and editing at once
+	latest := RichText{Text: "oh, hello world", Marks: MarkList{
+		{ID: "m2", Type: "italic", Start: 4, End: 9},
+		{ID: "m1", Type: "bold", Start: 10, End: 14},
+	}}
+	delta := shadow.GetDelta(latest).(RichTextDelta)
+	assert.Equal(t, []MarkChange{
+		{Op: "add", Mark: Mark{ID: "m2", Type: "italic", Start: 4, End: 9}},
+		{Op: "set", Mark: Mark{ID: "m1", Type: "bold", Start: 10, End: 14}},
+	}, delta.Marks, "only changes beyond the shift are sent")
+	res, patches, err := delta.Apply(shadow)
+	if assert.NoError(t, err) {
+		assert.Equal(t, latest, res)
+		if assert.Len(t, patches, 3) {
+			assert.Equal(t, "text", patches[0].Op)
+		}
+	}
+	assert.False(t, latest.GetDelta(latest).HasChanges())
+}
+
+func TestRichTextPatches(t *testing.T) {
+	base := RichText{Text: "hello", Marks: MarkList{{ID: "m1", Type: "bold", Start: 0, End: 5}}}
+	_, patches, _ := RichTextDelta{Marks: []MarkChange{
+		{Op: "set", Mark: Mark{ID: "m1", Type: "bold", Start: 0, End: 99}},
+		{Op: "add", Mark: Mark{ID: "m2", Type: "blink", Start: 0, End: 5}},
+		{Op: "add", Mark: Mark{ID: "m3", Type: "link", Start: 1, End: 3, Value: "https://example.com"}},
+		{Op: "rem", Mark: Mark{ID: "m1"}},
+		{Op: "rem", Mark: Mark{ID: "m4"}},
+	}}.Apply(base)
+	assert.Equal(t, []Patch{
+		{Op: "add-mark", Path: "m3", Value: Mark{ID: "m3", Type: "link", Start: 1, End: 3, Value: "https://example.com"}},
+		{Op: "rem-mark", Path: "m1"},
+	}, patches, "invalid or no-op changes must not be persisted")
+}
+
+func TestNoteRichDelta(t *testing.T) {
+	old := NewNote("hello")
+	master := NewNote("hello")
+	master.Format = NoteFormatRich
+	master.Marks = MarkList{{ID: "m1", Type: "bold", Start: 0, End: 5}}
+	delta := old.GetDelta(master).(NoteDelta)
+
+	raw, _ := json.Marshal(delta)
+	decoded := NoteDelta{}
+	if !assert.NoError(t, json.Unmarshal(raw, &decoded)) {
+		return
+	}
+	res, patches, err := decoded.Apply(old)
+	if assert.NoError(t, err) {
+		assert.Equal(t, master, res)
+		assert.Equal(t, []Patch{
+			{Op: "format", Value: NoteFormatRich, OldValue: NoteFormatPlain},
+			{Op: "add-mark", Path: "m1", Value: Mark{ID: "m1", Type: "bold", Start: 0, End: 5}},
+		}, patches)
+	}
+}
+
+func TestNoteSQLBackendMarks(t *testing.T) {
+	db := accountDB(t)
+	defer db.Close()
+	backend := NewNoteSQLBackend(db)
+	ctx := Context{uid: "uid00001"}
+	for _, patch := range []Patch{
+		{Op: "format", Value: NoteFormatRich, OldValue: NoteFormatPlain},
+		{Op: "add-mark", Path: "m1", Value: Mark{ID: "m1", Type: "bold", Start: 0, End: 6}},
+		{Op: "add-mark", Path: "m2", Value: Mark{ID: "m2", Type: "italic", Start: 7, End: 11}},
+		{Op: "add-mark", Path: "m2", Value: Mark{ID: "m2", Type: "italic", Start: 0, End: 1}},
+		{Op: "set-mark", Path: "m1", Value: Mark{ID: "m1", Type: "link", Start: 0, End: 6, Value: "https://example.com"}},
+	} {
+		assert.NoError(t, backend.Patch("nid00001", patch, NewSyncResult(), ctx))
+	}
+	value, err := backend.Get("nid00001")
+	if assert.NoError(t, err) {
+		note := value.(Note)
+		assert.Equal(t, NoteFormatRich, note.Format)
+		assert.Equal(t, MarkList{
+			{ID: "m1", Type: "link", Start: 0, End: 6, Value: "https://example.com"},
+			{ID: "m2", Type: "italic", Start: 7, End: 11},
+		}, note.Marks)
+	}
+
+	assert.NoError(t, backend.Patch("nid00001", Patch{Op: "rem-mark", Path: "m1"}, NewSyncResult(), ctx))
+	txn, _ := db.Begin()
+	assert.NoError(t, shiftStoredMarks(txn, "nid00001", "shared text", "shared plain text"))
+	txn.Commit()
+	value, _ = backend.Get("nid00001")
+	assert.Equal(t, MarkList{{ID: "m2", Type: "italic", Start: 13, End: 17}}, value.(Note).Marks)
+
+	// viewers can't format
+	err = backend.Patch("nid00001", Patch{Op: "rem-mark", Path: "m2"}, NewSyncResult(), Context{uid: "uid00003"})
+	assert.Equal(t, "permission-denied", err.(Remark).Slug)
+}
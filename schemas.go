@@ -1,14 +1,26 @@
 package diffsync
 
 const (
-	DROP_USERS        = "DROP TABLE IF EXISTS 'users'"
-	DROP_NOTES        = "DROP TABLE IF EXISTS 'notes'"
-	DROP_NOTEREFS     = "DROP TABLE IF EXISTS 'noterefs'"
-	DROP_CONTACTS     = "DROP TABLE IF EXISTS 'contacts'"
-	DROP_SESSIONS     = "DROP TABLE IF EXISTS 'sessions'"
-	DROP_TOKENS       = "DROP TABLE IF EXISTS 'tokens'"
-	DROP_STRIPETOKENS = "DROP TABLE IF EXISTS 'strip_tokens'"
-	CREATE_USERS      = `
+	DROP_USERS             = "DROP TABLE IF EXISTS 'users'"
+	DROP_NOTES             = "DROP TABLE IF EXISTS 'notes'"
+	DROP_NOTEREFS          = "DROP TABLE IF EXISTS 'noterefs'"
+	DROP_CONTACTS          = "DROP TABLE IF EXISTS 'contacts'"
+	DROP_SESSIONS          = "DROP TABLE IF EXISTS 'sessions'"
+	DROP_TOKENS            = "DROP TABLE IF EXISTS 'tokens'"
+	DROP_STRIPETOKENS      = "DROP TABLE IF EXISTS 'stripe_tokens'"
+	DROP_IDENTITIES        = "DROP TABLE IF EXISTS 'identities'"
+	DROP_TOKENCONSUMPTIONS = "DROP TABLE IF EXISTS 'token_consumptions'"
+	DROP_SHARELINKS        = "DROP TABLE IF EXISTS 'share_links'"
+	DROP_RATELIMITS        = "DROP TABLE IF EXISTS 'rate_limits'"
+	DROP_NOTECHANGELOG     = "DROP TABLE IF EXISTS 'note_changelog'"
+	DROP_FOLDERS           = "DROP TABLE IF EXISTS 'folders'"
+	DROP_NOTEREFTAGS       = "DROP TABLE IF EXISTS 'noteref_tags'"
+	DROP_NOTESEARCH        = "DROP TABLE IF EXISTS 'note_search'"
+	DROP_IMPORTS           = "DROP TABLE IF EXISTS 'imports'"
+	DROP_NOTEMARKS         = "DROP TABLE IF EXISTS 'note_marks'"
+	DROP_CHECKLISTITEMS    = "DROP TABLE IF EXISTS 'checklist_items'"
+	DROP_NOTECOMMENTS      = "DROP TABLE IF EXISTS 'note_comments'"
+	CREATE_USERS           = `
 		CREATE TABLE "users" (
 			uid text PRIMARY KEY,
 			name text default "",
@@ -22,6 +34,9 @@ const (
 			tmp_uid text default "",
 			created_for_sid text default "",
 			password text default NULL,
+			failed_logins integer default 0,
+			locked_until timestamp default NULL,
+			billing_event_at timestamp default NULL,
 			signup_at timestamp default NULL,
 			created_at timestamp default (datetime('now'))
 		);`
@@ -32,7 +47,9 @@ const (
 			txt text default "",
 			sharing_token text default "",
 			created_at timestamp default (datetime('now')),
-			created_by text default ""
+			created_by text default "",
+			format text default "",
+			kind text default ""
 		);`
 	CREATE_CONTACTS = `
 		CREATE TABLE "contacts" (
@@ -55,6 +72,11 @@ const (
 			last_seen timestamp default NULL,
 			last_edit timestamp default NULL,
 			invite_sent timestamp default NULL,
+			created_at timestamp default (datetime('now')),
+			folder text default "",
+			sort_key text default "",
+			pinned boolean default 0,
+			trashed_at timestamp default NULL,
 			CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE,
 			CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE,
 			CONSTRAINT uq_niduid UNIQUE (nid, uid) ON CONFLICT IGNORE
@@ -68,7 +90,14 @@ const (
 			email text default "",
 			phone text default "",
 			valid_from timestamp default (datetime('now')),
-			consumed_at timestamp default NULL
+			times_consumed integer default 0,
+			last_consumed_at timestamp default NULL,
+			created_by text default "",
+			revoked_at timestamp default NULL,
+			expires_at timestamp default NULL,
+			max_consumptions integer default NULL,
+			role text default "",
+			password text default NULL
 		);`
 	CREATE_SESSIONS = `
 		CREATE TABLE "sessions" (
@@ -76,14 +105,120 @@ const (
 			uid text not null,
 			data text default "",
 			token_used text default "",
+			status text default "active",
 			created_at timestamp default (datetime('now')),
 			saved_at timestamp default NULL,
 			CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE
 		);`
 	CREATE_STRIPETOKENS = `	
 		CREATE TABLE "stripe_tokens" (
-			token text default "",
+			token text default "" UNIQUE,
 			uid text default "",
 			seen_at timestamp
 		);`
+	CREATE_IDENTITIES = `
+		CREATE TABLE "identities" (
+			provider text not null,
+			subject text not null,
+			uid text not null,
+			email text default "",
+			created_at timestamp default (datetime('now')),
+			PRIMARY KEY (provider, subject),
+			CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE
+		);`
+	CREATE_TOKENCONSUMPTIONS = `
+		CREATE TABLE "token_consumptions" (
+			token text not null,
+			uid text default "",
+			sid text default "",
+			consumed_at timestamp default (datetime('now')),
+			CONSTRAINT fk_token FOREIGN KEY (token) REFERENCES "tokens" (token) ON DELETE CASCADE
+		);`
+	CREATE_SHARELINKS = `
+		CREATE TABLE "share_links" (
+			id text not null,
+			nid text not null,
+			token_hash text not null,
+			created_by text default "",
+			created_at timestamp default (datetime('now')),
+			PRIMARY KEY (nid, id),
+			CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE,
+			CONSTRAINT fk_token FOREIGN KEY (token_hash) REFERENCES "tokens" (token) ON DELETE CASCADE
+		);`
+	CREATE_RATELIMITS = `
+		CREATE TABLE "rate_limits" (
+			key text PRIMARY KEY,
+			tokens real not null,
+			updated_at timestamp not null
+		);`
+	CREATE_NOTECHANGELOG = `
+		CREATE TABLE "note_changelog" (
+			nid text not null,
+			uid text default "",
+			op text,
+			delta text,
+			txt_snapshot text default "",
+			ts timestamp default (datetime('now'))
+		);`
+	CREATE_FOLDERS = `
+		CREATE TABLE "folders" (
+			uid text not null,
+			path text not null,
+			sort_key text default "",
+			created_at timestamp default (datetime('now')),
+			PRIMARY KEY (uid, path),
+			CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE
+		);`
+	CREATE_NOTEREFTAGS = `
+		CREATE TABLE "noteref_tags" (
+			uid text not null,
+			nid text not null,
+			tag text not null,
+			created_at timestamp default (datetime('now')),
+			PRIMARY KEY (uid, nid, tag)
+		);`
+	CREATE_NOTESEARCH = `
+		CREATE VIRTUAL TABLE "note_search" USING fts4(nid, title, txt, notindexed=nid);`
+	CREATE_IMPORTS = `
+		CREATE TABLE "imports" (
+			uid text not null,
+			source text not null,
+			nid text not null,
+			created_at timestamp default (datetime('now')),
+			PRIMARY KEY (uid, source)
+		);`
+	CREATE_NOTEMARKS = `
+		CREATE TABLE "note_marks" (
+			nid text not null,
+			id text not null,
+			type text not null,
+			start_pos integer not null,
+			end_pos integer not null,
+			value text default "",
+			PRIMARY KEY (nid, id)
+		);`
+	CREATE_CHECKLISTITEMS = `
+		CREATE TABLE "checklist_items" (
+			nid text not null,
+			id text not null,
+			txt text default "",
+			checked boolean default false,
+			assignee text default "",
+			due timestamp,
+			sort_key text default "",
+			PRIMARY KEY (nid, id)
+		);`
+	CREATE_NOTECOMMENTS = `
+		CREATE TABLE "note_comments" (
+			nid text not null,
+			id text not null,
+			thread text default "",
+			author text default "",
+			txt text default "",
+			start_pos integer default 0,
+			end_pos integer default 0,
+			resolved boolean default false,
+			created_at timestamp default (datetime('now')),
+			PRIMARY KEY (nid, id)
+		);`
 )
@@ -0,0 +1,295 @@
+package diffsync
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SQL dialects, see Config.Dialect
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite3"
+)
+
+// SearchResult is a note matching a search query
+type SearchResult struct {
+	NID   string `json:"nid"`
+	Title string `json:"title"`
+	// Snippet is an excerpt of the note's text around the first match
+	Snippet string `json:"snippet"`
+	// Highlights are the [start, end) byte offsets of all matches within
+	// Snippet
+	Highlights [][2]int `json:"highlights,omitempty"`
+	Rank       float64  `json:"rank"`
+}
+
+// SearchIndex provides full-text search over the notes in a user's folio
+type SearchIndex interface {
+	// Reindex updates the index entry of a note after its title, text or
+	// checklist items changed
+	Reindex(nid string) error
+	// Search returns the notes in uid's folio matching all words of query
+	// (as prefixes), best matches first
+	Search(uid, query string, limit int) ([]SearchResult, error)
+}
+
+const (
+	// snippetLength is the maximum length of SearchResult.Snippet in bytes
+	snippetLength  = 160
+	maxSearchLimit = 100
+	// searchEventLimit is the number of results sent in response to a
+	// search event
+	searchEventLimit = 20
+)
+
+// NewSearchIndex returns the index implementation for the given dialect
+func NewSearchIndex(db *sql.DB, dialect string) (SearchIndex, error) {
+	switch dialect {
+	case DialectPostgres, "":
+		return pgSearchIndex{db}, nil
+	case DialectSQLite:
+		return sqliteSearchIndex{db}, nil
+	}
+	return nil, fmt.Errorf("search: unsupported sql dialect `%s`", dialect)
+}
+
+// pgSearchIndex keeps a tsvector of each note in notes.search
+type pgSearchIndex struct {
+	db *sql.DB
+}
+
+func (idx pgSearchIndex) Reindex(nid string) error {
+	_, err := idx.db.Exec(`UPDATE notes SET search = setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', txt), 'B') ||
+								setweight(to_tsvector('simple', coalesce((SELECT string_agg(checklist_items.txt, ' ') FROM checklist_items WHERE checklist_items.nid = notes.nid), '')), 'B')
+							WHERE nid = $1`, nid)
+	return err
+}
+
+func (idx pgSearchIndex) Search(uid, query string, limit int) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	tsquery := make([]string, len(terms))
+	for i := range terms {
+		tsquery[i] = terms[i] + ":*"
+	}
+	rows, err := idx.db.Query(`SELECT notes.nid, notes.title,
+									concat_ws(E'\n', nullif(notes.txt, ''), (SELECT string_agg(checklist_items.txt, E'\n' ORDER BY checklist_items.sort_key) FROM checklist_items WHERE checklist_items.nid = notes.nid)),
+									ts_rank(notes.search, to_tsquery('simple', $1)) AS rank
+								FROM notes JOIN noterefs ON noterefs.nid = notes.nid
+								WHERE noterefs.uid = $2 AND noterefs.status <> 'trashed' AND notes.search @@ to_tsquery('simple', $1)
+								ORDER BY rank DESC, notes.nid LIMIT $3`, strings.Join(tsquery, " & "), uid, clampSearchLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []SearchResult{}
+	for rows.Next() {
+		var txt string
+		res := SearchResult{}
+		if err = rows.Scan(&res.NID, &res.Title, &txt, &res.Rank); err != nil {
+			return nil, err
+		}
+		res.Snippet, res.Highlights = snippet(txt, terms, snippetLength)
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// sqliteSearchIndex keeps the notes in the note_search FTS4 table. sqlite
+// has no built-in ranking, results are ranked by their number of matches.
+type sqliteSearchIndex struct {
+	db *sql.DB
+}
+
+func (idx sqliteSearchIndex) Reindex(nid string) error {
+	if _, err := idx.db.Exec("DELETE FROM note_search WHERE nid = $1", nid); err != nil {
+		return err
+	}
+	var title, txt string
+	switch err := idx.db.QueryRow("SELECT title, txt FROM notes WHERE nid = $1", nid).Scan(&title, &txt); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+	// the items of checklists are indexed as part of the text
+	items, err := queryStrings(idx.db, "SELECT txt FROM checklist_items WHERE nid = $1 ORDER BY sort_key", nid)
+	if err != nil {
+		return err
+	}
+	if txt == "" {
+		txt = strings.Join(items, "\n")
+	} else if len(items) > 0 {
+		txt += "\n" + strings.Join(items, "\n")
+	}
+	_, err = idx.db.Exec("INSERT INTO note_search (nid, title, txt) VALUES ($1, $2, $3)", nid, title, txt)
+	return err
+}
+
+func (idx sqliteSearchIndex) Search(uid, query string, limit int) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	match := make([]string, len(terms))
+	for i := range terms {
+		match[i] = terms[i] + "*"
+	}
+	rows, err := idx.db.Query(`SELECT note_search.nid, note_search.title, note_search.txt
+								FROM note_search JOIN noterefs ON noterefs.nid = note_search.nid
+								WHERE note_search MATCH $1 AND noterefs.uid = $2 AND noterefs.status <> 'trashed'`, strings.Join(match, " "), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []SearchResult{}
+	for rows.Next() {
+		var txt string
+		res := SearchResult{}
+		if err = rows.Scan(&res.NID, &res.Title, &txt); err != nil {
+			return nil, err
+		}
+		// title matches weigh more, like setweight(..., 'A') on postgres
+		res.Rank = float64(2*len(findTerms(res.Title, terms)) + len(findTerms(txt, terms)))
+		res.Snippet, res.Highlights = snippet(txt, terms, snippetLength)
+		results = append(results, res)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(byRank(results))
+	if limit = clampSearchLimit(limit); len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+type byRank []SearchResult
+
+func (r byRank) Len() int      { return len(r) }
+func (r byRank) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRank) Less(i, j int) bool {
+	if r[i].Rank == r[j].Rank {
+		return r[i].NID < r[j].NID
+	}
+	return r[i].Rank > r[j].Rank
+}
+
+func clampSearchLimit(limit int) int {
+	if limit <= 0 || limit > maxSearchLimit {
+		return maxSearchLimit
+	}
+	return limit
+}
+
+// searchTerms splits query into lowercase words. Everything else is dropped,
+// so the terms are safe to use in tsquery and FTS MATCH expressions.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// findTerms returns the [start, end) offsets of all words in text starting
+// with one of terms
+func findTerms(text string, terms []string) [][2]int {
+	matches := [][2]int{}
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// offsets would not match, lowercasing changed the encoding
+		lower = text
+	}
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	for start := 0; start < len(lower); {
+		r, size := utf8.DecodeRuneInString(lower[start:])
+		if !isWord(r) {
+			start += size
+			continue
+		}
+		end := start
+		for end < len(lower) {
+			r, size := utf8.DecodeRuneInString(lower[end:])
+			if !isWord(r) {
+				break
+			}
+			end += size
+		}
+		for _, term := range terms {
+			if strings.HasPrefix(lower[start:end], term) {
+				matches = append(matches, [2]int{start, start + len(term)})
+				break
+			}
+		}
+		start = end
+	}
+	return matches
+}
+
+// snippet returns an excerpt of text of about length bytes around the
+// first match of terms, along with the offsets of all matches within it. If
+// only the title matched, the excerpt is the start of the text.
+func snippet(text string, terms []string, length int) (string, [][2]int) {
+	matches := findTerms(text, terms)
+	if len(matches) == 0 {
+		return peek(text, length), nil
+	}
+	// start a little before the first match
+	start := matches[0][0] - length/4
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	excerpt := peek(text[start:], length)
+	kept := len(excerpt)
+	if excerpt != text[start:] {
+		// don't highlight into the ellipsis
+		kept = len(strings.TrimRight(strings.TrimSuffix(excerpt, "..."), " "))
+	}
+	prefix := ""
+	if start > 0 {
+		prefix = "..."
+	}
+	highlights := [][2]int{}
+	for _, m := range matches {
+		if m[0] >= start && m[1] <= start+kept {
+			highlights = append(highlights, [2]int{m[0] - start + len(prefix), m[1] - start + len(prefix)})
+		}
+	}
+	return prefix + excerpt, highlights
+}
+
+// reindex updates the search index after a note's title, text or checklist
+// items changed.
+// Failures only delay the note's appearance in search results.
+func (store *Store) reindex(nid string) {
+	if store == nil || store.search == nil {
+		return
+	}
+	if err := store.search.Reindex(nid); err != nil {
+		store.log.Warn("search: could not reindex note", Fields{"nid": nid, "err": err})
+	}
+}
+
+// Search returns the notes in uid's folio matching query
+func (srv *Server) Search(uid, query string, limit int) ([]SearchResult, error) {
+	return srv.Store.search.Search(uid, query, limit)
+}
+
+// handleSearch serves the search event of a session. The event is sent back
+// to the client with the results, or a Remark on failure.
+func (tok *TokenConsumer) handleSearch(event Event) error {
+	if event.ctx.store == nil || event.ctx.store.search == nil {
+		return tok.respond(event, fmt.Errorf("no search index configured"))
+	}
+	results, err := event.ctx.store.search.Search(event.ctx.uid, event.Query, searchEventLimit)
+	event.Results = results
+	return tok.respond(event, err)
+}
@@ -0,0 +1,77 @@
+package diffsync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnippet(t *testing.T) {
+	text, highlights := snippet("Buy milk, then more Milkshakes", []string{"milk"}, 160)
+	assert.Equal(t, "Buy milk, then more Milkshakes", text)
+	assert.Equal(t, [][2]int{{4, 8}, {20, 24}}, highlights)
+
+	long := "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation"
+	text, highlights = snippet(long, []string{"labore"}, 60)
+	if assert.Len(t, highlights, 1) {
+		assert.Equal(t, "labore", text[highlights[0][0]:highlights[0][1]])
+	}
+	assert.True(t, len(text) <= 63+3, "snippet too long: %q", text)
+
+	// title-only matches show the beginning of the text
+	text, highlights = snippet(long, []string{"groceries"}, 20)
+	assert.Equal(t, "Lorem ipsum dolor ...", text)
+	assert.Len(t, highlights, 0)
+}
+
+func TestSQLiteSearch(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_NOTESEARCH, CREATE_CHECKLISTITEMS)
+	defer db.Close()
+	db.Exec(`INSERT INTO notes (nid, title, txt) VALUES
+				('nid00001', 'Groceries', 'milk, eggs and bread'),
+				('nid00002', 'Milk', 'remember the milk'),
+				('nid00003', 'Trashed', 'milk gone bad'),
+				('nid00004', 'Other user', 'milk')`)
+	db.Exec(`INSERT INTO noterefs (nid, uid, role, status) VALUES
+				('nid00001', 'uid00001', 'owner', 'active'),
+				('nid00002', 'uid00001', 'owner', 'archived'),
+				('nid00003', 'uid00001', 'owner', 'trashed'),
+				('nid00004', 'uid00002', 'owner', 'active')`)
+	idx, err := NewSearchIndex(db, DialectSQLite)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, nid := range []string{"nid00001", "nid00002", "nid00003", "nid00004"} {
+		assert.NoError(t, idx.Reindex(nid))
+	}
+
+	results, err := idx.Search("uid00001", "MIL", 10)
+	if assert.NoError(t, err) && assert.Len(t, results, 2) {
+		// title matches rank higher
+		assert.Equal(t, "nid00002", results[0].NID)
+		assert.Equal(t, "nid00001", results[1].NID)
+		assert.Equal(t, [][2]int{{0, 3}}, results[1].Highlights)
+	}
+	results, _ = idx.Search("uid00001", "milk bread", 10)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "nid00001", results[0].NID)
+	}
+	results, _ = idx.Search("uid00001", `"* OR -`, 10)
+	assert.Len(t, results, 0)
+
+	// edits show up after reindexing
+	db.Exec("UPDATE notes SET txt = 'cheese' WHERE nid = 'nid00001'")
+	assert.NoError(t, idx.Reindex("nid00001"))
+	results, _ = idx.Search("uid00001", "bread", 10)
+	assert.Len(t, results, 0)
+	results, _ = idx.Search("uid00001", "cheese", 10)
+	assert.Len(t, results, 1)
+
+	// so do the items of checklists
+	db.Exec("INSERT INTO checklist_items (nid, id, txt, sort_key) VALUES ('nid00001', 'i1', 'oatmeal', 'V')")
+	assert.NoError(t, idx.Reindex("nid00001"))
+	results, _ = idx.Search("uid00001", "oat", 10)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "cheese\noatmeal", results[0].Snippet)
+	}
+}
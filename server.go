@@ -3,6 +3,8 @@ package diffsync
 import (
 	"database/sql"
 	"errors"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/hiroapp-com/hync/comm"
@@ -14,14 +16,132 @@ type Server struct {
 	sessionHub     *SessionHub
 	Store          *Store
 	tokenConsumer  *TokenConsumer
+	log            *Logger
+	cfg            Config
+	draining       int32
+	stop           chan struct{}
+	stopOnce       sync.Once
+}
+
+// Config holds the tunables of a Server. Use DefaultConfig() as a starting
+// point and only override what you need.
+type Config struct {
+	// Logger receives the structured log output of the server and all of
+	// its components
+	Logger *Logger
+
+	// HubInboxSize is the number of events the SessionHub buffers before
+	// senders have to wait for the hub's main loop
+	HubInboxSize int
+	// SessionQueueSize bounds the number of events queued for a single
+	// session runner
+	SessionQueueSize int
+	// OverflowPolicy decides what happens to events routed to a session
+	// whose queue is full
+	OverflowPolicy OverflowPolicy
+
+	// FlushDebounce holds back taint-driven flushes of a session until no
+	// further taint arrived for this long. Zero flushes after every taint.
+	FlushDebounce time.Duration
+	// FlushMaxDelay caps how long a flush can be held back by a steady
+	// stream of taints
+	FlushMaxDelay time.Duration
+
+	// ReconnectDelay and ReconnectURL make up the hint clients receive when
+	// the server drains or hands over their session. An empty ReconnectURL
+	// tells clients to reconnect to the endpoint they're already using.
+	ReconnectDelay time.Duration
+	ReconnectURL   string
+	// Forward receives all events addressed to sessions which have been
+	// handed over to another process. If nil, those events are dropped.
+	Forward EventHandler
+
+	// IdentityProviders are the external identity providers users can log
+	// in with, see IdentityProvider
+	IdentityProviders []IdentityProvider
+
+	// Quotas limit what users can do depending on their tier. nil
+	// disables all limits.
+	Quotas QuotaPolicy
+
+	// TokenPolicies define lifetime and usage limits of each token kind
+	TokenPolicies TokenPolicies
+
+	// RateLimits throttle token consumption and actions which create users
+	// or send out messages. nil disables rate limiting.
+	RateLimits RateLimits
+	// RateLimitStore keeps the state of the rate limits. Defaults to an
+	// in-memory store, use a SQLRateLimitStore when running several
+	// processes.
+	RateLimitStore RateLimitStore
+
+	// TrashRetention is how long noterefs stay in the trash before they are
+	// purged. Zero keeps them forever.
+	TrashRetention time.Duration
+
+	// LazyMountRecent is the number of most recently edited notes mounted
+	// at session-create for clients asking for lazy mounting. The client
+	// mounts all other notes of its folio on demand with res-add.
+	LazyMountRecent int
+
+	// Dialect is the SQL dialect of the database, DialectPostgres or
+	// DialectSQLite. It selects the implementation of the search index.
+	Dialect string
+}
+
+const defaultLazyMountRecent = 20
+
+func DefaultConfig() Config {
+	return Config{
+		Logger:           NewLogger(os.Stderr, LevelInfo),
+		HubInboxSize:     1024,
+		SessionQueueSize: 32,
+		OverflowPolicy:   OverflowCoalesce,
+		FlushDebounce:    150 * time.Millisecond,
+		FlushMaxDelay:    1 * time.Second,
+		ReconnectDelay:   5 * time.Second,
+		Quotas:           DefaultQuotaPolicy(),
+		TokenPolicies:    DefaultTokenPolicies(),
+		RateLimits:       DefaultRateLimits(),
+		TrashRetention:   30 * 24 * time.Hour,
+		LazyMountRecent:  defaultLazyMountRecent,
+		Dialect:          DialectPostgres,
+	}
 }
 
 func NewServer(db *sql.DB, handler comm.Handler) (*Server, error) {
-	srv := &Server{db: db}
+	return NewServerWithConfig(db, handler, DefaultConfig())
+}
+
+func NewServerWithConfig(db *sql.DB, handler comm.Handler, cfg Config) (*Server, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger
+	}
+	srv := &Server{db: db, log: cfg.Logger, cfg: cfg, stop: make(chan struct{})}
 	srv.Store = NewStore(handler)
-	srv.sessionBackend = NewSQLSessions(db)
-	srv.sessionHub = NewSessionHub(srv.sessionBackend)
-	srv.tokenConsumer = NewTokenConsumer(srv.sessionBackend, db)
+	srv.Store.log = cfg.Logger
+	srv.Store.quotas = cfg.Quotas
+	if cfg.RateLimits != nil {
+		if cfg.RateLimitStore == nil {
+			cfg.RateLimitStore = NewMemRateLimitStore()
+		}
+		srv.Store.limiter = NewRateLimiter(cfg.RateLimits, cfg.RateLimitStore, cfg.Logger)
+	}
+	search, err := NewSearchIndex(db, cfg.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	srv.Store.search = search
+	srv.sessionBackend = NewSQLSessions(db, cfg.Logger)
+	srv.sessionHub = NewSessionHub(srv.sessionBackend, cfg)
+	srv.tokenConsumer = NewTokenConsumer(srv.sessionBackend, db, cfg.Logger)
+	if cfg.TokenPolicies != nil {
+		srv.tokenConsumer.policies = cfg.TokenPolicies
+	}
+	srv.tokenConsumer.lazyMountRecent = cfg.LazyMountRecent
+	for _, provider := range cfg.IdentityProviders {
+		srv.tokenConsumer.AddIdentityProvider(provider)
+	}
 	return srv, nil
 }
 
@@ -29,6 +149,21 @@ func (srv *Server) Handle(event Event) (err error) {
 	event.ctx.ts = time.Now()
 	event.ctx.store = srv.Store
 	event.ctx.Router = srv.sessionHub
+	if event.Name == "session-create" && srv.isDraining() {
+		// the client should go and find itself another server
+		event.Remark = srv.reconnectRemark()
+		return event.ctx.Client.Handle(event)
+	}
+	switch event.Name {
+	case "session-create", "token-consume", "account-delete-request":
+		ctx := event.ctx
+		ctx.sid = event.SID
+		if err = srv.Store.limiter.Allow(event.Name, ctx); err != nil {
+			r := err.(Remark)
+			event.Remark = &r
+			return event.ctx.Client.Handle(event)
+		}
+	}
 	if err = srv.tokenConsumer.Handle(event, srv.sessionHub); err != nil {
 		event.ctx.LogError(err)
 	}
@@ -37,7 +172,9 @@ func (srv *Server) Handle(event Event) (err error) {
 
 func (srv *Server) Run() {
 	go srv.sessionHub.Run()
-
+	if srv.cfg.TrashRetention > 0 {
+		go srv.purgeTrashEvery(time.Hour)
+	}
 }
 
 func (srv *Server) Token(kind string) (string, error) {
@@ -65,7 +202,12 @@ func (srv *Server) loginToken(uid string) (string, error) {
 	return token, nil
 }
 
+// Stop shuts down the server. It's safe to call more than once, e.g. after
+// Drain already stopped the server.
 func (srv *Server) Stop() {
-	srv.sessionHub.Stop()
-	srv.db.Close()
+	srv.stopOnce.Do(func() {
+		close(srv.stop)
+		srv.sessionHub.Stop()
+		srv.db.Close()
+	})
 }
@@ -2,7 +2,6 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
 	"time"
 
 	"database/sql/driver"
@@ -10,10 +9,6 @@ import (
 	"encoding/json"
 )
 
-var (
-	_ = log.Print
-)
-
 const (
 	SessionNotfound = iota
 	SessionExpired
@@ -50,6 +45,30 @@ type Session struct {
 	flushes map[string]time.Time
 	tags    []Tag
 	client  EventHandler
+	log     *Logger
+
+	debounce flushDebounce
+	pending  *pendingFlush
+	// remarks about rejected changes, to be sent along with the next
+	// sync of the resource
+	remarks map[string]Remark
+	// gone is set once the session's user has been deleted. Its runner
+	// stops right away and must not save it anymore.
+	gone bool
+}
+
+// flushDebounce configures how long taint-driven flushes are held back.
+// A zero window flushes immediately after every taint.
+type flushDebounce struct {
+	window   time.Duration
+	maxDelay time.Duration
+}
+
+// pendingFlush tracks taints whose flush has been deferred
+type pendingFlush struct {
+	first time.Time
+	last  time.Time
+	ctx   Context
 }
 
 func (session *Session) String() string {
@@ -75,6 +94,7 @@ func NewSession(sid, uid string) *Session {
 		tags:    []Tag{},
 		flushes: map[string]time.Time{},
 		client:  nil,
+		log:     defaultLogger.With(Fields{"sid": sid, "uid": uid}),
 	}
 }
 
@@ -85,7 +105,7 @@ func (sess *Session) setClient(c EventHandler) {
 }
 
 func (sess *Session) Handle(event Event) {
-	log.Printf("session[%s]: handling %s event\n", sess.sid[:6], event.Name)
+	sess.log.Sample("session-handle", 50).Debug("handling event", eventFields(event))
 	if event.SID != sess.sid {
 		panic("RECEIVED INVALID SID WTF?!")
 		return
@@ -110,9 +130,19 @@ func (sess *Session) Handle(event Event) {
 		sess.handle_gone(event)
 	case "snapshot":
 		sess.handle_snapshot(event)
+	case "server-draining", "session-handover":
+		sess.handle_farewell(event)
+	case "account-deleted":
+		sess.handle_account_deleted(event)
 	default:
 		sess.handle_notimplemented(event)
 	}
+	if isTaint(event) && sess.debounce.window > 0 {
+		// every keystroke of a peer results in a taint, don't reload
+		// the master for each of them. the runner will call flushIfDue
+		sess.deferFlush(event.ctx)
+		return
+	}
 	sess.flush(event.ctx)
 }
 
@@ -126,7 +156,7 @@ func (sess *Session) handle_sync(event Event) {
 		// TODO(flo) data validation should happen in adapter/connection layer
 		// eeeek, log and or respond that data was malformed
 		// for now just discard
-		log.Printf("session[%s]: malformed data; res missing\n", sess.sid[:6])
+		sess.log.Warn("malformed data; res missing", eventFields(event))
 		return
 	}
 	if event.Tag == "" {
@@ -135,10 +165,11 @@ func (sess *Session) handle_sync(event Event) {
 		return
 	}
 	if event.Changes == nil {
-		log.Printf("session[%s]: malformed data; changes missing\n", sess.sid[:6])
+		sess.log.Warn("malformed data; changes missing", eventFields(event))
 		return
 	}
 	sess.setClient(event.ctx.Client)
+	defer stats.SyncDuration.ObserveSince(time.Now(), kindLabel(event.Res.Kind))
 	// todo(ACL) check if session may access data.res
 	// note: we do not check the event-tag here, because the server will
 	// always ablige to a res-sync event, whether it's a response of a cycle
@@ -149,7 +180,7 @@ func (sess *Session) handle_sync(event Event) {
 	// update taglib in the end
 	shadow, ok := sess.getShadow(event.Res)
 	if !ok {
-		event.ctx.LogError(fmt.Errorf("shadow `%s` not found, cannot sync.", event.Res))
+		event.ctx.LogError(fmt.Errorf("shadow `%s` not found, cannot sync.", event.Res.StringRef()))
 		event.Changes = []Edit{}
 		event.Remark = &Remark{Level: "fatal", Slug: "shadow-missing"}
 		sess.push_client(event)
@@ -173,6 +204,14 @@ func (sess *Session) handle_sync(event Event) {
 		sess.markTainted(res)
 		event.ctx.Router.Handle(Event{Name: "res-sync", Res: res, ctx: event.ctx})
 	}
+	for _, r := range result.Remarks() {
+		// some changes have been rejected, or the client has to learn about
+		// something it can't see in the delta, e.g. the token of a new share
+		// link. make sure the client receives it, even if it doesn't expect
+		// an ACK
+		sess.addRemark(shadow.res.StringRef(), r)
+		sess.markTainted(shadow.res)
+	}
 	tag, ok := sess.getTag(shadow.res.StringRef())
 	if ok {
 		// we will remove the tag in our taglib anyways.
@@ -194,12 +233,13 @@ func (sess *Session) handle_sync(event Event) {
 	// ACK'ing a client's sync-SYN
 
 	// calculate changes and add them to pending and incease our SV
-	shadow.UpdatePending(true, event.ctx.store)
+	shadow.UpdatePending(true, event.ctx.store, sess.uid)
 	event.Changes = shadow.pending
+	event.Remark = sess.takeRemark(shadow.res.StringRef())
 	if !sess.push_client(event) {
 		// edge-case happened: client sent request and disconnected before we
 		// could response. set tainted state for resource.
-		log.Printf("session[%s]: client went offline during sync, resource (%s)", sess.sid[:6], event.Res.StringRef())
+		sess.log.Info("client went offline during sync", Fields{"res": event.Res.StringRef()})
 		//TODO the response is now los in the nirvana and the tag never ACK'd. should we expect the client to resend
 		// an SYN?
 	}
@@ -207,22 +247,75 @@ func (sess *Session) handle_sync(event Event) {
 }
 
 func (sess *Session) handle_taint(event Event) {
-	log.Printf("session[%s]: handling taint event for %s, all tainted: %s", sess.sid[:6], event.Res, sess.tainted)
 	lastFlush := sess.flushes[event.Res.StringRef()]
 	if event.ctx.ts.Before(lastFlush) {
-		log.Printf("session[%s]: old taint, changes already flushed. event timestamp: %s, last flush: %s", sess.sid[:6], event.ctx.ts, lastFlush)
+		sess.log.Debug("old taint, changes already flushed", Fields{"res": event.Res.StringRef(), "event_ts": event.ctx.ts, "last_flush": lastFlush})
 		return
 	}
+	if (event.Res.Kind == "note" || event.Res.Kind == "checklist") && !sess.hasShadow(event.Res) {
+		// a note the client hasn't mounted (see lazy session-create), it
+		// only learns about the changed metadata in its folio
+		event.Res = Resource{Kind: "folio", ID: sess.uid}
+	}
 	sess.markTainted(event.Res)
-	log.Printf("session[%s]:  all tainted: %s", sess.sid[:6], sess.tainted)
+	sess.log.Debug("resource tainted", Fields{"res": event.Res.StringRef(), "num_tainted": len(sess.tainted)})
 }
 
 func (sess *Session) handle_add(event Event) {
+	switch event.Res.Kind {
+	case "note", "checklist":
+		if sess.hasShadow(event.Res) {
+			break
+		}
+		ref, ok := sess.folioRef(event.Res.ID, event.ctx)
+		if !ok {
+			sess.log.Warn("cannot mount note, not in the user's folio", eventFields(event))
+			return
+		}
+		if event.Res.Kind == "checklist" && ref.Kind != NoteKindChecklist {
+			sess.log.Warn("cannot mount checklist, note is not a checklist", eventFields(event))
+			return
+		}
+		if event.Res.Kind == "note" && ref.Kind == NoteKindChecklist {
+			// the items of a checklist are mounted along with its note
+			checklist := Resource{Kind: "checklist", ID: ref.NID}
+			sess.addShadow(checklist, event.ctx)
+			sess.markTainted(checklist)
+		}
+	case "folio", "profile":
+		if event.Res.ID != sess.uid {
+			sess.log.Warn("cannot mount resource of another user", eventFields(event))
+			return
+		}
+	default:
+		sess.log.Warn("cannot mount resource of this kind", eventFields(event))
+		return
+	}
 	sess.addShadow(event.Res, event.ctx)
+	// the blank shadow gets filled with the next flush
+	sess.markTainted(event.Res)
+}
+
+// folioRef returns the noteref of nid in the session user's folio, ok is
+// false if nid is not part of it
+func (sess *Session) folioRef(nid string, ctx Context) (NoteRef, bool) {
+	folio := Resource{Kind: "folio", ID: sess.uid}
+	if err := ctx.store.Load(&folio); err != nil {
+		ctx.LogError(err)
+		return NoteRef{}, false
+	}
+	i, ok := folio.Value.(Folio).indexFromPath("nid:" + nid)
+	if !ok {
+		return NoteRef{}, false
+	}
+	return folio.Value.(Folio).NoteRefs[i], true
 }
 
 func (sess *Session) handle_remove(event Event) {
 	sess.removeShadow(event.Res, event.ctx)
+	if event.Res.Kind == "note" {
+		sess.removeShadow(Resource{Kind: "checklist", ID: event.Res.ID}, event.ctx)
+	}
 }
 
 func (sess *Session) handle_session_create(event Event) {
@@ -251,7 +344,7 @@ func (sess *Session) handle_snapshot(event Event) {
 }
 
 func (sess *Session) handle_gone(event Event) {
-	log.Printf("session[%s]: client gone\n", sess.sid[:6])
+	sess.log.Debug("client gone")
 	if sess.client != nil {
 		sess.client = nil
 	}
@@ -261,18 +354,67 @@ func (sess *Session) handle_notimplemented(event Event) {
 	return
 }
 
+func (sess *Session) deferFlush(ctx Context) {
+	ts := ctx.ts
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if sess.pending == nil {
+		sess.pending = &pendingFlush{first: ts}
+	}
+	sess.pending.last = ts
+	sess.pending.ctx = ctx
+}
+
+// flushDeadline returns the time a deferred flush is due: once no further
+// taint arrived within the debounce window, but no later than maxDelay after
+// the first deferred taint.
+func (sess *Session) flushDeadline() (time.Time, bool) {
+	if sess.pending == nil {
+		return time.Time{}, false
+	}
+	deadline := sess.pending.last.Add(sess.debounce.window)
+	if sess.debounce.maxDelay > 0 {
+		if max := sess.pending.first.Add(sess.debounce.maxDelay); max.Before(deadline) {
+			deadline = max
+		}
+	}
+	return deadline, true
+}
+
+func (sess *Session) flushIfDue(now time.Time) bool {
+	deadline, ok := sess.flushDeadline()
+	if !ok || now.Before(deadline) {
+		return false
+	}
+	stats.DeferredFlushes.Inc("deadline")
+	sess.flush(sess.pending.ctx)
+	return true
+}
+
+// flushPending flushes deferred taints right away, e.g. before the runner
+// shuts down
+func (sess *Session) flushPending() {
+	if sess.pending == nil {
+		return
+	}
+	stats.DeferredFlushes.Inc("shutdown")
+	sess.flush(sess.pending.ctx)
+}
+
 func (sess *Session) flush(ctx Context) {
+	// any flush covers all deferred taints as well
+	sess.pending = nil
 	// iterate over reset-resources and tainted resources and send syncs to client (if any)
 	if sess.client == nil {
-		log.Printf("session[%s]: flush requested, but client offline\n", sess.sid[:6])
+		sess.log.Debug("flush requested, but client offline")
 		// TODO(flo) check if any tags timed out (due to missing client) and taint them again
 		return
 	}
-	log.Printf("session[%s]: flush requested\n", sess.sid[:6])
 	for _, res := range sess.tainted {
 		shadow, ok := sess.getShadow(res)
 		if !ok {
-			ctx.LogError(fmt.Errorf("shadow `%s` not found, cannot sync.", res))
+			ctx.LogError(fmt.Errorf("shadow `%s` not found, cannot sync.", res.StringRef()))
 			sess.tickoffTainted(res.Ref())
 			continue
 
@@ -284,23 +426,24 @@ func (sess *Session) flush(ctx Context) {
 				continue
 			}
 			// stale tag, resend previous tag, keep resource in tainted state, will be flushed later
+			stats.TagRetries.Inc(res.Kind)
 			// if this time it get's through, the tag will be removed and the changes still sent
 			event := Event{Name: "res-sync", Tag: tag.Val, SID: sess.sid, Res: res.Ref(), Changes: shadow.pending}
 			if !sess.push_client(event) {
 				// client went offline, stop for now
-				log.Printf("session[%s]: client went offline during flush. aborting", sess.sid[:6])
+				sess.log.Info("client went offline during flush; aborting")
 				return
 			}
 			sess.tagSent(res.StringRef())
 			continue
 		}
-		modified := shadow.UpdatePending(false, ctx.store)
+		modified := shadow.UpdatePending(false, ctx.store, sess.uid)
 		if modified {
 			newTag := sess.createTag(res.StringRef())
-			event := Event{Name: "res-sync", Tag: newTag, SID: sess.sid, Res: res.Ref(), Changes: shadow.pending}
+			event := Event{Name: "res-sync", Tag: newTag, SID: sess.sid, Res: res.Ref(), Changes: shadow.pending, Remark: sess.takeRemark(res.StringRef())}
 			if !sess.push_client(event) {
 				// client went offline, stop for now
-				log.Printf("session[%s]: client went offline during flush. aborting", sess.sid[:6])
+				sess.log.Info("client went offline during flush; aborting")
 				return
 			}
 			sess.tagSent(res.StringRef())
@@ -311,8 +454,25 @@ func (sess *Session) flush(ctx Context) {
 	return
 }
 
+// handle_farewell is the last event a runner handles before this process
+// lets go of the session. The client gets whatever is pending and is then
+// told where and when to reconnect (see Event.Remark).
+func (sess *Session) handle_farewell(event Event) {
+	sess.flush(event.ctx)
+	sess.push_client(event)
+	sess.client = nil
+}
+
+// handle_account_deleted tells the client that its user is gone. Nothing is
+// flushed, the session's resources do not exist anymore.
+func (sess *Session) handle_account_deleted(event Event) {
+	sess.push_client(event)
+	sess.client = nil
+	sess.gone = true
+}
+
 func (sess *Session) handle_ehlo(event Event) {
-	log.Printf("session[%s]: received client-ehlo. saved new client and flushing changes", sess.sid[:6])
+	sess.log.Debug("received client-ehlo; saved new client and flushing changes")
 	return
 }
 
@@ -320,15 +480,34 @@ func (sess *Session) push_client(event Event) (sent bool) {
 	if sess.client == nil {
 		return false
 	}
+	if event.Remark != nil && event.Remark.Level == "fatal" {
+		stats.FatalRemarks.Inc(event.Remark.Slug)
+	}
 	if err := sess.client.Handle(event); err != nil {
-		log.Printf("session[%s]: error pushing to client: %s", sess.sid[:6], err)
+		sess.log.Warn("error pushing to client", Fields{"err": err, "event": event.Name})
 		sess.client = nil
 		return false
 	}
-	log.Printf("session[%s]: PUSH %s", sess.sid[:6], event)
+	sess.log.Sample("session-push", 50).Debug("pushed event to client", eventFields(event))
 	return true
 }
 
+func (sess *Session) addRemark(ref string, r Remark) {
+	if sess.remarks == nil {
+		sess.remarks = map[string]Remark{}
+	}
+	sess.remarks[ref] = r
+}
+
+func (sess *Session) takeRemark(ref string) *Remark {
+	r, ok := sess.remarks[ref]
+	if !ok {
+		return nil
+	}
+	delete(sess.remarks, ref)
+	return &r
+}
+
 func (sess *Session) getTag(ref string) (Tag, bool) {
 	for i := range sess.tags {
 		if sess.tags[i].Ref == ref {
@@ -415,7 +594,7 @@ func (sess *Session) addShadow(res Resource, ctx Context) {
 	res.Value = res.Value.Empty()
 	// TODO(flo) refactor: store needs to implement EmptyValue() and use resourcebackends Empty() as the
 	// official place to define empty resource values
-	log.Printf("session[%s]: storing new blank resource in shadows %s", sess.sid[:6], res.StringRef())
+	sess.log.Debug("storing new blank resource in shadows", Fields{"res": res.StringRef()})
 	sess.shadows = append(sess.shadows, NewShadow(res))
 }
 
@@ -468,7 +647,14 @@ func (s *Session) Value() (driver.Value, error) {
 }
 
 func (s *Session) Scan(value interface{}) error {
-	return s.UnmarshalJSON(value.([]byte))
+	switch data := value.(type) {
+	case []byte:
+		return s.UnmarshalJSON(data)
+	case string:
+		// e.g. text columns of sqlite
+		return s.UnmarshalJSON([]byte(data))
+	}
+	return fmt.Errorf("cannot scan session from %T", value)
 }
 
 func (s *Session) MarshalJSON() ([]byte, error) {
@@ -498,6 +684,7 @@ func (session *Session) UnmarshalJSON(from []byte) error {
 		tainted: vals.Tainted,
 		shadows: vals.Shadows,
 		flushes: vals.Flushes,
+		log:     defaultLogger.With(Fields{"sid": vals.SID, "uid": vals.UID}),
 	}
 	return nil
 }
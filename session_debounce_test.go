@@ -0,0 +1,89 @@
+package diffsync
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingBackend counts how often the master version of a resource has been
+// loaded
+type countingBackend struct {
+	*MemBackend
+	loads int64
+}
+
+func (b *countingBackend) Get(key string) (ResourceValue, error) {
+	atomic.AddInt64(&b.loads, 1)
+	return b.MemBackend.Get(key)
+}
+
+func (b *countingBackend) Patch(string, Patch, *SyncResult, Context) error {
+	return nil
+}
+
+func (b *countingBackend) CreateEmpty(Context) (string, error) {
+	return b.Insert(NewNote(""))
+}
+
+func debounceSession(window, maxDelay time.Duration) (*Session, *countingBackend, *Store) {
+	backend := &countingBackend{MemBackend: NewMemBackend(func() ResourceValue { return NewNote("") })}
+	backend.Upsert("n1", NewNote(""))
+	store := NewStore(nil)
+	store.Mount("note", backend)
+	sess := NewSession("sid", "uid")
+	sess.shadows = append(sess.shadows, NewShadow(Resource{Kind: "note", ID: "n1", Value: NewNote("")}))
+	sess.client = FuncHandler{Fn: func(Event) error { return nil }}
+	sess.debounce = flushDebounce{window: window, maxDelay: maxDelay}
+	return sess, backend, store
+}
+
+func TestSessionFlushDeadline(t *testing.T) {
+	sess, _, store := debounceSession(100*time.Millisecond, 250*time.Millisecond)
+	start := time.Now()
+	taint := func(offset time.Duration) {
+		ctx := Context{ts: start.Add(offset), store: store}
+		sess.Handle(Event{Name: "res-sync", SID: "sid", Res: Resource{Kind: "note", ID: "n1"}, ctx: ctx})
+	}
+	taint(0)
+	deadline, ok := sess.flushDeadline()
+	assert.True(t, ok, "taint did not defer the flush")
+	assert.Equal(t, start.Add(100*time.Millisecond), deadline)
+	taint(80 * time.Millisecond)
+	deadline, _ = sess.flushDeadline()
+	assert.Equal(t, start.Add(180*time.Millisecond), deadline, "debounce window not extended by repeated taint")
+	taint(200 * time.Millisecond)
+	deadline, _ = sess.flushDeadline()
+	assert.Equal(t, start.Add(250*time.Millisecond), deadline, "max delay not honored")
+	assert.False(t, sess.flushIfDue(start.Add(240*time.Millisecond)), "flushed before deadline")
+	assert.True(t, sess.flushIfDue(start.Add(250*time.Millisecond)), "did not flush at deadline")
+	_, ok = sess.flushDeadline()
+	assert.False(t, ok, "flush did not clear deferred taints")
+}
+
+// BenchmarkTaintFlush simulates a peer typing a keystroke every 30ms and
+// reports how many master loads each edit costs a subscribed session.
+func BenchmarkTaintFlush(b *testing.B) {
+	for _, window := range []time.Duration{0, 150 * time.Millisecond} {
+		b.Run(fmt.Sprintf("debounce=%s", window), func(b *testing.B) {
+			sess, backend, store := debounceSession(window, time.Second)
+			ref := Resource{Kind: "note", ID: "n1"}
+			// synthetic clock, decoupled from the benchmark's speed
+			now := time.Now().Add(time.Hour)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				now = now.Add(30 * time.Millisecond)
+				backend.Upsert("n1", NewNote(fmt.Sprintf("keystroke %d", i)))
+				sess.Handle(Event{Name: "res-sync", SID: "sid", Res: ref, ctx: Context{ts: now, store: store}})
+				sess.flushIfDue(now)
+				// pretend the client ACKed whatever has been sent
+				sess.removeTag(ref.StringRef())
+				sess.shadows[0].pending = sess.shadows[0].pending[:0]
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&backend.loads))/float64(b.N), "loads/edit")
+		})
+	}
+}
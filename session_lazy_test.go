@@ -0,0 +1,113 @@
+package diffsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentNoteRefs(t *testing.T) {
+	ts := func(d time.Duration) *UnixTime {
+		t := UnixTime(time.Unix(1400000000, 0).Add(d))
+		return &t
+	}
+	refs := []NoteRef{
+		{NID: "nid00001"},
+		{NID: "nid00002", LastEdit: ts(time.Hour)},
+		{NID: "nid00003", LastEdit: ts(2 * time.Hour)},
+		{NID: "nid00004"},
+	}
+	nids := func(refs []NoteRef) (nids []string) {
+		for _, ref := range refs {
+			nids = append(nids, ref.NID)
+		}
+		return
+	}
+	assert.Equal(t, []string{"nid00003", "nid00002", "nid00001"}, nids(recentNoteRefs(refs, 3)))
+	assert.Equal(t, "nid00001", refs[0].NID, "refs sorted in place")
+	assert.Len(t, recentNoteRefs(refs, 10), 4)
+	assert.Len(t, recentNoteRefs(refs, 0), 0)
+}
+
+func TestSessionLazyMount(t *testing.T) {
+	notes := NewMemBackend(func() ResourceValue { return NewNote("") })
+	notes.Upsert("nid00001", NewNote("mounted"))
+	notes.Upsert("nid00002", NewNote("not mounted"))
+	notes.Upsert("nid00003", NewNote("someone else's"))
+	folios := NewMemBackend(func() ResourceValue { return NewFolio() })
+	folio := NewFolio()
+	folio.NoteRefs = []NoteRef{{NID: "nid00001", Status: "active"}, {NID: "nid00002", Status: "active"}}
+	folios.Upsert("uid", folio)
+	store := NewStore(nil)
+	store.Mount("note", &countingBackend{MemBackend: notes})
+	store.Mount("folio", &countingBackend{MemBackend: folios})
+
+	sess := NewSession("sid", "uid")
+	sess.shadows = append(sess.shadows,
+		NewShadow(Resource{Kind: "folio", ID: "uid", Value: folio.Clone()}),
+		NewShadow(Resource{Kind: "note", ID: "nid00001", Value: NewNote("mounted")}))
+	pushed := []Event{}
+	sess.client = FuncHandler{Fn: func(event Event) error {
+		pushed = append(pushed, event)
+		return nil
+	}}
+	ctx := Context{ts: time.Now(), store: store}
+
+	// taints of unmounted notes update the folio instead
+	lastEdit := UnixTime(time.Now())
+	folio = folio.Clone().(Folio)
+	folio.NoteRefs[1].LastEdit = &lastEdit
+	folios.Upsert("uid", folio)
+	sess.Handle(Event{Name: "res-sync", SID: "sid", Res: Resource{Kind: "note", ID: "nid00002"}, ctx: ctx})
+	if assert.Len(t, pushed, 1) {
+		assert.Equal(t, Resource{Kind: "folio", ID: "uid"}, pushed[0].Res.Ref())
+		assert.Equal(t, FolioDelta{{"set-last-edit", "nid:nid00002", &lastEdit}}, pushed[0].Changes[0].Delta)
+	}
+
+	// mounting on demand sends the whole note
+	pushed = pushed[:0]
+	sess.Handle(Event{Name: "res-add", SID: "sid", Res: Resource{Kind: "note", ID: "nid00002"}, ctx: ctx})
+	assert.True(t, sess.hasShadow(Resource{Kind: "note", ID: "nid00002"}))
+	if assert.Len(t, pushed, 1) {
+		assert.Equal(t, Resource{Kind: "note", ID: "nid00002"}, pushed[0].Res.Ref())
+	}
+
+	// ...but only notes from the user's folio
+	pushed = pushed[:0]
+	sess.Handle(Event{Name: "res-add", SID: "sid", Res: Resource{Kind: "note", ID: "nid00003"}, ctx: ctx})
+	assert.False(t, sess.hasShadow(Resource{Kind: "note", ID: "nid00003"}))
+	assert.Len(t, pushed, 0)
+
+	// folios and profiles of other users can't be mounted, nor anything else
+	folios.Upsert("uid2", NewFolio())
+	for _, res := range []Resource{{Kind: "folio", ID: "uid2"}, {Kind: "profile", ID: "uid2"}, {Kind: "identity", ID: "uid"}} {
+		sess.Handle(Event{Name: "res-add", SID: "sid", Res: res, ctx: ctx})
+		assert.False(t, sess.hasShadow(res), res.StringRef())
+	}
+	assert.Len(t, pushed, 0)
+}
+
+func TestFolioSQLBackendLastEdit(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_FOLDERS, CREATE_NOTEREFTAGS)
+	defer db.Close()
+	lastEdit := time.Unix(1400000000, 0).UTC()
+	db.Exec(`INSERT INTO noterefs (nid, uid, role, last_edit) VALUES
+				('nid00001', 'uid00001', 'owner', NULL),
+				('nid00001', 'uid00002', 'peer', $1),
+				('nid00002', 'uid00001', 'owner', NULL)`, lastEdit)
+	value, err := NewFolioSQLBackend(db).Get("uid00001")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, ref := range value.(Folio).NoteRefs {
+		switch ref.NID {
+		case "nid00001":
+			if assert.NotNil(t, ref.LastEdit, "peer's edit missing") {
+				assert.True(t, lastEdit.Equal(time.Time(*ref.LastEdit)))
+			}
+		case "nid00002":
+			assert.Nil(t, ref.LastEdit)
+		}
+	}
+}
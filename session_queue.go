@@ -0,0 +1,201 @@
+package diffsync
+
+import (
+	"reflect"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to an event that is routed to a
+// session whose queue is already full.
+type OverflowPolicy int
+
+const (
+	// OverflowCoalesce drops events which cannot be merged into the queue.
+	// Note that repeated taints of the same resource are merged regardless
+	// of the policy, so a full queue only loses taints of other resources
+	// and client events.
+	OverflowCoalesce OverflowPolicy = iota
+	// OverflowDropDuplicates drops the incoming event silently if an
+	// identical event is already queued. Other events are dropped as well,
+	// but the client gets notified.
+	OverflowDropDuplicates
+	// OverflowTerminate shuts down the session's runner, discarding every
+	// queued event. The session will be re-loaded from the backend on the
+	// next event addressed to it.
+	OverflowTerminate
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OverflowCoalesce:       "coalesce",
+	OverflowDropDuplicates: "drop-duplicates",
+	OverflowTerminate:      "terminate",
+}
+
+func (p OverflowPolicy) String() string {
+	return overflowPolicyNames[p]
+}
+
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushMerged
+	pushDropped
+	pushTerminate
+)
+
+// sessionQueue is the bounded inbox of a session runner.
+//
+// push never blocks, which keeps the SessionHub's main loop independent of
+// how fast a single runner processes its events. The runner gets notified via
+// ready and pops all queued events at once.
+type sessionQueue struct {
+	sync.Mutex
+	events []Event
+	limit  int
+	policy OverflowPolicy
+	ready  chan struct{}
+	done   chan struct{}
+	closed bool
+	// farewell, if set, is handled by the runner after the remaining events
+	farewell *Event
+	// stopped is closed once the runner has saved the session and exited
+	stopped chan struct{}
+}
+
+func newSessionQueue(limit int, policy OverflowPolicy) *sessionQueue {
+	return &sessionQueue{
+		events:  make([]Event, 0, limit),
+		limit:   limit,
+		policy:  policy,
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (q *sessionQueue) push(event Event) pushResult {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return pushDropped
+	}
+	stats.SessionInboxDepth.Observe(float64(len(q.events)))
+	if isTaint(event) && q.mergeTaint(event) {
+		// a runner which has not gotten to the first taint yet
+		// does not need to hear about the resource twice
+		stats.TaintsMerged.Inc()
+		return pushMerged
+	}
+	if len(q.events) >= q.limit {
+		res := q.overflow(event)
+		stats.QueueOverflows.Inc(q.policy.String(), res.String())
+		return res
+	}
+	q.events = append(q.events, event)
+	q.notify()
+	return pushQueued
+}
+
+func (q *sessionQueue) overflow(event Event) pushResult {
+	switch q.policy {
+	case OverflowCoalesce:
+		// mergeable taints never get here
+		return pushDropped
+	case OverflowDropDuplicates:
+		for i := range q.events {
+			if sameEvent(q.events[i], event) {
+				return pushMerged
+			}
+		}
+		return pushDropped
+	}
+	q.events = q.events[:0]
+	return pushTerminate
+}
+
+// mergeTaint replaces an already queued taint of the same resource with
+// event and reports whether it found one
+func (q *sessionQueue) mergeTaint(event Event) bool {
+	for i := range q.events {
+		if isTaint(q.events[i]) && q.events[i].Res.SameRef(event.Res) {
+			// keep the newer one, its timestamp decides whether the
+			// taint has already been flushed
+			q.events[i] = event
+			return true
+		}
+	}
+	return false
+}
+
+func (q *sessionQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+		// runner has already been notified
+	}
+}
+
+func (q *sessionQueue) pop() (Event, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.events) == 0 {
+		return Event{}, false
+	}
+	event := q.events[0]
+	q.events[0] = Event{}
+	q.events = q.events[1:]
+	return event, true
+}
+
+// close signals the runner to stop after it processed the remaining events
+func (q *sessionQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.done)
+}
+
+// closeWith works like close, but lets the runner handle farewell as its
+// very last event
+func (q *sessionQueue) closeWith(farewell Event) {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return
+	}
+	q.farewell = &farewell
+	q.closed = true
+	close(q.done)
+}
+
+func (r pushResult) String() string {
+	switch r {
+	case pushQueued:
+		return "queued"
+	case pushMerged:
+		return "merged"
+	case pushDropped:
+		return "dropped"
+	case pushTerminate:
+		return "terminated"
+	}
+	return "unknown"
+}
+
+// isTaint reports whether event is a server-side notification about a
+// changed resource, as opposed to a res-sync sent by a client
+func isTaint(event Event) bool {
+	return event.Name == "res-sync" && event.Tag == "" && len(event.Changes) == 0
+}
+
+func sameEvent(a, b Event) bool {
+	return a.Name == b.Name &&
+		a.Res.SameRef(b.Res) &&
+		a.Tag == b.Tag &&
+		a.Token == b.Token &&
+		reflect.DeepEqual(a.Changes, b.Changes)
+}
@@ -0,0 +1,129 @@
+package diffsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fillQueue(q *sessionQueue, n int) {
+	for i := 0; i < n; i++ {
+		q.push(Event{Name: "res-sync", Tag: generateTag(), Res: Resource{Kind: "note", ID: "fill"}})
+	}
+}
+
+func TestSessionQueueCoalesce(t *testing.T) {
+	q := newSessionQueue(3, OverflowCoalesce)
+	fillQueue(q, 2)
+	taint := Event{Name: "res-sync", Res: Resource{Kind: "note", ID: "n1"}}
+	assert.Equal(t, pushQueued, q.push(taint), "taint should be queued while queue has room")
+	assert.Equal(t, pushMerged, q.push(taint), "repeated taint should be merged into the queued one")
+	other := Event{Name: "res-sync", Res: Resource{Kind: "note", ID: "n2"}}
+	assert.Equal(t, pushDropped, q.push(other), "unmergeable taint should be dropped")
+	count := 0
+	for _, ok := q.pop(); ok; _, ok = q.pop() {
+		count++
+	}
+	assert.Equal(t, 3, count, "queue holds more events than its limit")
+}
+
+func TestSessionQueueDropDuplicates(t *testing.T) {
+	q := newSessionQueue(2, OverflowDropDuplicates)
+	ev := Event{Name: "client-ehlo"}
+	q.push(ev)
+	q.push(Event{Name: "res-sync", Tag: "abc"})
+	assert.Equal(t, pushMerged, q.push(ev), "duplicate event should be dropped silently")
+	assert.Equal(t, pushDropped, q.push(Event{Name: "res-add"}), "event should be dropped when queue is full")
+}
+
+func TestSessionQueueKeepsDistinctSyncs(t *testing.T) {
+	q := newSessionQueue(1, OverflowDropDuplicates)
+	res := Resource{Kind: "note", ID: "n1"}
+	q.push(Event{Name: "res-sync", Tag: "abc", Res: res, Changes: []Edit{{Clock: Clock{CV: 0}}}})
+	resent := Event{Name: "res-sync", Tag: "abc", Res: res, Changes: []Edit{{Clock: Clock{CV: 1}}}}
+	assert.Equal(t, pushDropped, q.push(resent), "sync with other changes merged into the queued one")
+}
+
+func TestSessionHubHandleDoesNotBlock(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Logger = nil
+	cfg.HubInboxSize = 1
+	cfg.OverflowPolicy = OverflowTerminate
+	// no main loop, the inbox is never drained
+	hub := NewSessionHub(&memSessions{saved: map[string]int{}}, cfg)
+	events := make(chan Event, 1)
+	client := FuncHandler{Fn: func(event Event) error {
+		events <- event
+		return nil
+	}}
+	ctx := Context{sid: "sid1", Client: client}
+	done := make(chan struct{})
+	go func() {
+		hub.Handle(Event{Name: "client-ehlo", SID: "sid1", ctx: ctx})
+		hub.Handle(Event{Name: "res-sync", Tag: "abc", SID: "sid1", ctx: ctx})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handle blocked on a full hub inbox")
+	}
+	select {
+	case ev := <-events:
+		if assert.NotNil(t, ev.Remark) {
+			assert.Equal(t, "session-busy", ev.Remark.Slug)
+		}
+		assert.Equal(t, "abc", ev.Tag)
+	case <-time.After(time.Second):
+		t.Error("client not told about the dropped event")
+	}
+	assert.Equal(t, "sid1", <-hub.overflowed, "runner not scheduled for termination")
+}
+
+func TestSessionQueueTerminate(t *testing.T) {
+	q := newSessionQueue(1, OverflowTerminate)
+	q.push(Event{Name: "client-ehlo"})
+	assert.Equal(t, pushTerminate, q.push(Event{Name: "client-ehlo"}), "overflow should terminate the runner")
+	_, ok := q.pop()
+	assert.False(t, ok, "terminated queue still contains events")
+	q.close()
+	assert.Equal(t, pushDropped, q.push(Event{Name: "client-ehlo"}), "closed queue accepted an event")
+	select {
+	case <-q.done:
+	default:
+		t.Error("done channel not closed")
+	}
+}
+
+func TestSessionHubWaitsForStoppingRunner(t *testing.T) {
+	backend := &memSessions{saved: map[string]int{}, saving: make(chan struct{})}
+	cfg := DefaultConfig()
+	cfg.Logger = nil
+	// the hub's main loop is driven by hand
+	hub := NewSessionHub(backend, cfg)
+	defer func() {
+		close(hub.stopch)
+		hub.wg.Wait()
+	}()
+	assert.NoError(t, hub.toSession(Event{Name: "client-ehlo", SID: "sid1"}))
+	old := hub.active["sid1"]
+	// e.g. terminated due to an overflow, the runner is still saving
+	hub.stopRunner("sid1")
+	assert.NoError(t, hub.toSession(Event{Name: "client-ehlo", SID: "sid1"}))
+	assert.Nil(t, hub.active["sid1"], "second runner started while the first one is still saving")
+
+	hub.runnerStopped(runnerSignal{"sid1", newSessionQueue(1, OverflowTerminate)})
+	assert.Nil(t, hub.active["sid1"], "stale runner signal not ignored")
+
+	close(backend.saving)
+	select {
+	case sig := <-hub.runner_done:
+		assert.True(t, sig == runnerSignal{"sid1", old}, "signal of unknown runner")
+		hub.runnerStopped(sig)
+	case <-time.After(time.Second):
+		t.Fatal("runner did not stop")
+	}
+	assert.True(t, hub.active["sid1"] != nil && hub.active["sid1"] != old, "held back event not delivered")
+	assert.Equal(t, []string{"get sid1", "save sid1", "get sid1"}, backend.history())
+}
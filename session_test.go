@@ -127,12 +127,12 @@ func (suite *SessionTests) createUserWith2Notes(name string) User {
 	}
 	user := res.Value.(Profile).User
 	result := NewSyncResult()
-	err = store.Patch(res, Patch{"set-tier", "user/", int64(1), int64(0)}, &result, ctx)
+	err = store.Patch(res, Patch{"set-tier", "user/", int64(1), int64(0)}, result, ctx)
 	suite.NoError(err, "cannot lift users tier")
 	suite.Equal(1, len(result.tainted), "set-tier did not taint profile")
 	// reset result
-	result = SyncResult{}
-	err = store.Patch(res, Patch{"set-name", "user/", name, ""}, &result, ctx)
+	result = NewSyncResult()
+	err = store.Patch(res, Patch{"set-name", "user/", name, ""}, result, ctx)
 	suite.NoError(err, "cannot users name")
 	suite.Equal(1, len(result.tainted), "set-name did not taint profile")
 	_, err = store.NewResource("note", Context{uid: user.UID})
@@ -155,6 +155,10 @@ func (suite *SessionTests) awaitResponse(ch <-chan Event, timeoutMsg string) Eve
 func (suite *SessionTests) awaitAddPeer(client Client, peerUID string, shared Resource) {
 	// see if sessA got hold of the new peer
 	peersEvent, err := client.awaitResponse()
+	for err == nil && peersEvent.Name == "res-sync" && peersEvent.Res.Kind == "profile" {
+		// the new peer has been added to the contacts as well
+		peersEvent, err = client.awaitResponse()
+	}
 	log.Println("TESTETSTEST, (expected peers) event", peersEvent)
 	if suite.NoError(err, "inviter didnot receive add-peers event") {
 		suite.Equal("res-sync", peersEvent.Name, "got unexpected event-name from connection")
@@ -170,7 +174,7 @@ func (suite *SessionTests) awaitAddPeer(client Client, peerUID string, shared Re
 			suite.Equal(1, len(deltas), "wrong number of changes")
 			suite.Equal("add-peer", deltas[0].Op, "wrong delta.Op")
 			suite.Equal(peerUID, deltas[0].Value.(Peer).User.UID, "wrong peer UID")
-			suite.Equal("active", deltas[0].Value.(Peer).Role, "wrong peer UID")
+			suite.Equal("peer", deltas[0].Value.(Peer).Role, "wrong peer role")
 		}
 	}
 }
@@ -204,7 +208,7 @@ func (suite *SessionTests) TestVisitorWithAnonToken() {
 		if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
 			suite.NotEmpty(shadow.res.ID, "first (and only) shadow has empty ID")
 			suite.IsType(Folio{}, shadow.res.Value, "expected folio-shadow's resource did not contain a valid Folio value")
-			folio := shadow.res.Value.(Folio)
+			folio := shadow.res.Value.(Folio).NoteRefs
 			suite.Equal(0, len(folio), "folio with 0 notes expected, but contains `%d`", len(folio))
 		}
 	}
@@ -226,7 +230,7 @@ func (suite *SessionTests) TestVisitorWithURLShareToken() {
 	suite.Equal(3, len(sessB.shadows), "anon user should have 3 shadows (profile, folio, note), but has %d", len(sessB.shadows))
 	shadow := extractShadow(sessB, "folio")
 	if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-		folio := shadow.res.Value.(Folio)
+		folio := shadow.res.Value.(Folio).NoteRefs
 		if suite.Equal(1, len(folio), "folio has the wrong number of notes. expected 1, got %s", len(folio)) {
 			suite.Equal(noteRes.ID, folio[0].NID, "folio contains wrong NID; expected `%s`, got `%s`", noteRes.ID, folio[0].NID)
 		}
@@ -244,7 +248,7 @@ func (suite *SessionTests) TestVisitorWithEmailShareToken() {
 		suite.Equal(3, len(sessB.shadows), "anon user should have 3 shadows (profile, folio, note)")
 		shadow := extractShadow(sessB, "folio")
 		if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-			folio := shadow.res.Value.(Folio)
+			folio := shadow.res.Value.(Folio).NoteRefs
 			if suite.Equal(1, len(folio), "folio has the wrong number of notes") {
 				suite.Equal(shared.ID, folio[0].NID, "folio contains wrong NID")
 			}
@@ -263,7 +267,7 @@ func (suite *SessionTests) TestVisitorWithPhoneShareToken() {
 		suite.Equal(3, len(sessB.shadows), "anon user should have 3 shadows (profile, folio, note), but has %d", len(sessB.shadows))
 		shadow := extractShadow(sessB, "folio")
 		if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-			folio := shadow.res.Value.(Folio)
+			folio := shadow.res.Value.(Folio).NoteRefs
 			if suite.Equal(1, len(folio), "folio has the wrong number of notes") {
 				suite.Equal(shared.ID, folio[0].NID, "folio contains wrong NID")
 			}
@@ -280,12 +284,12 @@ func (suite *SessionTests) TestVisitorWithLoginToken() {
 	if suite.NotNil(shadow, "profile shaddow missing in session") {
 		profile := shadow.res.Value.(Profile)
 		suite.Equal(user.UID, profile.User.UID, "new session's profile-user has wrong UID")
-		suite.Equal(1, profile.User.Tier, "new session's user is not signed up")
+		suite.Equal(int64(1), profile.User.Tier, "new session's user is not signed up")
 	}
 	// check if flio contains 2 notes
 	shadow = extractShadow(clientA.session, "folio")
 	if suite.NotNil(shadow, "folio shadow missing in session") {
-		folio := shadow.res.Value.(Folio)
+		folio := shadow.res.Value.(Folio).NoteRefs
 		suite.Equal(2, len(folio), "folio has the wrong number of notes")
 	}
 }
@@ -300,7 +304,7 @@ func (suite *SessionTests) TestVisitorWithVerifyEmailToken() {
 		Tag:  "test",
 		Res:  Resource{Kind: "profile", ID: user.UID},
 		Changes: []Edit{{
-			Clock: SessionClock{0, 0, 0},
+			Clock: Clock{CV: 0, SV: 0},
 			Delta: ProfileDelta{
 				UserChange{Op: "set-email", Path: "user/", Value: "test@hiroapp.com"},
 			},
@@ -325,7 +329,7 @@ func (suite *SessionTests) TestVisitorWithVerifyEmailToken() {
 		suite.Equal(4, len(sessA.shadows), "verify user should have 4 shadows (profile, folio, 2*note), but has %d", len(sessA.shadows))
 		shadow := extractShadow(sessA, "folio")
 		if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-			folio := shadow.res.Value.(Folio)
+			folio := shadow.res.Value.(Folio).NoteRefs
 			suite.Equal(2, len(folio), "folio has the wrong number of notes. expected 2, got %s", len(folio))
 		}
 
@@ -334,7 +338,7 @@ func (suite *SessionTests) TestVisitorWithVerifyEmailToken() {
 		if suite.NotNil(shadow, "returned session did not contain a profile shadow") {
 			profile := shadow.res.Value.(Profile)
 			suite.Equal(user.UID, profile.User.UID, "new session's profile-user has wrong UID. expected `%s`, got `%s`", user.UID, profile.User.UID)
-			suite.Equal(1, profile.User.Tier, "new session's user is not signed up")
+			suite.Equal(int64(1), profile.User.Tier, "new session's user is not signed up")
 
 			// check if the email is verified
 			err := suite.srv.Store.Load(&shadow.res)
@@ -351,10 +355,11 @@ func (suite *SessionTests) TestAnonConsumeURLShare() {
 		clientB := suite.anonSession()
 		suite.addNote(clientB)
 		suite.srv.Handle(Event{SID: clientB.session.sid, Name: "token-consume", Token: shareToken})
-		// we're gonna get 3 responses: the token-consume echo, the folio update and the note-sync
-		responses := [3]Event{}
+		// we're gonna get 4 responses: the token-consume echo, the folio
+		// and profile (new contact) updates and the note-sync
+		responses := [4]Event{}
 		var err error
-		for i := 0; i < 3; i++ {
+		for i := 0; i < 4; i++ {
 			responses[i], err = clientB.awaitResponse()
 			suite.NoError(err, "token-consume response missing")
 		}
@@ -365,7 +370,9 @@ func (suite *SessionTests) TestAnonConsumeURLShare() {
 				found++
 				continue
 			case "res-sync":
-				if resp.Res.Kind == "note" {
+				if resp.Res.Kind == "profile" {
+					found++
+				} else if resp.Res.Kind == "note" {
 					found++
 					suite.Equal(shared.ID, resp.Res.ID, "note-id mismatch. expected `%s`, got `%s`", shared.ID, resp.Res.ID)
 					// expecting 3 deltas: set-token & 2*add-peer (sessA and sessB users)
@@ -389,7 +396,7 @@ func (suite *SessionTests) TestAnonConsumeURLShare() {
 
 			}
 		}
-		suite.Equal(3, found, "not all expected responses received")
+		suite.Equal(4, found, "not all expected responses received")
 
 	})
 
@@ -419,7 +426,7 @@ func (suite *SessionTests) withShareToken(kind string, client Client, fn func(st
 		Tag:  "test",
 		Res:  sharedRes,
 		Changes: []Edit{{
-			Clock: SessionClock{0, 1, 0},
+			Clock: Clock{CV: 0, SV: 1},
 			Delta: NoteDelta{
 				NoteDeltaElement{Op: "invite", Path: "peers/", Value: invitee},
 			},
@@ -434,10 +441,11 @@ func (suite *SessionTests) withShareToken(kind string, client Client, fn func(st
 		suite.Equal("note", event.Res.Kind, "expected a note-sync")
 		suite.Equal(sharedRes.ID, event.Res.ID, "note-id mismatch")
 		if suite.Equal(1, len(event.Changes), "wrong number of changes") {
-			// expect swap-user and change-role changes
+			// peers are loaded without their email or phone, the
+			// invited (dangling) peer gets replaced by the actual user
 			if suite.Equal(2, len(event.Changes[0].Delta.(NoteDelta)), "wrong number of deltas") {
-				suite.Equal("swap-user", event.Changes[0].Delta.(NoteDelta)[0].Op, "unexpected note-delta")
-				suite.Equal("change-role", event.Changes[0].Delta.(NoteDelta)[1].Op, "unexpected note-delta")
+				suite.Equal("add-peer", event.Changes[0].Delta.(NoteDelta)[0].Op, "unexpected note-delta")
+				suite.Equal("rem-peer", event.Changes[0].Delta.(NoteDelta)[1].Op, "unexpected note-delta")
 			}
 			// ACK the sync
 			//event.Changes[0].Clock.SV++
@@ -485,9 +493,10 @@ func (suite *SessionTests) TestAnonConsumeEmailShare() {
 		suite.addNote(clientB)
 		err := suite.srv.Handle(Event{SID: clientB.session.sid, Name: "token-consume", Token: token, ctx: clientB.ctx()})
 		suite.NoError(err, "error sending token-consume request")
-		// we're gonna get 3 responses: the token-consume echo, the folio update and the note-sync
-		responses := [3]Event{}
-		for i := 0; i < 3; i++ {
+		// we're gonna get 4 responses: the token-consume echo, the folio
+		// and profile (new contact) updates and the note-sync
+		responses := [4]Event{}
+		for i := 0; i < 4; i++ {
 			responses[i], err = clientB.awaitResponse()
 			if !suite.NoError(err, "%d response(s) missing after token-consume", 3-i) {
 				break
@@ -500,7 +509,9 @@ func (suite *SessionTests) TestAnonConsumeEmailShare() {
 				found++
 				continue
 			case "res-sync":
-				if resp.Res.Kind == "note" {
+				if resp.Res.Kind == "profile" {
+					found++
+				} else if resp.Res.Kind == "note" {
 					found++
 					suite.Equal(shared.ID, resp.Res.ID, "note-id mismatch. expected `%s`, got `%s`", shared.ID, resp.Res.ID)
 					suite.Equal(4, len(resp.Changes[0].Delta.(NoteDelta)), "wrong number of deltas for note")
@@ -523,7 +534,7 @@ func (suite *SessionTests) TestAnonConsumeEmailShare() {
 
 			}
 		}
-		suite.Equal(3, found, "not all expected responses received")
+		suite.Equal(4, found, "not all expected responses received")
 		// see if sessA got hold of the new peer
 		suite.awaitAddPeer(clientA, clientB.session.uid, shared)
 	})
@@ -537,9 +548,10 @@ func (suite *SessionTests) TestAnonConsumePhoneShare() {
 		suite.addNote(clientB)
 		err := suite.srv.Handle(Event{SID: clientB.session.sid, Name: "token-consume", Token: token, ctx: clientB.ctx()})
 		suite.NoError(err, "cannot consume token")
-		// we're gonna get 3 responses: the token-consume echo, the folio update and the note-sync
-		responses := [3]Event{}
-		for i := 0; i < 3; i++ {
+		// we're gonna get 4 responses: the token-consume echo, the folio
+		// and profile (new contact) updates and the note-sync
+		responses := [4]Event{}
+		for i := 0; i < 4; i++ {
 			responses[i], err = clientB.awaitResponse()
 			log.Println("RESSPONSES", responses[i])
 			if !suite.NoError(err, "%d missing responses", 3-i) {
@@ -553,7 +565,9 @@ func (suite *SessionTests) TestAnonConsumePhoneShare() {
 				found++
 				continue
 			case "res-sync":
-				if resp.Res.Kind == "note" {
+				if resp.Res.Kind == "profile" {
+					found++
+				} else if resp.Res.Kind == "note" {
 					found++
 					suite.Equal(shared.ID, resp.Res.ID, "note-id mismatch")
 					suite.Equal(4, len(resp.Changes[0].Delta.(NoteDelta)), "wrong number of deltas for note")
@@ -576,7 +590,7 @@ func (suite *SessionTests) TestAnonConsumePhoneShare() {
 
 			}
 		}
-		suite.Equal(3, found, "not all expected responses received")
+		suite.Equal(4, found, "not all expected responses received")
 		// see if sessA got hold of the new peer
 		suite.awaitAddPeer(clientA, clientB.session.uid, shared)
 	})
@@ -607,12 +621,12 @@ func (suite *SessionTests) TestAnonLogin() {
 	if suite.NotNil(shadow, "returned session did not contain a profile shadow") {
 		profile := shadow.res.Value.(Profile)
 		suite.Equal(user.UID, profile.User.UID, "new session's profile-user has wrong UID")
-		suite.Equal(1, profile.User.Tier, "new session's user is not signed up")
+		suite.Equal(int64(1), profile.User.Tier, "new session's user is not signed up")
 	}
 	// check if folio contains 3 notes
 	shadow = extractShadow(sessA, "folio")
 	if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-		folio := shadow.res.Value.(Folio)
+		folio := shadow.res.Value.(Folio).NoteRefs
 		suite.Equal(3, len(folio), "folio has the wrong number of notes")
 	}
 }
@@ -626,7 +640,7 @@ func (suite *SessionTests) TestAnonWithVerifyEmailToken() {
 		Tag:  "test",
 		Res:  Resource{Kind: "profile", ID: user.UID},
 		Changes: []Edit{{
-			Clock: SessionClock{0, 0, 0},
+			Clock: Clock{CV: 0, SV: 0},
 			Delta: ProfileDelta{
 				UserChange{Op: "set-email", Path: "user/", Value: "test@hiroapp.com"},
 			},
@@ -670,7 +684,7 @@ func (suite *SessionTests) TestAnonWithVerifyEmailToken() {
 		if suite.NotNil(shadow, "returned session did not contain a profile shadow") {
 			profile := shadow.res.Value.(Profile)
 			suite.Equal(user.UID, profile.User.UID, "new session's profile-user has wrong UID. expected `%s`, got `%s`", user.UID, profile.User.UID)
-			suite.Equal(1, profile.User.Tier, "new session's user is not signed up")
+			suite.Equal(int64(1), profile.User.Tier, "new session's user is not signed up")
 
 			// check if the email is verified
 			err := suite.srv.Store.Load(&shadow.res)
@@ -680,7 +694,7 @@ func (suite *SessionTests) TestAnonWithVerifyEmailToken() {
 
 		shadow = extractShadow(sessA, "folio")
 		if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-			folio := shadow.res.Value.(Folio)
+			folio := shadow.res.Value.(Folio).NoteRefs
 			suite.Equal(3, len(folio), "folio has the wrong number of notes. expected 3, got %s", len(folio))
 		}
 
@@ -700,11 +714,12 @@ func (suite *SessionTests) TestUserConsumeURLShare() {
 
 		err = suite.srv.Handle(Event{SID: clientB.session.sid, Name: "token-consume", Token: shareToken})
 		suite.NoError(err, "cannot consume token")
-		// we're gonna get 3 responses: the token-consume echo, the folio update and the note-sync
-		responses := [3]Event{}
-		for i := 0; i < 3; i++ {
+		// we're gonna get 4 responses: the token-consume echo, the folio
+		// and profile (new contact) updates and the note-sync
+		responses := [4]Event{}
+		for i := 0; i < 4; i++ {
 			responses[i], err = clientB.awaitResponse()
-			if !suite.NoError(err, "%d responses missing", 3-i) {
+			if !suite.NoError(err, "%d responses missing", 4-i) {
 				break
 			}
 		}
@@ -715,7 +730,9 @@ func (suite *SessionTests) TestUserConsumeURLShare() {
 				found++
 				continue
 			case "res-sync":
-				if resp.Res.Kind == "note" {
+				if resp.Res.Kind == "profile" {
+					found++
+				} else if resp.Res.Kind == "note" {
 					found++
 					suite.Equal(shared.ID, resp.Res.ID, "note-id mismatch")
 					// expecting 3 deltas: set-token & 2*add-peer (sessA and sessB users)
@@ -735,7 +752,7 @@ func (suite *SessionTests) TestUserConsumeURLShare() {
 
 			}
 		}
-		suite.Equal(3, found, "not all expected responses received")
+		suite.Equal(4, found, "not all expected responses received")
 		suite.awaitAddPeer(clientA, sessB.uid, shared)
 	})
 }
@@ -753,11 +770,12 @@ func (suite *SessionTests) TestUserConsumeEmailShare() {
 
 		err = suite.srv.Handle(Event{SID: sessB.sid, Name: "token-consume", Token: shareToken, ctx: clientB.ctx()})
 		suite.NoError(err, "no respons to token-consume")
-		// we're gonna get 3 responses: the token-consume echo, the folio update and the note-sync
-		responses := [3]Event{}
-		for i := 0; i < 3; i++ {
+		// we're gonna get 4 responses: the token-consume echo, the folio
+		// and profile (new contact) updates and the note-sync
+		responses := [4]Event{}
+		for i := 0; i < 4; i++ {
 			responses[i], err = clientB.awaitResponse()
-			if !suite.NoError(err, "%d responses missing", 3-i) {
+			if !suite.NoError(err, "%d responses missing", 4-i) {
 				break
 			}
 		}
@@ -768,7 +786,9 @@ func (suite *SessionTests) TestUserConsumeEmailShare() {
 				found++
 				continue
 			case "res-sync":
-				if resp.Res.Kind == "note" {
+				if resp.Res.Kind == "profile" {
+					found++
+				} else if resp.Res.Kind == "note" {
 					found++
 					suite.Equal(shared.ID, resp.Res.ID, "note-id mismatch")
 					// expecting 3 deltas: set-token & 3*add-peer (sessA, sessB and email-invite user)
@@ -788,7 +808,7 @@ func (suite *SessionTests) TestUserConsumeEmailShare() {
 
 			}
 		}
-		suite.Equal(3, found, "not all expected responses received")
+		suite.Equal(4, found, "not all expected responses received")
 		// see if sessA got hold of the new peer
 		suite.awaitAddPeer(clientA, sessB.uid, shared)
 	})
@@ -806,11 +826,12 @@ func (suite *SessionTests) TestUserConsumePhoneShare() {
 		sessB := clientB.session
 
 		err = suite.srv.Handle(Event{SID: sessB.sid, Name: "token-consume", Token: shareToken, ctx: clientB.ctx()})
-		// we're gonna get 3 responses: the token-consume echo, the folio update and the note-sync
-		responses := [3]Event{}
-		for i := 0; i < 3; i++ {
+		// we're gonna get 4 responses: the token-consume echo, the folio
+		// and profile (new contact) updates and the note-sync
+		responses := [4]Event{}
+		for i := 0; i < 4; i++ {
 			responses[i], err = clientB.awaitResponse()
-			if !suite.NoError(err, "%d responses missing", 3-i) {
+			if !suite.NoError(err, "%d responses missing", 4-i) {
 				break
 			}
 		}
@@ -821,7 +842,9 @@ func (suite *SessionTests) TestUserConsumePhoneShare() {
 				found++
 				continue
 			case "res-sync":
-				if resp.Res.Kind == "note" {
+				if resp.Res.Kind == "profile" {
+					found++
+				} else if resp.Res.Kind == "note" {
 					found++
 					suite.Equal(shared.ID, resp.Res.ID, "note-id mismatch")
 					// expecting 3 deltas: set-token & 3*add-peer (sessA, sessB and email-invite user)
@@ -841,7 +864,7 @@ func (suite *SessionTests) TestUserConsumePhoneShare() {
 
 			}
 		}
-		suite.Equal(3, found, "not all expected responses received")
+		suite.Equal(4, found, "not all expected responses received")
 		// see if sessA got hold of the new peer
 		suite.awaitAddPeer(clientA, sessB.uid, shared)
 	})
@@ -866,7 +889,7 @@ func (suite *SessionTests) TestInvitedWithVerifyEmailToken() {
 		Tag:  "test",
 		Res:  Resource{Kind: "profile", ID: userB.UID},
 		Changes: []Edit{{
-			Clock: SessionClock{0, 0, 0},
+			Clock: Clock{CV: 0, SV: 0},
 			Delta: ProfileDelta{
 				UserChange{Op: "set-email", Path: "user/", Value: "test@hiroapp.com"},
 			},
@@ -893,7 +916,7 @@ func (suite *SessionTests) TestInvitedWithVerifyEmailToken() {
 		suite.NoError(err, "session-create response (of invitee) did not arrive")
 		// overwrite old (anon)session
 		if resp.Session == nil {
-			log.Println("WUWUUWWU %s", resp)
+			suite.T().Logf("session-create response: %s", resp)
 			suite.T().Fatal("empty session received")
 		}
 		// overwrite with newly created session
@@ -906,7 +929,7 @@ func (suite *SessionTests) TestInvitedWithVerifyEmailToken() {
 		if suite.NotNil(shadow, "returned session did not contain a profile shadow") {
 			profile := shadow.res.Value.(Profile)
 			suite.Equal(userB.UID, profile.User.UID, "new session's profile-user has wrong UID")
-			suite.Equal(1, profile.User.Tier, "new session's user is not signed up")
+			suite.Equal(int64(1), profile.User.Tier, "new session's user is not signed up")
 
 			// check if the email is verified
 			err := suite.srv.Store.Load(&shadow.res)
@@ -915,7 +938,7 @@ func (suite *SessionTests) TestInvitedWithVerifyEmailToken() {
 		}
 		shadow = extractShadow(sessB, "folio")
 		if suite.NotNil(shadow, "returned session did not contain a folio shadow") {
-			folio := shadow.res.Value.(Folio)
+			folio := shadow.res.Value.(Folio).NoteRefs
 			suite.Equal(3, len(folio), "folio has the wrong number of notes")
 			found := false
 			for i := range folio {
@@ -935,7 +958,7 @@ func (suite *SessionTests) addNote(client Client) Resource {
 		SID:     sess.sid,
 		Tag:     "test",
 		Res:     Resource{Kind: "folio", ID: sess.uid},
-		Changes: []Edit{{SessionClock{0, 0, 0}, FolioDelta{{"add-noteref", "", NoteRef{NID: "test", Status: "active"}}}}},
+		Changes: []Edit{{Clock: Clock{CV: 0, SV: 0}, Delta: FolioDelta{{"add-noteref", "", NoteRef{NID: "test", Status: "active"}}}}},
 		ctx:     client.ctx(),
 	})
 	suite.NoError(err, "add-noteref failed (request)")
@@ -977,31 +1000,17 @@ func (suite *SessionTests) addNote(client Client) Resource {
 		SID:     sess.sid,
 		Tag:     resp.Tag,
 		Res:     resp.Res,
-		Changes: []Edit{{SessionClock{0, 1, 0}, NoteDelta{}}}})
+		Changes: []Edit{{Clock: Clock{CV: 0, SV: 1}, Delta: NoteDelta{}}}})
 	return res
 }
 
 func resetDB(db *sql.DB) error {
-	txn, err := db.Begin()
-	if err != nil {
-		return err
+	// every test gets a fresh database file, see SetupTest
+	for _, qry := range allTables {
+		if _, err := db.Exec(qry); err != nil {
+			return err
+		}
 	}
-	txn.Exec(DROP_USERS)
-	txn.Exec(DROP_NOTES)
-	txn.Exec(DROP_TOKENS)
-	txn.Exec(DROP_SESSIONS)
-	txn.Exec(DROP_CONTACTS)
-	txn.Exec(DROP_NOTEREFS)
-	txn.Exec(DROP_STRIPETOKENS)
-
-	txn.Exec(CREATE_USERS)
-	txn.Exec(CREATE_NOTES)
-	txn.Exec(CREATE_TOKENS)
-	txn.Exec(CREATE_SESSIONS)
-	txn.Exec(CREATE_CONTACTS)
-	txn.Exec(CREATE_NOTEREFS)
-	txn.Exec(CREATE_STRIPETOKENS)
-	txn.Commit()
 	return nil
 }
 
@@ -1020,7 +1029,7 @@ func TestSessionSuite(t *testing.T) {
 }
 func TestSessionSerialize(t *testing.T) {
 	profile := Profile{User: User{UID: "uid:test"}, Contacts: []User{User{UID: "uid:contact1"}, User{UID: "uid:contact2"}}}
-	folio := Folio{NoteRef{NID: "nid:one", Status: "active"}, NoteRef{NID: "nid:two", Status: "archived"}}
+	folio := Folio{NoteRefs: []NoteRef{NoteRef{NID: "nid:one", Status: "active"}, NoteRef{NID: "nid:two", Status: "archived"}}, Folders: []Folder{}}
 
 	ts := time.Now()
 	sess := NewSession("sid:test", "uid:test")
@@ -1,7 +1,6 @@
 package diffsync
 
 import (
-	"log"
 	"sync"
 	"time"
 
@@ -15,13 +14,19 @@ type SQLSessions struct {
 	sessbuff chan *Session
 	uidCache map[string]string
 	uidLock  sync.Mutex
+	// deleted holds the uids of deleted users, their sessions must not
+	// be re-created by runners which are still about to save them
+	deleted map[string]bool
+	log     *Logger
 }
 
-func NewSQLSessions(db *sql.DB) *SQLSessions {
+func NewSQLSessions(db *sql.DB, log *Logger) *SQLSessions {
 	return &SQLSessions{
 		db:       db,
+		log:      log,
 		sessbuff: make(chan *Session, 256),
 		uidCache: map[string]string{},
+		deleted:  map[string]bool{},
 	}
 }
 
@@ -46,8 +51,22 @@ func (store *SQLSessions) Get(sid string) (*Session, error) {
 
 func (store *SQLSessions) Save(session *Session) error {
 	// is an upsert, needs doc
-	log.Printf("sessionbackend: saving %s", session.sid)
-	res, err := store.db.Exec("UPDATE sessions SET uid = $1, data = cast($2 as text), saved_at = now() WHERE sid = $3", session.uid, session, session.sid)
+	store.uidLock.Lock()
+	deleted := store.deleted[session.uid]
+	store.uidLock.Unlock()
+	if deleted {
+		store.log.Debug("sessionbackend: not saving session of deleted user", Fields{"sid": session.sid})
+		return nil
+	}
+	store.log.Debug("sessionbackend: saving session", Fields{"sid": session.sid})
+	defer stats.SessionSaveDuration.ObserveSince(time.Now())
+	data, err := session.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	stats.SessionSaveBytes.Observe(float64(len(data)))
+	now := time.Now()
+	res, err := store.db.Exec("UPDATE sessions SET uid = $1, data = cast($2 as text), saved_at = $3 WHERE sid = $4", session.uid, string(data), now, session.sid)
 	if err != nil {
 		return err
 	}
@@ -57,7 +76,7 @@ func (store *SQLSessions) Save(session *Session) error {
 		return nil
 	}
 	// nothing was updated, need to create session
-	_, err = store.db.Exec("INSERT INTO sessions (sid, uid, data, saved_at) VALUES ($1, $2, $3, now())", session.sid, session.uid, session)
+	_, err = store.db.Exec("INSERT INTO sessions (sid, uid, data, saved_at) VALUES ($1, $2, $3, $4)", session.sid, session.uid, string(data), now)
 	return err
 }
 
@@ -77,6 +96,19 @@ func (store *SQLSessions) GetUID(sid string) (string, error) {
 	return uid, nil
 }
 
+// ForgetUser is called after uid has been deleted. Sessions of the user
+// won't resolve anymore and are never saved again.
+func (store *SQLSessions) ForgetUser(uid string) {
+	store.uidLock.Lock()
+	defer store.uidLock.Unlock()
+	for sid := range store.uidCache {
+		if store.uidCache[sid] == uid {
+			delete(store.uidCache, sid)
+		}
+	}
+	store.deleted[uid] = true
+}
+
 func (store *SQLSessions) SessionsOfUser(uid string) ([]string, error) {
 	sids := []string{}
 	rows, err := store.db.Query("SELECT sid FROM sessions WHERE uid = $1 AND status = 'active' AND created_at > $2", uid, time.Now().Add((-1)*SessionLifetime))
@@ -96,7 +128,7 @@ func (store *SQLSessions) SessionsOfUser(uid string) ([]string, error) {
 
 func (store *SQLSessions) GetSubscriptions(res Resource) (map[string]Resource, error) {
 	switch res.Kind {
-	case "note":
+	case "note", "checklist":
 		// get all sessions of all users who have a noteref for this note
 		return store.subsByQuery(res, "SELECT uid FROM noterefs WHERE nid = $1", res.ID)
 	case "folio":
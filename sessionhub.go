@@ -2,7 +2,6 @@ package diffsync
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"sync"
 	"time"
@@ -10,12 +9,41 @@ import (
 
 type SessionHub struct {
 	inbox       chan Event
-	runner_done chan string
-	active      map[string]chan Event
+	runner_idle chan runnerSignal
+	runner_done chan runnerSignal
+	overflowed  chan string
+	active      map[string]*sessionQueue
 	backend     SessionBackend
 	stopch      chan struct{}
 	shutdown    chan struct{}
 	wg          sync.WaitGroup
+	log         *Logger
+	queueSize   int
+	overflow    OverflowPolicy
+	debounce    flushDebounce
+	drainch     chan Event
+	handoverch  chan handoverRequest
+	draining    bool
+	released    map[string]bool
+	forward     EventHandler
+	// stopping holds the inboxes of runners which have been told to stop
+	// but did not save their session yet, and waiting the events which
+	// arrived for those sessions in the meantime
+	stopping map[string]*sessionQueue
+	waiting  map[string][]Event
+}
+
+// runnerSignal identifies a runner by its inbox. A session may get a new
+// runner before the hub hears back from the old one, signals of stale
+// runners are ignored.
+type runnerSignal struct {
+	sid   string
+	inbox *sessionQueue
+}
+
+type handoverRequest struct {
+	farewell Event
+	stopped  chan (<-chan struct{})
 }
 
 type InvalidEventError struct{}
@@ -32,21 +60,40 @@ func (err ResponseTimeoutErr) Error() string {
 	return fmt.Sprintf("response to sessions timed out. sid: `%s`", err.sid)
 }
 
-func NewSessionHub(backend SessionBackend) *SessionHub {
+func NewSessionHub(backend SessionBackend, cfg Config) *SessionHub {
 	return &SessionHub{
-		inbox:       make(chan Event),
-		runner_done: make(chan string, 64),
-		active:      map[string]chan Event{},
+		inbox:       make(chan Event, cfg.HubInboxSize),
+		runner_idle: make(chan runnerSignal, 64),
+		runner_done: make(chan runnerSignal, 64),
+		overflowed:  make(chan string, 64),
+		active:      map[string]*sessionQueue{},
+		stopping:    map[string]*sessionQueue{},
+		waiting:     map[string][]Event{},
 		backend:     backend,
 		stopch:      make(chan struct{}),
 		shutdown:    make(chan struct{}),
 		wg:          sync.WaitGroup{},
+		log:         cfg.Logger,
+		queueSize:   cfg.SessionQueueSize,
+		overflow:    cfg.OverflowPolicy,
+		debounce:    flushDebounce{window: cfg.FlushDebounce, maxDelay: cfg.FlushMaxDelay},
+		drainch:     make(chan Event),
+		handoverch:  make(chan handoverRequest),
+		released:    map[string]bool{},
+		forward:     cfg.Forward,
 	}
 }
 
 func (hub *SessionHub) Handle(event Event) error {
 	if event.SID != "" {
-		hub.inbox <- event
+		// routing must never block, Handle is called from session runners
+		// and request handlers which would otherwise pile up behind a
+		// busy hub
+		select {
+		case hub.inbox <- event:
+		default:
+			hub.inboxOverflow(event)
+		}
 		return nil
 	}
 	if event.UID != "" {
@@ -84,36 +131,100 @@ func (hub *SessionHub) Handle(event Event) error {
 
 func (hub *SessionHub) Run() {
 	// spawn the hubrunner
-	log.Println("sessionhub: entering main loop")
+	hub.log.Info("sessionhub: entering main loop")
 	defer close(hub.stopch)
 	for {
 		select {
-		case sid := <-hub.runner_done:
-			log.Printf("sessionhub: sess-runner signaled shutdown %s\n", sid)
-			// close channel and remove from active runners
-			hub.cleanup_runner(sid)
+		case sig := <-hub.runner_idle:
+			if hub.active[sig.sid] == sig.inbox {
+				hub.log.Debug("sessionhub: sess-runner idle, stopping it", Fields{"sid": sig.sid})
+				hub.stopRunner(sig.sid)
+			}
+		case sig := <-hub.runner_done:
+			hub.log.Debug("sessionhub: sess-runner stopped", Fields{"sid": sig.sid})
+			hub.runnerStopped(sig)
+		case sid := <-hub.overflowed:
+			hub.log.Warn("sessionhub: events for session dropped, terminating runner", Fields{"sid": sid})
+			hub.stopRunner(sid)
 		case event := <-hub.inbox:
+			stats.HubInboxDepth.Set(float64(len(hub.inbox)))
 			hub.logEvent(event)
-			log.Println(hub.toSession(event))
+			if err := hub.toSession(event); err != nil {
+				hub.log.Warn("sessionhub: could not deliver event", eventFields(event), Fields{"err": err})
+			}
+		case farewell := <-hub.drainch:
+			hub.log.Info("sessionhub: draining active runners", Fields{"num_runners": len(hub.active)})
+			hub.draining = true
+			for sid, inbox := range hub.active {
+				farewell.SID = sid
+				inbox.closeWith(farewell)
+				delete(hub.active, sid)
+			}
+			stats.ActiveRunners.Set(0)
+		case req := <-hub.handoverch:
+			sid := req.farewell.SID
+			hub.log.Info("sessionhub: handing over session", Fields{"sid": sid})
+			hub.released[sid] = true
+			inbox, ok := hub.active[sid]
+			if !ok {
+				// no runner, nothing to wait for
+				inbox = newSessionQueue(0, hub.overflow)
+				close(inbox.stopped)
+			} else {
+				delete(hub.active, sid)
+				inbox.closeWith(req.farewell)
+				stats.ActiveRunners.Set(float64(len(hub.active)))
+			}
+			req.stopped <- inbox.stopped
 		case <-hub.shutdown:
 			return
 		}
 	}
 }
 
+// Drain stops all active runners. Each runner handles farewell as its last
+// event, which gives it the chance to flush pending changes and notify its
+// client, and then saves its session. From now on no new runners will be
+// started. Drain reports whether all runners stopped within timeout.
+func (hub *SessionHub) Drain(farewell Event, timeout time.Duration) bool {
+	hub.drainch <- farewell
+	done := make(chan struct{})
+	go func() {
+		hub.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Handover stops the runner of farewell.SID the same way Drain does, and
+// marks the session as released: all further events addressed to it will be
+// passed on to the configured forward handler. The returned channel is
+// closed once the runner saved the session.
+func (hub *SessionHub) Handover(farewell Event) <-chan struct{} {
+	req := handoverRequest{farewell: farewell, stopped: make(chan (<-chan struct{}), 1)}
+	hub.handoverch <- req
+	return <-req.stopped
+}
+
 func (hub *SessionHub) Stop() {
-	log.Println("sessionhub: stop requested")
+	hub.log.Info("sessionhub: stop requested")
 	// first shut hub inbox
 	close(hub.shutdown)
 	hub.wg.Wait()
-	log.Println("sessionhub: stopped.")
+	hub.log.Info("sessionhub: stopped")
 }
 
 func (hub *SessionHub) handleInvalidSession(err error, event Event) {
 	if e, ok := err.(ErrInvalidSession); ok {
 		// only notify client if it exists and is of same SID this event is addressed to
 		if event.ctx.sid == event.SID && event.ctx.Client != nil {
-			log.Println("clientpush session-terminated")
+			hub.log.Info("sessionhub: pushing invalid-session remark to client", eventFields(event), Fields{"remark": e.Slug()})
+			stats.FatalRemarks.Inc(e.Slug())
 			event.ctx.Client.Handle(Event{SID: event.SID,
 				Tag:    event.Tag,
 				Name:   event.Name,
@@ -122,17 +233,34 @@ func (hub *SessionHub) handleInvalidSession(err error, event Event) {
 			})
 		}
 	} else {
-		event.ctx.LogError(fmt.Errorf("error retrieving session `%s`: %s", event.SID, err))
+		ctx := event.ctx
+		ctx.sid = event.SID
+		ctx.LogError(fmt.Errorf("error retrieving session: %s", err))
 	}
 }
 
 func (hub *SessionHub) toSession(event Event) error {
 	// if session has an active runner, get its inbox
 	inbox, ok := hub.active[event.SID]
+	if !ok && (hub.draining || hub.released[event.SID]) {
+		// session is not ours anymore
+		hub.forwardEvent(event)
+		return nil
+	}
+	if _, stopping := hub.stopping[event.SID]; !ok && stopping {
+		// the session must be saved by its old runner before a new one may
+		// load it, hold back the event until then
+		if len(hub.waiting[event.SID]) >= hub.queueSize {
+			hub.log.Warn("sessionhub: too many events for stopping session, dropped event", eventFields(event))
+			return nil
+		}
+		hub.waiting[event.SID] = append(hub.waiting[event.SID], event)
+		return nil
+	}
 	if !ok {
 		// no active runner found
 		// fetch session from sessionstore
-		inbox = make(chan Event, 32)
+		inbox = newSessionQueue(hub.queueSize, hub.overflow)
 		session, err := hub.backend.Get(event.SID)
 		if err != nil {
 			go hub.handleInvalidSession(err, event)
@@ -142,53 +270,130 @@ func (hub *SessionHub) toSession(event Event) error {
 		hub.wg.Add(1)
 		go checkInbox(inbox, session, hub)
 		hub.active[event.SID] = inbox
+		stats.ActiveRunners.Set(float64(len(hub.active)))
+	}
+	// note: pushing to the inbox never blocks, a slow runner must not be
+	// able to stall the hub
+	switch inbox.push(event) {
+	case pushDropped:
+		hub.log.Warn("sessionhub: session inbox full, dropped event", eventFields(event), Fields{"policy": hub.overflow})
+		notifyBusy(event)
+	case pushTerminate:
+		hub.log.Warn("sessionhub: session inbox overflowed, terminating runner", eventFields(event))
+		hub.stopRunner(event.SID)
 	}
-	inbox <- event
 	return nil
 }
 
-func checkInbox(inbox <-chan Event, session *Session, hub *SessionHub) {
+// inboxOverflow handles an event which did not fit into the hub's inbox. The
+// event is dropped; under OverflowTerminate the session's runner is stopped
+// as well, so that it reloads a consistent state instead of silently missing
+// an update.
+func (hub *SessionHub) inboxOverflow(event Event) {
+	stats.HubOverflows.Inc(hub.overflow.String())
+	hub.log.Warn("sessionhub: hub inbox full, dropped event", eventFields(event), Fields{"policy": hub.overflow})
+	notifyBusy(event)
+	if hub.overflow == OverflowTerminate {
+		select {
+		case hub.overflowed <- event.SID:
+		default:
+		}
+	}
+}
+
+// notifyBusy tells the client which sent event itself that it was dropped
+// and should be retried later
+func notifyBusy(event Event) {
+	if event.ctx.sid != event.SID || event.ctx.Client == nil {
+		return
+	}
+	go event.ctx.Client.Handle(Event{SID: event.SID,
+		Tag:    event.Tag,
+		Name:   event.Name,
+		Res:    event.Res,
+		Remark: &Remark{Level: "error", Slug: "session-busy"},
+	})
+}
+
+func (hub *SessionHub) forwardEvent(event Event) {
+	if hub.forward == nil {
+		hub.log.Debug("sessionhub: dropping event for released session", eventFields(event))
+		return
+	}
+	go func() {
+		if err := hub.forward.Handle(event); err != nil {
+			hub.log.Warn("sessionhub: could not forward event for released session", eventFields(event), Fields{"err": err})
+		}
+	}()
+}
+
+func checkInbox(inbox *sessionQueue, session *Session, hub *SessionHub) {
+	defer close(inbox.stopped)
 	defer func(sid, uid string, h *SessionHub) {
 		if e := recover(); e != nil {
 			(Context{uid: uid}).LogCritical(fmt.Errorf("runtime panic: %v", e))
-			hub.runner_done <- session.sid
 		}
 		//signal shuwdown of runner to hub
+		h.signal(h.runner_done, runnerSignal{sid, inbox})
 		h.wg.Done()
-		log.Printf("session[%s]: runner stopped.", sid[:6])
+		session.log.Debug("runner stopped")
 	}(session.sid, session.uid, hub)
 	if session == nil {
 		panic("NILSESSION")
 	}
 	if session.sid == "" {
-		log.Println(session)
 		panic("EMPTY SID")
 	}
-
-	log.Printf("(sessionhub starting runner for %s)", session.sid)
+	session.log = hub.log.With(Fields{"sid": session.sid, "uid": session.uid})
+	session.debounce = hub.debounce
+	session.log.Debug("starting runner")
 	saveTicker := time.Tick(1 * time.Minute)
 	// event loop runs is being executed for the
 	// whole lifetime of this runner.
 	idleTimeout := time.After(5 * time.Minute)
 	unsavedChanges := false
+	// fires when deferred taints of the session are due to be flushed
+	var flushTimer <-chan time.Time
 CheckInbox:
 	for {
 		select {
-		case event, ok := <-inbox:
-			if !ok {
-				log.Printf("session[%s]: inbox shut down; stopping runner", session.sid[:6])
+		case <-inbox.ready:
+			for event, ok := inbox.pop(); ok; event, ok = inbox.pop() {
+				session.Handle(event)
+				unsavedChanges = true
+			}
+			if session.gone {
+				session.log.Debug("session is gone; stopping runner")
 				break CheckInbox
 			}
-			session.Handle(event)
+			flushTimer = deferredFlushTimer(session)
 			idleTimeout = time.After(5 * time.Minute)
-			unsavedChanges = true
+		case <-flushTimer:
+			if !session.flushIfDue(time.Now()) {
+				// timer was armed with an outdated deadline
+				flushTimer = deferredFlushTimer(session)
+				continue
+			}
+			flushTimer = nil
+		case <-inbox.done:
+			// process whatever arrived before the inbox was shut down
+			for event, ok := inbox.pop(); ok; event, ok = inbox.pop() {
+				session.Handle(event)
+				unsavedChanges = true
+			}
+			if inbox.farewell != nil {
+				session.Handle(*inbox.farewell)
+				unsavedChanges = true
+			}
+			session.log.Debug("inbox shut down; stopping runner")
+			break CheckInbox
 		case <-hub.stopch:
-			log.Printf("session[%s]: stop requested", session.sid[:6])
+			session.log.Debug("stop requested")
 			break CheckInbox
 		case <-idleTimeout:
 			// idle for too long, shut down
-			log.Printf("session[%s]: no action for 5 minutes; stopping runner", session.sid[:6])
-			hub.runner_done <- session.sid
+			session.log.Debug("no action for 5 minutes; stopping runner")
+			hub.signal(hub.runner_idle, runnerSignal{session.sid, inbox})
 		case <-saveTicker:
 			// persist sessiondata periodically
 			if unsavedChanges {
@@ -197,22 +402,72 @@ CheckInbox:
 			}
 		}
 	}
+	if session.gone {
+		// the session has been deleted along with its user
+		return
+	}
+	// don't let the client miss out on deferred changes
+	session.flushPending()
 	// persist session before shutting down runner
 	if unsavedChanges {
 		hub.backend.Save(session)
 	}
 }
 
+func deferredFlushTimer(session *Session) <-chan time.Time {
+	deadline, ok := session.flushDeadline()
+	if !ok {
+		return nil
+	}
+	return time.After(deadline.Sub(time.Now()))
+}
+
 func (hub *SessionHub) logEvent(event Event) {
 	//TODO(flo) write event to some persistent datastore
 	// in case of a server crash or restart, this log will
 	// be used to replay any unhandled events.
-	log.Printf("event-log: received %s\n", event)
+	hub.log.Sample("event-log", 20).Debug("event-log: received event", eventFields(event))
+	stats.Events.Inc(eventLabel(event.Name))
 }
 
-func (hub *SessionHub) cleanup_runner(sid string) {
+// stopRunner closes the inbox of sid's runner. Until the runner saved the
+// session, events for sid are held back, see toSession.
+func (hub *SessionHub) stopRunner(sid string) {
 	if inbox, ok := hub.active[sid]; ok {
 		delete(hub.active, sid)
-		close(inbox)
+		hub.stopping[sid] = inbox
+		inbox.close()
+		stats.ActiveRunners.Set(float64(len(hub.active)))
+	}
+}
+
+// runnerStopped forgets about a runner which exited and passes on the events
+// which were held back for its session
+func (hub *SessionHub) runnerStopped(sig runnerSignal) {
+	switch {
+	case hub.stopping[sig.sid] == sig.inbox:
+		delete(hub.stopping, sig.sid)
+	case hub.active[sig.sid] == sig.inbox:
+		// exited on its own, e.g. due to a panic
+		delete(hub.active, sig.sid)
+		stats.ActiveRunners.Set(float64(len(hub.active)))
+	default:
+		return
+	}
+	waiting := hub.waiting[sig.sid]
+	delete(hub.waiting, sig.sid)
+	for _, event := range waiting {
+		if err := hub.toSession(event); err != nil {
+			hub.log.Warn("sessionhub: could not deliver event", eventFields(event), Fields{"err": err})
+		}
+	}
+}
+
+// signal is used by runners to notify the hub, it gives up once the hub
+// has stopped
+func (hub *SessionHub) signal(ch chan runnerSignal, sig runnerSignal) {
+	select {
+	case ch <- sig:
+	case <-hub.stopch:
 	}
 }
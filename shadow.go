@@ -3,12 +3,12 @@ package diffsync
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
 )
 
 type SyncResult struct {
 	tainted []Resource
+	remarks []Remark
 }
 
 type Shadow struct {
@@ -52,15 +52,19 @@ func (shadow *Shadow) AddEdit(edit Edit) {
 	shadow.pending = append(shadow.pending, edit)
 }
 
-func (shadow *Shadow) UpdatePending(forceEmptyDelta bool, store *Store) bool {
+// UpdatePending adds the changes of the master version, as seen by uid, to
+// the pending edits
+func (shadow *Shadow) UpdatePending(forceEmptyDelta bool, store *Store, uid string) bool {
 	res := shadow.res.Ref()
-	log.Printf("shadow[%s]: calculating new delta and upate pending-queue\n", res.StringRef())
 	if err := store.Load(&res); err != nil {
-		log.Printf("shadow[%s]: error - could not load master-version for update. err: %s", res.StringRef(), err)
+		store.log.Error("could not load master-version for update", Fields{"res": res.StringRef(), "err": err})
+	}
+	if v, ok := res.Value.(restrictedValue); ok {
+		res.Value = v.viewOf(uid)
 	}
 	delta := shadow.res.Value.GetDelta(res.Value)
-	log.Printf("shadow[%s]: found delta: `%s`\n", res.StringRef(), delta)
 	if delta.HasChanges() {
+		store.log.Sample("shadow-delta", 20).Debug("found delta, updating pending-queue", Fields{"res": res.StringRef()})
 		shadow.AddEdit(Edit{delta, shadow.res.Value, shadow.Clock.Clone()})
 		shadow.res = res
 		shadow.SV++
@@ -82,7 +86,6 @@ func (s *Shadow) svCheck(sv int64) bool {
 		return true
 	}
 	// Versions diverged, check backups in pending queue for
-	log.Println("sessionclock: SV mismatch, restoring backup")
 	for i := range s.pending {
 		if s.pending[i].SV == sv {
 			s.SV = sv
@@ -96,7 +99,10 @@ func (s *Shadow) svCheck(sv int64) bool {
 
 func (shadow *Shadow) SyncIncoming(edit Edit, result *SyncResult, ctx Context) error {
 	// Make sure clocks are in sync or recoverable
-	log.Printf("shadow[%s]: sync incoming edit: `%v`\n", shadow.res.StringRef(), edit)
+	log := ctx.Log().With(Fields{"res": shadow.res.StringRef()})
+	if shadow.SV != edit.SV {
+		log.Info("SV mismatch, restoring backup", Fields{"client_sv": edit.SV, "server_sv": shadow.SV})
+	}
 	if !shadow.svCheck(edit.SV) {
 		return Remark{
 			Level: "fatal",
@@ -123,7 +129,7 @@ func (shadow *Shadow) SyncIncoming(edit Edit, result *SyncResult, ctx Context) e
 	if !edit.Delta.HasChanges() {
 		return nil
 	}
-	log.Printf("received delta: %s", edit.Delta)
+	log.Sample("shadow-incoming", 20).Debug("applying incoming delta", Fields{"cv": edit.CV, "sv": edit.SV})
 	newres, patches, err := edit.Delta.Apply(shadow.res.Value)
 	if err != nil {
 		return Remark{
@@ -136,8 +142,17 @@ func (shadow *Shadow) SyncIncoming(edit Edit, result *SyncResult, ctx Context) e
 	shadow.CV++
 	// send patches to store
 	for i := range patches {
-		log.Printf("found patch: %s", patches[i])
+		log.Sample("shadow-patch", 20).Debug("patching store", Fields{"op": patches[i].Op})
 		err := ctx.store.Patch(shadow.res.Ref(), patches[i], result, ctx)
+		if r, ok := err.(Remark); ok && r.Level != "fatal" {
+			// the store rejected the change, e.g. because of a quota. the
+			// edit itself has been received though, so the shadow stays in
+			// line with the client's and the next delta will revert the
+			// change on the client.
+			log.Info("patch rejected", Fields{"op": patches[i].Op, "remark": r.Slug})
+			result.remarks = append(result.remarks, r)
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -146,13 +161,34 @@ func (shadow *Shadow) SyncIncoming(edit Edit, result *SyncResult, ctx Context) e
 }
 
 func (s *Shadow) MarshalJSON() ([]byte, error) {
+	pending := make([]map[string]interface{}, len(s.pending))
+	for i, edit := range s.pending {
+		pending[i] = map[string]interface{}{
+			"delta":  edit.Delta,
+			"backup": storedValue(edit.Backup),
+			"clock":  edit.Clock,
+		}
+	}
+	res := map[string]interface{}{"kind": s.res.Kind, "id": s.res.ID}
+	if s.res.Value != nil {
+		res["val"] = storedValue(s.res.Value)
+	}
 	return json.Marshal(map[string]interface{}{
-		"res":     s.res,
-		"pending": s.pending,
+		"res":     res,
+		"pending": pending,
 		"clock":   s.Clock,
 	})
 }
 
+// storedValue returns what is stored of value in sessions. Unlike on the
+// wire, folios keep their folders.
+func storedValue(value ResourceValue) interface{} {
+	if folio, ok := value.(Folio); ok {
+		return folioState{folio.NoteRefs, folio.Folders}
+	}
+	return value
+}
+
 func (shadow *Shadow) UnmarshalJSON(from []byte) error {
 	// It is rather unfortunate, that we have to implement
 	// such a clumsy JSON unmarshaler, taking care of proper
@@ -200,14 +236,14 @@ func (shadow *Shadow) UnmarshalJSON(from []byte) error {
 			shadow.pending[i] = Edit{Clock: tmp.Pending[i].Clock, Delta: delta, Backup: backup}
 		}
 	case "folio":
-		folio := Folio{}
+		folio := NewFolio()
 		if err := json.Unmarshal(tmp.Res.RawValue, &folio); err != nil {
 			return err
 		}
 		shadow.res.Value = folio
 		for i := range tmp.Pending {
 			delta := FolioDelta{}
-			backup := Folio{}
+			backup := NewFolio()
 			if err := json.Unmarshal(tmp.Pending[i].RawDelta, &delta); err != nil {
 				return err
 			}
@@ -233,6 +269,23 @@ func (shadow *Shadow) UnmarshalJSON(from []byte) error {
 			}
 			shadow.pending[i] = Edit{Clock: tmp.Pending[i].Clock, Delta: delta, Backup: backup}
 		}
+	case "checklist":
+		checklist := NewChecklist()
+		if err := json.Unmarshal(tmp.Res.RawValue, &checklist); err != nil {
+			return err
+		}
+		shadow.res.Value = checklist
+		for i := range tmp.Pending {
+			delta := ChecklistDelta{}
+			backup := NewChecklist()
+			if err := json.Unmarshal(tmp.Pending[i].RawDelta, &delta); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(tmp.Pending[i].RawBackup, &backup); err != nil {
+				return err
+			}
+			shadow.pending[i] = Edit{Clock: tmp.Pending[i].Clock, Delta: delta, Backup: backup}
+		}
 	}
 	return nil
 }
@@ -247,6 +300,10 @@ func (sr *SyncResult) Tainted(r Resource) {
 	sr.tainted = append(sr.tainted, r)
 }
 
+func (sr *SyncResult) Remarks() []Remark {
+	return sr.remarks
+}
+
 func (sr *SyncResult) TaintedItems() []Resource {
 	return sr.tainted
 }
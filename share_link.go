@@ -0,0 +1,234 @@
+package diffsync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ShareLink is a share-url token of a note with its own options. Owners create
+// them via the add-share-link op, everybody holding the link's token can join
+// the note with the link's role.
+type ShareLink struct {
+	ID string `json:"id"`
+	// Token is issued by the server. Only its hash is stored, the owner
+	// creating the link receives it once with a share-link-created Remark.
+	Token string `json:"token,omitempty"`
+	// Role is either viewer (read-only) or editor
+	Role      string    `json:"role"`
+	ExpiresAt *UnixTime `json:"expires_at,omitempty"`
+	MaxUses   int64     `json:"max_uses,omitempty"`
+	Uses      int64     `json:"uses"`
+	Protected bool      `json:"protected"`
+	// Password is only sent by clients creating a link. It's never stored
+	// or synced in plaintext.
+	Password string `json:"password,omitempty"`
+}
+
+type ShareLinkList []ShareLink
+
+// MarshalJSON leaves out the password, links are stored in shadows and
+// backups and sent to peers
+func (link ShareLink) MarshalJSON() ([]byte, error) {
+	type plainLink ShareLink
+	l := plainLink(link)
+	l.Password = ""
+	return json.Marshal(l)
+}
+
+const (
+	linkRoleViewer = "viewer"
+	linkRoleEditor = "editor"
+	// maxShareLinkID limits the length of client chosen link IDs
+	maxShareLinkID = 32
+)
+
+var (
+	errShareLinkInvalid   = Remark{Level: "error", Slug: "share-link-invalid"}
+	errLinkPasswordNeeded = Remark{Level: "error", Slug: "password-required"}
+)
+
+func (link ShareLink) equals(other ShareLink) bool {
+	sameExpiry := link.ExpiresAt == other.ExpiresAt ||
+		(link.ExpiresAt != nil && other.ExpiresAt != nil && time.Time(*link.ExpiresAt).Equal(time.Time(*other.ExpiresAt)))
+	link.ExpiresAt, other.ExpiresAt = nil, nil
+	return sameExpiry && link == other
+}
+
+func (links ShareLinkList) indexFromPath(path string) (int, bool) {
+	if !strings.HasPrefix(path, "share_links/") {
+		return 0, false
+	}
+	id := path[12:]
+	for i := range links {
+		if links[i].ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (link ShareLink) pathRef() string {
+	return "share_links/" + link.ID
+}
+
+func diffShareLinks(old, master ShareLinkList) NoteDelta {
+	delta := NoteDelta{}
+	for _, link := range master {
+		idx, ok := old.indexFromPath(link.pathRef())
+		switch {
+		case !ok:
+			delta = append(delta, NoteDeltaElement{"add-share-link", "share_links/", link})
+		case !old[idx].equals(link):
+			delta = append(delta, NoteDeltaElement{"set-share-link", link.pathRef(), link})
+		}
+	}
+	for _, link := range old {
+		if _, ok := master.indexFromPath(link.pathRef()); !ok {
+			delta = append(delta, NoteDeltaElement{Op: "rem-share-link", Path: link.pathRef()})
+		}
+	}
+	return delta
+}
+
+// tokenRole maps the role granted by a token to the role of the noteref
+// created for its consumer
+func tokenRole(token Token) string {
+	if token.Role == linkRoleViewer {
+		return "viewer"
+	}
+	return "peer"
+}
+
+// checkLinkPassword makes sure the consumer of a password protected share
+// link knows its password
+func (tok *TokenConsumer) checkLinkPassword(token Token, creds *Credentials) error {
+	if token.password == "" {
+		return nil
+	}
+	if creds == nil || creds.Password == "" {
+		return errLinkPasswordNeeded
+	}
+	ok, err := checkPassword(creds.Password, token.password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+func (backend NoteSQLBackend) getShareLinks(nid string) (ShareLinkList, error) {
+	rows, err := backend.db.Query(`SELECT sl.id, t.role, t.expires_at, COALESCE(t.max_consumptions, 0), t.times_consumed, t.password IS NOT NULL
+								   FROM share_links AS sl
+								     JOIN tokens AS t ON t.token = sl.token_hash
+								   WHERE sl.nid = $1 AND t.revoked_at IS NULL
+								   ORDER BY sl.created_at`, nid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := ShareLinkList{}
+	for rows.Next() {
+		link := ShareLink{}
+		var expiresAt *time.Time
+		if err = rows.Scan(&link.ID, &link.Role, &expiresAt, &link.MaxUses, &link.Uses, &link.Protected); err != nil {
+			return nil, err
+		}
+		if expiresAt != nil {
+			ts := UnixTime(*expiresAt)
+			link.ExpiresAt = &ts
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// addShareLink issues the token of a new link. The plaintext token is handed
+// to the creator via result and cannot be recovered later on.
+func (backend NoteSQLBackend) addShareLink(nid string, link ShareLink, result *SyncResult, ctx Context) error {
+	if link.Role == "" {
+		link.Role = linkRoleEditor
+	}
+	if link.ID == "" || len(link.ID) > maxShareLinkID || link.MaxUses < 0 || (link.Role != linkRoleViewer && link.Role != linkRoleEditor) {
+		return errShareLinkInvalid
+	}
+	var password *string
+	if link.Password != "" {
+		hashed, err := hashPassword(link.Password)
+		if err != nil {
+			return err
+		}
+		password = &hashed
+	}
+	var expiresAt *time.Time
+	if link.ExpiresAt != nil {
+		ts := time.Time(*link.ExpiresAt)
+		expiresAt = &ts
+	}
+	var maxUses *int64
+	if link.MaxUses > 0 {
+		maxUses = &link.MaxUses
+	}
+	plain, hashed := GenerateToken()
+	_, err := backend.db.Exec("INSERT INTO tokens (token, kind, uid, nid, created_by, expires_at, max_consumptions, role, password) VALUES ($1, 'share-url', '', $2, $3, $4, $5, $6, $7)",
+		hashed, nid, ctx.uid, expiresAt, maxUses, link.Role, password)
+	if err != nil {
+		return err
+	}
+	if _, err = backend.db.Exec("INSERT INTO share_links (id, nid, token_hash, created_by) VALUES ($1, $2, $3, $4)", link.ID, nid, hashed, ctx.uid); err != nil {
+		return fmt.Errorf("notesqlbackend: could not store share-link `%s` of note(%s): %s", link.ID, nid, err)
+	}
+	result.remarks = append(result.remarks, Remark{Level: "info", Slug: "share-link-created", Data: map[string]string{"id": link.ID, "token": plain}})
+	return nil
+}
+
+func (backend NoteSQLBackend) remShareLink(nid, id string) error {
+	var hashed string
+	err := backend.db.QueryRow("SELECT token_hash FROM share_links WHERE nid = $1 AND id = $2", nid, id).Scan(&hashed)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err = backend.db.Exec("UPDATE tokens SET revoked_at = $1 WHERE token = $2", time.Now(), hashed); err != nil {
+		return err
+	}
+	_, err = backend.db.Exec("DELETE FROM share_links WHERE nid = $1 AND id = $2", nid, id)
+	return err
+}
+
+// role returns the role of ctx's user on the note, or an empty string if the
+// user has no access
+func (backend NoteSQLBackend) role(nid string, ctx Context) (string, error) {
+	var role string
+	err := backend.db.QueryRow("SELECT role FROM noterefs WHERE nid = $1 AND uid = $2", nid, ctx.uid).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// viewerOps are the ops viewers may apply to a note, they don't change its
+// content or peers
+var viewerOps = map[string]bool{"set-cursor": true, "set-seen": true, "add-comment": true}
+
+// checkPermission returns a permission-denied Remark if ctx's user is not
+// allowed to apply the given op to the note. Viewers can only apply
+// viewerOps, only owners can manage its share links.
+func (backend NoteSQLBackend) checkPermission(nid, op string, ctx Context) error {
+	if ctx.uid == "sys" {
+		return nil
+	}
+	role, err := backend.role(nid, ctx)
+	if err != nil {
+		return err
+	}
+	if (role == "viewer" && !viewerOps[op]) || (strings.HasSuffix(op, "share-link") && role != "owner") {
+		return Remark{Level: "error", Slug: "permission-denied", Data: map[string]string{"op": op, "role": role}}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package diffsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareLinkDelta(t *testing.T) {
+	shadow := NewNote("")
+	link := ShareLink{ID: "l1", Role: "viewer", Password: "secret"}
+	newres, patches, err := NoteDelta{{Op: "add-share-link", Path: "share_links/", Value: link}}.Apply(shadow)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, shadow.ShareLinks, 0, "shadow modified in place")
+	assert.Equal(t, []Patch{{Op: "add-share-link", Value: link}}, patches)
+	assert.Equal(t, "", newres.(Note).ShareLinks[0].Password, "password kept in shadow")
+	raw, _ := json.Marshal(NoteDelta{{Op: "add-share-link", Path: "share_links/", Value: link}})
+	assert.NotContains(t, string(raw), "secret", "password serialized")
+
+	// the server fills in the token and drops the password
+	master := NewNote("")
+	master.ShareLinks = ShareLinkList{{ID: "l1", Role: "viewer", Token: "abc", Protected: true}}
+	delta := newres.GetDelta(master).(NoteDelta)
+	assert.Equal(t, NoteDelta{{"set-share-link", "share_links/l1", master.ShareLinks[0]}}, delta)
+	newres, patches, _ = delta.Apply(newres)
+	assert.Len(t, patches, 0, "set-share-link must not be persisted")
+	assert.Equal(t, master.ShareLinks, newres.(Note).ShareLinks)
+
+	_, patches, _ = NoteDelta{{Op: "rem-share-link", Path: "share_links/l1"}}.Apply(newres)
+	assert.Equal(t, []Patch{{Op: "rem-share-link", Path: "l1"}}, patches)
+}
+
+func TestShareLinks(t *testing.T) {
+	defer fastScrypt()()
+	db := testDB(t, allTables...)
+	defer db.Close()
+	db.Exec("INSERT INTO users (uid, tier) VALUES ('uid00001', 1), ('uid00002', 1), ('uid00003', 0)")
+	db.Exec("INSERT INTO notes (nid, title) VALUES ('nid00001', 'title')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ('nid00001', 'uid00001', 'owner'), ('nid00001', 'uid00002', 'peer'), ('nid00001', 'uid00003', 'viewer')")
+	backend := NewNoteSQLBackend(db)
+	tok := NewTokenConsumer(nil, db, defaultLogger)
+	ctx := Context{uid: "uid00002"}
+	patch := Patch{Op: "add-share-link", Value: ShareLink{ID: "l1", Role: "viewer", MaxUses: 1, Password: "secret"}}
+
+	err := backend.Patch("nid00001", patch, NewSyncResult(), ctx)
+	if assert.IsType(t, Remark{}, err) {
+		assert.Equal(t, "permission-denied", err.(Remark).Slug, "peers must not create share links")
+	}
+	ctx.uid = "uid00001"
+	result := NewSyncResult()
+	if !assert.NoError(t, backend.Patch("nid00001", patch, result, ctx)) || !assert.Len(t, result.Remarks(), 1) {
+		return
+	}
+	// the token is handed out once and never stored in plaintext
+	created := result.Remarks()[0]
+	assert.Equal(t, "share-link-created", created.Slug)
+	assert.Equal(t, "l1", created.Data["id"])
+	var n int
+	db.QueryRow("SELECT count(*) FROM share_links WHERE token_hash = $1", hashToken(created.Data["token"])).Scan(&n)
+	assert.Equal(t, 1, n)
+	value, err := backend.Get("nid00001")
+	if !assert.NoError(t, err) || !assert.Len(t, value.(Note).ShareLinks, 1) {
+		return
+	}
+	link := value.(Note).ShareLinks[0]
+	assert.Equal(t, "l1", link.ID)
+	assert.Equal(t, "viewer", link.Role)
+	assert.Equal(t, int64(1), link.MaxUses)
+	assert.True(t, link.Protected)
+	assert.Empty(t, link.Password)
+	assert.Empty(t, link.Token)
+
+	token, err := tok.getToken(created.Data["token"])
+	if assert.NoError(t, err) {
+		assert.Equal(t, "viewer", tokenRole(token))
+		assert.Equal(t, errLinkPasswordNeeded, tok.checkLinkPassword(token, nil))
+		assert.Equal(t, errInvalidCredentials, tok.checkLinkPassword(token, &Credentials{Password: "wrong"}))
+		assert.NoError(t, tok.checkLinkPassword(token, &Credentials{Password: "secret"}))
+	}
+
+	// viewers are read-only, apart from commenting
+	ctx.uid = "uid00003"
+	for _, p := range []Patch{
+		{Op: "title", Value: "new", OldValue: "title"},
+		{Op: "rem-peer", Path: "uid00001"},
+		{Op: "resolve-comment", Path: "c1", Value: true},
+	} {
+		err = backend.Patch("nid00001", p, NewSyncResult(), ctx)
+		if assert.IsType(t, Remark{}, err, p.Op) {
+			assert.Equal(t, "permission-denied", err.(Remark).Slug)
+		}
+	}
+	assert.Equal(t, 3, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = 'nid00001'"))
+	assert.NoError(t, backend.Patch("nid00001", Patch{Op: "add-comment", Path: "c1", Value: Comment{ID: "c1", Text: "nice"}}, NewSyncResult(), ctx))
+
+	ctx.uid = "uid00001"
+	assert.NoError(t, backend.Patch("nid00001", Patch{Op: "rem-share-link", Path: "l1"}, NewSyncResult(), ctx))
+	_, err = tok.getToken(created.Data["token"])
+	assert.Equal(t, Remark{Level: "error", Slug: "token-revoked"}, err)
+	value, _ = backend.Get("nid00001")
+	assert.Len(t, value.(Note).ShareLinks, 0)
+}
+
+func TestSharingTokenHiddenFromViewers(t *testing.T) {
+	note := NewNote("")
+	note.SharingToken = "secret"
+	note.Peers = PeerList{{User: User{UID: "uid00001"}, Role: "owner"}, {User: User{UID: "uid00002"}, Role: "peer"}, {User: User{UID: "uid00003"}, Role: "viewer"}}
+	assert.Equal(t, "secret", note.viewOf("uid00001").(Note).SharingToken)
+	assert.Equal(t, "secret", note.viewOf("uid00002").(Note).SharingToken)
+	assert.Empty(t, note.viewOf("uid00003").(Note).SharingToken)
+	assert.Empty(t, note.viewOf("uid00004").(Note).SharingToken)
+	assert.Equal(t, "secret", note.SharingToken)
+
+	// viewers' shadows never learn about it
+	notes := NewMemBackend(func() ResourceValue { return NewNote("") })
+	notes.Upsert("nid00001", note)
+	store := NewStore(nil)
+	store.Mount("note", &countingBackend{MemBackend: notes})
+	shadow := NewShadow(Resource{Kind: "note", ID: "nid00001", Value: NewNote("")})
+	assert.True(t, shadow.UpdatePending(false, store, "uid00003"))
+	assert.NotContains(t, fmt.Sprint(shadow.pending[0].Delta), "secret")
+	assert.Empty(t, shadow.res.Value.(Note).SharingToken)
+}
@@ -0,0 +1,106 @@
+package diffsync
+
+import "strings"
+
+// Sort keys order noterefs and folders within a folio. They are strings over
+// sortKeyDigits, compared bytewise, which never end in the zero digit. That
+// way there is always room for another key between two keys, and moving an
+// item only ever changes its own key: concurrent reorders from two devices
+// touch different rows and merge without conflict.
+const sortKeyDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sortKeyBetween returns a key which sorts after a and before b. An empty a
+// means "before everything", an empty b "after everything".
+func sortKeyBetween(a, b string) string {
+	if b != "" && a >= b {
+		// invalid bounds, rather sort after a than fail
+		b = ""
+	}
+	if b != "" {
+		// keep the common prefix, pad a with zeros
+		n := 0
+		for n < len(b) && sortKeyDigitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(a) {
+				rest = a[n:]
+			}
+			return b[:n] + sortKeyBetween(rest, b[n:])
+		}
+	}
+	lo := 0
+	if a != "" {
+		lo = strings.IndexByte(sortKeyDigits, a[0])
+	}
+	hi := len(sortKeyDigits)
+	if b != "" {
+		hi = strings.IndexByte(sortKeyDigits, b[0])
+	}
+	if hi-lo > 1 {
+		return string(sortKeyDigits[(lo+hi)/2])
+	}
+	// the first digits are adjacent
+	if len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if len(a) > 1 {
+		rest = a[1:]
+	}
+	return string(sortKeyDigits[lo]) + sortKeyBetween(rest, "")
+}
+
+func sortKeyDigitAt(key string, i int) byte {
+	if i < len(key) {
+		return key[i]
+	}
+	return sortKeyDigits[0]
+}
+
+func validSortKey(key string) bool {
+	if key == "" || key[len(key)-1] == sortKeyDigits[0] {
+		return false
+	}
+	for i := range key {
+		if strings.IndexByte(sortKeyDigits, key[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// lastSortKey returns the highest of keys
+func lastSortKey(keys []string) string {
+	last := ""
+	for _, key := range keys {
+		if key > last {
+			last = key
+		}
+	}
+	return last
+}
+
+type noteRefsByKey []NoteRef
+
+func (refs noteRefsByKey) Len() int      { return len(refs) }
+func (refs noteRefsByKey) Swap(i, j int) { refs[i], refs[j] = refs[j], refs[i] }
+func (refs noteRefsByKey) Less(i, j int) bool {
+	// concurrent inserts may pick the same key
+	if refs[i].SortKey == refs[j].SortKey {
+		return refs[i].NID < refs[j].NID
+	}
+	return refs[i].SortKey < refs[j].SortKey
+}
+
+type foldersByKey []Folder
+
+func (folders foldersByKey) Len() int      { return len(folders) }
+func (folders foldersByKey) Swap(i, j int) { folders[i], folders[j] = folders[j], folders[i] }
+func (folders foldersByKey) Less(i, j int) bool {
+	if folders[i].SortKey == folders[j].SortKey {
+		return folders[i].Path < folders[j].Path
+	}
+	return folders[i].SortKey < folders[j].SortKey
+}
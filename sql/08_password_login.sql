@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN failed_logins smallint NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN locked_until timestamptz DEFAULT NULL;
@@ -0,0 +1,14 @@
+CREATE TABLE "identities" (
+    provider varchar(32) NOT NULL,
+    subject varchar(255) NOT NULL,
+    uid varchar(10) NOT NULL,
+    email varchar(255) default '',
+    created_at timestamptz default NOW(),
+    PRIMARY KEY (provider, subject),
+    CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE
+);
+CREATE INDEX identities_uid_idx ON identities (uid);
+
+-- carry over existing facebook logins
+INSERT INTO identities (provider, subject, uid)
+    SELECT 'facebook', fb_uid, uid FROM users WHERE fb_uid <> '';
@@ -0,0 +1,6 @@
+-- align with the column name used by the application
+ALTER TABLE users RENAME COLUMN stripe_customer_id TO stripe_cust_id;
+CREATE INDEX users_stripe_cust_id_idx ON users (stripe_cust_id) WHERE stripe_cust_id <> '';
+
+-- stripe_tokens holds the ids of processed billing events
+CREATE UNIQUE INDEX stripe_tokens_token_idx ON stripe_tokens (token);
@@ -0,0 +1,12 @@
+ALTER TABLE tokens ADD COLUMN revoked_at timestamptz DEFAULT NULL;
+
+CREATE TABLE "token_consumptions" (
+    token varchar(128) NOT NULL,
+    uid varchar(10) default '',
+    sid varchar(32) default '',
+    consumed_at timestamptz default NOW(),
+    CONSTRAINT fk_token FOREIGN KEY (token) REFERENCES "tokens" (token) ON DELETE CASCADE
+);
+CREATE INDEX token_consumptions_token_idx ON token_consumptions (token);
+CREATE INDEX tokens_nid_idx ON tokens (nid) WHERE nid <> '';
+CREATE INDEX tokens_uid_idx ON tokens (uid) WHERE uid <> '';
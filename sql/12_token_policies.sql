@@ -0,0 +1,3 @@
+-- per-token overrides of the token kind's policy
+ALTER TABLE tokens ADD COLUMN expires_at timestamptz DEFAULT NULL;
+ALTER TABLE tokens ADD COLUMN max_consumptions smallint DEFAULT NULL;
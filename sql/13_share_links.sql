@@ -0,0 +1,17 @@
+ALTER TYPE noteref_role ADD VALUE 'viewer';
+
+-- share links grant a role and may be protected by a password
+ALTER TABLE tokens ADD COLUMN role varchar(16) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN password varchar(255) DEFAULT NULL;
+
+CREATE TABLE "share_links" (
+    id varchar(32) NOT NULL,
+    nid varchar(10) NOT NULL,
+    token varchar(32) NOT NULL,
+    token_hash varchar(128) NOT NULL,
+    created_by varchar(10) default '',
+    created_at timestamptz default NOW(),
+    PRIMARY KEY (nid, id),
+    CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE,
+    CONSTRAINT fk_token FOREIGN KEY (token_hash) REFERENCES "tokens" (token) ON DELETE CASCADE
+);
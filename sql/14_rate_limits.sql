@@ -0,0 +1,7 @@
+-- token buckets of the SQLRateLimitStore
+CREATE TABLE "rate_limits" (
+    key varchar(255) PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamptz NOT NULL
+);
+CREATE INDEX rate_limits_updated_at_idx ON rate_limits (updated_at);
@@ -0,0 +1,4 @@
+-- confirms account-delete events
+ALTER TYPE token_kind ADD VALUE 'delete-account';
+-- owned notes of deleted accounts are transferred to their oldest peer
+ALTER TABLE noterefs ADD COLUMN created_at timestamptz DEFAULT now();
@@ -0,0 +1,12 @@
+-- folders and manual ordering of the folio
+ALTER TABLE noterefs ADD COLUMN folder varchar(1024) NOT NULL DEFAULT '';
+ALTER TABLE noterefs ADD COLUMN sort_key varchar(255) NOT NULL DEFAULT '';
+
+CREATE TABLE "folders" (
+    uid varchar(10) NOT NULL,
+    path varchar(1024) NOT NULL,
+    sort_key varchar(255) NOT NULL DEFAULT '',
+    created_at timestamptz default NOW(),
+    PRIMARY KEY (uid, path),
+    CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE
+);
@@ -0,0 +1,11 @@
+-- private tags of a user's noterefs
+CREATE TABLE "noteref_tags" (
+    uid varchar(10) NOT NULL,
+    nid varchar(10) NOT NULL,
+    tag varchar(64) NOT NULL,
+    created_at timestamptz default NOW(),
+    PRIMARY KEY (uid, nid, tag),
+    CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE,
+    CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE
+);
+CREATE INDEX noteref_tags_tag_idx ON noteref_tags (uid, tag);
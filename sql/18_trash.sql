@@ -0,0 +1,5 @@
+-- pinned noterefs and a trash which is purged after Config.TrashRetention
+ALTER TYPE noteref_status ADD VALUE 'trashed';
+ALTER TABLE noterefs ADD COLUMN pinned boolean NOT NULL DEFAULT false;
+ALTER TABLE noterefs ADD COLUMN trashed_at timestamptz DEFAULT NULL;
+CREATE INDEX noterefs_trashed_at_idx ON noterefs (trashed_at) WHERE status = 'trashed';
@@ -0,0 +1,5 @@
+-- full-text index of each note's title and text, kept up to date by the
+-- server (see SearchIndex)
+ALTER TABLE notes ADD COLUMN search tsvector;
+UPDATE notes SET search = setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', txt), 'B');
+CREATE INDEX notes_search_idx ON notes USING gin (search);
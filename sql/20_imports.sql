@@ -0,0 +1,10 @@
+-- notes imported from elsewhere, so re-imports don't create duplicates
+CREATE TABLE "imports" (
+    uid varchar(10) NOT NULL,
+    source text NOT NULL,
+    nid varchar(10) NOT NULL,
+    created_at timestamptz default NOW(),
+    PRIMARY KEY (uid, source),
+    CONSTRAINT fk_uid FOREIGN KEY (uid) REFERENCES "users" (uid) ON DELETE CASCADE,
+    CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE
+);
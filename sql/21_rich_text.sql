@@ -0,0 +1,12 @@
+-- rich-text notes: the format of a note and the marks formatting its text
+ALTER TABLE notes ADD COLUMN format varchar(10) NOT NULL DEFAULT '';
+CREATE TABLE "note_marks" (
+    nid varchar(10) NOT NULL,
+    id varchar(32) NOT NULL,
+    type varchar(16) NOT NULL,
+    start_pos integer NOT NULL,
+    end_pos integer NOT NULL,
+    value text DEFAULT '',
+    PRIMARY KEY (nid, id),
+    CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE
+);
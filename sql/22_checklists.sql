@@ -0,0 +1,13 @@
+-- checklist notes: the kind of a note and the items of checklists
+ALTER TABLE notes ADD COLUMN kind varchar(10) NOT NULL DEFAULT '';
+CREATE TABLE "checklist_items" (
+    nid varchar(10) NOT NULL,
+    id varchar(32) NOT NULL,
+    txt text NOT NULL DEFAULT '',
+    checked boolean NOT NULL DEFAULT false,
+    assignee varchar(10) NOT NULL DEFAULT '',
+    due timestamptz DEFAULT NULL,
+    sort_key varchar(64) NOT NULL DEFAULT '',
+    PRIMARY KEY (nid, id),
+    CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE
+);
@@ -0,0 +1,15 @@
+-- threaded comments anchored to text ranges of notes
+CREATE TABLE "note_comments" (
+    nid varchar(10) NOT NULL,
+    id varchar(32) NOT NULL,
+    thread varchar(32) NOT NULL DEFAULT '',
+    author varchar(10) NOT NULL DEFAULT '',
+    txt text NOT NULL DEFAULT '',
+    start_pos integer NOT NULL DEFAULT 0,
+    end_pos integer NOT NULL DEFAULT 0,
+    resolved boolean NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (nid, id),
+    CONSTRAINT fk_nid FOREIGN KEY (nid) REFERENCES "notes" (nid) ON DELETE CASCADE
+);
+CREATE INDEX note_comments_thread ON note_comments (nid, thread);
@@ -0,0 +1,2 @@
+-- share link tokens are only stored hashed, see tokens.token
+ALTER TABLE share_links DROP COLUMN token;
@@ -0,0 +1,3 @@
+-- issue time of the latest billing event applied to the user, older
+-- events delivered late are ignored
+ALTER TABLE users ADD COLUMN billing_event_at timestamptz;
@@ -5,6 +5,17 @@ DROP TABLE IF EXISTS "contacts" CASCADE;
 DROP TABLE IF EXISTS "sessions" CASCADE;
 DROP TABLE IF EXISTS "tokens" CASCADE;
 DROP TABLE IF EXISTS "stripe_tokens" CASCADE;
+DROP TABLE IF EXISTS "identities" CASCADE;
+DROP TABLE IF EXISTS "token_consumptions" CASCADE;
+DROP TABLE IF EXISTS "share_links" CASCADE;
+DROP TABLE IF EXISTS "rate_limits" CASCADE;
+DROP TABLE IF EXISTS "note_changelog" CASCADE;
+DROP TABLE IF EXISTS "folders" CASCADE;
+DROP TABLE IF EXISTS "noteref_tags" CASCADE;
+DROP TABLE IF EXISTS "imports" CASCADE;
+DROP TABLE IF EXISTS "note_marks" CASCADE;
+DROP TABLE IF EXISTS "checklist_items" CASCADE;
+DROP TABLE IF EXISTS "note_comments" CASCADE;
 
 DROP TYPE noteref_status;
 DROP TYPE noteref_role;
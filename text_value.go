@@ -3,7 +3,6 @@ package diffsync
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 
 	"encoding/json"
@@ -13,7 +12,6 @@ import (
 
 var (
 	dmp = DMP.New()
-	_   = log.Print
 	_   = fmt.Print
 )
 
@@ -64,7 +62,6 @@ func (patch textPatch) Patch(val ResourceValue) (ResourceValue, error) {
 }
 
 func (delta TextDelta) HasChanges() bool {
-	log.Println("DELTA", delta)
 	if string(delta) == "" {
 		return false
 	}
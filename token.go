@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -17,16 +16,6 @@ import (
 	"database/sql"
 )
 
-var tokenLifeTimes = map[string]time.Duration{
-	"anon": 5 * time.Minute,
-	//"login":     5 * 24 * time.Hour,
-	"login":          2 * 7 * 24 * time.Hour,    //2 weeks for now, so that sent-out login tokens to alpha users live a little longer
-	"login-campaign": 2 * 7 * 24 * time.Hour,    //2 weeks for now
-	"verify":         2 * 7 * 24 * time.Hour,    //2 weeks
-	"share-url":      3 * 30.5 * 24 * time.Hour, //3 months
-	"share":          1 * 30.5 * 24 * time.Hour, //1 month
-}
-
 type Token struct {
 	Key           string
 	Kind          string
@@ -37,54 +26,85 @@ type Token struct {
 	ValidFrom     *time.Time
 	TimesConsumed int64
 	CreatedBy     string
+	// ExpiresAt and MaxConsumptions override the TokenPolicy of the
+	// token's kind, if set
+	ExpiresAt       *time.Time
+	MaxConsumptions *int64
+	// Role granted by share links, see ShareLink
+	Role string
+	// password is the hash of a share link's password
+	password string
 }
 
-func (t Token) Expired() bool {
-	lt, _ := tokenLifeTimes[t.Kind]
-	return time.Now().After(t.ValidFrom.Add(lt))
+type TokenConsumer struct {
+	db        *sql.DB
+	sessions  SessionBackend
+	log       *Logger
+	providers map[string]IdentityProvider
+	policies  TokenPolicies
+	// lazyMountRecent is the number of notes mounted at session-create
+	// for clients asking for lazy mounting
+	lazyMountRecent int
 }
 
-func (t Token) Exhausted() bool {
-	if t.Kind == "share-url" {
-		return t.TimesConsumed >= 10
+func NewTokenConsumer(backend SessionBackend, db *sql.DB, log *Logger) *TokenConsumer {
+	return &TokenConsumer{
+		db:              db,
+		sessions:        backend,
+		log:             log,
+		providers:       map[string]IdentityProvider{},
+		policies:        DefaultTokenPolicies(),
+		lazyMountRecent: defaultLazyMountRecent,
 	}
-	// NOTE this should be disable a few
-	// days after beta deployment
-	if t.Kind == "login" {
-		return t.TimesConsumed > 4
-	}
-	return t.TimesConsumed > 0
 }
 
-type TokenConsumer struct {
-	db       *sql.DB
-	sessions SessionBackend
-}
-
-func NewTokenConsumer(backend SessionBackend, db *sql.DB) *TokenConsumer {
-	return &TokenConsumer{db, backend}
+func (tok *TokenConsumer) AddIdentityProvider(provider IdentityProvider) {
+	tok.providers[provider.Name()] = provider
 }
 
 func (tok *TokenConsumer) Handle(event Event, next EventHandler) error {
 	var session *Session
 	switch event.Name {
 	case "session-create":
-		token, err := tok.getToken(event.Token)
+		var token Token
+		var err error
+		switch {
+		case event.Credentials != nil && event.Token == "":
+			token, err = tok.authenticate(*event.Credentials)
+		case event.Identity != nil:
+			token, err = tok.authenticateIdentity(*event.Identity, event.ctx)
+		default:
+			token, err = tok.getToken(event.Token)
+			if err == nil && token.Kind == "delete-account" {
+				// only confirms account-delete events
+				err = Remark{Level: "error", Slug: "token-noexist-or-invalid"}
+			}
+			if err == nil {
+				err = tok.checkTier(token, event.SID)
+			}
+			if err == nil {
+				// credentials sent along with a token protect share links
+				err = tok.checkLinkPassword(token, event.Credentials)
+			}
+		}
 		if err != nil {
-			event.ctx.LogInfo("Consumation of token `%s` failed with error: %s", event.Token, err)
+			event.ctx.LogInfo("Consumation of token failed with error: %s", err)
 			if r, ok := err.(Remark); ok {
 				event.Remark = &r
 			} else {
 				event.Remark = &Remark{Level: "error", Slug: "system-error"}
 			}
+			stats.TokenConsumptions.Inc("unknown", event.Remark.Slug)
 			event.ctx.Client.Handle(event)
 			return nil
 		}
 		event.ctx.sid = event.SID
-		session, err = tok.createSession(token, event.ctx)
+		session, err = tok.createSession(token, event.Lazy, event.ctx)
 		if err != nil {
+			stats.TokenConsumptions.Inc(token.Kind, "error")
 			return err
 		}
+		stats.TokenConsumptions.Inc(token.Kind, "ok")
 		// save event.SID in context (if any was sent)
 		if event.SID != "" {
 			event.ctx.sid = event.SID
@@ -93,29 +113,84 @@ func (tok *TokenConsumer) Handle(event Event, next EventHandler) error {
 		}
 		event.ctx.uid = session.uid
 		event.SID = session.sid
-		if err = tok.markConsumed(token); err != nil {
+		if token.Key == "" {
+			// credentials and identities are not stored as tokens,
+			// there is nothing to consume
+			break
+		}
+		if err = tok.markConsumed(token, event.ctx); err != nil {
 			return err
 		}
 	case "token-consume":
 		token, err := tok.getToken(event.Token)
+		if err == nil {
+			err = tok.checkTier(token, event.SID)
+		}
+		if err == nil {
+			err = tok.checkLinkPassword(token, event.Credentials)
+		}
 		if err != nil {
-			event.ctx.LogInfo("Consumation of token `%s` failed with error: %s", event.Token, err)
+			event.ctx.LogInfo("Consumation of token failed with error: %s", err)
 			if r, ok := err.(Remark); ok {
 				event.Remark = &r
 			} else {
 				event.Remark = &Remark{Level: "error", Slug: "system-error"}
 			}
+			stats.TokenConsumptions.Inc("unknown", event.Remark.Slug)
 			event.ctx.Client.Handle(event)
 			return nil
 		}
 		event.ctx.sid = event.SID
 		session, err := tok.consumeToken(token, event.ctx)
 		if err != nil {
+			stats.TokenConsumptions.Inc(token.Kind, "error")
 			return err
 		}
+		stats.TokenConsumptions.Inc(token.Kind, "ok")
 		event.ctx.sid = session.sid
 		event.ctx.uid = session.uid
 		event.SID = session.sid
+	case "token-list", "token-revoke", "token-rotate":
+		uid, err := tok.GetUID(event.SID)
+		if err != nil {
+			return err
+		}
+		event.ctx.uid = uid
+		event.ctx.sid = event.SID
+		return tok.handleTokenAdmin(event)
+	case "search":
+		uid, err := tok.GetUID(event.SID)
+		if err != nil {
+			return err
+		}
+		event.ctx.uid = uid
+		event.ctx.sid = event.SID
+		return tok.handleSearch(event)
+	case "account-delete-request", "account-delete":
+		uid, err := tok.GetUID(event.SID)
+		if err != nil {
+			return err
+		}
+		event.ctx.uid = uid
+		event.ctx.sid = event.SID
+		if event.Name == "account-delete-request" {
+			return tok.handleAccountDeleteRequest(event)
+		}
+		return tok.handleAccountDelete(event)
+	case "identity-link", "identity-unlink":
+		if event.Identity == nil {
+			return InvalidEventError{}
+		}
+		uid, err := tok.GetUID(event.SID)
+		if err != nil {
+			return err
+		}
+		event.ctx.uid = uid
+		event.ctx.sid = event.SID
+		if event.Name == "identity-link" {
+			return tok.handleIdentityLink(event)
+		}
+		return tok.handleIdentityUnlink(event)
 	default:
 		uid, err := tok.GetUID(event.SID)
 		if err != nil {
@@ -127,7 +202,10 @@ func (tok *TokenConsumer) Handle(event Event, next EventHandler) error {
 	return next.Handle(event)
 }
 
-func (tok *TokenConsumer) createSession(token Token, ctx Context) (*Session, error) {
+// createSession sets up the session for token's user. Unless lazy is set,
+// all notes of the user's folio are mounted, otherwise only the most
+// recently edited ones. Clients mount the others on demand with res-add.
+func (tok *TokenConsumer) createSession(token Token, lazy bool, ctx Context) (*Session, error) {
 	store := ctx.store
 	sid := generateSID()
 	var profile Resource
@@ -139,7 +217,7 @@ func (tok *TokenConsumer) createSession(token Token, ctx Context) (*Session, err
 			return nil, err
 		}
 		// add note to folio, if any in token
-		if err = tok.addNoteRef(profile.Value.(Profile).User.UID, token.NID, ctx); err != nil {
+		if err = tok.addNoteRef(profile.Value.(Profile).User.UID, token.NID, tokenRole(token), ctx); err != nil {
 			return nil, err
 		}
 	case "share":
@@ -164,7 +242,7 @@ func (tok *TokenConsumer) createSession(token Token, ctx Context) (*Session, err
 			ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "profile", ID: u.UID}, ctx: ctx})
 		}
 		// add note to folio, if any in token
-		if err = tok.addNoteRef(token.UID, token.NID, ctx); err != nil {
+		if err = tok.addNoteRef(token.UID, token.NID, tokenRole(token), ctx); err != nil {
 			return nil, err
 		}
 		if token.CreatedBy != "" {
@@ -188,8 +266,8 @@ func (tok *TokenConsumer) createSession(token Token, ctx Context) (*Session, err
 		}
 		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "profile", ID: u.UID}, ctx: ctx})
 		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "folio", ID: u.UID}, ctx: ctx})
-	case "login", "login-campaign":
-		// login token
+	case "login", "login-campaign", "password", "identity":
+		// login token, valid credentials or identity
 		// load token's user
 		profile = Resource{Kind: "profile", ID: token.UID}
 		if err = store.Load(&profile); err != nil {
@@ -231,13 +309,24 @@ func (tok *TokenConsumer) createSession(token Token, ctx Context) (*Session, err
 	// load notes and mount shadows
 	// TODO should this happe in the sessionhandler? e.g. only send the session-create
 	//  down and let the handle_session_create() do the rest, load all its info
-	for _, ref := range folio.Value.(Folio) {
-		log.Printf("loading note-shadow into session[%s]: `%s`\n", session.sid, ref.NID)
+	refs := folio.Value.(Folio).NoteRefs
+	if lazy {
+		refs = recentNoteRefs(refs, tok.lazyMountRecent)
+	}
+	for _, ref := range refs {
+		ctx.Log().Sample("mount-note", 20).Debug("loading note-shadow into session", Fields{"new_sid": session.sid, "nid": ref.NID})
 		res := Resource{Kind: "note", ID: ref.NID}
 		if err := store.Load(&res); err != nil {
 			return nil, err
 		}
 		session.shadows = append(session.shadows, NewShadow(res))
+		if ref.Kind == NoteKindChecklist {
+			checklist := Resource{Kind: "checklist", ID: ref.NID}
+			if err := store.Load(&checklist); err != nil {
+				return nil, err
+			}
+			session.shadows = append(session.shadows, NewShadow(checklist))
+		}
 	}
 	if err = tok.sessions.Save(session); err != nil {
 		return nil, err
@@ -270,10 +359,10 @@ func (tok *TokenConsumer) consumeToken(token Token, ctx Context) (*Session, erro
 		// consume token
 		return session, nil
 	}
-	if err = tok.addNoteRef(session.uid, token.NID, ctx); err != nil {
+	if err = tok.addNoteRef(session.uid, token.NID, tokenRole(token), ctx); err != nil {
 		return nil, err
 	}
-	if err = tok.markConsumed(token); err != nil {
+	if err = tok.markConsumed(token, ctx); err != nil {
 		return nil, err
 	}
 	return session, nil
@@ -303,7 +392,7 @@ func (tok *TokenConsumer) snapshotSession(sid string, ctx Context) (*Session, er
 	case <-time.After(5 * time.Second):
 		// request timed out. we'll ignore the old session alltogether
 		// TBD should we fail hard here, so old anon session data never gets lost (because client will retry)?
-		log.Printf("token: could not fetch session data for `%s`. request to hub timed out. ignoring old sessiondata and continue. ", sid)
+		ctx.Log().Warn("token: could not fetch session data, request to hub timed out", Fields{"snapshot_sid": sid})
 		return nil, ResponseTimeoutErr{sid}
 	}
 }
@@ -312,13 +401,13 @@ func (tok *TokenConsumer) notifyInviter(uid, nid string, peer User, ctx Context)
 	// create login token
 	token, hashed := GenerateToken()
 	if _, err := tok.db.Exec("INSERT INTO tokens (token, kind, uid) VALUES ($1, 'login', $2)", hashed, uid); err != nil {
-		log.Printf("error: notifyInviter failed to create logintoken; err: %v", err)
+		ctx.Log().Error("notifyInviter: failed to create logintoken", Fields{"nid": nid, "err": err})
 		return
 	}
 	// collect info about the shared note
 	res := Resource{Kind: "note", ID: nid}
 	if err := ctx.store.Load(&res); err != nil {
-		log.Printf("error: sendInvite could not fetch note info of shared note; err: %v", err)
+		ctx.Log().Error("notifyInviter: could not fetch note info of shared note", Fields{"nid": nid, "err": err})
 		return
 	}
 	note := res.Value.(Note)
@@ -338,49 +427,62 @@ func (tok *TokenConsumer) notifyInviter(uid, nid string, peer User, ctx Context)
 	}
 	res = Resource{Kind: "profile", ID: uid}
 	if err := ctx.store.Load(&res); err != nil {
-		log.Printf("error: notifyInviter could not fetch profile info of inviter; err: %v", err)
+		ctx.Log().Error("notifyInviter: could not fetch profile info of inviter", Fields{"nid": nid, "err": err})
 		return
 	}
 	req := comm.NewRequest("invite-accepted", res.Value.(Profile).User, data)
 	if err := ctx.store.commHandler(req); err != nil {
-		log.Printf("error: sendInvite could not forward request to comm.Handler; err: %v", err)
+		ctx.Log().Error("notifyInviter: could not forward request to comm.Handler", Fields{"nid": nid, "err": err})
 	}
 }
 
-func (tok *TokenConsumer) markConsumed(token Token) (err error) {
-	_, err = tok.db.Exec("UPDATE tokens SET times_consumed = times_consumed+1, last_consumed_at=now() WHERE token = $1", token.Key)
+func (tok *TokenConsumer) markConsumed(token Token, ctx Context) (err error) {
+	now := time.Now()
+	if _, err = tok.db.Exec("UPDATE tokens SET times_consumed = times_consumed+1, last_consumed_at = $1 WHERE token = $2", now, token.Key); err != nil {
+		return err
+	}
+	// keep an audit trail of who used the token
+	if _, err = tok.db.Exec("INSERT INTO token_consumptions (token, uid, sid, consumed_at) VALUES ($1, $2, $3, $4)", token.Key, ctx.uid, ctx.sid, now); err != nil {
+		return err
+	}
 	token.TimesConsumed++
-	if token.Kind == "share-url" && token.Exhausted() {
-		// re-create token
-		plain, hashed := GenerateToken()
-		if _, err = tok.db.Exec("INSERT INTO tokens (token, kind, uid, nid) VALUES ($1, 'share-url', '', $2)", hashed, token.NID); err != nil {
+	if token.Kind == "share-url" && tok.policies[token.Kind].Regenerate && tok.policies.Exhausted(token) {
+		// re-create token, if it's the one the note hands out
+		var current string
+		switch err = tok.db.QueryRow("SELECT sharing_token FROM notes WHERE nid = $1", token.NID).Scan(&current); {
+		case err == sql.ErrNoRows:
+			// note has been deleted meanwhile, nothing to rotate
+			return nil
+		case err != nil:
 			return err
 		}
-		if _, err = tok.db.Exec("UPDATE notes SET sharing_token = $1 WHERE nid = $2", plain, token.NID); err != nil {
-			return err
+		if hashToken(current) == token.Key {
+			_, err = tok.regenerateShareURL(token.NID, ctx)
 		}
 	}
 	return err
 }
 
 func (tok *TokenConsumer) getToken(plain string) (Token, error) {
-	h := sha512.New()
-	io.WriteString(h, plain)
-	hashed := hex.EncodeToString(h.Sum(nil))
 	t := Token{}
-	err := tok.db.QueryRow("SELECT token, kind, uid, nid, email, phone, valid_from, times_consumed, created_by FROM tokens where token = $1", hashed).Scan(&t.Key, &t.Kind, &t.UID, &t.NID, &t.Email, &t.Phone, &t.ValidFrom, &t.TimesConsumed, &t.CreatedBy)
+	var revokedAt *time.Time
+	err := tok.db.QueryRow(`SELECT token, kind, uid, nid, email, phone, valid_from, times_consumed, created_by, revoked_at, expires_at, max_consumptions, role, COALESCE(password, '')
+							FROM tokens where token = $1`, hashToken(plain)).Scan(&t.Key, &t.Kind, &t.UID, &t.NID, &t.Email, &t.Phone, &t.ValidFrom, &t.TimesConsumed, &t.CreatedBy, &revokedAt, &t.ExpiresAt, &t.MaxConsumptions, &t.Role, &t.password)
 	if err == sql.ErrNoRows {
 		return Token{}, Remark{Level: "error", Slug: "token-noexist-or-invalid"}
 	} else if err != nil {
 		return Token{}, err
 	}
-	if t.Expired() {
+	if revokedAt != nil {
+		return Token{}, Remark{Level: "error", Slug: "token-revoked"}
+	}
+	if tok.policies.Expired(t) {
 		return Token{}, Remark{Level: "error", Slug: "token-expired"}
 	}
-	if t.Exhausted() {
+	if tok.policies.Exhausted(t) {
 		return Token{}, Remark{Level: "error", Slug: "token-exhausted", Data: map[string]string{"max-consumes": strconv.Itoa(int(t.TimesConsumed))}}
 	}
-	log.Printf("retrieved token from db: %v\n", t)
+	tok.log.Debug("retrieved token from db", Fields{"kind": t.Kind, "nid": t.NID, "uid": t.UID})
 	return t, nil
 }
 
@@ -444,12 +546,15 @@ func (tok *TokenConsumer) assimilateUser(uidMan, uidBorg string, ctx Context) er
 		txn.Rollback()
 		return err
 	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	// sessions only see the moved noterefs once they are committed
 	for i := range nids {
 		ctx.Router.Handle(Event{UID: uidMan, Name: "res-remove", Res: Resource{Kind: "note", ID: nids[i]}, ctx: ctx})
 		ctx.Router.Handle(Event{UID: uidBorg, Name: "res-add", Res: Resource{Kind: "note", ID: nids[i]}, ctx: ctx})
 		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "note", ID: nids[i]}, ctx: ctx})
 	}
-	txn.Commit()
 	return nil
 }
 func (tok *TokenConsumer) claimIDAndSignup(id string, user User, ctx Context) error {
@@ -514,22 +619,24 @@ func (tok *TokenConsumer) claimIDAndSignup(id string, user User, ctx Context) er
 		txn.Rollback()
 		return err
 	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
 	for i := range nids {
 		ctx.Router.Handle(Event{UID: nids[i][0], Name: "res-remove", Res: Resource{Kind: "note", ID: nids[i][1]}, ctx: ctx})
 		ctx.Router.Handle(Event{UID: user.UID, Name: "res-add", Res: Resource{Kind: "note", ID: nids[i][1]}, ctx: ctx})
 		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "note", ID: nids[i][1]}, ctx: ctx})
 	}
-	txn.Commit()
 	return nil
 }
 
-func (tok *TokenConsumer) addNoteRef(uid, nid string, ctx Context) error {
+func (tok *TokenConsumer) addNoteRef(uid, nid, role string, ctx Context) error {
 	if nid == "" {
 		// no nid provided, nothin to add
 		return nil
 	}
 	res := NewSyncResult()
-	if err := ctx.store.Patch(Resource{Kind: "folio", ID: uid}, Patch{Op: "add-noteref", Value: NoteRef{NID: nid, Status: "active"}}, res, ctx); err != nil {
+	if err := ctx.store.Patch(Resource{Kind: "folio", ID: uid}, Patch{Op: "add-noteref", Value: NoteRef{NID: nid, Status: "active", role: role}}, res, ctx); err != nil {
 		return err
 	}
 	for _, r := range res.TaintedItems() {
@@ -540,6 +647,23 @@ func (tok *TokenConsumer) addNoteRef(uid, nid string, ctx Context) error {
 	return nil
 }
 
+// respond sends event back to the client, with err turned into a Remark
+func (tok *TokenConsumer) respond(event Event, err error) error {
+	if err != nil {
+		r, ok := err.(Remark)
+		if !ok {
+			event.ctx.LogError(fmt.Errorf("%s failed: %s", event.Name, err))
+			r = Remark{Level: "error", Slug: "system-error"}
+		}
+		event.Remark = &r
+	}
+	event.Token = ""
+	if event.ctx.Client == nil {
+		return err
+	}
+	return event.ctx.Client.Handle(event)
+}
+
 func GenerateToken() (string, string) {
 	uuid := make([]byte, 16)
 	if n, err := rand.Read(uuid); err != nil || n != len(uuid) {
@@ -549,8 +673,12 @@ func GenerateToken() (string, string) {
 	uuid[8] = 0x80 // variant bits
 	uuid[4] = 0x40 // v4
 	plain := hex.EncodeToString(uuid)
+	return plain, hashToken(plain)
+}
+
+// hashToken returns the form a token is stored in
+func hashToken(plain string) string {
 	h := sha512.New()
 	io.WriteString(h, plain)
-	hashed := hex.EncodeToString(h.Sum(nil))
-	return plain, hashed
+	return hex.EncodeToString(h.Sum(nil))
 }
@@ -0,0 +1,257 @@
+package diffsync
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenInfo describes an issued token without revealing it. ID is the
+// token's hash and can be used to revoke it.
+type TokenInfo struct {
+	ID            string `json:"id"`
+	Kind          string `json:"kind"`
+	UID           string `json:"uid,omitempty"`
+	NID           string `json:"nid,omitempty"`
+	CreatedBy     string `json:"created_by,omitempty"`
+	TimesConsumed int64  `json:"times_consumed"`
+	// MaxConsumptions is zero for tokens which can be used any number of
+	// times
+	MaxConsumptions int64      `json:"max_consumptions,omitempty"`
+	ValidFrom       time.Time  `json:"valid_from"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+// TokenFilter narrows down the tokens returned by Server.Tokens. Empty
+// fields match every token.
+type TokenFilter struct {
+	UID  string
+	NID  string
+	Kind string
+}
+
+// TokenConsumption is an entry of a token's audit trail
+type TokenConsumption struct {
+	UID        string    `json:"uid"`
+	SID        string    `json:"sid"`
+	ConsumedAt time.Time `json:"consumed_at"`
+}
+
+var errTokenAccessDenied = Remark{Level: "error", Slug: "token-access-denied"}
+
+// Tokens lists all tokens matching filter, newest first
+func (srv *Server) Tokens(filter TokenFilter) ([]TokenInfo, error) {
+	return srv.tokenConsumer.listTokens(filter)
+}
+
+// TokenConsumptions returns who consumed the token with the given ID, and
+// when
+func (srv *Server) TokenConsumptions(id string) ([]TokenConsumption, error) {
+	return srv.tokenConsumer.consumptions(id)
+}
+
+// RevokeToken invalidates the token with the given ID. If it is the current
+// share-url of a note, the note gets a fresh one.
+func (srv *Server) RevokeToken(id string) error {
+	return srv.tokenConsumer.revokeToken(id, srv.adminContext())
+}
+
+// RotateSharingToken revokes the share-url of the given note and returns its
+// successor
+func (srv *Server) RotateSharingToken(nid string) (string, error) {
+	return srv.tokenConsumer.rotateSharingToken(nid, srv.adminContext())
+}
+
+func (srv *Server) adminContext() Context {
+	ctx := NewContext(srv.sessionHub, srv.Store, nil)
+	ctx.uid = "sys"
+	return ctx
+}
+
+func (tok *TokenConsumer) listTokens(filter TokenFilter) ([]TokenInfo, error) {
+	where, args := []string{}, []interface{}{}
+	for _, cond := range []struct{ col, val string }{{"uid", filter.UID}, {"nid", filter.NID}, {"kind", filter.Kind}} {
+		if cond.val == "" {
+			continue
+		}
+		args = append(args, cond.val)
+		where = append(where, fmt.Sprintf("%s = $%d", cond.col, len(args)))
+	}
+	qry := "SELECT token, kind, uid, nid, created_by, times_consumed, valid_from, revoked_at, expires_at, max_consumptions FROM tokens"
+	if len(where) > 0 {
+		qry += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := tok.db.Query(qry+" ORDER BY valid_from DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []TokenInfo{}
+	for rows.Next() {
+		t := Token{}
+		info := TokenInfo{}
+		if err = rows.Scan(&t.Key, &t.Kind, &t.UID, &t.NID, &t.CreatedBy, &t.TimesConsumed, &t.ValidFrom, &info.RevokedAt, &t.ExpiresAt, &t.MaxConsumptions); err != nil {
+			return nil, err
+		}
+		info.ID, info.Kind, info.UID, info.NID, info.CreatedBy = t.Key, t.Kind, t.UID, t.NID, t.CreatedBy
+		info.TimesConsumed = t.TimesConsumed
+		info.MaxConsumptions = tok.policies[t.Kind].MaxConsumptions
+		if t.MaxConsumptions != nil {
+			info.MaxConsumptions = *t.MaxConsumptions
+		}
+		info.ValidFrom = *t.ValidFrom
+		info.ExpiresAt = tok.policies.ExpiresAt(t)
+		tokens = append(tokens, info)
+	}
+	return tokens, rows.Err()
+}
+
+func (tok *TokenConsumer) consumptions(id string) ([]TokenConsumption, error) {
+	rows, err := tok.db.Query("SELECT uid, sid, consumed_at FROM token_consumptions WHERE token = $1 ORDER BY consumed_at", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []TokenConsumption{}
+	for rows.Next() {
+		c := TokenConsumption{}
+		if err = rows.Scan(&c.UID, &c.SID, &c.ConsumedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+func (tok *TokenConsumer) revokeToken(id string, ctx Context) error {
+	var kind, nid string
+	err := tok.db.QueryRow("SELECT kind, nid FROM tokens WHERE token = $1", id).Scan(&kind, &nid)
+	if err == sql.ErrNoRows {
+		return Remark{Level: "error", Slug: "token-noexist-or-invalid"}
+	} else if err != nil {
+		return err
+	}
+	if _, err = tok.db.Exec("UPDATE tokens SET revoked_at = $1 WHERE token = $2 AND revoked_at IS NULL", time.Now(), id); err != nil {
+		return err
+	}
+	tok.log.Info("token revoked", Fields{"kind": kind, "nid": nid, "by": ctx.uid})
+	if kind != "share-url" {
+		return nil
+	}
+	// if the note currently hands out this very token, replace it
+	var current string
+	if err = tok.db.QueryRow("SELECT sharing_token FROM notes WHERE nid = $1", nid).Scan(&current); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if current != "" && hashToken(current) == id {
+		_, err = tok.regenerateShareURL(nid, ctx)
+	}
+	return err
+}
+
+func (tok *TokenConsumer) rotateSharingToken(nid string, ctx Context) (string, error) {
+	if _, err := tok.db.Exec("UPDATE tokens SET revoked_at = $1 WHERE kind = 'share-url' AND nid = $2 AND revoked_at IS NULL", time.Now(), nid); err != nil {
+		return "", err
+	}
+	tok.log.Info("sharing token rotated", Fields{"nid": nid, "by": ctx.uid})
+	return tok.regenerateShareURL(nid, ctx)
+}
+
+// regenerateShareURL issues a new share-url token for the note and makes it
+// the one the note hands out to its peers
+func (tok *TokenConsumer) regenerateShareURL(nid string, ctx Context) (string, error) {
+	plain, hashed := GenerateToken()
+	if _, err := tok.db.Exec("INSERT INTO tokens (token, kind, uid, nid) VALUES ($1, 'share-url', '', $2)", hashed, nid); err != nil {
+		return "", err
+	}
+	if _, err := tok.db.Exec("UPDATE notes SET sharing_token = $1 WHERE nid = $2", plain, nid); err != nil {
+		return "", err
+	}
+	if ctx.Router != nil {
+		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "note", ID: nid}, ctx: ctx})
+	}
+	return plain, nil
+}
+
+// handleTokenAdmin serves the token-list, token-revoke and token-rotate
+// events of a session. Users can list the tokens of the notes they have
+// access to, revoke the ones issued for or by them, and manage all tokens of
+// the notes they own. The event is sent back to
+// the client, with a Remark on failure.
+func (tok *TokenConsumer) handleTokenAdmin(event Event) error {
+	ctx := event.ctx
+	var err error
+	switch event.Name {
+	case "token-list":
+		filter := TokenFilter{}
+		switch event.Res.Kind {
+		case "note":
+			filter.NID = event.Res.ID
+			err = tok.checkNoteAccess(ctx.uid, event.Res.ID)
+		case "profile":
+			filter.UID = ctx.uid
+		default:
+			return InvalidEventError{}
+		}
+		if err == nil {
+			event.Tokens, err = tok.listTokens(filter)
+		}
+	case "token-revoke":
+		var uid, nid, createdBy string
+		err = tok.db.QueryRow("SELECT uid, nid, created_by FROM tokens WHERE token = $1", event.Token).Scan(&uid, &nid, &createdBy)
+		switch {
+		case err == sql.ErrNoRows:
+			err = Remark{Level: "error", Slug: "token-noexist-or-invalid"}
+		case err != nil:
+		case uid == ctx.uid || createdBy == ctx.uid:
+			err = tok.revokeToken(event.Token, ctx)
+		case nid == "":
+			err = errTokenAccessDenied
+		default:
+			if err = tok.checkNoteOwner(ctx.uid, nid); err == nil {
+				err = tok.revokeToken(event.Token, ctx)
+			}
+		}
+	case "token-rotate":
+		if event.Res.Kind != "note" {
+			return InvalidEventError{}
+		}
+		if err = tok.checkNoteOwner(ctx.uid, event.Res.ID); err == nil {
+			// peers receive the new token with the note's next sync
+			_, err = tok.rotateSharingToken(event.Res.ID, ctx)
+		}
+	}
+	if err != nil {
+		r, ok := err.(Remark)
+		if !ok {
+			ctx.LogError(fmt.Errorf("%s failed: %s", event.Name, err))
+			r = Remark{Level: "error", Slug: "system-error"}
+		}
+		event.Remark = &r
+	}
+	if ctx.Client == nil {
+		return err
+	}
+	return ctx.Client.Handle(event)
+}
+
+func (tok *TokenConsumer) checkNoteAccess(uid, nid string) error {
+	return tok.checkNoteRef(uid, nid, "SELECT count(*) FROM noterefs WHERE nid = $1 AND uid = $2")
+}
+
+func (tok *TokenConsumer) checkNoteOwner(uid, nid string) error {
+	return tok.checkNoteRef(uid, nid, "SELECT count(*) FROM noterefs WHERE nid = $1 AND uid = $2 AND role = 'owner'")
+}
+
+func (tok *TokenConsumer) checkNoteRef(uid, nid, qry string) error {
+	var n int
+	if err := tok.db.QueryRow(qry, nid, uid).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errTokenAccessDenied
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package diffsync
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func tokenAdminDB(t *testing.T) *sql.DB {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_TOKENS, CREATE_TOKENCONSUMPTIONS)
+	db.Exec("INSERT INTO users (uid, tier) VALUES ('uid00001', 1), ('uid00002', 1)")
+	db.Exec("INSERT INTO notes (nid) VALUES ('nid00001')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ('nid00001', 'uid00001', 'owner')")
+	return db
+}
+
+func TestTokenRevocation(t *testing.T) {
+	db := tokenAdminDB(t)
+	defer db.Close()
+	tok := NewTokenConsumer(nil, db, defaultLogger)
+	synced := []Resource{}
+	ctx := NewContext(FuncHandler{Fn: func(event Event) error {
+		synced = append(synced, event.Res)
+		return nil
+	}}, nil, nil)
+	sharingToken := func() (plain string) {
+		db.QueryRow("SELECT sharing_token FROM notes WHERE nid = 'nid00001'").Scan(&plain)
+		return
+	}
+
+	plain, err := tok.regenerateShareURL("nid00001", ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, plain, sharingToken())
+	assert.Equal(t, []Resource{{Kind: "note", ID: "nid00001"}}, synced, "note not synced after new sharing token")
+
+	token, err := tok.getToken(plain)
+	assert.NoError(t, err)
+	ctx.uid, ctx.sid = "uid00002", "sid00002"
+	assert.NoError(t, tok.markConsumed(token, ctx))
+
+	tokens, err := tok.listTokens(TokenFilter{NID: "nid00001"})
+	if assert.NoError(t, err) && assert.Len(t, tokens, 1) {
+		info := tokens[0]
+		assert.Equal(t, hashToken(plain), info.ID)
+		assert.Equal(t, int64(1), info.TimesConsumed)
+		assert.Equal(t, info.ValidFrom.Add(DefaultTokenPolicies()["share-url"].Lifetime), info.ExpiresAt)
+		assert.Nil(t, info.RevokedAt)
+	}
+	audit, err := tok.consumptions(hashToken(plain))
+	if assert.NoError(t, err) && assert.Len(t, audit, 1) {
+		assert.Equal(t, "uid00002", audit[0].UID)
+		assert.Equal(t, "sid00002", audit[0].SID)
+	}
+
+	// revoking the current share-url hands out a fresh one
+	synced = synced[:0]
+	ctx.uid = "sys"
+	assert.NoError(t, tok.revokeToken(hashToken(plain), ctx))
+	_, err = tok.getToken(plain)
+	assert.Equal(t, Remark{Level: "error", Slug: "token-revoked"}, err)
+	assert.NotEqual(t, plain, sharingToken(), "sharing token not regenerated")
+	assert.Len(t, synced, 1)
+	_, err = tok.getToken(sharingToken())
+	assert.NoError(t, err, "regenerated token invalid")
+}
+
+func TestTokenAdminEvents(t *testing.T) {
+	db := tokenAdminDB(t)
+	defer db.Close()
+	tok := NewTokenConsumer(nil, db, defaultLogger)
+	responses := []Event{}
+	ctx := NewContext(FuncHandler{Fn: func(Event) error { return nil }}, nil, FuncHandler{Fn: func(event Event) error {
+		responses = append(responses, event)
+		return nil
+	}})
+	plain, _ := tok.regenerateShareURL("nid00001", ctx)
+
+	// uid00002 has no access to the note
+	ctx.uid = "uid00002"
+	tok.handleTokenAdmin(Event{Name: "token-rotate", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	tok.handleTokenAdmin(Event{Name: "token-revoke", Token: hashToken(plain), ctx: ctx})
+	if assert.Len(t, responses, 2) {
+		assert.Equal(t, &errTokenAccessDenied, responses[0].Remark)
+		assert.Equal(t, &errTokenAccessDenied, responses[1].Remark)
+	}
+	_, err := tok.getToken(plain)
+	assert.NoError(t, err, "token revoked without access to note")
+
+	// peers may list the note's tokens, but only the owner manages them
+	db.Exec("INSERT INTO noterefs (nid, uid, role) VALUES ('nid00001', 'uid00002', 'peer')")
+	responses = responses[:0]
+	tok.handleTokenAdmin(Event{Name: "token-list", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	tok.handleTokenAdmin(Event{Name: "token-rotate", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	tok.handleTokenAdmin(Event{Name: "token-revoke", Token: hashToken(plain), ctx: ctx})
+	if assert.Len(t, responses, 3) {
+		assert.Nil(t, responses[0].Remark)
+		assert.Equal(t, &errTokenAccessDenied, responses[1].Remark)
+		assert.Equal(t, &errTokenAccessDenied, responses[2].Remark)
+	}
+	_, err = tok.getToken(plain)
+	assert.NoError(t, err, "token revoked by a peer")
+
+	responses = responses[:0]
+	ctx.uid = "uid00001"
+	tok.handleTokenAdmin(Event{Name: "token-list", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	tok.handleTokenAdmin(Event{Name: "token-rotate", Res: Resource{Kind: "note", ID: "nid00001"}, ctx: ctx})
+	if assert.Len(t, responses, 2) {
+		assert.Nil(t, responses[0].Remark)
+		assert.Len(t, responses[0].Tokens, 1)
+		assert.Nil(t, responses[1].Remark)
+	}
+	_, err = tok.getToken(plain)
+	assert.Error(t, err, "old token still valid after rotation")
+}
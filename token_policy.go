@@ -0,0 +1,135 @@
+package diffsync
+
+import (
+	"time"
+)
+
+// TokenPolicy decides how long and how often tokens of a kind can be used
+type TokenPolicy struct {
+	Lifetime time.Duration
+	// MaxConsumptions is the number of times a token can be consumed. Zero
+	// means unlimited.
+	MaxConsumptions int64
+	// Regenerate issues a fresh token once a note's sharing token is
+	// exhausted. Only applies to share-url tokens.
+	Regenerate bool
+	// AllowedTiers restricts which users can consume the tokens. Empty
+	// allows everybody.
+	AllowedTiers []int64
+}
+
+// TokenPolicies maps token kinds to their policy. Tokens of unknown kinds
+// expire immediately.
+type TokenPolicies map[string]TokenPolicy
+
+func DefaultTokenPolicies() TokenPolicies {
+	return TokenPolicies{
+		"anon":           {Lifetime: 5 * time.Minute, MaxConsumptions: 1},
+		"login":          {Lifetime: 2 * 7 * 24 * time.Hour, MaxConsumptions: 5},
+		"login-campaign": {Lifetime: 2 * 7 * 24 * time.Hour, MaxConsumptions: 1},
+		"verify":         {Lifetime: 2 * 7 * 24 * time.Hour, MaxConsumptions: 1},
+		"share-url":      {Lifetime: 3 * 30.5 * 24 * time.Hour, MaxConsumptions: 10, Regenerate: true},
+		"share":          {Lifetime: 1 * 30.5 * 24 * time.Hour, MaxConsumptions: 1},
+		"delete-account": {Lifetime: time.Hour, MaxConsumptions: 1},
+	}
+}
+
+// TokenLimits override the policy of a single token. Zero values leave the
+// policy's limits in place.
+type TokenLimits struct {
+	Lifetime        time.Duration
+	MaxConsumptions int64
+}
+
+func (policies TokenPolicies) ExpiresAt(t Token) time.Time {
+	if t.ExpiresAt != nil {
+		return *t.ExpiresAt
+	}
+	return t.ValidFrom.Add(policies[t.Kind].Lifetime)
+}
+
+func (policies TokenPolicies) Expired(t Token) bool {
+	return time.Now().After(policies.ExpiresAt(t))
+}
+
+func (policies TokenPolicies) Exhausted(t Token) bool {
+	max := policies[t.Kind].MaxConsumptions
+	if t.MaxConsumptions != nil {
+		max = *t.MaxConsumptions
+	}
+	return max > 0 && t.TimesConsumed >= max
+}
+
+// Allows reports whether users of the given tier can consume t
+func (policies TokenPolicies) Allows(t Token, tier int64) bool {
+	allowed := policies[t.Kind].AllowedTiers
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// consumerTier returns the tier of the user presenting a token: the user of
+// the session it is presented in, or for fresh sessions the token's user.
+func (tok *TokenConsumer) consumerTier(token Token, sid string) (int64, error) {
+	if sid != "" {
+		uid, tier, err := tok.uidFromSID(sid)
+		if err != nil || uid != "" {
+			return int64(tier), err
+		}
+	}
+	if token.UID == "" {
+		// the token will create a new anonymous user
+		return 0, nil
+	}
+	var tier int64
+	err := tok.db.QueryRow("SELECT tier FROM users WHERE uid = $1", token.UID).Scan(&tier)
+	return tier, err
+}
+
+func (tok *TokenConsumer) checkTier(token Token, sid string) error {
+	if len(tok.policies[token.Kind].AllowedTiers) == 0 {
+		return nil
+	}
+	tier, err := tok.consumerTier(token, sid)
+	if err != nil {
+		return err
+	}
+	if !tok.policies.Allows(token, tier) {
+		return Remark{Level: "error", Slug: "token-tier-not-allowed"}
+	}
+	return nil
+}
+
+// issueToken stores a new token with the given limits and returns its
+// plaintext
+func (tok *TokenConsumer) issueToken(token Token, limits TokenLimits) (string, error) {
+	plain, hashed := GenerateToken()
+	var expiresAt *time.Time
+	var maxConsumptions *int64
+	if limits.Lifetime > 0 {
+		t := time.Now().Add(limits.Lifetime)
+		expiresAt = &t
+	}
+	if limits.MaxConsumptions > 0 {
+		maxConsumptions = &limits.MaxConsumptions
+	}
+	_, err := tok.db.Exec("INSERT INTO tokens (token, kind, uid, nid, created_by, expires_at, max_consumptions) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		hashed, token.Kind, token.UID, token.NID, token.CreatedBy, expiresAt, maxConsumptions)
+	if err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// ShareToken issues an additional share-url token for the given note, e.g. a
+// link which expires in an hour or can only be used once. Unlike the note's
+// sharing token it is not regenerated when exhausted.
+func (srv *Server) ShareToken(nid, createdBy string, limits TokenLimits) (string, error) {
+	return srv.tokenConsumer.issueToken(Token{Kind: "share-url", NID: nid, CreatedBy: createdBy}, limits)
+}
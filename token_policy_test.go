@@ -0,0 +1,62 @@
+package diffsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenPolicies(t *testing.T) {
+	policies := DefaultTokenPolicies()
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	assert.False(t, policies.Expired(Token{Kind: "share", ValidFrom: &now}))
+	assert.True(t, policies.Expired(Token{Kind: "anon", ValidFrom: &old}))
+	assert.True(t, policies.Expired(Token{Kind: "unknown", ValidFrom: &old}), "unknown kinds must expire immediately")
+	assert.False(t, policies.Exhausted(Token{Kind: "login", TimesConsumed: 4}))
+	assert.True(t, policies.Exhausted(Token{Kind: "login", TimesConsumed: 5}))
+
+	// per-token overrides
+	soon := now.Add(-time.Minute)
+	one := int64(1)
+	assert.True(t, policies.Expired(Token{Kind: "share-url", ValidFrom: &now, ExpiresAt: &soon}))
+	assert.True(t, policies.Exhausted(Token{Kind: "share-url", TimesConsumed: 1, MaxConsumptions: &one}))
+
+	policies["share"] = TokenPolicy{Lifetime: time.Hour, AllowedTiers: []int64{1, 2}}
+	assert.False(t, policies.Exhausted(Token{Kind: "share", TimesConsumed: 100}), "zero MaxConsumptions must be unlimited")
+	assert.False(t, policies.Allows(Token{Kind: "share"}, 0))
+	assert.True(t, policies.Allows(Token{Kind: "share"}, 2))
+	assert.True(t, policies.Allows(Token{Kind: "login"}, 0))
+}
+
+func TestShareTokenLimits(t *testing.T) {
+	db := tokenAdminDB(t)
+	defer db.Close()
+	tok := NewTokenConsumer(nil, db, defaultLogger)
+	ctx := NewContext(FuncHandler{Fn: func(Event) error { return nil }}, nil, nil)
+	shared, _ := tok.regenerateShareURL("nid00001", ctx)
+
+	plain, err := tok.issueToken(Token{Kind: "share-url", NID: "nid00001", CreatedBy: "uid00001"}, TokenLimits{Lifetime: time.Hour, MaxConsumptions: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	token, err := tok.getToken(plain)
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), tok.policies.ExpiresAt(token), time.Minute)
+	}
+	ctx.uid = "uid00002"
+	assert.NoError(t, tok.markConsumed(token, ctx))
+	_, err = tok.getToken(plain)
+	assert.Equal(t, "token-exhausted", err.(Remark).Slug)
+
+	var current string
+	db.QueryRow("SELECT sharing_token FROM notes WHERE nid = 'nid00001'").Scan(&current)
+	assert.Equal(t, shared, current, "exhausted one-off link must not replace the note's sharing token")
+
+	// the note may be gone by the time its last link gets used
+	plain, _ = tok.issueToken(Token{Kind: "share-url", NID: "nid00001", CreatedBy: "uid00001"}, TokenLimits{Lifetime: time.Hour, MaxConsumptions: 1})
+	token, _ = tok.getToken(plain)
+	db.Exec("DELETE FROM notes WHERE nid = 'nid00001'")
+	assert.NoError(t, tok.markConsumed(token, ctx))
+}
@@ -0,0 +1,132 @@
+package diffsync
+
+import (
+	"database/sql"
+	"time"
+)
+
+// deleteNote removes a note with everything that refers to it
+func deleteNote(db execer, nid string) error {
+	for _, qry := range []string{
+		"DELETE FROM note_changelog WHERE nid = $1",
+		"DELETE FROM tokens WHERE nid = $1",
+		"DELETE FROM noteref_tags WHERE nid = $1",
+		"DELETE FROM noterefs WHERE nid = $1",
+		"DELETE FROM notes WHERE nid = $1",
+	} {
+		if _, err := db.Exec(qry, nid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeNoteRef removes nid from uid's folio for good. If uid was the note's
+// last owner, the note is deleted as well and peers lists the users who lost
+// it along with it.
+func purgeNoteRef(db *sql.DB, uid, nid string) (deleted bool, peers []string, err error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return false, nil, err
+	}
+	var role string
+	err = txn.QueryRow("SELECT role FROM noterefs WHERE uid = $1 AND nid = $2", uid, nid).Scan(&role)
+	if err == sql.ErrNoRows {
+		txn.Rollback()
+		return false, nil, nil
+	} else if err != nil {
+		txn.Rollback()
+		return false, nil, err
+	}
+	if _, err = txn.Exec("DELETE FROM noteref_tags WHERE uid = $1 AND nid = $2", uid, nid); err != nil {
+		txn.Rollback()
+		return false, nil, err
+	}
+	if _, err = txn.Exec("DELETE FROM noterefs WHERE uid = $1 AND nid = $2", uid, nid); err != nil {
+		txn.Rollback()
+		return false, nil, err
+	}
+	if role == "owner" {
+		var owners int
+		if err = txn.QueryRow("SELECT count(*) FROM noterefs WHERE nid = $1 AND role = 'owner'", nid).Scan(&owners); err != nil {
+			txn.Rollback()
+			return false, nil, err
+		}
+		if owners == 0 {
+			if peers, err = queryStrings(txn, "SELECT uid FROM noterefs WHERE nid = $1", nid); err != nil {
+				txn.Rollback()
+				return false, nil, err
+			}
+			if err = deleteNote(txn, nid); err != nil {
+				txn.Rollback()
+				return false, nil, err
+			}
+			deleted = true
+		}
+	}
+	return deleted, peers, txn.Commit()
+}
+
+// notifyPurged tells uid's sessions and, if the note is gone, its former
+// peers that nid is no longer part of their folio
+func notifyPurged(uid, nid string, peers []string, ctx Context) {
+	ctx.Router.Handle(Event{UID: uid, Name: "res-remove", Res: Resource{Kind: "note", ID: nid}, ctx: ctx})
+	for _, peer := range peers {
+		ctx.Router.Handle(Event{UID: peer, Name: "res-remove", Res: Resource{Kind: "note", ID: nid}, ctx: ctx})
+		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "folio", ID: peer}, ctx: ctx})
+	}
+}
+
+// PurgeTrash removes all noterefs which have been in the trash for longer
+// than the configured retention and returns how many were purged
+func (srv *Server) PurgeTrash(now time.Time) (int, error) {
+	if srv.cfg.TrashRetention <= 0 {
+		return 0, nil
+	}
+	rows, err := srv.db.Query("SELECT uid, nid FROM noterefs WHERE status = 'trashed' AND trashed_at < $1", now.Add(-srv.cfg.TrashRetention))
+	if err != nil {
+		return 0, err
+	}
+	refs := [][2]string{}
+	for rows.Next() {
+		var uid, nid string
+		if err = rows.Scan(&uid, &nid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		refs = append(refs, [2]string{uid, nid})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	ctx := NewContext(srv.sessionHub, srv.Store, nil)
+	ctx.uid = "sys"
+	for i, ref := range refs {
+		deleted, peers, err := purgeNoteRef(srv.db, ref[0], ref[1])
+		if err != nil {
+			return i, err
+		}
+		srv.log.Info("trash: purged noteref", Fields{"uid": ref[0], "nid": ref[1], "note_deleted": deleted})
+		notifyPurged(ref[0], ref[1], peers, ctx)
+		ctx.Router.Handle(Event{Name: "res-sync", Res: Resource{Kind: "folio", ID: ref[0]}, ctx: ctx})
+	}
+	return len(refs), nil
+}
+
+// purgeTrashEvery runs PurgeTrash in the given interval until the server
+// stops
+func (srv *Server) purgeTrashEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if n, err := srv.PurgeTrash(now); err != nil {
+				srv.log.Error("trash: purge failed", Fields{"err": err, "purged": n})
+			}
+		case <-srv.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package diffsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFolioTrashDelta(t *testing.T) {
+	folio := NewFolio()
+	folio.NoteRefs = []NoteRef{{NID: "nid00001", Status: "active"}}
+	res, patches, _ := FolioDelta{
+		{"set-status", "nid:nid00001", "trashed"},
+		{"set-pinned", "nid:nid00001", true},
+	}.Apply(folio)
+	assert.Equal(t, []Patch{
+		{Op: "set-status", Path: "nid00001", Value: "trashed", OldValue: "active"},
+		{Op: "set-pinned", Path: "nid00001", Value: true},
+	}, patches)
+
+	// the server sets the time a noteref was trashed
+	master := res.Clone().(Folio)
+	trashedAt := UnixTime(time.Now())
+	master.NoteRefs[0].TrashedAt = &trashedAt
+	delta := res.GetDelta(master).(FolioDelta)
+	assert.Equal(t, FolioDelta{{"set-trashed-at", "nid:nid00001", &trashedAt}}, delta)
+	res, patches, _ = delta.Apply(res)
+	assert.Len(t, patches, 0, "set-trashed-at must not be persisted")
+	assert.Equal(t, master, res)
+
+	// restoring clears the timestamp
+	res, _, _ = FolioDelta{{"set-status", "nid:nid00001", "active"}}.Apply(res)
+	assert.Nil(t, res.(Folio).NoteRefs[0].TrashedAt)
+
+	_, patches, _ = FolioDelta{{Op: "rem-noteref", Path: "nid:nid00001"}}.Apply(res)
+	assert.Equal(t, []Patch{{Op: "rem-noteref", Path: "nid00001"}}, patches)
+}
+
+func TestFolioSQLBackendTrash(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_FOLDERS, CREATE_NOTEREFTAGS)
+	defer db.Close()
+	for _, qry := range []string{CREATE_TOKENS, CREATE_NOTECHANGELOG} {
+		if _, err := db.Exec(qry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec("INSERT INTO notes (nid) VALUES ('nid00001'), ('nid00002')")
+	db.Exec(`INSERT INTO noterefs (nid, uid, role, status) VALUES
+				('nid00001', 'uid00001', 'owner', 'active'),
+				('nid00001', 'uid00002', 'peer', 'active'),
+				('nid00002', 'uid00001', 'owner', 'active'),
+				('nid00002', 'uid00002', 'owner', 'active')`)
+	backend := NewFolioSQLBackend(db)
+	events := []Event{}
+	ctx := NewContext(FuncHandler{Fn: func(event Event) error {
+		event.ctx = Context{}
+		events = append(events, event)
+		return nil
+	}}, nil, nil)
+	ctx.uid = "uid00001"
+	noteref := func(uid, nid string) (ref NoteRef) {
+		value, _ := backend.Get(uid)
+		for _, ref = range value.(Folio).NoteRefs {
+			if ref.NID == nid {
+				return
+			}
+		}
+		return NoteRef{}
+	}
+
+	assert.NoError(t, backend.Patch("uid00001", Patch{Op: "set-status", Path: "nid00001", Value: "trashed", OldValue: "active"}, NewSyncResult(), ctx))
+	assert.NoError(t, backend.Patch("uid00001", Patch{Op: "set-pinned", Path: "nid00001", Value: true}, NewSyncResult(), ctx))
+	ref := noteref("uid00001", "nid00001")
+	assert.Equal(t, "trashed", ref.Status)
+	assert.True(t, ref.Pinned)
+	assert.NotNil(t, ref.TrashedAt)
+	assert.NoError(t, backend.Patch("uid00001", Patch{Op: "set-status", Path: "nid00001", Value: "active", OldValue: "trashed"}, NewSyncResult(), ctx))
+	assert.Nil(t, noteref("uid00001", "nid00001").TrashedAt, "restored noteref still trashed")
+
+	// nid00002 has another owner and survives
+	assert.NoError(t, backend.Patch("uid00001", Patch{Op: "rem-noteref", Path: "nid00002"}, NewSyncResult(), ctx))
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM notes WHERE nid = 'nid00002'"))
+	assert.Equal(t, "nid00002", noteref("uid00002", "nid00002").NID)
+
+	// ...nid00001 goes along with its last owner
+	events = events[:0]
+	assert.NoError(t, backend.Patch("uid00001", Patch{Op: "rem-noteref", Path: "nid00001"}, NewSyncResult(), ctx))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM notes WHERE nid = 'nid00001'"))
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = 'nid00001'"))
+	assert.Contains(t, events, Event{UID: "uid00001", Name: "res-remove", Res: Resource{Kind: "note", ID: "nid00001"}})
+	assert.Contains(t, events, Event{UID: "uid00002", Name: "res-remove", Res: Resource{Kind: "note", ID: "nid00001"}})
+}
+
+func TestPurgeTrash(t *testing.T) {
+	db := testDB(t, CREATE_USERS, CREATE_NOTES, CREATE_NOTEREFS, CREATE_FOLDERS, CREATE_NOTEREFTAGS)
+	defer db.Close()
+	for _, qry := range []string{CREATE_TOKENS, CREATE_NOTECHANGELOG, CREATE_SESSIONS} {
+		if _, err := db.Exec(qry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	db.Exec("INSERT INTO notes (nid) VALUES ('nid00001'), ('nid00002')")
+	db.Exec("INSERT INTO noterefs (nid, uid, role, status, trashed_at) VALUES ('nid00001', 'uid00001', 'owner', 'trashed', $1), ('nid00002', 'uid00001', 'owner', 'trashed', $2)",
+		now.Add(-31*24*time.Hour), now.Add(-time.Hour))
+	cfg := DefaultConfig()
+	cfg.TrashRetention = 30 * 24 * time.Hour
+	srv, _ := NewServerWithConfig(db, nil, cfg)
+
+	n, err := srv.PurgeTrash(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, queryCount(db, "SELECT count(*) FROM notes WHERE nid = 'nid00001'"))
+	assert.Equal(t, 1, queryCount(db, "SELECT count(*) FROM noterefs WHERE nid = 'nid00002'"), "noteref purged before retention")
+
+	srv.cfg.TrashRetention = 0
+	n, _ = srv.PurgeTrash(now.Add(365 * 24 * time.Hour))
+	assert.Equal(t, 0, n, "purged with retention disabled")
+}
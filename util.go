@@ -2,6 +2,7 @@ package diffsync
 
 import (
 	"crypto/rand"
+	"database/sql"
 	mrand "math/rand"
 	"strings"
 	"time"
@@ -50,3 +51,32 @@ func peek(s string, limit int) string {
 func init() {
 	mrand.Seed(time.Now().UnixNano())
 }
+
+type execer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+type querier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+type rowQuerier interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+func queryStrings(db querier, qry string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []string{}
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}